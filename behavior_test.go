@@ -0,0 +1,3042 @@
+// Written by Gemini CLI
+// This file is licensed under the MIT License.
+// See the LICENSE file for details.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cenkalti/backoff/v4"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stevemcghee/go-to-production/internal/app"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// todoBehaviorTests is the storage-agnostic handler test suite. Every
+// Store backend runs it (see runTodoBehaviorTests) so they are held to
+// the same observable behavior through the HTTP API.
+var todoBehaviorTests = []struct {
+	name string
+	fn   func(t *testing.T, srv *app.Server)
+}{
+	{"GetTodosEmpty", testGetTodosEmpty},
+	{"AddTodo", testAddTodo},
+	{"AddTodoTrimsTask", testAddTodoTrimsTask},
+	{"GetTodosWithData", testGetTodosWithData},
+	{"GetTodo", testGetTodo},
+	{"GetTodoNotFound", testGetTodoNotFound},
+	{"UpdateTodo", testUpdateTodo},
+	{"UpdateTodoTask", testUpdateTodoTask},
+	{"PatchTodo", testPatchTodo},
+	{"PatchTodoNotFound", testPatchTodoNotFound},
+	{"PatchTodoInvalid", testPatchTodoInvalid},
+	{"UpdateTodoNotFound", testUpdateTodoNotFound},
+	{"DeleteTodo", testDeleteTodo},
+	{"DeleteTodoNotFound", testDeleteTodoNotFound},
+	{"ListPagination", testListPagination},
+	{"ListSortByTask", testListSortByTask},
+	{"ListFilters", testListFilters},
+	{"ListInvalidParams", testListInvalidParams},
+	{"SearchTodos", testSearchTodos},
+	{"SearchTodosInvalidParams", testSearchTodosInvalidParams},
+	{"TodoDetails", testTodoDetails},
+	{"TodoDetailsInvalid", testTodoDetailsInvalid},
+	{"TodoTimestamps", testTodoTimestamps},
+	{"ListDueFilters", testListDueFilters},
+	{"TodoLists", testTodoLists},
+	{"ListTodosByList", testListTodosByList},
+	{"DeleteListNotEmpty", testDeleteListNotEmpty},
+	{"Tags", testTags},
+	{"TodoTags", testTodoTags},
+	{"ListTagFilters", testListTagFilters},
+	{"Subtasks", testSubtasks},
+	{"SubtaskRollup", testSubtaskRollup},
+	{"SubtaskCycles", testSubtaskCycles},
+	{"DeleteSubtasks", testDeleteSubtasks},
+	{"Blockers", testBlockers},
+	{"BlockerCycles", testBlockerCycles},
+	{"ListReady", testListReady},
+	{"RecurringTodos", testRecurringTodos},
+	{"RecurringTodosEnd", testRecurringTodosEnd},
+	{"RecurringTodosInvalid", testRecurringTodosInvalid},
+	{"MoveTodos", testMoveTodos},
+	{"MoveTodosInvalid", testMoveTodosInvalid},
+	{"MoveTodosConcurrently", testMoveTodosConcurrently},
+	{"CreateTodosConcurrently", testCreateTodosConcurrently},
+	{"Trash", testTrash},
+	{"TrashSubtasks", testTrashSubtasks},
+	{"TrashBlockers", testTrashBlockers},
+	{"DeleteListWithTrash", testDeleteListWithTrash},
+	{"TodoHistory", testTodoHistory},
+	{"TodoHistoryRelatedChanges", testTodoHistoryRelatedChanges},
+	{"Batch", testBatch},
+	{"BatchPerItem", testBatchPerItem},
+	{"BatchClearCompleted", testBatchClearCompleted},
+	{"BatchCompleteAll", testBatchCompleteAll},
+	{"BatchInvalid", testBatchInvalid},
+	{"TodoVersions", testTodoVersions},
+	{"IdempotencyKeys", testIdempotencyKeys},
+	{"IdempotencyKeysConcurrently", testIdempotencyKeysConcurrently},
+	{"UntrustedActorHeader", testUntrustedActorHeader},
+	{"ListConditionalGet", testListConditionalGet},
+	{"TodoEventStream", testTodoEventStream},
+	{"FullWorkflow", testFullWorkflow},
+}
+
+// runTodoBehaviorTests runs the suite, calling newServer for a server with an
+// empty todo list before each test.
+func runTodoBehaviorTests(t *testing.T, newServer func(t *testing.T) *app.Server) {
+	for _, tt := range todoBehaviorTests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.fn(t, newServer(t))
+		})
+	}
+}
+
+// addTodo creates a todo through the API and returns it.
+func addTodo(t *testing.T, srv *app.Server, task string) app.Todo {
+	t.Helper()
+	return createTodo(t, srv, map[string]any{"task": task})
+}
+
+// createTodo posts body as a new todo through the API and returns it.
+func createTodo(t *testing.T, srv *app.Server, todo map[string]any) app.Todo {
+	t.Helper()
+	body, _ := json.Marshal(todo)
+	req := httptest.NewRequest(http.MethodPost, "/todos", bytes.NewBuffer(body))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+
+	srv.AddTodo(w, req)
+
+	if w.Code != http.StatusCreated {
+		t.Fatalf("failed to add todo: status %d, body %q", w.Code, w.Body.String())
+	}
+	var created app.Todo
+	if err := json.NewDecoder(w.Body).Decode(&created); err != nil {
+		t.Fatalf("failed to decode created todo: %v", err)
+	}
+	return created
+}
+
+// listTodos fetches all todos through the API.
+func listTodos(t *testing.T, srv *app.Server) []app.Todo {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodGet, "/todos", nil)
+	w := httptest.NewRecorder()
+
+	srv.GetTodos(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("failed to list todos: status %d, body %q", w.Code, w.Body.String())
+	}
+	var todos []app.Todo
+	if err := json.NewDecoder(w.Body).Decode(&todos); err != nil {
+		t.Fatalf("failed to decode todos: %v", err)
+	}
+	return todos
+}
+
+// listPage fetches one page of todos with the given query string, returning
+// the todos and the next cursor ("" on the last page).
+func listPage(t *testing.T, srv *app.Server, query string) ([]app.Todo, string) {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodGet, "/todos?"+query, nil)
+	w := httptest.NewRecorder()
+
+	srv.GetTodos(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("failed to list todos with %q: status %d, body %q", query, w.Code, w.Body.String())
+	}
+	var todos []app.Todo
+	if err := json.NewDecoder(w.Body).Decode(&todos); err != nil {
+		t.Fatalf("failed to decode todos: %v", err)
+	}
+	next := w.Header().Get("X-Next-Cursor")
+	if link := w.Header().Get("Link"); (next == "") != (link == "") {
+		t.Errorf("expected Link and X-Next-Cursor together, got %q and %q", link, next)
+	} else if next != "" && !strings.Contains(link, "cursor="+next) {
+		t.Errorf("expected Link %q to carry cursor %q", link, next)
+	}
+	return todos, next
+}
+
+// listAllPages follows next cursors from the first page, returning the task
+// of every todo in order.
+func listAllPages(t *testing.T, srv *app.Server, query string) []string {
+	t.Helper()
+	var tasks []string
+	cursor := ""
+	for pages := 0; ; pages++ {
+		if pages > 100 {
+			t.Fatal("pagination did not terminate")
+		}
+		q := query
+		if cursor != "" {
+			q += "&cursor=" + url.QueryEscape(cursor)
+		}
+		todos, next := listPage(t, srv, q)
+		for _, todo := range todos {
+			tasks = append(tasks, todo.Task)
+		}
+		if next == "" {
+			return tasks
+		}
+		cursor = next
+	}
+}
+
+// todoBasics is the id, task and completion state of a todo.
+type todoBasics struct {
+	ID        int
+	Task      string
+	Completed bool
+}
+
+// basics returns the basics of t, for comparing todos without regard to
+// timestamps and other details.
+func basics(t app.Todo) todoBasics {
+	return todoBasics{ID: t.ID, Task: t.Task, Completed: t.Completed}
+}
+
+// setCompleted marks a todo (in)complete through the API and returns the status code.
+func setCompleted(t *testing.T, srv *app.Server, todo app.Todo, completed bool) int {
+	t.Helper()
+	todo.Completed = completed
+	body, _ := json.Marshal(todo)
+	req := httptest.NewRequest(http.MethodPut, fmt.Sprintf("/todos/%d", todo.ID), bytes.NewBuffer(body))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+
+	srv.UpdateTodo(w, req, todo.ID)
+	return w.Code
+}
+
+// testGetTodosEmpty tests getting todos when the store is empty
+func testGetTodosEmpty(t *testing.T, srv *app.Server) {
+	todos := listTodos(t, srv)
+	if len(todos) != 0 {
+		t.Errorf("expected 0 todos, got %d", len(todos))
+	}
+}
+
+// testAddTodo tests adding a new todo
+func testAddTodo(t *testing.T, srv *app.Server) {
+	created := addTodo(t, srv, "Integration test todo")
+
+	if created.ID == 0 {
+		t.Error("expected non-zero ID")
+	}
+	if created.Task != "Integration test todo" {
+		t.Errorf("expected task %q, got %q", "Integration test todo", created.Task)
+	}
+	if created.Completed != false {
+		t.Errorf("expected completed to be false, got %v", created.Completed)
+	}
+}
+
+// testAddTodoTrimsTask tests that surrounding whitespace isn't stored
+func testAddTodoTrimsTask(t *testing.T, srv *app.Server) {
+	created := addTodo(t, srv, "  Padded task\n")
+	if created.Task != "Padded task" {
+		t.Errorf("expected trimmed task %q, got %q", "Padded task", created.Task)
+	}
+}
+
+// testGetTodosWithData tests getting todos when the store has data
+func testGetTodosWithData(t *testing.T, srv *app.Server) {
+	addTodo(t, srv, "Test task 1")
+	second := addTodo(t, srv, "Test task 2")
+	if code := setCompleted(t, srv, second, true); code != http.StatusOK {
+		t.Fatalf("failed to complete todo: status %d", code)
+	}
+
+	todos := listTodos(t, srv)
+	if len(todos) != 2 {
+		t.Fatalf("expected 2 todos, got %d", len(todos))
+	}
+	if todos[0].Task != "Test task 1" {
+		t.Errorf("expected first task to be 'Test task 1', got %q", todos[0].Task)
+	}
+	if todos[1].Completed != true {
+		t.Errorf("expected second todo to be completed")
+	}
+}
+
+// getTodo fetches a single todo through the API, returning the recorder.
+func getTodo(t *testing.T, srv *app.Server, id int) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodGet, fmt.Sprintf("/todos/%d", id), nil)
+	w := httptest.NewRecorder()
+	srv.HandleTodo(w, req)
+	return w
+}
+
+// testGetTodo tests fetching a single todo by id
+func testGetTodo(t *testing.T, srv *app.Server) {
+	addTodo(t, srv, "Other task")
+	created := addTodo(t, srv, "Fetch me")
+
+	w := getTodo(t, srv, created.ID)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, w.Code)
+	}
+	var got app.Todo
+	if err := json.NewDecoder(w.Body).Decode(&got); err != nil {
+		t.Fatalf("failed to decode todo: %v", err)
+	}
+	if got.ID != created.ID || got.Task != "Fetch me" || got.Completed {
+		t.Errorf("expected %+v, got %+v", created, got)
+	}
+}
+
+// testGetTodoNotFound tests that fetching a missing todo returns 404
+func testGetTodoNotFound(t *testing.T, srv *app.Server) {
+	expectNotFound(t, getTodo(t, srv, 424242))
+}
+
+// testUpdateTodo tests updating a todo
+func testUpdateTodo(t *testing.T, srv *app.Server) {
+	created := addTodo(t, srv, "Test task")
+
+	if code := setCompleted(t, srv, created, true); code != http.StatusOK {
+		t.Errorf("expected status %d, got %d", http.StatusOK, code)
+	}
+
+	todos := listTodos(t, srv)
+	if len(todos) != 1 || !todos[0].Completed {
+		t.Errorf("expected todo to be completed, got %+v", todos)
+	}
+}
+
+// patchTodo sends a merge patch for a todo through the API, returning the recorder.
+func patchTodo(t *testing.T, srv *app.Server, id int, patch string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPatch, fmt.Sprintf("/todos/%d", id), bytes.NewBufferString(patch))
+	req.Header.Set("Content-Type", "application/merge-patch+json")
+	w := httptest.NewRecorder()
+	srv.HandleTodo(w, req)
+	return w
+}
+
+// testUpdateTodoTask tests that PUT replaces the task text and returns the todo
+func testUpdateTodoTask(t *testing.T, srv *app.Server) {
+	created := addTodo(t, srv, "Typo tsak")
+
+	body, _ := json.Marshal(app.Todo{Task: "Fixed task", Completed: true})
+	req := httptest.NewRequest(http.MethodPut, fmt.Sprintf("/todos/%d", created.ID), bytes.NewBuffer(body))
+	w := httptest.NewRecorder()
+	srv.HandleTodo(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, w.Code)
+	}
+	var got app.Todo
+	if err := json.NewDecoder(w.Body).Decode(&got); err != nil {
+		t.Fatalf("failed to decode todo: %v", err)
+	}
+	want := todoBasics{ID: created.ID, Task: "Fixed task", Completed: true}
+	if basics(got) != want {
+		t.Errorf("expected %+v, got %+v", want, got)
+	}
+	if todos := listTodos(t, srv); len(todos) != 1 || basics(todos[0]) != want {
+		t.Errorf("expected stored todo %+v, got %+v", want, todos)
+	}
+}
+
+// testPatchTodo tests that PATCH only touches the fields in the patch
+func testPatchTodo(t *testing.T, srv *app.Server) {
+	created := addTodo(t, srv, "Original task")
+	if code := setCompleted(t, srv, created, true); code != http.StatusOK {
+		t.Fatalf("failed to complete todo: status %d", code)
+	}
+
+	w := patchTodo(t, srv, created.ID, `{"task": "Renamed task"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	var got app.Todo
+	if err := json.NewDecoder(w.Body).Decode(&got); err != nil {
+		t.Fatalf("failed to decode todo: %v", err)
+	}
+	if got.Task != "Renamed task" || !got.Completed {
+		t.Errorf("expected renamed, still completed todo, got %+v", got)
+	}
+
+	// null resets a field, and id cannot be changed
+	w = patchTodo(t, srv, created.ID, `{"completed": null, "id": 999}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	want := todoBasics{ID: created.ID, Task: "Renamed task"}
+	if todos := listTodos(t, srv); len(todos) != 1 || basics(todos[0]) != want {
+		t.Errorf("expected stored todo %+v, got %+v", want, todos)
+	}
+}
+
+// testPatchTodoNotFound tests that patching a missing todo returns 404
+func testPatchTodoNotFound(t *testing.T, srv *app.Server) {
+	expectNotFound(t, patchTodo(t, srv, 424242, `{"task": "x"}`))
+}
+
+// testPatchTodoInvalid tests that malformed patches are rejected without changes
+func testPatchTodoInvalid(t *testing.T, srv *app.Server) {
+	created := addTodo(t, srv, "Unchanged")
+
+	for _, patch := range []string{`not json`, `["task"]`} {
+		expectProblem(t, patchTodo(t, srv, created.ID, patch), http.StatusBadRequest, app.CodeMalformedRequest)
+	}
+	for _, patch := range []string{`{"completed": "yes"}`, `{"task": null}`, `{"task": " "}`, `{"colour": "red"}`} {
+		p := expectProblem(t, patchTodo(t, srv, created.ID, patch), http.StatusUnprocessableEntity, app.CodeValidationFailed)
+		if len(p.Errors) != 1 {
+			t.Errorf("patch %s: expected one field error, got %+v", patch, p.Errors)
+		}
+	}
+	if todos := listTodos(t, srv); len(todos) != 1 || !reflect.DeepEqual(todos[0], created) {
+		t.Errorf("expected todo to be unchanged, got %+v", todos)
+	}
+}
+
+// testDeleteTodo tests deleting a todo
+func testDeleteTodo(t *testing.T, srv *app.Server) {
+	created := addTodo(t, srv, "Test task")
+
+	req := httptest.NewRequest(http.MethodDelete, fmt.Sprintf("/todos/%d", created.ID), nil)
+	w := httptest.NewRecorder()
+	srv.DeleteTodo(w, req, created.ID)
+
+	if w.Code != http.StatusNoContent {
+		t.Errorf("expected status %d, got %d", http.StatusNoContent, w.Code)
+	}
+	if todos := listTodos(t, srv); len(todos) != 0 {
+		t.Errorf("expected todo to be deleted, got %+v", todos)
+	}
+}
+
+// expectProblem checks for a problem+json response with the given status and code.
+func expectProblem(t *testing.T, w *httptest.ResponseRecorder, status int, code string) app.Problem {
+	t.Helper()
+	if w.Code != status {
+		t.Fatalf("expected status %d, got %d: %s", status, w.Code, w.Body.String())
+	}
+	if ct := w.Header().Get("Content-Type"); ct != app.ProblemContentType {
+		t.Errorf("expected Content-Type %s, got %q", app.ProblemContentType, ct)
+	}
+	var p app.Problem
+	if err := json.NewDecoder(w.Body).Decode(&p); err != nil {
+		t.Fatalf("failed to decode problem: %v", err)
+	}
+	if p.Code != code || p.Status != status {
+		t.Errorf("expected code %q and status %d, got %+v", code, status, p)
+	}
+	return p
+}
+
+// expectNotFound checks for a not_found problem.
+func expectNotFound(t *testing.T, w *httptest.ResponseRecorder) {
+	t.Helper()
+	expectProblem(t, w, http.StatusNotFound, app.CodeNotFound)
+}
+
+// testUpdateTodoNotFound tests that updating a missing todo returns 404 and
+// isn't counted as an update
+func testUpdateTodoNotFound(t *testing.T, srv *app.Server) {
+	before := testutil.ToFloat64(app.TodosUpdated)
+
+	body, _ := json.Marshal(app.Todo{Task: "Ghost", Completed: true})
+	req := httptest.NewRequest(http.MethodPut, "/todos/424242", bytes.NewBuffer(body))
+	w := httptest.NewRecorder()
+	srv.HandleTodo(w, req)
+
+	expectNotFound(t, w)
+	if after := testutil.ToFloat64(app.TodosUpdated); after != before {
+		t.Errorf("expected todos_updated_total to stay at %v, got %v", before, after)
+	}
+	if todos := listTodos(t, srv); len(todos) != 0 {
+		t.Errorf("expected no todos to be created, got %+v", todos)
+	}
+}
+
+// testDeleteTodoNotFound tests that deleting a missing todo returns 404 and
+// isn't counted as a delete
+func testDeleteTodoNotFound(t *testing.T, srv *app.Server) {
+	created := addTodo(t, srv, "Delete me once")
+
+	req := httptest.NewRequest(http.MethodDelete, fmt.Sprintf("/todos/%d", created.ID), nil)
+	w := httptest.NewRecorder()
+	srv.HandleTodo(w, req)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("expected status %d, got %d", http.StatusNoContent, w.Code)
+	}
+
+	before := testutil.ToFloat64(app.TodosDeleted)
+	w = httptest.NewRecorder()
+	srv.HandleTodo(w, httptest.NewRequest(http.MethodDelete, fmt.Sprintf("/todos/%d", created.ID), nil))
+
+	expectNotFound(t, w)
+	if after := testutil.ToFloat64(app.TodosDeleted); after != before {
+		t.Errorf("expected todos_deleted_total to stay at %v, got %v", before, after)
+	}
+}
+
+// testListPagination tests walking the list a page at a time in both directions
+func testListPagination(t *testing.T, srv *app.Server) {
+	var want []string
+	for i := 1; i <= 5; i++ {
+		task := fmt.Sprintf("Task %d", i)
+		addTodo(t, srv, task)
+		want = append(want, task)
+	}
+
+	todos, next := listPage(t, srv, "limit=2")
+	if len(todos) != 2 || next == "" {
+		t.Fatalf("expected a first page of 2 with a next cursor, got %+v and %q", todos, next)
+	}
+	if got := listAllPages(t, srv, "limit=2"); !slices.Equal(got, want) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+	if _, next := listPage(t, srv, "limit=5"); next != "" {
+		t.Errorf("expected no next cursor when everything fits, got %q", next)
+	}
+
+	slices.Reverse(want)
+	if got := listAllPages(t, srv, "limit=2&sort=-id"); !slices.Equal(got, want) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+}
+
+// testListSortByTask tests keyset pagination on a non-unique sort key
+func testListSortByTask(t *testing.T, srv *app.Server) {
+	for _, task := range []string{"b", "a", "c", "b", "a"} {
+		addTodo(t, srv, task)
+	}
+
+	want := []string{"a", "a", "b", "b", "c"}
+	if got := listAllPages(t, srv, "limit=2&sort=task"); !slices.Equal(got, want) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+	slices.Reverse(want)
+	if got := listAllPages(t, srv, "limit=1&sort=-task"); !slices.Equal(got, want) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+}
+
+// testListFilters tests the completed and q filters, alone and combined
+func testListFilters(t *testing.T, srv *app.Server) {
+	milk := addTodo(t, srv, "Buy MILK")
+	addTodo(t, srv, "Buy bread")
+	addTodo(t, srv, "100% done_ish")
+	if code := setCompleted(t, srv, milk, true); code != http.StatusOK {
+		t.Fatalf("failed to complete todo: status %d", code)
+	}
+
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"completed=true", []string{"Buy MILK"}},
+		{"completed=false", []string{"Buy bread", "100% done_ish"}},
+		{"q=milk", []string{"Buy MILK"}},
+		{"q=buy&completed=false", []string{"Buy bread"}},
+		{"q=" + url.QueryEscape("0%"), []string{"100% done_ish"}},
+		{"q=" + url.QueryEscape("e_i"), []string{"100% done_ish"}},
+		{"q=" + url.QueryEscape("y_b"), nil},
+		{"q=nothing", nil},
+	}
+	for _, tt := range tests {
+		if got := listAllPages(t, srv, tt.query+"&limit=1"); !slices.Equal(got, tt.want) {
+			t.Errorf("%s: expected %v, got %v", tt.query, tt.want, got)
+		}
+	}
+}
+
+// testListInvalidParams tests that bad query parameters are rejected with 422
+func testListInvalidParams(t *testing.T, srv *app.Server) {
+	addTodo(t, srv, "Task")
+	addTodo(t, srv, "Task")
+	_, idCursor := listPage(t, srv, "limit=1")
+
+	tests := []struct {
+		query string
+		field string
+	}{
+		{"limit=0", "limit"},
+		{"limit=1000", "limit"},
+		{"limit=ten", "limit"},
+		{"completed=maybe", "completed"},
+		{"sort=colour", "sort"},
+		{"cursor=not-a-cursor", "cursor"},
+		{"sort=task&cursor=" + url.QueryEscape(idCursor), "cursor"},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/todos?"+tt.query, nil)
+		w := httptest.NewRecorder()
+		srv.GetTodos(w, req)
+
+		p := expectProblem(t, w, http.StatusUnprocessableEntity, app.CodeValidationFailed)
+		if len(p.Errors) != 1 || p.Errors[0].Field != tt.field {
+			t.Errorf("%s: expected a field error for %s, got %+v", tt.query, tt.field, p.Errors)
+		}
+	}
+}
+
+// searchTodos runs a search through the API.
+func searchTodos(t *testing.T, srv *app.Server, query string) []app.SearchResult {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodGet, "/todos/search?"+query, nil)
+	w := httptest.NewRecorder()
+
+	srv.SearchTodos(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("search %q failed: status %d, body %q", query, w.Code, w.Body.String())
+	}
+	var results []app.SearchResult
+	if err := json.NewDecoder(w.Body).Decode(&results); err != nil {
+		t.Fatalf("failed to decode search results: %v", err)
+	}
+	return results
+}
+
+// testSearchTodos tests ranking, matching and highlighting of search results
+func testSearchTodos(t *testing.T, srv *app.Server) {
+	addTodo(t, srv, "Call the plumber about the boiler")
+	report := addTodo(t, srv, "Write quarterly report")
+	addTodo(t, srv, "Report: report <b>bugs</b> in the report tool")
+	addTodo(t, srv, "Unrelated chore")
+
+	results := searchTodos(t, srv, "q=report")
+	if len(results) != 2 {
+		t.Fatalf("expected 2 results, got %+v", results)
+	}
+	if results[0].Rank < results[1].Rank {
+		t.Errorf("expected results ordered by rank, got %+v", results)
+	}
+	for _, r := range results {
+		if !strings.Contains(strings.ToLower(r.Snippet), "<mark>report</mark>") {
+			t.Errorf("expected highlighted match in snippet %q", r.Snippet)
+		}
+		if strings.Contains(r.Snippet, "<b>") {
+			t.Errorf("expected task markup to be escaped in snippet %q", r.Snippet)
+		}
+	}
+
+	results = searchTodos(t, srv, "q="+url.QueryEscape("quarterly report"))
+	if len(results) != 1 || results[0].ID != report.ID || results[0].Task != report.Task {
+		t.Errorf("expected only %+v to match every term, got %+v", report, results)
+	}
+
+	if results := searchTodos(t, srv, "q=report&limit=1"); len(results) != 1 {
+		t.Errorf("expected limit to cap results at 1, got %d", len(results))
+	}
+	if results := searchTodos(t, srv, "q=nonexistent"); len(results) != 0 {
+		t.Errorf("expected no results, got %+v", results)
+	}
+
+	// Characters the highlighting uses internally can't unbalance the tags.
+	addTodo(t, srv, "Stray \ue001plumbing and \ue000wiring")
+	results = searchTodos(t, srv, "q=stray")
+	if len(results) != 1 {
+		t.Fatalf("expected 1 result, got %+v", results)
+	}
+	if s := results[0].Snippet; strings.Count(s, "<mark>") != 1 || strings.Count(s, "</mark>") != 1 || strings.ContainsAny(s, "\ue000\ue001") {
+		t.Errorf("expected one balanced highlight in snippet %q", s)
+	}
+}
+
+// testSearchTodosInvalidParams tests that bad search parameters are rejected with 422
+func testSearchTodosInvalidParams(t *testing.T, srv *app.Server) {
+	for query, field := range map[string]string{
+		"":              "q",
+		"q=++":          "q",
+		"q=a&limit=0":   "limit",
+		"q=a&limit=big": "limit",
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/todos/search?"+query, nil)
+		w := httptest.NewRecorder()
+		srv.SearchTodos(w, req)
+
+		p := expectProblem(t, w, http.StatusUnprocessableEntity, app.CodeValidationFailed)
+		if len(p.Errors) != 1 || p.Errors[0].Field != field {
+			t.Errorf("%q: expected a field error for %s, got %+v", query, field, p.Errors)
+		}
+	}
+}
+
+// testTodoDetails tests that due dates, priorities and notes round-trip
+func testTodoDetails(t *testing.T, srv *app.Server) {
+	due := time.Date(2030, 1, 2, 15, 4, 5, 123456000, time.FixedZone("EST", -5*3600))
+	created := createTodo(t, srv, map[string]any{
+		"task":     "File taxes",
+		"due_at":   due.Format(time.RFC3339Nano),
+		"priority": "urgent",
+		"notes":    "Receipts are in the blue folder",
+	})
+
+	if created.DueAt == nil || !created.DueAt.Equal(due) || created.DueAt.Location() != time.UTC {
+		t.Errorf("expected due_at %v in UTC, got %v", due, created.DueAt)
+	}
+	if created.Priority != app.PriorityUrgent || created.Notes != "Receipts are in the blue folder" {
+		t.Errorf("expected priority and notes to be stored, got %+v", created)
+	}
+
+	w := getTodo(t, srv, created.ID)
+	var got app.Todo
+	if err := json.NewDecoder(w.Body).Decode(&got); err != nil {
+		t.Fatalf("failed to decode todo: %v", err)
+	}
+	if got.DueAt == nil || !got.DueAt.Equal(due) || got.Priority != app.PriorityUrgent || got.Notes != created.Notes {
+		t.Errorf("expected stored details to match %+v, got %+v", created, got)
+	}
+
+	// Patching one detail keeps the others, and null clears the due date
+	w = patchTodo(t, srv, created.ID, `{"priority": "low", "due_at": null}`)
+	if err := json.NewDecoder(w.Body).Decode(&got); err != nil {
+		t.Fatalf("failed to decode todo: %v", err)
+	}
+	if got.DueAt != nil || got.Priority != app.PriorityLow || got.Notes != created.Notes {
+		t.Errorf("expected low priority, no due date and unchanged notes, got %+v", got)
+	}
+
+	if todo := addTodo(t, srv, "Defaults"); todo.Priority != app.PriorityNormal || todo.DueAt != nil {
+		t.Errorf("expected normal priority and no due date by default, got %+v", todo)
+	}
+}
+
+// testTodoDetailsInvalid tests validation of the detail fields
+func testTodoDetailsInvalid(t *testing.T, srv *app.Server) {
+	created := addTodo(t, srv, "Task")
+
+	for patch, field := range map[string]string{
+		`{"priority": "whenever"}`:                        "priority",
+		`{"due_at": "next tuesday"}`:                      "due_at",
+		`{"notes": "` + strings.Repeat("n", 10001) + `"}`: "notes",
+	} {
+		p := expectProblem(t, patchTodo(t, srv, created.ID, patch), http.StatusUnprocessableEntity, app.CodeValidationFailed)
+		if len(p.Errors) != 1 || p.Errors[0].Field != field {
+			t.Errorf("expected a field error for %s, got %+v", field, p.Errors)
+		}
+	}
+}
+
+// testTodoTimestamps tests the server-managed timestamps
+func testTodoTimestamps(t *testing.T, srv *app.Server) {
+	start := time.Now().Add(-time.Second)
+	created := createTodo(t, srv, map[string]any{"task": "Stamp me", "created_at": "2000-01-01T00:00:00Z"})
+	if created.CreatedAt.Before(start) || !created.UpdatedAt.Equal(created.CreatedAt) || created.CompletedAt != nil {
+		t.Fatalf("expected fresh created_at = updated_at and no completed_at, got %+v", created)
+	}
+
+	time.Sleep(2 * time.Millisecond)
+	var completed app.Todo
+	if err := json.NewDecoder(patchTodo(t, srv, created.ID, `{"completed": true}`).Body).Decode(&completed); err != nil {
+		t.Fatalf("failed to decode todo: %v", err)
+	}
+	if !completed.CreatedAt.Equal(created.CreatedAt) || !completed.UpdatedAt.After(created.UpdatedAt) {
+		t.Errorf("expected created_at kept and updated_at advanced, got %+v", completed)
+	}
+	if completed.CompletedAt == nil || !completed.CompletedAt.Equal(completed.UpdatedAt) {
+		t.Errorf("expected completed_at to be stamped, got %v", completed.CompletedAt)
+	}
+
+	// Editing a completed todo keeps its completed_at
+	var renamed app.Todo
+	if err := json.NewDecoder(patchTodo(t, srv, created.ID, `{"task": "Renamed"}`).Body).Decode(&renamed); err != nil {
+		t.Fatalf("failed to decode todo: %v", err)
+	}
+	if renamed.CompletedAt == nil || !renamed.CompletedAt.Equal(*completed.CompletedAt) {
+		t.Errorf("expected completed_at %v to be kept, got %v", completed.CompletedAt, renamed.CompletedAt)
+	}
+
+	var reopened app.Todo
+	if err := json.NewDecoder(patchTodo(t, srv, created.ID, `{"completed": false, "completed_at": "2000-01-01T00:00:00Z"}`).Body).Decode(&reopened); err != nil {
+		t.Fatalf("failed to decode todo: %v", err)
+	}
+	if reopened.CompletedAt != nil {
+		t.Errorf("expected completed_at to be cleared on reopening, got %v", reopened.CompletedAt)
+	}
+}
+
+// testListDueFilters tests the overdue and this_week filters
+func testListDueFilters(t *testing.T, srv *app.Server) {
+	now := time.Now().UTC()
+	monday := time.Date(now.Year(), now.Month(), now.Day()-(int(now.Weekday())+6)%7, 0, 0, 0, 0, time.UTC)
+	due := func(task string, at time.Time) app.Todo {
+		return createTodo(t, srv, map[string]any{"task": task, "due_at": at.Format(time.RFC3339Nano)})
+	}
+
+	due("Overdue", now.Add(-time.Hour))
+	done := due("Overdue but done", now.Add(-time.Hour))
+	if code := setCompleted(t, srv, done, true); code != http.StatusOK {
+		t.Fatalf("failed to complete todo: status %d", code)
+	}
+	due("Last week", monday.Add(-time.Hour))
+	due("Early this week", monday.Add(time.Minute))
+	due("Next week", monday.AddDate(0, 0, 7).Add(time.Minute))
+	addTodo(t, srv, "No due date")
+
+	if got := listAllPages(t, srv, "due=overdue"); !slices.Contains(got, "Overdue") || slices.Contains(got, "Overdue but done") ||
+		slices.Contains(got, "Next week") || slices.Contains(got, "No due date") {
+		t.Errorf("unexpected overdue todos %v", got)
+	}
+
+	got := listAllPages(t, srv, "due=this_week&tz=UTC")
+	if !slices.Contains(got, "Early this week") {
+		t.Errorf("expected %q due this week, got %v", "Early this week", got)
+	}
+	for _, task := range []string{"Last week", "Next week", "No due date"} {
+		if slices.Contains(got, task) {
+			t.Errorf("expected %q not to be due this week, got %v", task, got)
+		}
+	}
+
+	for _, query := range []string{"due=someday", "due=overdue&completed=true", "due=this_week&tz=Mars/Olympus"} {
+		w := httptest.NewRecorder()
+		srv.GetTodos(w, httptest.NewRequest(http.MethodGet, "/todos?"+query, nil))
+		expectProblem(t, w, http.StatusUnprocessableEntity, app.CodeValidationFailed)
+	}
+}
+
+// serveLists sends a request to the /lists handlers, returning the recorder.
+func serveLists(t *testing.T, srv *app.Server, method, path, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	w := httptest.NewRecorder()
+	if path == "/lists" || strings.HasPrefix(path, "/lists?") {
+		srv.HandleLists(w, req)
+	} else {
+		srv.HandleList(w, req)
+	}
+	return w
+}
+
+// decodeList decodes a successful list response with the given status.
+func decodeList(t *testing.T, w *httptest.ResponseRecorder, status int) app.TodoList {
+	t.Helper()
+	if w.Code != status {
+		t.Fatalf("expected status %d, got %d: %s", status, w.Code, w.Body.String())
+	}
+	var l app.TodoList
+	if err := json.NewDecoder(w.Body).Decode(&l); err != nil {
+		t.Fatalf("failed to decode list: %v", err)
+	}
+	return l
+}
+
+// createList creates a list through the API and returns it.
+func createList(t *testing.T, srv *app.Server, name string) app.TodoList {
+	t.Helper()
+	body, _ := json.Marshal(map[string]string{"name": name})
+	return decodeList(t, serveLists(t, srv, http.MethodPost, "/lists", string(body)), http.StatusCreated)
+}
+
+// listNames fetches lists with the given query string, returning their names.
+func listNames(t *testing.T, srv *app.Server, query string) []string {
+	t.Helper()
+	w := serveLists(t, srv, http.MethodGet, "/lists"+query, "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("failed to list lists: status %d, body %q", w.Code, w.Body.String())
+	}
+	var lists []app.TodoList
+	if err := json.NewDecoder(w.Body).Decode(&lists); err != nil {
+		t.Fatalf("failed to decode lists: %v", err)
+	}
+	var names []string
+	for _, l := range lists {
+		names = append(names, l.Name)
+	}
+	return names
+}
+
+// testTodoLists tests creating, renaming, archiving and deleting lists, and
+// that the default list can't be archived or deleted
+func testTodoLists(t *testing.T, srv *app.Server) {
+	if names := listNames(t, srv, ""); !slices.Equal(names, []string{"Inbox"}) {
+		t.Fatalf("expected only the default list, got %q", names)
+	}
+
+	infra := createList(t, srv, "  infra ")
+	if infra.ID == app.DefaultListID || infra.Name != "infra" || infra.Archived || infra.CreatedAt.IsZero() {
+		t.Errorf("unexpected created list %+v", infra)
+	}
+	path := fmt.Sprintf("/lists/%d", infra.ID)
+	if got := decodeList(t, serveLists(t, srv, http.MethodGet, path, ""), http.StatusOK); got.Name != "infra" {
+		t.Errorf("expected to fetch list %q, got %+v", "infra", got)
+	}
+
+	renamed := decodeList(t, serveLists(t, srv, http.MethodPatch, path, `{"name": "Infrastructure"}`), http.StatusOK)
+	if renamed.ID != infra.ID || renamed.Name != "Infrastructure" || !renamed.CreatedAt.Equal(infra.CreatedAt) {
+		t.Errorf("unexpected renamed list %+v", renamed)
+	}
+	decodeList(t, serveLists(t, srv, http.MethodPatch, path, `{"archived": true}`), http.StatusOK)
+	if names := listNames(t, srv, ""); !slices.Equal(names, []string{"Inbox"}) {
+		t.Errorf("expected archived list to be hidden, got %q", names)
+	}
+	if names := listNames(t, srv, "?include_archived=true"); !slices.Equal(names, []string{"Inbox", "Infrastructure"}) {
+		t.Errorf("expected archived list with include_archived, got %q", names)
+	}
+
+	p := expectProblem(t, serveLists(t, srv, http.MethodPatch, path, `{"name": ""}`), http.StatusUnprocessableEntity, app.CodeValidationFailed)
+	if len(p.Errors) != 1 || p.Errors[0].Field != "name" {
+		t.Errorf("expected a name error, got %+v", p.Errors)
+	}
+	expectProblem(t, serveLists(t, srv, http.MethodPost, "/lists", `{"name": "x", "color": "red"}`), http.StatusUnprocessableEntity, app.CodeValidationFailed)
+
+	inbox := fmt.Sprintf("/lists/%d", app.DefaultListID)
+	expectProblem(t, serveLists(t, srv, http.MethodPatch, inbox, `{"archived": true}`), http.StatusConflict, app.CodeDefaultList)
+	expectProblem(t, serveLists(t, srv, http.MethodDelete, inbox, ""), http.StatusConflict, app.CodeDefaultList)
+	if got := decodeList(t, serveLists(t, srv, http.MethodPatch, inbox, `{"name": "Personal"}`), http.StatusOK); got.Name != "Personal" || got.Archived {
+		t.Errorf("expected default list to be renamed, got %+v", got)
+	}
+
+	if w := serveLists(t, srv, http.MethodDelete, path, ""); w.Code != http.StatusNoContent {
+		t.Fatalf("expected status %d deleting empty list, got %d: %s", http.StatusNoContent, w.Code, w.Body.String())
+	}
+	expectNotFound(t, serveLists(t, srv, http.MethodGet, path, ""))
+	expectNotFound(t, serveLists(t, srv, http.MethodDelete, path, ""))
+	expectNotFound(t, serveLists(t, srv, http.MethodPatch, path, `{"name": "gone"}`))
+}
+
+// testListTodosByList tests that todos default to the default list, can be
+// created in and listed by list, and can move between lists
+func testListTodosByList(t *testing.T, srv *app.Server) {
+	inboxTodo := addTodo(t, srv, "Buy milk")
+	if inboxTodo.ListID != app.DefaultListID {
+		t.Errorf("expected todo in the default list, got list %d", inboxTodo.ListID)
+	}
+
+	infra := createList(t, srv, "infra")
+	todosPath := fmt.Sprintf("/lists/%d/todos", infra.ID)
+	w := serveLists(t, srv, http.MethodPost, todosPath, `{"task": "Rotate certs"}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusCreated, w.Code, w.Body.String())
+	}
+	var certs app.Todo
+	if err := json.NewDecoder(w.Body).Decode(&certs); err != nil {
+		t.Fatalf("failed to decode todo: %v", err)
+	}
+	if certs.ListID != infra.ID {
+		t.Errorf("expected todo in list %d, got %d", infra.ID, certs.ListID)
+	}
+	createTodo(t, srv, map[string]any{"task": "Upgrade cluster", "list_id": infra.ID})
+
+	if tasks := listAllPages(t, srv, ""); !slices.Equal(tasks, []string{"Buy milk", "Rotate certs", "Upgrade cluster"}) {
+		t.Errorf("expected /todos to list every list, got %q", tasks)
+	}
+	if tasks := listAllPages(t, srv, fmt.Sprintf("list_id=%d", infra.ID)); !slices.Equal(tasks, []string{"Rotate certs", "Upgrade cluster"}) {
+		t.Errorf("expected list_id filter to match the list, got %q", tasks)
+	}
+
+	w = serveLists(t, srv, http.MethodGet, todosPath+"?limit=1", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	var page []app.Todo
+	if err := json.NewDecoder(w.Body).Decode(&page); err != nil {
+		t.Fatalf("failed to decode todos: %v", err)
+	}
+	if len(page) != 1 || page[0].ID != certs.ID || w.Header().Get("X-Next-Cursor") == "" {
+		t.Errorf("expected first page of the list with a next cursor, got %+v", page)
+	}
+
+	// PUT without list_id keeps the todo where it is; PATCH moves it.
+	if code := setCompleted(t, srv, app.Todo{ID: certs.ID, Task: certs.Task}, true); code != http.StatusOK {
+		t.Fatalf("failed to complete todo: status %d", code)
+	}
+	moved := patchTodo(t, srv, certs.ID, fmt.Sprintf(`{"list_id": %d}`, app.DefaultListID))
+	if moved.Code != http.StatusOK {
+		t.Fatalf("expected status %d moving todo, got %d: %s", http.StatusOK, moved.Code, moved.Body.String())
+	}
+	if tasks := listAllPages(t, srv, fmt.Sprintf("list_id=%d", app.DefaultListID)); !slices.Equal(tasks, []string{"Buy milk", "Rotate certs"}) {
+		t.Errorf("expected todo to move to the default list, got %q", tasks)
+	}
+
+	p := expectProblem(t, patchTodo(t, srv, certs.ID, `{"list_id": 424242}`), http.StatusUnprocessableEntity, app.CodeValidationFailed)
+	if len(p.Errors) != 1 || p.Errors[0].Field != "list_id" {
+		t.Errorf("expected a list_id error, got %+v", p.Errors)
+	}
+	body, _ := json.Marshal(map[string]any{"task": "Nowhere", "list_id": 424242})
+	req := httptest.NewRequest(http.MethodPost, "/todos", bytes.NewReader(body))
+	w = httptest.NewRecorder()
+	srv.AddTodo(w, req)
+	expectProblem(t, w, http.StatusUnprocessableEntity, app.CodeValidationFailed)
+
+	expectNotFound(t, serveLists(t, srv, http.MethodGet, "/lists/424242/todos", ""))
+	expectNotFound(t, serveLists(t, srv, http.MethodPost, "/lists/424242/todos", `{"task": "Nowhere"}`))
+}
+
+// testDeleteListNotEmpty tests that a list with todos can't be deleted
+// until they are moved out
+func testDeleteListNotEmpty(t *testing.T, srv *app.Server) {
+	infra := createList(t, srv, "infra")
+	todo := createTodo(t, srv, map[string]any{"task": "Rotate certs", "list_id": infra.ID})
+
+	path := fmt.Sprintf("/lists/%d", infra.ID)
+	expectProblem(t, serveLists(t, srv, http.MethodDelete, path, ""), http.StatusConflict, app.CodeListNotEmpty)
+	if todos := listTodos(t, srv); len(todos) != 1 {
+		t.Errorf("expected the todo to survive, got %+v", todos)
+	}
+
+	if w := patchTodo(t, srv, todo.ID, fmt.Sprintf(`{"list_id": %d}`, app.DefaultListID)); w.Code != http.StatusOK {
+		t.Fatalf("failed to move todo: status %d, body %q", w.Code, w.Body.String())
+	}
+	if w := serveLists(t, srv, http.MethodDelete, path, ""); w.Code != http.StatusNoContent {
+		t.Errorf("expected status %d, got %d: %s", http.StatusNoContent, w.Code, w.Body.String())
+	}
+}
+
+// serveTags sends a request to the /tags handlers, returning the recorder.
+func serveTags(t *testing.T, srv *app.Server, method, path, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	w := httptest.NewRecorder()
+	if path == "/tags" {
+		srv.HandleTags(w, req)
+	} else {
+		srv.HandleTag(w, req)
+	}
+	return w
+}
+
+// createTag creates a tag through the API and returns it.
+func createTag(t *testing.T, srv *app.Server, name string) app.Tag {
+	t.Helper()
+	body, _ := json.Marshal(map[string]string{"name": name})
+	w := serveTags(t, srv, http.MethodPost, "/tags", string(body))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("failed to create tag: status %d, body %q", w.Code, w.Body.String())
+	}
+	var g app.Tag
+	if err := json.NewDecoder(w.Body).Decode(&g); err != nil {
+		t.Fatalf("failed to decode tag: %v", err)
+	}
+	return g
+}
+
+// setTag attaches (PUT) or detaches (DELETE) a tag through the API.
+func setTag(t *testing.T, srv *app.Server, method string, todoID, tagID int) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(method, fmt.Sprintf("/todos/%d/tags/%d", todoID, tagID), nil)
+	w := httptest.NewRecorder()
+	srv.HandleTodo(w, req)
+	return w
+}
+
+// tagNames returns the names of a todo's tags, in order.
+func tagNames(todo app.Todo) []string {
+	names := []string{}
+	for _, g := range todo.Tags {
+		names = append(names, g.Name)
+	}
+	return names
+}
+
+// decodeTodo decodes a successful todo response.
+func decodeTodo(t *testing.T, w *httptest.ResponseRecorder) app.Todo {
+	t.Helper()
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	var todo app.Todo
+	if err := json.NewDecoder(w.Body).Decode(&todo); err != nil {
+		t.Fatalf("failed to decode todo: %v", err)
+	}
+	return todo
+}
+
+// testTags tests creating, renaming and deleting tags, with names
+// normalized to lower case and kept unique
+func testTags(t *testing.T, srv *app.Server) {
+	infra := createTag(t, srv, " Infra ")
+	if infra.ID == 0 || infra.Name != "infra" {
+		t.Errorf("expected normalized tag, got %+v", infra)
+	}
+	createTag(t, srv, "bug")
+	expectProblem(t, serveTags(t, srv, http.MethodPost, "/tags", `{"name": "INFRA"}`), http.StatusConflict, app.CodeTagExists)
+	expectProblem(t, serveTags(t, srv, http.MethodPost, "/tags", `{"name": "  "}`), http.StatusUnprocessableEntity, app.CodeValidationFailed)
+
+	w := serveTags(t, srv, http.MethodGet, "/tags", "")
+	var tags []app.Tag
+	if err := json.NewDecoder(w.Body).Decode(&tags); err != nil {
+		t.Fatalf("failed to decode tags: %v", err)
+	}
+	if len(tags) != 2 || tags[0].Name != "bug" || tags[1].Name != "infra" {
+		t.Errorf("expected tags ordered by name, got %+v", tags)
+	}
+
+	path := fmt.Sprintf("/tags/%d", infra.ID)
+	expectProblem(t, serveTags(t, srv, http.MethodPatch, path, `{"name": "Bug"}`), http.StatusConflict, app.CodeTagExists)
+	w = serveTags(t, srv, http.MethodPatch, path, `{"name": "Ops"}`)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"name":"ops"`) {
+		t.Errorf("expected rename to ops, got %d: %s", w.Code, w.Body.String())
+	}
+	// Renaming a tag to its own name is not a conflict.
+	if w := serveTags(t, srv, http.MethodPatch, path, `{"name": "ops"}`); w.Code != http.StatusOK {
+		t.Errorf("expected status %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+
+	if w := serveTags(t, srv, http.MethodDelete, path, ""); w.Code != http.StatusNoContent {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusNoContent, w.Code, w.Body.String())
+	}
+	expectNotFound(t, serveTags(t, srv, http.MethodGet, path, ""))
+	expectNotFound(t, serveTags(t, srv, http.MethodDelete, path, ""))
+	expectNotFound(t, serveTags(t, srv, http.MethodPatch, path, `{"name": "gone"}`))
+}
+
+// testTodoTags tests attaching and detaching tags, which are returned inline
+// with todos everywhere
+func testTodoTags(t *testing.T, srv *app.Server) {
+	todo := addTodo(t, srv, "Rotate certs")
+	if todo.Tags == nil || len(todo.Tags) != 0 {
+		t.Errorf("expected an empty tag list, got %#v", todo.Tags)
+	}
+	ops, urgent := createTag(t, srv, "ops"), createTag(t, srv, "alpha")
+
+	tagged := decodeTodo(t, setTag(t, srv, http.MethodPut, todo.ID, ops.ID))
+	tagged = decodeTodo(t, setTag(t, srv, http.MethodPut, todo.ID, urgent.ID))
+	if names := tagNames(tagged); !slices.Equal(names, []string{"alpha", "ops"}) {
+		t.Errorf("expected tags ordered by name, got %q", names)
+	}
+	if tagged.UpdatedAt.Before(todo.UpdatedAt) {
+		t.Errorf("expected tagging to touch updated_at")
+	}
+	// Attaching twice is a no-op.
+	if again := decodeTodo(t, setTag(t, srv, http.MethodPut, todo.ID, ops.ID)); len(again.Tags) != 2 || !again.UpdatedAt.Equal(tagged.UpdatedAt) {
+		t.Errorf("expected re-tagging to change nothing, got %+v", again)
+	}
+
+	got := decodeTodo(t, getTodo(t, srv, todo.ID))
+	if names := tagNames(got); !slices.Equal(names, []string{"alpha", "ops"}) {
+		t.Errorf("expected tags on GET, got %q", names)
+	}
+	if todos := listTodos(t, srv); len(todos) != 1 || len(todos[0].Tags) != 2 {
+		t.Errorf("expected tags in listing, got %+v", todos)
+	}
+	if results := searchTodos(t, srv, "q=certs"); len(results) != 1 || len(results[0].Tags) != 2 {
+		t.Errorf("expected tags in search results, got %+v", results)
+	}
+
+	// Updates keep tags, even if the body names others.
+	patched := decodeTodo(t, patchTodo(t, srv, todo.ID, `{"task": "Rotate all certs", "tags": []}`))
+	if len(patched.Tags) != 2 {
+		t.Errorf("expected PATCH to keep tags, got %+v", patched.Tags)
+	}
+
+	untagged := decodeTodo(t, setTag(t, srv, http.MethodDelete, todo.ID, urgent.ID))
+	if names := tagNames(untagged); !slices.Equal(names, []string{"ops"}) {
+		t.Errorf("expected only ops after detaching, got %q", names)
+	}
+	decodeTodo(t, setTag(t, srv, http.MethodDelete, todo.ID, urgent.ID))
+
+	// Renaming and deleting a tag show up on its todos, and touch them like
+	// tagging does, but leave todos in the trash alone.
+	trashed := addTodo(t, srv, "Old certs")
+	decodeTodo(t, setTag(t, srv, http.MethodPut, trashed.ID, ops.ID))
+	if w := deleteTodo(t, srv, trashed.ID, ""); w.Code != http.StatusNoContent {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusNoContent, w.Code, w.Body.String())
+	}
+	trashedEvents := len(todoHistory(t, srv, trashed.ID))
+
+	serveTags(t, srv, http.MethodPatch, fmt.Sprintf("/tags/%d", ops.ID), `{"name": "infra"}`)
+	renamed := decodeTodo(t, getTodo(t, srv, todo.ID))
+	if names := tagNames(renamed); !slices.Equal(names, []string{"infra"}) {
+		t.Errorf("expected renamed tag, got %q", names)
+	}
+	if renamed.Version != untagged.Version+1 || renamed.UpdatedAt.Before(untagged.UpdatedAt) {
+		t.Errorf("expected renaming the tag to touch the todo, got version %d at %v (was %d at %v)",
+			renamed.Version, renamed.UpdatedAt, untagged.Version, untagged.UpdatedAt)
+	}
+	serveTags(t, srv, http.MethodDelete, fmt.Sprintf("/tags/%d", ops.ID), "")
+	got = decodeTodo(t, getTodo(t, srv, todo.ID))
+	if len(got.Tags) != 0 {
+		t.Errorf("expected deleted tag to be detached, got %+v", got.Tags)
+	}
+	if got.Version != renamed.Version+1 || got.UpdatedAt.Before(renamed.UpdatedAt) {
+		t.Errorf("expected deleting the tag to touch the todo, got version %d at %v (was %d at %v)",
+			got.Version, got.UpdatedAt, renamed.Version, renamed.UpdatedAt)
+	}
+	if after := len(todoHistory(t, srv, trashed.ID)); after != trashedEvents {
+		t.Errorf("expected the trashed todo untouched, got %d events (was %d)", after, trashedEvents)
+	}
+
+	expectNotFound(t, setTag(t, srv, http.MethodPut, 424242, urgent.ID))
+	expectNotFound(t, setTag(t, srv, http.MethodPut, todo.ID, 424242))
+	if w := setTag(t, srv, http.MethodGet, todo.ID, urgent.ID); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected status %d, got %d", http.StatusMethodNotAllowed, w.Code)
+	}
+}
+
+// testListTagFilters tests filtering todos by tags with AND and OR semantics
+func testListTagFilters(t *testing.T, srv *app.Server) {
+	infra, bug := createTag(t, srv, "infra"), createTag(t, srv, "bug")
+	both := addTodo(t, srv, "Both")
+	onlyInfra := addTodo(t, srv, "Only infra")
+	onlyBug := addTodo(t, srv, "Only bug")
+	addTodo(t, srv, "Neither")
+	for _, tag := range []struct{ todo, tag int }{
+		{both.ID, infra.ID}, {both.ID, bug.ID}, {onlyInfra.ID, infra.ID}, {onlyBug.ID, bug.ID},
+	} {
+		decodeTodo(t, setTag(t, srv, http.MethodPut, tag.todo, tag.tag))
+	}
+
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"tag=infra", []string{"Both", "Only infra"}},
+		{"tag=infra&tag=BUG", []string{"Both"}},
+		{"tag=infra&tag=bug&tag_mode=all", []string{"Both"}},
+		{"tag=infra&tag=bug&tag_mode=any", []string{"Both", "Only infra", "Only bug"}},
+		{"tag=infra&tag=infra", []string{"Both", "Only infra"}},
+		{"tag=nope", nil},
+		{"tag=bug&tag=nope&tag_mode=any&limit=1", []string{"Both", "Only bug"}},
+	}
+	for _, tt := range tests {
+		if got := listAllPages(t, srv, tt.query); !slices.Equal(got, tt.want) {
+			t.Errorf("%s: expected %q, got %q", tt.query, tt.want, got)
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/todos?tag=infra&tag_mode=some", nil)
+	w := httptest.NewRecorder()
+	srv.GetTodos(w, req)
+	p := expectProblem(t, w, http.StatusUnprocessableEntity, app.CodeValidationFailed)
+	if len(p.Errors) != 1 || p.Errors[0].Field != "tag_mode" {
+		t.Errorf("expected a tag_mode error, got %+v", p.Errors)
+	}
+}
+
+// testSubtasks tests creating subtasks, which inherit their parent's list,
+// and listing them by parent
+func testSubtasks(t *testing.T, srv *app.Server) {
+	work := createList(t, srv, "Work")
+	parent := createTodo(t, srv, map[string]any{"task": "Launch", "list_id": work.ID})
+	child := createTodo(t, srv, map[string]any{"task": "Write docs", "parent_id": parent.ID})
+	if child.ParentID == nil || *child.ParentID != parent.ID || child.ListID != work.ID {
+		t.Errorf("expected a subtask of %d in list %d, got %+v", parent.ID, work.ID, child)
+	}
+	grandchild := createTodo(t, srv, map[string]any{"task": "Proofread", "parent_id": child.ID, "list_id": app.DefaultListID})
+	if grandchild.ListID != app.DefaultListID {
+		t.Errorf("expected an explicit list to win over the parent's, got %d", grandchild.ListID)
+	}
+	addTodo(t, srv, "Unrelated")
+
+	if got := decodeTodo(t, getTodo(t, srv, parent.ID)); got.ChildCount != 1 || got.ParentID != nil {
+		t.Errorf("expected a top-level todo with 1 subtask, got %+v", got)
+	}
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{fmt.Sprintf("parent_id=%d", parent.ID), []string{"Write docs"}},
+		{fmt.Sprintf("parent_id=%d", child.ID), []string{"Proofread"}},
+		{"top_level=true", []string{"Launch", "Unrelated"}},
+		{"top_level=false", []string{"Launch", "Write docs", "Proofread", "Unrelated"}},
+	}
+	for _, tt := range tests {
+		if got := listAllPages(t, srv, tt.query); !slices.Equal(got, tt.want) {
+			t.Errorf("%s: expected %q, got %q", tt.query, tt.want, got)
+		}
+	}
+
+	// Moving a subtask to the top level.
+	moved := decodeTodo(t, patchTodo(t, srv, grandchild.ID, `{"parent_id": null}`))
+	if moved.ParentID != nil {
+		t.Errorf("expected a top-level todo, got parent %d", *moved.ParentID)
+	}
+	if got := decodeTodo(t, getTodo(t, srv, child.ID)); got.ChildCount != 0 {
+		t.Errorf("expected no subtasks left, got %d", got.ChildCount)
+	}
+
+	w := httptest.NewRecorder()
+	srv.AddTodo(w, httptest.NewRequest(http.MethodPost, "/todos", strings.NewReader(`{"task": "Orphan", "parent_id": 424242}`)))
+	p := expectProblem(t, w, http.StatusUnprocessableEntity, app.CodeValidationFailed)
+	if len(p.Errors) != 1 || p.Errors[0].Field != "parent_id" {
+		t.Errorf("expected a parent_id error, got %+v", p.Errors)
+	}
+
+	for _, query := range []string{"parent_id=0", "parent_id=x", "top_level=maybe", "parent_id=1&top_level=true"} {
+		w := httptest.NewRecorder()
+		srv.GetTodos(w, httptest.NewRequest(http.MethodGet, "/todos?"+query, nil))
+		expectProblem(t, w, http.StatusUnprocessableEntity, app.CodeValidationFailed)
+	}
+}
+
+// testSubtaskRollup tests that a parent with auto_complete follows its
+// subtasks' completion, up through every ancestor, and one without doesn't
+func testSubtaskRollup(t *testing.T, srv *app.Server) {
+	root := createTodo(t, srv, map[string]any{"task": "Release", "auto_complete": true})
+	parent := createTodo(t, srv, map[string]any{"task": "Testing", "parent_id": root.ID, "auto_complete": true})
+	a := createTodo(t, srv, map[string]any{"task": "Unit", "parent_id": parent.ID})
+	b := createTodo(t, srv, map[string]any{"task": "Integration", "parent_id": parent.ID})
+	manual := createTodo(t, srv, map[string]any{"task": "Manual", "parent_id": a.ID})
+
+	completed := func(id int) bool {
+		t.Helper()
+		return decodeTodo(t, getTodo(t, srv, id)).Completed
+	}
+
+	// a has a subtask but no auto_complete, so it's completed by hand.
+	setCompleted(t, srv, a, true)
+	if completed(parent.ID) {
+		t.Error("expected parent to stay open with a subtask open")
+	}
+	if completed(manual.ID) {
+		t.Error("expected completing a parent to leave its subtasks alone")
+	}
+	setCompleted(t, srv, b, true)
+	if !completed(parent.ID) || !completed(root.ID) {
+		t.Error("expected completing the last subtask to complete every auto_complete ancestor")
+	}
+	if got := decodeTodo(t, getTodo(t, srv, root.ID)); got.CompletedAt == nil {
+		t.Error("expected completed_at on a rolled-up todo")
+	}
+
+	// Reopening a subtask, or adding a new one, reopens the ancestors.
+	setCompleted(t, srv, b, false)
+	if completed(parent.ID) || completed(root.ID) {
+		t.Error("expected reopening a subtask to reopen its ancestors")
+	}
+	setCompleted(t, srv, b, true)
+	createTodo(t, srv, map[string]any{"task": "E2E", "parent_id": parent.ID})
+	if completed(parent.ID) {
+		t.Error("expected a new subtask to reopen its parent")
+	}
+
+	// An auto_complete parent's completion can't be set by hand.
+	got := decodeTodo(t, patchTodo(t, srv, parent.ID, `{"completed": true}`))
+	if got.Completed {
+		t.Error("expected an auto_complete parent to follow its subtasks")
+	}
+	// Turning auto_complete off leaves it to the client.
+	got = decodeTodo(t, patchTodo(t, srv, parent.ID, `{"completed": true, "auto_complete": false}`))
+	if !got.Completed || got.AutoComplete {
+		t.Errorf("expected a manually completed parent, got %+v", got)
+	}
+}
+
+// testSubtaskCycles tests that a todo can't become its own ancestor
+func testSubtaskCycles(t *testing.T, srv *app.Server) {
+	parent := addTodo(t, srv, "Parent")
+	child := createTodo(t, srv, map[string]any{"task": "Child", "parent_id": parent.ID})
+	grandchild := createTodo(t, srv, map[string]any{"task": "Grandchild", "parent_id": child.ID})
+
+	for _, newParent := range []int{parent.ID, child.ID, grandchild.ID} {
+		w := patchTodo(t, srv, parent.ID, fmt.Sprintf(`{"parent_id": %d}`, newParent))
+		p := expectProblem(t, w, http.StatusUnprocessableEntity, app.CodeValidationFailed)
+		if len(p.Errors) != 1 || p.Errors[0].Field != "parent_id" {
+			t.Errorf("parent %d: expected a parent_id error, got %+v", newParent, p.Errors)
+		}
+	}
+	expectProblem(t, patchTodo(t, srv, child.ID, `{"parent_id": 424242}`), http.StatusUnprocessableEntity, app.CodeValidationFailed)
+
+	// Moving a subtree elsewhere is fine.
+	other := addTodo(t, srv, "Other")
+	if got := decodeTodo(t, patchTodo(t, srv, child.ID, fmt.Sprintf(`{"parent_id": %d}`, other.ID))); *got.ParentID != other.ID {
+		t.Errorf("expected child under %d, got %+v", other.ID, got)
+	}
+}
+
+// deleteTodo deletes a todo through the API, with the given query string.
+func deleteTodo(t *testing.T, srv *app.Server, id int, query string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodDelete, fmt.Sprintf("/todos/%d?%s", id, query), nil)
+	w := httptest.NewRecorder()
+	srv.HandleTodo(w, req)
+	return w
+}
+
+// testDeleteSubtasks tests that deleting a todo with subtasks requires
+// ?cascade=true, which deletes the whole subtree, and rolls up the parent
+func testDeleteSubtasks(t *testing.T, srv *app.Server) {
+	root := createTodo(t, srv, map[string]any{"task": "Root", "auto_complete": true})
+	parent := createTodo(t, srv, map[string]any{"task": "Parent", "parent_id": root.ID})
+	child := createTodo(t, srv, map[string]any{"task": "Child", "parent_id": parent.ID})
+	grandchild := createTodo(t, srv, map[string]any{"task": "Grandchild", "parent_id": child.ID})
+	tag := createTag(t, srv, "deep")
+	decodeTodo(t, setTag(t, srv, http.MethodPut, grandchild.ID, tag.ID))
+	done := createTodo(t, srv, map[string]any{"task": "Done", "parent_id": root.ID})
+	setCompleted(t, srv, done, true)
+
+	p := expectProblem(t, deleteTodo(t, srv, parent.ID, ""), http.StatusConflict, app.CodeHasSubtasks)
+	if !strings.Contains(p.Detail, "cascade=true") {
+		t.Errorf("expected the detail to mention cascade=true, got %q", p.Detail)
+	}
+	expectProblem(t, deleteTodo(t, srv, parent.ID, "cascade=yes"), http.StatusUnprocessableEntity, app.CodeValidationFailed)
+	if len(listTodos(t, srv)) != 5 {
+		t.Fatal("expected a refused delete to delete nothing")
+	}
+
+	if w := deleteTodo(t, srv, parent.ID, "cascade=true"); w.Code != http.StatusNoContent {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusNoContent, w.Code, w.Body.String())
+	}
+	for _, id := range []int{parent.ID, child.ID, grandchild.ID} {
+		expectNotFound(t, getTodo(t, srv, id))
+	}
+	got := decodeTodo(t, getTodo(t, srv, root.ID))
+	if got.ChildCount != 1 || !got.Completed {
+		t.Errorf("expected root with only its completed subtask left to be completed, got %+v", got)
+	}
+
+	// Leaves, and todos with no subtasks left, need no cascade.
+	if w := deleteTodo(t, srv, done.ID, ""); w.Code != http.StatusNoContent {
+		t.Errorf("expected status %d, got %d: %s", http.StatusNoContent, w.Code, w.Body.String())
+	}
+	if w := deleteTodo(t, srv, root.ID, ""); w.Code != http.StatusNoContent {
+		t.Errorf("expected status %d, got %d: %s", http.StatusNoContent, w.Code, w.Body.String())
+	}
+}
+
+// setBlocker adds (PUT) or removes (DELETE) a dependency through the API.
+func setBlocker(t *testing.T, srv *app.Server, method string, todoID, blockerID int) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(method, fmt.Sprintf("/todos/%d/blockers/%d", todoID, blockerID), nil)
+	w := httptest.NewRecorder()
+	srv.HandleTodo(w, req)
+	return w
+}
+
+// listBlockers returns the tasks of the todos blocking a todo.
+func listBlockers(t *testing.T, srv *app.Server, id int) []string {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodGet, fmt.Sprintf("/todos/%d/blockers", id), nil)
+	w := httptest.NewRecorder()
+	srv.HandleTodo(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("failed to list blockers: status %d, body %q", w.Code, w.Body.String())
+	}
+	var todos []app.Todo
+	if err := json.NewDecoder(w.Body).Decode(&todos); err != nil {
+		t.Fatalf("failed to decode blockers: %v", err)
+	}
+	tasks := []string{}
+	for _, todo := range todos {
+		tasks = append(tasks, todo.Task)
+	}
+	return tasks
+}
+
+// testBlockers tests adding and removing blockers, and that a todo can't be
+// completed while any is open
+func testBlockers(t *testing.T, srv *app.Server) {
+	deploy := addTodo(t, srv, "Deploy")
+	review := addTodo(t, srv, "Review")
+	build := addTodo(t, srv, "Build")
+
+	blocked := decodeTodo(t, setBlocker(t, srv, http.MethodPut, deploy.ID, review.ID))
+	blocked = decodeTodo(t, setBlocker(t, srv, http.MethodPut, deploy.ID, build.ID))
+	if blocked.OpenBlockers != 2 || blocked.UpdatedAt.Before(deploy.UpdatedAt) {
+		t.Errorf("expected 2 open blockers and a touched updated_at, got %+v", blocked)
+	}
+	// Adding twice is a no-op.
+	if again := decodeTodo(t, setBlocker(t, srv, http.MethodPut, deploy.ID, review.ID)); again.OpenBlockers != 2 || !again.UpdatedAt.Equal(blocked.UpdatedAt) {
+		t.Errorf("expected re-adding to change nothing, got %+v", again)
+	}
+	if got := listBlockers(t, srv, deploy.ID); !slices.Equal(got, []string{"Review", "Build"}) {
+		t.Errorf("expected blockers in id order, got %q", got)
+	}
+	if got := listBlockers(t, srv, review.ID); len(got) != 0 {
+		t.Errorf("expected no blockers, got %q", got)
+	}
+
+	p := expectProblem(t, patchTodo(t, srv, deploy.ID, `{"completed": true}`), http.StatusConflict, app.CodeTodoBlocked)
+	if !strings.Contains(p.Detail, "2 open") {
+		t.Errorf("expected the detail to count open blockers, got %q", p.Detail)
+	}
+	// Other edits of a blocked todo are fine.
+	decodeTodo(t, patchTodo(t, srv, deploy.ID, `{"task": "Deploy v2"}`))
+
+	setCompleted(t, srv, review, true)
+	if got := decodeTodo(t, getTodo(t, srv, deploy.ID)); got.OpenBlockers != 1 {
+		t.Errorf("expected 1 open blocker, got %d", got.OpenBlockers)
+	}
+	decodeTodo(t, setBlocker(t, srv, http.MethodDelete, deploy.ID, build.ID))
+	decodeTodo(t, setBlocker(t, srv, http.MethodDelete, deploy.ID, build.ID))
+	if got := decodeTodo(t, patchTodo(t, srv, deploy.ID, `{"completed": true}`)); !got.Completed {
+		t.Errorf("expected an unblocked todo to complete, got %+v", got)
+	}
+
+	// Deleting a blocker removes the dependency.
+	decodeTodo(t, setBlocker(t, srv, http.MethodPut, build.ID, review.ID))
+	deleteTodo(t, srv, review.ID, "")
+	if got := listBlockers(t, srv, build.ID); len(got) != 0 {
+		t.Errorf("expected the deleted blocker to be gone, got %q", got)
+	}
+
+	expectNotFound(t, setBlocker(t, srv, http.MethodPut, 424242, build.ID))
+	expectNotFound(t, setBlocker(t, srv, http.MethodPut, build.ID, 424242))
+	w := httptest.NewRecorder()
+	srv.HandleTodo(w, httptest.NewRequest(http.MethodGet, "/todos/424242/blockers", nil))
+	expectNotFound(t, w)
+	if w := setBlocker(t, srv, http.MethodGet, build.ID, deploy.ID); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected status %d, got %d", http.StatusMethodNotAllowed, w.Code)
+	}
+}
+
+// testBlockerCycles tests that dependencies can't form a cycle, however long
+func testBlockerCycles(t *testing.T, srv *app.Server) {
+	a, b, c := addTodo(t, srv, "A"), addTodo(t, srv, "B"), addTodo(t, srv, "C")
+	decodeTodo(t, setBlocker(t, srv, http.MethodPut, a.ID, b.ID))
+	decodeTodo(t, setBlocker(t, srv, http.MethodPut, b.ID, c.ID))
+
+	for _, dep := range []struct{ todo, blocker int }{{a.ID, a.ID}, {b.ID, a.ID}, {c.ID, a.ID}} {
+		expectProblem(t, setBlocker(t, srv, http.MethodPut, dep.todo, dep.blocker), http.StatusConflict, app.CodeDependencyCycle)
+	}
+	// A diamond isn't a cycle.
+	decodeTodo(t, setBlocker(t, srv, http.MethodPut, a.ID, c.ID))
+	if got := listBlockers(t, srv, c.ID); len(got) != 0 {
+		t.Errorf("expected refused dependencies to be dropped, got %q", got)
+	}
+}
+
+// testListReady tests the filter for todos that are ready to work on
+func testListReady(t *testing.T, srv *app.Server) {
+	blocked := addTodo(t, srv, "Blocked")
+	blocker := addTodo(t, srv, "Blocker")
+	done := addTodo(t, srv, "Done")
+	addTodo(t, srv, "Free")
+	setCompleted(t, srv, done, true)
+	decodeTodo(t, setBlocker(t, srv, http.MethodPut, blocked.ID, blocker.ID))
+
+	if got := listAllPages(t, srv, "ready=true"); !slices.Equal(got, []string{"Blocker", "Free"}) {
+		t.Errorf("expected ready todos, got %q", got)
+	}
+	if got := listAllPages(t, srv, "ready=false"); !slices.Equal(got, []string{"Blocked", "Done"}) {
+		t.Errorf("expected todos that aren't ready, got %q", got)
+	}
+	setCompleted(t, srv, blocker, true)
+	if got := listAllPages(t, srv, "ready=true&limit=1"); !slices.Equal(got, []string{"Blocked", "Free"}) {
+		t.Errorf("expected completing the blocker to make its todo ready, got %q", got)
+	}
+
+	w := httptest.NewRecorder()
+	srv.GetTodos(w, httptest.NewRequest(http.MethodGet, "/todos?ready=soon", nil))
+	p := expectProblem(t, w, http.StatusUnprocessableEntity, app.CodeValidationFailed)
+	if len(p.Errors) != 1 || p.Errors[0].Field != "ready" {
+		t.Errorf("expected a ready error, got %+v", p.Errors)
+	}
+}
+
+// testRecurringTodos tests that completing a recurring todo creates the
+// next occurrence, which takes over the rule and the tags
+func testRecurringTodos(t *testing.T, srv *app.Server) {
+	due := time.Now().UTC().Add(time.Hour).Truncate(time.Second)
+	chore := createTodo(t, srv, map[string]any{
+		"task": "Review dashboards", "priority": "high", "notes": "Check the SLOs",
+		"due_at": due, "recurrence": "freq=weekly;byday=mo,th", "recurrence_tz": "Europe/London",
+	})
+	if chore.Recurrence != "FREQ=WEEKLY;BYDAY=MO,TH" || chore.RecurrenceTZ != "Europe/London" {
+		t.Errorf("expected a normalized rule, got %q in %q", chore.Recurrence, chore.RecurrenceTZ)
+	}
+	tag := createTag(t, srv, "ops")
+	decodeTodo(t, setTag(t, srv, http.MethodPut, chore.ID, tag.ID))
+
+	done := decodeTodo(t, patchTodo(t, srv, chore.ID, `{"completed": true}`))
+	if !done.Completed || done.Recurrence != "" {
+		t.Errorf("expected the completed todo to hand its rule on, got %+v", done)
+	}
+	todos := listTodos(t, srv)
+	if len(todos) != 2 {
+		t.Fatalf("expected the next occurrence to be created, got %+v", todos)
+	}
+	next := todos[1]
+	london, _ := time.LoadLocation("Europe/London")
+	if next.DueAt == nil || !next.DueAt.After(due) || next.DueAt.Sub(due) > 7*24*time.Hour {
+		t.Fatalf("expected the next occurrence within a week after %v, got %v", due, next.DueAt)
+	}
+	if wd := next.DueAt.In(london).Weekday(); wd != time.Monday && wd != time.Thursday {
+		t.Errorf("expected a Monday or Thursday in London, got %v", wd)
+	}
+	if next.Completed || next.Task != chore.Task || next.Priority != "high" || next.Notes != chore.Notes ||
+		next.Recurrence != chore.Recurrence || next.RecurrenceTZ != "Europe/London" || !slices.Equal(tagNames(next), []string{"ops"}) {
+		t.Errorf("expected a copy of the todo, got %+v", next)
+	}
+
+	// Reopening and completing again doesn't repeat the occurrence.
+	setCompleted(t, srv, done, false)
+	decodeTodo(t, patchTodo(t, srv, chore.ID, `{"completed": true}`))
+	if todos := listTodos(t, srv); len(todos) != 2 {
+		t.Errorf("expected no further occurrence, got %d todos", len(todos))
+	}
+}
+
+// testRecurringTodosEnd tests that COUNT and UNTIL end a series, and that
+// occurrences already in the past are skipped
+func testRecurringTodosEnd(t *testing.T, srv *app.Server) {
+	// Due 10 days ago, daily, 12 times: completing it now skips the past
+	// occurrences, and each of them counts.
+	due := time.Now().UTC().Add(-10*24*time.Hour + time.Hour).Truncate(time.Second)
+	late := createTodo(t, srv, map[string]any{"task": "Water plants", "due_at": due, "recurrence": "FREQ=DAILY;COUNT=12"})
+	decodeTodo(t, patchTodo(t, srv, late.ID, `{"completed": true}`))
+	todos, _ := listPage(t, srv, "completed=false")
+	if len(todos) != 1 {
+		t.Fatalf("expected one next occurrence, got %+v", todos)
+	}
+	next := todos[0]
+	if !next.DueAt.After(time.Now()) || next.DueAt.After(time.Now().Add(24*time.Hour)) {
+		t.Errorf("expected the next occurrence within a day, got %v", next.DueAt)
+	}
+	if next.Recurrence != "FREQ=DAILY;COUNT=2" {
+		t.Errorf("expected 2 occurrences left, got %q", next.Recurrence)
+	}
+
+	last := decodeTodo(t, patchTodo(t, srv, next.ID, `{"completed": true}`))
+	todos, _ = listPage(t, srv, "completed=false")
+	if len(todos) != 1 || todos[0].Recurrence != "FREQ=DAILY;COUNT=1" {
+		t.Fatalf("expected the last occurrence, got %+v", todos)
+	}
+	if last.Recurrence != "" {
+		t.Errorf("expected the rule to move on, got %q", last.Recurrence)
+	}
+	decodeTodo(t, patchTodo(t, srv, todos[0].ID, `{"completed": true}`))
+	if todos, _ := listPage(t, srv, "completed=false"); len(todos) != 0 {
+		t.Errorf("expected the series to end after COUNT occurrences, got %+v", todos)
+	}
+
+	until := time.Now().UTC().Add(24 * time.Hour).Format("20060102T150405Z")
+	ending := createTodo(t, srv, map[string]any{
+		"task": "Until", "due_at": time.Now().UTC().Add(time.Hour), "recurrence": "FREQ=WEEKLY;UNTIL=" + until,
+	})
+	decodeTodo(t, patchTodo(t, srv, ending.ID, `{"completed": true}`))
+	if todos, _ := listPage(t, srv, "completed=false"); len(todos) != 0 {
+		t.Errorf("expected no occurrence after UNTIL, got %+v", todos)
+	}
+}
+
+// testRecurringTodosInvalid tests validation of recurrence fields
+func testRecurringTodosInvalid(t *testing.T, srv *app.Server) {
+	due := time.Now().UTC().Add(time.Hour)
+	tests := []struct {
+		todo  map[string]any
+		field string
+	}{
+		{map[string]any{"task": "No due date", "recurrence": "FREQ=DAILY"}, "due_at"},
+		{map[string]any{"task": "Yearly", "due_at": due, "recurrence": "FREQ=YEARLY"}, "recurrence"},
+		{map[string]any{"task": "Bad zone", "due_at": due, "recurrence": "FREQ=DAILY", "recurrence_tz": "Mars/Olympus"}, "recurrence_tz"},
+	}
+	for _, tt := range tests {
+		body, _ := json.Marshal(tt.todo)
+		w := httptest.NewRecorder()
+		srv.AddTodo(w, httptest.NewRequest(http.MethodPost, "/todos", bytes.NewBuffer(body)))
+		p := expectProblem(t, w, http.StatusUnprocessableEntity, app.CodeValidationFailed)
+		if len(p.Errors) != 1 || p.Errors[0].Field != tt.field {
+			t.Errorf("%v: expected a %s error, got %+v", tt.todo, tt.field, p.Errors)
+		}
+	}
+
+	// A time zone without a rule is dropped, and a rule can't lose its due date.
+	plain := createTodo(t, srv, map[string]any{"task": "Plain", "recurrence_tz": "Europe/London"})
+	if plain.RecurrenceTZ != "" {
+		t.Errorf("expected no time zone without a rule, got %q", plain.RecurrenceTZ)
+	}
+	recurring := createTodo(t, srv, map[string]any{"task": "Daily", "due_at": due, "recurrence": "FREQ=DAILY"})
+	if recurring.RecurrenceTZ != "UTC" {
+		t.Errorf("expected the time zone to default to UTC, got %q", recurring.RecurrenceTZ)
+	}
+	expectProblem(t, patchTodo(t, srv, recurring.ID, `{"due_at": null}`), http.StatusUnprocessableEntity, app.CodeValidationFailed)
+}
+
+// moveTodo moves a todo through the API with the given JSON body.
+func moveTodo(t *testing.T, srv *app.Server, id int, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, fmt.Sprintf("/todos/%d/move", id), strings.NewReader(body))
+	w := httptest.NewRecorder()
+	srv.HandleTodo(w, req)
+	return w
+}
+
+// testMoveTodos tests reordering todos and that a move only changes the
+// moved todo
+func testMoveTodos(t *testing.T, srv *app.Server) {
+	a, b, c := addTodo(t, srv, "A"), addTodo(t, srv, "B"), addTodo(t, srv, "C")
+	if !(a.Position < b.Position && b.Position < c.Position) {
+		t.Fatalf("expected new todos to go last, got positions %q, %q, %q", a.Position, b.Position, c.Position)
+	}
+
+	moved := decodeTodo(t, moveTodo(t, srv, c.ID, fmt.Sprintf(`{"before": %d}`, a.ID)))
+	if moved.Position >= a.Position || moved.UpdatedAt.Before(c.UpdatedAt) {
+		t.Errorf("expected C before A with a touched updated_at, got %+v", moved)
+	}
+	if got := listAllPages(t, srv, "sort=position"); !slices.Equal(got, []string{"C", "A", "B"}) {
+		t.Errorf("expected C, A, B, got %q", got)
+	}
+	decodeTodo(t, moveTodo(t, srv, c.ID, fmt.Sprintf(`{"after": %d}`, a.ID)))
+	decodeTodo(t, moveTodo(t, srv, a.ID, fmt.Sprintf(`{"after": %d}`, b.ID)))
+	if got := listAllPages(t, srv, "sort=position"); !slices.Equal(got, []string{"C", "B", "A"}) {
+		t.Errorf("expected C, B, A, got %q", got)
+	}
+	if got := listAllPages(t, srv, "sort=-position&limit=1"); !slices.Equal(got, []string{"A", "B", "C"}) {
+		t.Errorf("expected A, B, C paging backwards, got %q", got)
+	}
+	if got := decodeTodo(t, getTodo(t, srv, b.ID)); got.Position != b.Position {
+		t.Errorf("expected B's position to be untouched, got %q (was %q)", got.Position, b.Position)
+	}
+
+	// Repeatedly moving into the same gap keeps finding room.
+	for i := range 50 {
+		todo, anchor := a, c
+		if i%2 == 1 {
+			todo, anchor = c, a
+		}
+		decodeTodo(t, moveTodo(t, srv, todo.ID, fmt.Sprintf(`{"after": %d}`, anchor.ID)))
+	}
+	if got := listAllPages(t, srv, "sort=position"); !slices.Equal(got, []string{"A", "C", "B"}) {
+		t.Errorf("expected A, C, B, got %q", got)
+	}
+
+	// Edits can't change a position.
+	got := decodeTodo(t, patchTodo(t, srv, b.ID, `{"position": "a0"}`))
+	if got.Position != b.Position {
+		t.Errorf("expected PATCH to ignore position, got %q", got.Position)
+	}
+}
+
+// testMoveTodosInvalid tests rejecting moves that don't name one other,
+// existing todo
+func testMoveTodosInvalid(t *testing.T, srv *app.Server) {
+	a, b := addTodo(t, srv, "A"), addTodo(t, srv, "B")
+	for _, body := range []string{
+		`{}`,
+		fmt.Sprintf(`{"before": %d, "after": %d}`, b.ID, b.ID),
+		fmt.Sprintf(`{"before": %d}`, a.ID),
+		`{"after": 424242}`,
+		`{"after": "last"}`,
+		`{"position": "a0"}`,
+	} {
+		expectProblem(t, moveTodo(t, srv, a.ID, body), http.StatusUnprocessableEntity, app.CodeValidationFailed)
+	}
+	expectProblem(t, moveTodo(t, srv, a.ID, `[`), http.StatusBadRequest, app.CodeMalformedRequest)
+	expectNotFound(t, moveTodo(t, srv, 424242, fmt.Sprintf(`{"after": %d}`, a.ID)))
+
+	w := httptest.NewRecorder()
+	srv.HandleTodo(w, httptest.NewRequest(http.MethodGet, fmt.Sprintf("/todos/%d/move", a.ID), nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected status %d, got %d", http.StatusMethodNotAllowed, w.Code)
+	}
+	if got := listAllPages(t, srv, "sort=position"); !slices.Equal(got, []string{"A", "B"}) {
+		t.Errorf("expected refused moves to change nothing, got %q", got)
+	}
+}
+
+// testMoveTodosConcurrently tests that concurrent moves into the same gap
+// all land in it, each with a position of its own
+func testMoveTodosConcurrently(t *testing.T, srv *app.Server) {
+	first, last := addTodo(t, srv, "First"), addTodo(t, srv, "Last")
+	var movers []app.Todo
+	for i := range 8 {
+		movers = append(movers, addTodo(t, srv, fmt.Sprintf("Mover %d", i)))
+	}
+
+	var wg sync.WaitGroup
+	for _, todo := range movers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if w := moveTodo(t, srv, todo.ID, fmt.Sprintf(`{"after": %d}`, first.ID)); w.Code != http.StatusOK {
+				t.Errorf("move failed: status %d, body %q", w.Code, w.Body.String())
+			}
+		}()
+	}
+	wg.Wait()
+
+	todos, _ := listPage(t, srv, "sort=position")
+	if len(todos) != len(movers)+2 || todos[0].ID != first.ID || todos[len(todos)-1].ID != last.ID {
+		t.Fatalf("expected every mover between First and Last, got %v", todos)
+	}
+	for i := 1; i < len(todos); i++ {
+		if todos[i-1].Position >= todos[i].Position {
+			t.Errorf("expected distinct, increasing positions, got %q then %q", todos[i-1].Position, todos[i].Position)
+		}
+	}
+}
+
+// testCreateTodosConcurrently tests that concurrent creates each get a
+// position of their own the first time, without retrying
+func testCreateTodosConcurrently(t *testing.T, srv *app.Server) {
+	original := app.BackoffStrategy
+	app.BackoffStrategy = &backoff.StopBackOff{}
+	t.Cleanup(func() { app.BackoffStrategy = original })
+
+	var wg sync.WaitGroup
+	for i := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req := httptest.NewRequest(http.MethodPost, "/todos", strings.NewReader(fmt.Sprintf(`{"task": "Todo %d"}`, i)))
+			w := httptest.NewRecorder()
+			srv.AddTodo(w, req)
+			if w.Code != http.StatusCreated {
+				t.Errorf("create failed: status %d, body %q", w.Code, w.Body.String())
+			}
+		}()
+	}
+	wg.Wait()
+
+	todos, _ := listPage(t, srv, "sort=position")
+	if len(todos) != 8 {
+		t.Fatalf("expected 8 todos, got %v", todos)
+	}
+	for i := 1; i < len(todos); i++ {
+		if todos[i-1].Position >= todos[i].Position {
+			t.Errorf("expected distinct, increasing positions, got %q then %q", todos[i-1].Position, todos[i].Position)
+		}
+	}
+}
+
+// restoreTodo takes a todo out of the trash through the API.
+func restoreTodo(t *testing.T, srv *app.Server, id int) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, fmt.Sprintf("/todos/%d/restore", id), nil)
+	w := httptest.NewRecorder()
+	srv.HandleTodo(w, req)
+	return w
+}
+
+// listTrash returns the tasks of the todos in the trash, in id order.
+func listTrash(t *testing.T, srv *app.Server) []string {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodGet, "/trash", nil)
+	w := httptest.NewRecorder()
+	srv.HandleTrash(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("failed to list trash: status %d, body %q", w.Code, w.Body.String())
+	}
+	var todos []app.Todo
+	if err := json.NewDecoder(w.Body).Decode(&todos); err != nil {
+		t.Fatalf("failed to decode trash: %v", err)
+	}
+	tasks := []string{}
+	for _, todo := range todos {
+		if todo.DeletedAt == nil {
+			t.Errorf("expected deleted_at on %+v in the trash", todo)
+		}
+		tasks = append(tasks, todo.Task)
+	}
+	return tasks
+}
+
+// testTrash tests that deleted todos move to the trash, out of every other
+// view, and can be restored as they were
+func testTrash(t *testing.T, srv *app.Server) {
+	report := addTodo(t, srv, "Write report")
+	addTodo(t, srv, "Review report")
+
+	if w := deleteTodo(t, srv, report.ID, ""); w.Code != http.StatusNoContent {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusNoContent, w.Code, w.Body.String())
+	}
+	expectNotFound(t, getTodo(t, srv, report.ID))
+	expectNotFound(t, patchTodo(t, srv, report.ID, `{"task": "Edited"}`))
+	expectNotFound(t, deleteTodo(t, srv, report.ID, ""))
+	if got := listAllPages(t, srv, "limit=1"); !slices.Equal(got, []string{"Review report"}) {
+		t.Errorf("expected the deleted todo to be left out, got %q", got)
+	}
+	if results := searchTodos(t, srv, "q=report"); len(results) != 1 {
+		t.Errorf("expected search to leave out the deleted todo, got %+v", results)
+	}
+	if got := listTrash(t, srv); !slices.Equal(got, []string{"Write report"}) {
+		t.Errorf("expected the deleted todo in the trash, got %q", got)
+	}
+
+	restored := decodeTodo(t, restoreTodo(t, srv, report.ID))
+	if restored.DeletedAt != nil || restored.Task != report.Task || restored.Position != report.Position {
+		t.Errorf("expected the todo back as it was, got %+v", restored)
+	}
+	if got := listAllPages(t, srv, ""); !slices.Equal(got, []string{"Write report", "Review report"}) {
+		t.Errorf("expected the restored todo back in the list, got %q", got)
+	}
+	if got := listTrash(t, srv); len(got) != 0 {
+		t.Errorf("expected an empty trash, got %q", got)
+	}
+	// Restoring again is a no-op.
+	if again := decodeTodo(t, restoreTodo(t, srv, report.ID)); !again.UpdatedAt.Equal(restored.UpdatedAt) {
+		t.Errorf("expected restoring a live todo to change nothing, got %+v", again)
+	}
+	expectNotFound(t, restoreTodo(t, srv, 424242))
+
+	w := httptest.NewRecorder()
+	srv.HandleTodo(w, httptest.NewRequest(http.MethodGet, fmt.Sprintf("/todos/%d/restore", report.ID), nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected status %d, got %d", http.StatusMethodNotAllowed, w.Code)
+	}
+	w = httptest.NewRecorder()
+	srv.HandleTrash(w, httptest.NewRequest(http.MethodGet, "/trash?completed=maybe", nil))
+	expectProblem(t, w, http.StatusUnprocessableEntity, app.CodeValidationFailed)
+}
+
+// testTrashSubtasks tests that a cascading delete trashes the subtree, and
+// that restoring its root brings back only what was deleted with it
+func testTrashSubtasks(t *testing.T, srv *app.Server) {
+	root := createTodo(t, srv, map[string]any{"task": "Root", "auto_complete": true})
+	done := createTodo(t, srv, map[string]any{"task": "Done", "parent_id": root.ID})
+	setCompleted(t, srv, done, true)
+	parent := createTodo(t, srv, map[string]any{"task": "Parent", "parent_id": root.ID})
+	child := createTodo(t, srv, map[string]any{"task": "Child", "parent_id": parent.ID})
+	earlier := createTodo(t, srv, map[string]any{"task": "Earlier", "parent_id": parent.ID})
+
+	if w := deleteTodo(t, srv, earlier.ID, ""); w.Code != http.StatusNoContent {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusNoContent, w.Code, w.Body.String())
+	}
+	if got := decodeTodo(t, getTodo(t, srv, parent.ID)); got.ChildCount != 1 {
+		t.Errorf("expected trashed subtasks not to count, got %+v", got)
+	}
+	if w := deleteTodo(t, srv, parent.ID, "cascade=true"); w.Code != http.StatusNoContent {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusNoContent, w.Code, w.Body.String())
+	}
+	expectNotFound(t, getTodo(t, srv, child.ID))
+	if got := listTrash(t, srv); !slices.Equal(got, []string{"Parent", "Child", "Earlier"}) {
+		t.Errorf("expected the subtree in the trash, got %q", got)
+	}
+	if got := decodeTodo(t, getTodo(t, srv, root.ID)); got.ChildCount != 1 || !got.Completed {
+		t.Errorf("expected root with only its completed subtask left to be completed, got %+v", got)
+	}
+
+	p := expectProblem(t, restoreTodo(t, srv, child.ID), http.StatusConflict, app.CodeParentTrashed)
+	if !strings.Contains(p.Detail, "parent") {
+		t.Errorf("expected the detail to mention the parent, got %q", p.Detail)
+	}
+
+	decodeTodo(t, restoreTodo(t, srv, parent.ID))
+	if got := decodeTodo(t, getTodo(t, srv, child.ID)); got.DeletedAt != nil {
+		t.Errorf("expected the subtask deleted with its parent to be restored, got %+v", got)
+	}
+	if got := listTrash(t, srv); !slices.Equal(got, []string{"Earlier"}) {
+		t.Errorf("expected the subtask deleted before its parent to stay in the trash, got %q", got)
+	}
+	if got := decodeTodo(t, getTodo(t, srv, root.ID)); got.ChildCount != 2 || got.Completed {
+		t.Errorf("expected restoring an open subtask to reopen root, got %+v", got)
+	}
+	decodeTodo(t, restoreTodo(t, srv, earlier.ID))
+	if got := decodeTodo(t, getTodo(t, srv, parent.ID)); got.ChildCount != 2 {
+		t.Errorf("expected both subtasks back, got %+v", got)
+	}
+}
+
+// testTrashBlockers tests that a trashed blocker stops blocking, and blocks
+// again once restored
+func testTrashBlockers(t *testing.T, srv *app.Server) {
+	deploy := addTodo(t, srv, "Deploy")
+	review := addTodo(t, srv, "Review")
+	decodeTodo(t, setBlocker(t, srv, http.MethodPut, deploy.ID, review.ID))
+
+	if w := deleteTodo(t, srv, review.ID, ""); w.Code != http.StatusNoContent {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusNoContent, w.Code, w.Body.String())
+	}
+	if got := decodeTodo(t, getTodo(t, srv, deploy.ID)); got.OpenBlockers != 0 {
+		t.Errorf("expected a trashed blocker not to count, got %+v", got)
+	}
+	if got := listBlockers(t, srv, deploy.ID); len(got) != 0 {
+		t.Errorf("expected no blockers listed, got %q", got)
+	}
+	expectNotFound(t, setBlocker(t, srv, http.MethodPut, review.ID, deploy.ID))
+
+	decodeTodo(t, restoreTodo(t, srv, review.ID))
+	if got := decodeTodo(t, getTodo(t, srv, deploy.ID)); got.OpenBlockers != 1 {
+		t.Errorf("expected the restored blocker to block again, got %+v", got)
+	}
+}
+
+// testDeleteListWithTrash tests that trashed todos don't keep a list from
+// being deleted, and go with it
+func testDeleteListWithTrash(t *testing.T, srv *app.Server) {
+	infra := createList(t, srv, "infra")
+	todo := createTodo(t, srv, map[string]any{"task": "Rotate certs", "list_id": infra.ID})
+	if w := deleteTodo(t, srv, todo.ID, ""); w.Code != http.StatusNoContent {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusNoContent, w.Code, w.Body.String())
+	}
+
+	path := fmt.Sprintf("/lists/%d", infra.ID)
+	if w := serveLists(t, srv, http.MethodDelete, path, ""); w.Code != http.StatusNoContent {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusNoContent, w.Code, w.Body.String())
+	}
+	if got := listTrash(t, srv); len(got) != 0 {
+		t.Errorf("expected the list's trashed todos to be deleted with it, got %q", got)
+	}
+	expectNotFound(t, restoreTodo(t, srv, todo.ID))
+}
+
+// testPurgeTrash tests that Purge permanently deletes only todos trashed
+// before the cutoff. It takes the store, since purging has no endpoint.
+func testPurgeTrash(t *testing.T, store app.Store) {
+	ctx := context.Background()
+	srv := app.NewServer(store)
+	parent := addTodo(t, srv, "Parent")
+	child := createTodo(t, srv, map[string]any{"task": "Child", "parent_id": parent.ID})
+	addTodo(t, srv, "Keep")
+	if w := deleteTodo(t, srv, parent.ID, "cascade=true"); w.Code != http.StatusNoContent {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusNoContent, w.Code, w.Body.String())
+	}
+
+	n, err := store.Purge(ctx, time.Now().Add(-time.Hour))
+	if err != nil || n != 0 {
+		t.Fatalf("expected nothing purged before the cutoff, got %d (err %v)", n, err)
+	}
+	if got := listTrash(t, srv); len(got) != 2 {
+		t.Errorf("expected the trash untouched, got %q", got)
+	}
+
+	n, err = store.Purge(ctx, time.Now().Add(time.Second))
+	if err != nil || n != 2 {
+		t.Fatalf("expected 2 todos purged, got %d (err %v)", n, err)
+	}
+	if got := listTrash(t, srv); len(got) != 0 {
+		t.Errorf("expected an empty trash, got %q", got)
+	}
+	expectNotFound(t, restoreTodo(t, srv, child.ID))
+	if got := listAllPages(t, srv, ""); !slices.Equal(got, []string{"Keep"}) {
+		t.Errorf("expected live todos to be kept, got %q", got)
+	}
+	// The history outlives the todo.
+	events := todoHistory(t, srv, child.ID)
+	if last := events[len(events)-1]; last.Action != app.EventPurge || last.After != nil || last.Actor != app.SystemActor {
+		t.Errorf("expected a purge by the system last, got %+v", last)
+	}
+}
+
+// auditedRequest sends a request to the /todos handlers through the
+// request id and actor middleware, with the given actor header (none if
+// empty), request id and trace.
+func auditedRequest(t *testing.T, srv *app.Server, actor, requestID string, traceID trace.TraceID, method, path, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/todos", srv.HandleTodos)
+	mux.HandleFunc("/todos/", srv.HandleTodo)
+	handler := app.RequestIDMiddleware(app.ActorMiddleware(mux, true))
+
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	if actor != "" {
+		req.Header.Set(app.ActorHeader, actor)
+	}
+	req.Header.Set(app.RequestIDHeader, requestID)
+	sc := trace.NewSpanContext(trace.SpanContextConfig{TraceID: traceID, SpanID: trace.SpanID{1}})
+	req = req.WithContext(trace.ContextWithSpanContext(req.Context(), sc))
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	return w
+}
+
+// todoHistory returns the events of a todo through the API.
+func todoHistory(t *testing.T, srv *app.Server, id int) []app.TodoEvent {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodGet, fmt.Sprintf("/todos/%d/history", id), nil)
+	w := httptest.NewRecorder()
+	srv.HandleTodo(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("failed to get history: status %d, body %q", w.Code, w.Body.String())
+	}
+	var events []app.TodoEvent
+	if err := json.NewDecoder(w.Body).Decode(&events); err != nil {
+		t.Fatalf("failed to decode history: %v", err)
+	}
+	return events
+}
+
+// eventActions returns the actions of events, in order.
+func eventActions(events []app.TodoEvent) []string {
+	actions := []string{}
+	for _, e := range events {
+		actions = append(actions, e.Action)
+	}
+	return actions
+}
+
+// testTodoHistory tests that every change to a todo is recorded with its
+// before and after state, and who made it in which request and trace
+func testTodoHistory(t *testing.T, srv *app.Server) {
+	traceID := trace.TraceID{0x4b, 0xf9, 0x2f, 0x35, 0x77, 0xb3, 0x4d, 0xa6, 0xa3, 0xce, 0x92, 0x9d, 0x0e, 0x0e, 0x47, 0x36}
+	w := auditedRequest(t, srv, "accounts.google.com:alice@example.com", "req-create", traceID, http.MethodPost, "/todos", `{"task": "Draft"}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("failed to create todo: status %d, body %q", w.Code, w.Body.String())
+	}
+	var created app.Todo
+	if err := json.NewDecoder(w.Body).Decode(&created); err != nil {
+		t.Fatalf("failed to decode todo: %v", err)
+	}
+	w = auditedRequest(t, srv, "bob@example.com", "req-edit", traceID, http.MethodPatch, fmt.Sprintf("/todos/%d", created.ID), `{"task": "Final"}`)
+	decodeTodo(t, w)
+	if w := auditedRequest(t, srv, "", "req-delete", traceID, http.MethodDelete, fmt.Sprintf("/todos/%d", created.ID), ""); w.Code != http.StatusNoContent {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusNoContent, w.Code, w.Body.String())
+	}
+	decodeTodo(t, restoreTodo(t, srv, created.ID))
+
+	events := todoHistory(t, srv, created.ID)
+	if got := eventActions(events); !slices.Equal(got, []string{app.EventCreate, app.EventUpdate, app.EventDelete, app.EventRestore}) {
+		t.Fatalf("expected create, update, delete and restore events, got %q", got)
+	}
+	for i := 1; i < len(events); i++ {
+		if events[i].ID <= events[i-1].ID || events[i].CreatedAt.Before(events[i-1].CreatedAt) {
+			t.Errorf("expected events oldest first, got %+v then %+v", events[i-1], events[i])
+		}
+	}
+	create, update, del, restore := events[0], events[1], events[2], events[3]
+	if create.Before != nil || create.After == nil || create.After.Task != "Draft" || create.TodoID != created.ID {
+		t.Errorf("expected a create event with only an after state, got %+v", create)
+	}
+	if create.Actor != "alice@example.com" || create.RequestID != "req-create" || create.TraceID != traceID.String() {
+		t.Errorf("expected the create attributed to alice's request and trace, got %+v", create)
+	}
+	if update.Before == nil || update.Before.Task != "Draft" || update.After == nil || update.After.Task != "Final" {
+		t.Errorf("expected the update's before and after tasks, got %+v", update)
+	}
+	if update.Actor != "bob@example.com" || update.RequestID != "req-edit" {
+		t.Errorf("expected the update attributed to bob's request, got %+v", update)
+	}
+	if del.Before.DeletedAt != nil || del.After.DeletedAt == nil || del.Actor != app.AnonymousActor {
+		t.Errorf("expected an anonymous delete setting deleted_at, got %+v", del)
+	}
+	// Changes outside the middleware have no request or trace.
+	if restore.After.DeletedAt != nil || restore.Actor != app.SystemActor || restore.RequestID != "" || restore.TraceID != "" {
+		t.Errorf("expected a restore clearing deleted_at by the system, got %+v", restore)
+	}
+
+	expectNotFound(t, auditedRequest(t, srv, "", "req-missing", traceID, http.MethodGet, "/todos/424242/history", ""))
+	w = httptest.NewRecorder()
+	srv.HandleTodo(w, httptest.NewRequest(http.MethodPost, fmt.Sprintf("/todos/%d/history", created.ID), nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected status %d, got %d", http.StatusMethodNotAllowed, w.Code)
+	}
+}
+
+// testTodoHistoryRelatedChanges tests that todos changed as a side effect
+// of a request get events too, and that refused or no-op changes get none
+func testTodoHistoryRelatedChanges(t *testing.T, srv *app.Server) {
+	root := createTodo(t, srv, map[string]any{"task": "Root", "auto_complete": true})
+	child := createTodo(t, srv, map[string]any{"task": "Child", "parent_id": root.ID})
+	grandchild := createTodo(t, srv, map[string]any{"task": "Grandchild", "parent_id": child.ID})
+	setCompleted(t, srv, grandchild, true)
+	if got := eventActions(todoHistory(t, srv, root.ID)); !slices.Equal(got, []string{app.EventCreate}) {
+		t.Errorf("expected only a create event for root, got %q", got)
+	}
+
+	// Completing child completes root too.
+	setCompleted(t, srv, decodeTodo(t, getTodo(t, srv, child.ID)), true)
+	events := todoHistory(t, srv, root.ID)
+	if got := eventActions(events); !slices.Equal(got, []string{app.EventCreate, app.EventUpdate}) {
+		t.Fatalf("expected root's rollup recorded, got %q", got)
+	}
+	if last := events[len(events)-1]; last.Before.Completed || !last.After.Completed {
+		t.Errorf("expected the rollup to complete root, got %+v", last)
+	}
+
+	// Deleting child trashes grandchild with it, in the same request.
+	if w := deleteTodo(t, srv, child.ID, "cascade=true"); w.Code != http.StatusNoContent {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusNoContent, w.Code, w.Body.String())
+	}
+	events = todoHistory(t, srv, grandchild.ID)
+	if last := events[len(events)-1]; last.Action != app.EventDelete || last.After.DeletedAt == nil {
+		t.Errorf("expected the subtask's delete recorded, got %+v", last)
+	}
+
+	// Tags are part of the recorded state, shown by name; renaming a tag
+	// changes the todos it is on, and deleting it detaches it.
+	tag := createTag(t, srv, "ops")
+	decodeTodo(t, setTag(t, srv, http.MethodPut, root.ID, tag.ID))
+	decodeTodo(t, setTag(t, srv, http.MethodPut, root.ID, tag.ID))
+	for range 2 {
+		if w := serveTags(t, srv, http.MethodPatch, fmt.Sprintf("/tags/%d", tag.ID), `{"name": "infra"}`); w.Code != http.StatusOK {
+			t.Fatalf("failed to rename tag: status %d, body %q", w.Code, w.Body.String())
+		}
+	}
+	if w := serveTags(t, srv, http.MethodDelete, fmt.Sprintf("/tags/%d", tag.ID), ""); w.Code != http.StatusNoContent {
+		t.Fatalf("failed to delete tag: status %d, body %q", w.Code, w.Body.String())
+	}
+	events = todoHistory(t, srv, root.ID)
+	if got := eventActions(events); len(got) != 5 {
+		t.Fatalf("expected the tag, its rename and its deletion recorded once each, got %q", got)
+	}
+	tagged, renamed, untagged := events[2], events[3], events[4]
+	if !slices.Equal(tagNames(*tagged.After), []string{"ops"}) || len(untagged.After.Tags) != 0 {
+		t.Errorf("expected the tag attached and then detached, got %+v and %+v", tagged.After, untagged.After)
+	}
+	if renamed.Action != app.EventUpdate || !slices.Equal(tagNames(*renamed.Before), []string{"ops"}) || !slices.Equal(tagNames(*renamed.After), []string{"infra"}) {
+		t.Errorf("expected the rename recorded as an update, got %+v", renamed)
+	}
+
+	// Refused changes and no-ops leave no trace.
+	other := addTodo(t, srv, "Other")
+	before := len(todoHistory(t, srv, root.ID))
+	expectProblem(t, patchTodo(t, srv, root.ID, `{"task": ""}`), http.StatusUnprocessableEntity, app.CodeValidationFailed)
+	expectProblem(t, setBlocker(t, srv, http.MethodPut, root.ID, root.ID), http.StatusConflict, app.CodeDependencyCycle)
+	decodeTodo(t, setBlocker(t, srv, http.MethodDelete, root.ID, other.ID))
+	if after := len(todoHistory(t, srv, root.ID)); after != before {
+		t.Errorf("expected refused changes not to be recorded, got %d events (was %d)", after, before)
+	}
+}
+
+// postBatch posts a batch of operations to /todos:batch.
+func postBatch(t *testing.T, srv *app.Server, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, "/todos:batch", strings.NewReader(body))
+	w := httptest.NewRecorder()
+	srv.HandleTodosBatch(w, req)
+	return w
+}
+
+// batchResult is one result of a batch response.
+type batchResult struct {
+	Status  int          `json:"status"`
+	Todo    *app.Todo    `json:"todo"`
+	Count   *int         `json:"count"`
+	Problem *app.Problem `json:"problem"`
+}
+
+// batchResults decodes the results of a successful batch and checks their
+// statuses.
+func batchResults(t *testing.T, w *httptest.ResponseRecorder, statuses ...int) []batchResult {
+	t.Helper()
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	var body struct {
+		Results []batchResult `json:"results"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+		t.Fatalf("failed to decode batch results: %v", err)
+	}
+	got := make([]int, len(body.Results))
+	for i, res := range body.Results {
+		got[i] = res.Status
+	}
+	if !slices.Equal(got, statuses) {
+		t.Fatalf("expected statuses %v, got %v", statuses, got)
+	}
+	return body.Results
+}
+
+// todoTasks returns the tasks of the todos, in order.
+func todoTasks(todos []app.Todo) []string {
+	tasks := make([]string, len(todos))
+	for i, todo := range todos {
+		tasks[i] = todo.Task
+	}
+	return tasks
+}
+
+// testBatch tests that an atomic batch applies all its operations, or none
+// of them if one fails
+func testBatch(t *testing.T, srv *app.Server) {
+	a := addTodo(t, srv, "A")
+	b := addTodo(t, srv, "B")
+	c := addTodo(t, srv, "C")
+
+	results := batchResults(t, postBatch(t, srv, fmt.Sprintf(`{"operations": [
+		{"op": "create", "todo": {"task": "D", "priority": "high"}},
+		{"op": "update", "id": %d, "patch": {"completed": true}},
+		{"op": "delete", "id": %d}
+	]}`, a.ID, b.ID)), http.StatusCreated, http.StatusOK, http.StatusNoContent)
+	if got := results[0].Todo; got == nil || got.ID == 0 || got.Task != "D" || got.Priority != "high" {
+		t.Errorf("expected the created todo, got %+v", got)
+	}
+	if got := results[1].Todo; got == nil || got.ID != a.ID || !got.Completed {
+		t.Errorf("expected the updated todo, got %+v", got)
+	}
+	todos := listTodos(t, srv)
+	if got := todoTasks(todos); !slices.Equal(got, []string{"A", "C", "D"}) || !todos[0].Completed {
+		t.Errorf("expected A completed, B deleted and D created, got %+v", todos)
+	}
+
+	w := postBatch(t, srv, fmt.Sprintf(`{"mode": "atomic", "operations": [
+		{"op": "update", "id": %d, "patch": {"task": "C2"}},
+		{"op": "create", "todo": {"task": "E"}},
+		{"op": "delete", "id": %d}
+	]}`, c.ID, b.ID))
+	p := expectProblem(t, w, http.StatusNotFound, app.CodeNotFound)
+	if p.Operation == nil || *p.Operation != 2 {
+		t.Errorf("expected the problem to name operation 2, got %+v", p)
+	}
+	if got := todoTasks(listTodos(t, srv)); !slices.Equal(got, []string{"A", "C", "D"}) {
+		t.Errorf("expected a failed atomic batch to change nothing, got %q", got)
+	}
+	if got := eventActions(todoHistory(t, srv, c.ID)); !slices.Equal(got, []string{app.EventCreate}) {
+		t.Errorf("expected no history for the rolled back update, got %q", got)
+	}
+}
+
+// testBatchPerItem tests that a per-item batch reports each failed operation
+// and still applies the others
+func testBatchPerItem(t *testing.T, srv *app.Server) {
+	deploy := addTodo(t, srv, "Deploy")
+	review := addTodo(t, srv, "Review")
+	decodeTodo(t, setBlocker(t, srv, http.MethodPut, deploy.ID, review.ID))
+
+	results := batchResults(t, postBatch(t, srv, fmt.Sprintf(`{"mode": "per_item", "operations": [
+		{"op": "update", "id": %d, "patch": {"task": "Review PR"}},
+		{"op": "delete", "id": 999},
+		{"op": "create", "todo": {"task": "Orphan", "parent_id": 999}},
+		{"op": "update", "id": %d, "patch": {"completed": true}},
+		{"op": "update", "id": %d, "patch": {"priority": "someday"}},
+		{"op": "create", "todo": {"task": "Announce"}}
+	]}`, review.ID, deploy.ID, deploy.ID)),
+		http.StatusOK, http.StatusNotFound, http.StatusUnprocessableEntity, http.StatusConflict,
+		http.StatusUnprocessableEntity, http.StatusCreated)
+
+	wantCodes := []string{"", app.CodeNotFound, app.CodeValidationFailed, app.CodeTodoBlocked, app.CodeValidationFailed, ""}
+	for i, res := range results {
+		code := ""
+		if res.Problem != nil {
+			code = res.Problem.Code
+		}
+		if code != wantCodes[i] {
+			t.Errorf("operation %d: expected problem code %q, got %+v", i, wantCodes[i], res.Problem)
+		}
+	}
+	if got := results[2].Problem.Errors; len(got) != 1 || got[0].Field != "parent_id" {
+		t.Errorf("expected the unknown parent to be reported, got %+v", got)
+	}
+	todos := listTodos(t, srv)
+	if got := todoTasks(todos); !slices.Equal(got, []string{"Deploy", "Review PR", "Announce"}) || todos[0].Completed {
+		t.Errorf("expected only the valid operations to apply, got %+v", todos)
+	}
+}
+
+// testBatchClearCompleted tests that clear_completed trashes completed todos
+// with their subtasks, leaving those with open subtasks
+func testBatchClearCompleted(t *testing.T, srv *app.Server) {
+	work := createList(t, srv, "Work")
+	done := addTodo(t, srv, "Done")
+	setCompleted(t, srv, done, true)
+	parent := addTodo(t, srv, "Parent")
+	child := createTodo(t, srv, map[string]any{"task": "Child", "parent_id": parent.ID})
+	setCompleted(t, srv, child, true)
+	setCompleted(t, srv, decodeTodo(t, getTodo(t, srv, parent.ID)), true)
+	busy := addTodo(t, srv, "Busy")
+	createTodo(t, srv, map[string]any{"task": "Busy subtask", "parent_id": busy.ID})
+	setCompleted(t, srv, decodeTodo(t, getTodo(t, srv, busy.ID)), true)
+	addTodo(t, srv, "Open")
+	other := createTodo(t, srv, map[string]any{"task": "Other list", "list_id": work.ID})
+	setCompleted(t, srv, other, true)
+
+	results := batchResults(t, postBatch(t, srv, fmt.Sprintf(`{"operations": [{"op": "clear_completed", "list_id": %d}]}`,
+		app.DefaultListID)), http.StatusOK)
+	if results[0].Count == nil || *results[0].Count != 3 {
+		t.Errorf("expected 3 todos cleared, got %+v", results[0])
+	}
+	if got := listTrash(t, srv); !slices.Equal(got, []string{"Done", "Parent", "Child"}) {
+		t.Errorf("expected the completed todos and their subtasks in the trash, got %q", got)
+	}
+	if got := todoTasks(listTodos(t, srv)); !slices.Equal(got, []string{"Busy", "Busy subtask", "Open", "Other list"}) {
+		t.Errorf("expected todos with open subtasks and other lists to stay, got %q", got)
+	}
+	decodeTodo(t, restoreTodo(t, srv, parent.ID))
+	if got := decodeTodo(t, getTodo(t, srv, child.ID)); got.DeletedAt != nil {
+		t.Errorf("expected the subtask cleared with its parent to be restored with it, got %+v", got)
+	}
+
+	results = batchResults(t, postBatch(t, srv, `{"operations": [{"op": "clear_completed"}]}`), http.StatusOK)
+	if results[0].Count == nil || *results[0].Count != 3 {
+		t.Errorf("expected 3 todos cleared from every list, got %+v", results[0])
+	}
+	if got := todoTasks(listTodos(t, srv)); !slices.Equal(got, []string{"Busy", "Busy subtask", "Open"}) {
+		t.Errorf("expected only open todos and their parents left, got %q", got)
+	}
+}
+
+// testBatchCompleteAll tests that complete_all completes a list's open
+// todos, in whatever order their blockers need
+func testBatchCompleteAll(t *testing.T, srv *app.Server) {
+	release := createList(t, srv, "Release")
+	inList := func(todo map[string]any) app.Todo {
+		todo["list_id"] = release.ID
+		return createTodo(t, srv, todo)
+	}
+	deploy := inList(map[string]any{"task": "Deploy"})
+	review := inList(map[string]any{"task": "Review"})
+	decodeTodo(t, setBlocker(t, srv, http.MethodPut, deploy.ID, review.ID))
+	external := addTodo(t, srv, "External")
+	ship := inList(map[string]any{"task": "Ship"})
+	decodeTodo(t, setBlocker(t, srv, http.MethodPut, ship.ID, external.ID))
+	parent := inList(map[string]any{"task": "Parent", "auto_complete": true})
+	createTodo(t, srv, map[string]any{"task": "Subtask", "parent_id": parent.ID})
+	inList(map[string]any{"task": "Weekly", "due_at": time.Now().UTC().Add(time.Hour), "recurrence": "FREQ=WEEKLY"})
+
+	results := batchResults(t, postBatch(t, srv, fmt.Sprintf(`{"operations": [{"op": "complete_all", "list_id": %d}]}`,
+		release.ID)), http.StatusOK)
+	if results[0].Count == nil || *results[0].Count != 4 {
+		t.Errorf("expected Deploy, Review, Subtask and Weekly completed, got %+v", results[0])
+	}
+
+	var open, completed []string
+	for _, todo := range listTodos(t, srv) {
+		if todo.Completed {
+			completed = append(completed, todo.Task)
+		} else {
+			open = append(open, todo.Task)
+		}
+	}
+	if !slices.Equal(completed, []string{"Deploy", "Review", "Parent", "Subtask", "Weekly"}) {
+		t.Errorf("expected the list's todos completed, with the parent rolled up, got %q", completed)
+	}
+	if !slices.Equal(open, []string{"External", "Ship", "Weekly"}) {
+		t.Errorf("expected other lists, todos still blocked and the next occurrence left open, got %q", open)
+	}
+}
+
+// testBatchInvalid tests that malformed batches are rejected before any
+// operation runs
+func testBatchInvalid(t *testing.T, srv *app.Server) {
+	todo := addTodo(t, srv, "Keep")
+
+	tests := []struct {
+		body   string
+		fields []string
+	}{
+		{`{"operations": []}`, []string{"operations"}},
+		{`{"mode": "best_effort", "operations": [{"op": "clear_completed"}]}`, []string{"mode"}},
+		{`{"operations": [{"op": "archive"}]}`, []string{"operations[0].op"}},
+		{`{"operations": [{"op": "create", "todo": {"task": " "}}, {"op": "delete"}]}`,
+			[]string{"operations[0].todo.task", "operations[1].id"}},
+		{`{"operations": [{"op": "create", "todo": {"task": "x", "colour": "red"}}]}`, []string{"operations[0].todo.colour"}},
+		{`{"operations": [{"op": "create", "todo": [1]}]}`, []string{"operations[0].todo"}},
+		{`{"operations": [{"op": "update", "id": 1}]}`, []string{"operations[0].patch"}},
+		{`{"operations": [{"op": "update", "id": 1, "patch": [1]}]}`, []string{"operations[0].patch"}},
+		{`{"operations": [{"op": "delete", "id": 1, "list_id": 1}]}`, []string{"operations[0].list_id"}},
+		{`{"operations": [{"op": "complete_all"}]}`, []string{"operations[0].list_id"}},
+	}
+	for _, tt := range tests {
+		p := expectProblem(t, postBatch(t, srv, tt.body), http.StatusUnprocessableEntity, app.CodeValidationFailed)
+		var fields []string
+		for _, f := range p.Errors {
+			fields = append(fields, f.Field)
+		}
+		if !slices.Equal(fields, tt.fields) {
+			t.Errorf("%s: expected invalid fields %q, got %+v", tt.body, tt.fields, p.Errors)
+		}
+	}
+
+	ops := strings.Repeat(`{"op": "clear_completed"},`, app.MaxBatchOperations+1)
+	expectProblem(t, postBatch(t, srv, `{"operations": [`+strings.TrimSuffix(ops, ",")+`]}`),
+		http.StatusUnprocessableEntity, app.CodeValidationFailed)
+	expectProblem(t, postBatch(t, srv, `[]`), http.StatusBadRequest, app.CodeMalformedRequest)
+
+	p := expectProblem(t, postBatch(t, srv, `{"operations": [{"op": "complete_all", "list_id": 999}]}`),
+		http.StatusUnprocessableEntity, app.CodeValidationFailed)
+	if p.Operation == nil || *p.Operation != 0 {
+		t.Errorf("expected the problem to name operation 0, got %+v", p)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/todos:batch", nil)
+	w := httptest.NewRecorder()
+	srv.HandleTodosBatch(w, req)
+	expectProblem(t, w, http.StatusMethodNotAllowed, app.CodeMethodNotAllowed)
+
+	if got := todoTasks(listTodos(t, srv)); !slices.Equal(got, []string{todo.Task}) {
+		t.Errorf("expected invalid batches to change nothing, got %q", got)
+	}
+}
+
+// conditionalRequest sends a request for a todo with an If-Match header,
+// returning the recorder.
+func conditionalRequest(t *testing.T, srv *app.Server, method string, id int, ifMatch, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(method, fmt.Sprintf("/todos/%d", id), strings.NewReader(body))
+	if method == http.MethodPatch {
+		req.Header.Set("Content-Type", "application/merge-patch+json")
+	}
+	req.Header.Set("If-Match", ifMatch)
+	w := httptest.NewRecorder()
+	srv.HandleTodo(w, req)
+	return w
+}
+
+// expectETag checks a response's ETag header.
+func expectETag(t *testing.T, w *httptest.ResponseRecorder, want string) {
+	t.Helper()
+	if got := w.Header().Get("ETag"); got != want {
+		t.Errorf("expected ETag %s, got %q", want, got)
+	}
+}
+
+// testTodoVersions tests that every change to a todo bumps its version and
+// ETag, and that If-Match refuses changes to any other version with 412
+func testTodoVersions(t *testing.T, srv *app.Server) {
+	body, _ := json.Marshal(app.Todo{Task: "Versioned"})
+	w := httptest.NewRecorder()
+	srv.HandleTodos(w, httptest.NewRequest(http.MethodPost, "/todos", bytes.NewBuffer(body)))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("failed to create todo: status %d, body %q", w.Code, w.Body.String())
+	}
+	expectETag(t, w, `"1"`)
+	var created app.Todo
+	if err := json.NewDecoder(w.Body).Decode(&created); err != nil {
+		t.Fatalf("failed to decode todo: %v", err)
+	}
+	if created.Version != 1 {
+		t.Errorf("expected version 1, got %d", created.Version)
+	}
+	w = getTodo(t, srv, created.ID)
+	expectETag(t, w, `"1"`)
+
+	w = conditionalRequest(t, srv, http.MethodPatch, created.ID, `"1"`, `{"task": "Versioned twice"}`)
+	expectETag(t, w, `"2"`)
+	if updated := decodeTodo(t, w); updated.Version != 2 {
+		t.Errorf("expected version 2, got %d", updated.Version)
+	}
+
+	// A stale version is refused, and the response says what is current.
+	w = conditionalRequest(t, srv, http.MethodPatch, created.ID, `"1"`, `{"task": "Lost update"}`)
+	expectETag(t, w, `"2"`)
+	expectProblem(t, w, http.StatusPreconditionFailed, app.CodePreconditionFailed)
+	put, _ := json.Marshal(app.Todo{Task: "Lost update", Completed: true})
+	expectProblem(t, conditionalRequest(t, srv, http.MethodPut, created.ID, `"1"`, string(put)), http.StatusPreconditionFailed, app.CodePreconditionFailed)
+	// If-Match compares strongly, so weak ETags never match.
+	expectProblem(t, conditionalRequest(t, srv, http.MethodPatch, created.ID, `W/"2"`, `{"task": "Lost update"}`), http.StatusPreconditionFailed, app.CodePreconditionFailed)
+	if got := decodeTodo(t, getTodo(t, srv, created.ID)); got.Task != "Versioned twice" || got.Completed || got.Version != 2 {
+		t.Errorf("expected refused changes to leave the todo alone, got %+v", got)
+	}
+
+	// Any of a list of ETags may match, as may "*".
+	decodeTodo(t, conditionalRequest(t, srv, http.MethodPut, created.ID, `"5", "2"`, string(put)))
+	w = conditionalRequest(t, srv, http.MethodPatch, created.ID, "*", `{"completed": false}`)
+	expectETag(t, w, `"4"`)
+	decodeTodo(t, w)
+
+	// Tags are part of the version; so are changes made as a side effect.
+	tag := createTag(t, srv, "versioned")
+	if tagged := decodeTodo(t, setTag(t, srv, http.MethodPut, created.ID, tag.ID)); tagged.Version != 5 {
+		t.Errorf("expected attaching a tag to bump the version to 5, got %d", tagged.Version)
+	}
+	if again := decodeTodo(t, setTag(t, srv, http.MethodPut, created.ID, tag.ID)); again.Version != 5 {
+		t.Errorf("expected attaching it again to leave the version at 5, got %d", again.Version)
+	}
+	// Todos show their tags' names, so renaming a tag changes them.
+	rename := func(name string) {
+		t.Helper()
+		if w := serveTags(t, srv, http.MethodPatch, fmt.Sprintf("/tags/%d", tag.ID), fmt.Sprintf(`{"name": %q}`, name)); w.Code != http.StatusOK {
+			t.Fatalf("failed to rename tag: status %d, body %q", w.Code, w.Body.String())
+		}
+	}
+	rename("renamed")
+	renamed := decodeTodo(t, getTodo(t, srv, created.ID))
+	if renamed.Version != 6 || !slices.Equal(tagNames(renamed), []string{"renamed"}) {
+		t.Errorf("expected renaming the tag to bump the version to 6, got %+v", renamed)
+	}
+	events := todoHistory(t, srv, created.ID)
+	if last := events[len(events)-1]; last.Action != app.EventUpdate || !slices.Equal(tagNames(*last.Before), []string{"versioned"}) || !slices.Equal(tagNames(*last.After), []string{"renamed"}) {
+		t.Errorf("expected an update event for the rename, got %+v", last)
+	}
+	rename("renamed")
+	if again := decodeTodo(t, getTodo(t, srv, created.ID)); again.Version != 6 {
+		t.Errorf("expected renaming it to the same name to leave the version at 6, got %d", again.Version)
+	}
+	parent := createTodo(t, srv, map[string]any{"task": "Parent", "auto_complete": true})
+	child := createTodo(t, srv, map[string]any{"task": "Child", "parent_id": parent.ID})
+	setCompleted(t, srv, child, true)
+	rolledUp := decodeTodo(t, getTodo(t, srv, parent.ID))
+	if !rolledUp.Completed || rolledUp.Version != 2 {
+		t.Errorf("expected the rollup to complete the parent at version 2, got %+v", rolledUp)
+	}
+	events = todoHistory(t, srv, parent.ID)
+	if last := events[len(events)-1]; last.After.Version != rolledUp.Version {
+		t.Errorf("expected the last event to record version %d, got %+v", rolledUp.Version, last.After)
+	}
+
+	expectProblem(t, conditionalRequest(t, srv, http.MethodDelete, created.ID, `"5"`, ""), http.StatusPreconditionFailed, app.CodePreconditionFailed)
+	if w := conditionalRequest(t, srv, http.MethodDelete, created.ID, `"6"`, ""); w.Code != http.StatusNoContent {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusNoContent, w.Code, w.Body.String())
+	}
+	// A missing todo is missing whatever the request expected of it.
+	expectNotFound(t, conditionalRequest(t, srv, http.MethodPatch, 424242, `"1"`, `{"task": "x"}`))
+	expectNotFound(t, conditionalRequest(t, srv, http.MethodDelete, created.ID, `"6"`, ""))
+}
+
+// postWithKey posts a todo to path through the actor middleware, with the
+// given actor header (none if empty) and Idempotency-Key.
+func postWithKey(t *testing.T, srv *app.Server, actor, path, key, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/todos", srv.HandleTodos)
+	mux.HandleFunc("/lists/", srv.HandleList)
+	handler := app.ActorMiddleware(mux, true)
+
+	req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+	if actor != "" {
+		req.Header.Set(app.ActorHeader, actor)
+	}
+	req.Header.Set("Idempotency-Key", key)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	return w
+}
+
+// decodeCreated decodes a 201 response with a todo.
+func decodeCreated(t *testing.T, w *httptest.ResponseRecorder) app.Todo {
+	t.Helper()
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusCreated, w.Code, w.Body.String())
+	}
+	var todo app.Todo
+	if err := json.NewDecoder(w.Body).Decode(&todo); err != nil {
+		t.Fatalf("failed to decode todo: %v", err)
+	}
+	return todo
+}
+
+// testIdempotencyKeys tests that repeating a create with the same
+// Idempotency-Key replays the original response instead of creating another
+// todo, and that reusing the key for a different request is refused
+func testIdempotencyKeys(t *testing.T, srv *app.Server) {
+	added := testutil.ToFloat64(app.TodosAdded)
+	w := postWithKey(t, srv, "", "/todos", "key-1", `{"task": "Once"}`)
+	if w.Header().Get("Idempotent-Replayed") != "" {
+		t.Errorf("expected the first request not to be a replay")
+	}
+	created := decodeCreated(t, w)
+
+	// Retries replay the original response, even if the todo changed since,
+	// and however the JSON is formatted.
+	decodeTodo(t, patchTodo(t, srv, created.ID, `{"task": "Changed"}`))
+	w = postWithKey(t, srv, "", "/todos", "key-1", `{ "task":"Once" }`)
+	if got := w.Header().Get("Idempotent-Replayed"); got != "true" {
+		t.Errorf("expected Idempotent-Replayed: true, got %q", got)
+	}
+	expectETag(t, w, `"1"`)
+	if replayed := decodeCreated(t, w); replayed.ID != created.ID || replayed.Task != "Once" || !replayed.CreatedAt.Equal(created.CreatedAt) {
+		t.Errorf("expected the original response %+v, got %+v", created, replayed)
+	}
+	if got := listAllPages(t, srv, ""); !slices.Equal(got, []string{"Changed"}) {
+		t.Errorf("expected a single todo, got %q", got)
+	}
+	if after := testutil.ToFloat64(app.TodosAdded); after != added+1 {
+		t.Errorf("expected todos_added_total to go up by 1, got %v (was %v)", after, added)
+	}
+
+	// The key belongs to the request it was first used with.
+	expectProblem(t, postWithKey(t, srv, "", "/todos", "key-1", `{"task": "Twice"}`), http.StatusUnprocessableEntity, app.CodeIdempotencyKeyReused)
+	expectProblem(t, postWithKey(t, srv, "", fmt.Sprintf("/lists/%d/todos", app.DefaultListID), "key-1", `{"task": "Once"}`), http.StatusUnprocessableEntity, app.CodeIdempotencyKeyReused)
+	// A request that failed kept nothing, so its key can be used again.
+	expectProblem(t, postWithKey(t, srv, "", "/todos", "key-2", `{"task": "Orphan", "parent_id": 424242}`), http.StatusUnprocessableEntity, app.CodeValidationFailed)
+	if adopted := decodeCreated(t, postWithKey(t, srv, "", "/todos", "key-2", `{"task": "Adopted"}`)); adopted.Task != "Adopted" {
+		t.Errorf("expected a new todo for a key whose request failed, got %+v", adopted)
+	}
+
+	// Keys belong to the actor that sent them.
+	other := decodeCreated(t, postWithKey(t, srv, "bob@example.com", "/todos", "key-1", `{"task": "Once"}`))
+	if other.ID == created.ID {
+		t.Errorf("expected another actor's key to create its own todo, got %+v", other)
+	}
+
+	for _, key := range []string{"", "has space", strings.Repeat("k", 256)} {
+		w := postWithKey(t, srv, "", "/todos", key, `{"task": "Bad key"}`)
+		expectProblem(t, w, http.StatusBadRequest, app.CodeValidationFailed)
+	}
+	if got := listAllPages(t, srv, "q="+url.QueryEscape("Bad key")); len(got) != 0 {
+		t.Errorf("expected requests with invalid keys to create nothing, got %q", got)
+	}
+}
+
+// testIdempotencyKeysConcurrently tests that concurrent requests with the
+// same key create a single todo and all get it back
+func testIdempotencyKeysConcurrently(t *testing.T, srv *app.Server) {
+	ids := make([]int, 8)
+	var wg sync.WaitGroup
+	for i := range ids {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w := postWithKey(t, srv, "", "/todos", "racing", `{"task": "Racing"}`)
+			if w.Code != http.StatusCreated {
+				t.Errorf("create failed: status %d, body %q", w.Code, w.Body.String())
+				return
+			}
+			var todo app.Todo
+			if err := json.NewDecoder(w.Body).Decode(&todo); err != nil {
+				t.Errorf("failed to decode todo: %v", err)
+			}
+			ids[i] = todo.ID
+		}()
+	}
+	wg.Wait()
+
+	if got := listAllPages(t, srv, ""); len(got) != 1 {
+		t.Fatalf("expected a single todo, got %q", got)
+	}
+	for _, id := range ids {
+		if id != ids[0] {
+			t.Errorf("expected every request to get the same todo, got ids %v", ids)
+			break
+		}
+	}
+}
+
+// testUntrustedActorHeader tests that without IAP in front of the service,
+// a client-supplied actor header is ignored: changes are anonymous, and
+// can't claim another key space for an Idempotency-Key
+func testUntrustedActorHeader(t *testing.T, srv *app.Server) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/todos", srv.HandleTodos)
+	handler := app.ActorMiddleware(mux, false)
+	post := func(actor string) app.Todo {
+		req := httptest.NewRequest(http.MethodPost, "/todos", strings.NewReader(`{"task": "Forged"}`))
+		req.Header.Set(app.ActorHeader, actor)
+		req.Header.Set("Idempotency-Key", "forged")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return decodeCreated(t, w)
+	}
+
+	created := post("accounts.google.com:alice@example.com")
+	if events := todoHistory(t, srv, created.ID); len(events) != 1 || events[0].Actor != app.AnonymousActor {
+		t.Errorf("expected the forged actor to be ignored, got %+v", events)
+	}
+	if again := post("accounts.google.com:bob@example.com"); again.ID != created.ID {
+		t.Errorf("expected the key replayed whatever the actor header, got todo %d (was %d)", again.ID, created.ID)
+	}
+}
+
+// testPurgeIdempotencyKeys tests expiring Idempotency-Keys, after which a
+// repeated request creates a new todo.
+func testPurgeIdempotencyKeys(t *testing.T, store app.Store) {
+	ctx := context.Background()
+	srv := app.NewServer(store)
+	first := decodeCreated(t, postWithKey(t, srv, "", "/todos", "expiring", `{"task": "Expiring"}`))
+
+	n, err := store.PurgeIdempotencyKeys(ctx, time.Now().Add(-time.Hour))
+	if err != nil || n != 0 {
+		t.Fatalf("expected no keys purged before the cutoff, got %d (err %v)", n, err)
+	}
+	if replayed := decodeCreated(t, postWithKey(t, srv, "", "/todos", "expiring", `{"task": "Expiring"}`)); replayed.ID != first.ID {
+		t.Errorf("expected the kept key to be replayed, got %+v", replayed)
+	}
+
+	n, err = store.PurgeIdempotencyKeys(ctx, time.Now().Add(time.Second))
+	if err != nil || n != 1 {
+		t.Fatalf("expected 1 key purged, got %d (err %v)", n, err)
+	}
+	if again := decodeCreated(t, postWithKey(t, srv, "", "/todos", "expiring", `{"task": "Expiring"}`)); again.ID == first.ID {
+		t.Errorf("expected an expired key to create a new todo, got %+v", again)
+	}
+}
+
+// testEventsSince tests reading events by revision: a batch is one change,
+// and a limit counts whole changes.
+func testEventsSince(t *testing.T, store app.Store) {
+	ctx := context.Background()
+	srv := app.NewServer(store)
+	first := addTodo(t, srv, "First")
+	batchResults(t, postBatch(t, srv, `{"mode": "per_item", "operations": [{"op": "create", "todo": {"task": "Second"}}, {"op": "delete", "id": 424242}, {"op": "create", "todo": {"task": "Third"}}]}`),
+		http.StatusCreated, http.StatusNotFound, http.StatusCreated)
+	addTodo(t, srv, "Fourth")
+
+	events, err := store.Events(ctx, 0, 2)
+	if err != nil {
+		t.Fatalf("failed to read events: %v", err)
+	}
+	tasks := func(events []app.TodoEvent) []string {
+		var tasks []string
+		for _, e := range events {
+			tasks = append(tasks, e.After.Task)
+		}
+		return tasks
+	}
+	if got := tasks(events); !slices.Equal(got, []string{"First", "Second", "Third"}) {
+		t.Fatalf("expected the first create and the batch, got %q", got)
+	}
+	if events[0].TodoID != first.ID || events[1].Revision <= events[0].Revision || events[1].Revision != events[2].Revision {
+		t.Errorf("expected the batch as one later revision, got %+v", events)
+	}
+
+	events, err = store.Events(ctx, events[2].Revision, 10)
+	if err != nil || !slices.Equal(tasks(events), []string{"Fourth"}) {
+		t.Fatalf("expected the last create after the batch, got %+v (err %v)", events, err)
+	}
+	if events, err = store.Events(ctx, events[0].Revision, 10); err != nil || len(events) != 0 {
+		t.Errorf("expected no events after the last, got %+v (err %v)", events, err)
+	}
+}
+
+// getTodosIfNoneMatch lists todos with an If-None-Match header (none if
+// empty), returning the recorder.
+func getTodosIfNoneMatch(t *testing.T, srv *app.Server, query, etag string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodGet, "/todos?"+query, nil)
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+	w := httptest.NewRecorder()
+	srv.HandleTodos(w, req)
+	return w
+}
+
+// testListConditionalGet tests that listing todos returns an ETag that
+// changes with every change to any todo, and 304 for If-None-Match while it
+// hasn't
+func testListConditionalGet(t *testing.T, srv *app.Server) {
+	todo := addTodo(t, srv, "Cached")
+	w := getTodosIfNoneMatch(t, srv, "", "")
+	etag := w.Header().Get("ETag")
+	if w.Code != http.StatusOK || !strings.HasPrefix(etag, `W/"`) {
+		t.Fatalf("expected 200 with a weak ETag, got %d with %q", w.Code, etag)
+	}
+	if got := w.Header().Get("Cache-Control"); got != "private, no-cache" {
+		t.Errorf("expected Cache-Control: private, no-cache, got %q", got)
+	}
+	modified, err := http.ParseTime(w.Header().Get("Last-Modified"))
+	if err != nil || modified.Before(todo.CreatedAt.Truncate(time.Second)) || modified.After(time.Now()) {
+		t.Errorf("expected Last-Modified at the create, got %q (err %v)", w.Header().Get("Last-Modified"), err)
+	}
+
+	// notModified checks the list is still at etag, for any query.
+	notModified := func(what string) {
+		t.Helper()
+		for _, query := range []string{"", "completed=false&sort=-task", "limit=1"} {
+			w := getTodosIfNoneMatch(t, srv, query, etag)
+			if w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+				t.Errorf("expected 304 with no body after %s, got %d: %s", what, w.Code, w.Body.String())
+			}
+			expectETag(t, w, etag)
+		}
+	}
+	// changed checks the list moved on from etag, and returns the new one.
+	changed := func(what string) {
+		t.Helper()
+		w := getTodosIfNoneMatch(t, srv, "", etag)
+		if w.Code != http.StatusOK || w.Header().Get("ETag") == etag {
+			t.Fatalf("expected 200 with a new ETag after %s, got %d with %q", what, w.Code, w.Header().Get("ETag"))
+		}
+		etag = w.Header().Get("ETag")
+	}
+
+	notModified("nothing")
+	if w := getTodosIfNoneMatch(t, srv, "", `"other", `+strings.TrimPrefix(etag, "W/")); w.Code != http.StatusNotModified {
+		t.Errorf("expected any matching ETag to match weakly, got %d", w.Code)
+	}
+	if w := getTodosIfNoneMatch(t, srv, "", "*"); w.Code != http.StatusNotModified {
+		t.Errorf("expected * to match, got %d", w.Code)
+	}
+
+	decodeTodo(t, patchTodo(t, srv, todo.ID, `{"task": "Renamed"}`))
+	changed("an update")
+	// Refused changes and no-ops change nothing.
+	expectProblem(t, patchTodo(t, srv, todo.ID, `{"task": ""}`), http.StatusUnprocessableEntity, app.CodeValidationFailed)
+	expectProblem(t, postBatch(t, srv, `{"operations": [{"op": "create", "todo": {"task": "Rolled back"}}, {"op": "delete", "id": 424242}]}`), http.StatusNotFound, app.CodeNotFound)
+	tag := createTag(t, srv, "cached")
+	notModified("refused changes")
+
+	decodeTodo(t, setTag(t, srv, http.MethodPut, todo.ID, tag.ID))
+	changed("tagging")
+	decodeTodo(t, setTag(t, srv, http.MethodPut, todo.ID, tag.ID))
+	notModified("tagging again")
+	// Todos are listed with their tags' names.
+	if w := serveTags(t, srv, http.MethodPatch, fmt.Sprintf("/tags/%d", tag.ID), `{"name": "renamed"}`); w.Code != http.StatusOK {
+		t.Fatalf("failed to rename tag: status %d, body %q", w.Code, w.Body.String())
+	}
+	changed("renaming a tag")
+	batchResults(t, postBatch(t, srv, `{"mode": "per_item", "operations": [{"op": "delete", "id": 424242}, {"op": "create", "todo": {"task": "Batched"}}]}`),
+		http.StatusNotFound, http.StatusCreated)
+	changed("a batch")
+	if w := deleteTodo(t, srv, todo.ID, ""); w.Code != http.StatusNoContent {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusNoContent, w.Code, w.Body.String())
+	}
+	changed("a delete")
+
+	// Overdue todos change as time passes, so they are never cached.
+	w = getTodosIfNoneMatch(t, srv, "due=overdue", etag)
+	if w.Code != http.StatusOK || w.Header().Get("ETag") != "" || w.Header().Get("Last-Modified") != "" {
+		t.Errorf("expected 200 without an ETag or Last-Modified for overdue todos, got %d with %q", w.Code, w.Header())
+	}
+}
+
+// sseMessage is one message of a Server-Sent Events stream.
+type sseMessage struct {
+	Event, ID, Data string
+}
+
+// eventStream reads GET /todos/events from a test server.
+type eventStream struct {
+	t    *testing.T
+	body *bufio.Reader
+}
+
+// openEventStream starts streaming todo events through the same middleware
+// as the server, resuming after lastEventID if it is set.
+func openEventStream(t *testing.T, srv *app.Server, lastEventID string) *eventStream {
+	t.Helper()
+	ts := httptest.NewServer(app.SecurityHeadersMiddleware(http.HandlerFunc(srv.HandleTodoEvents)))
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, ts.URL+"/todos/events", nil)
+	if lastEventID != "" {
+		req.Header.Set("Last-Event-ID", lastEventID)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("failed to open event stream: %v", err)
+	}
+	t.Cleanup(func() {
+		cancel()
+		resp.Body.Close()
+		ts.Close()
+	})
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("expected 200 with text/event-stream, got %d with %q", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	return &eventStream{t: t, body: bufio.NewReader(resp.Body)}
+}
+
+// next returns the next message, skipping comments.
+func (s *eventStream) next() sseMessage {
+	s.t.Helper()
+	var msg sseMessage
+	for {
+		line, err := s.body.ReadString('\n')
+		if err != nil {
+			s.t.Fatalf("failed to read event stream: %v", err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		if line == "" && msg != (sseMessage{}) {
+			return msg
+		}
+		field, value, _ := strings.Cut(line, ": ")
+		switch field {
+		case "event":
+			msg.Event = value
+		case "id":
+			msg.ID = value
+		case "data":
+			msg.Data = value
+		}
+	}
+}
+
+// nextEvent returns the next message, which must be of type typ, with its
+// data decoded.
+func (s *eventStream) nextEvent(typ string) (sseMessage, app.TodoEvent) {
+	s.t.Helper()
+	msg := s.next()
+	var e app.TodoEvent
+	if msg.Event != typ {
+		s.t.Fatalf("expected a %s event, got %+v", typ, msg)
+	}
+	if err := json.Unmarshal([]byte(msg.Data), &e); err != nil {
+		s.t.Fatalf("failed to decode event data %q: %v", msg.Data, err)
+	}
+	return msg, e
+}
+
+// testTodoEventStream tests that GET /todos/events streams every change
+// from the current revision on, one id per change, and resumes after
+// Last-Event-ID
+func testTodoEventStream(t *testing.T, srv *app.Server) {
+	parent := addTodo(t, srv, "Parent")
+	child := createTodo(t, srv, map[string]any{"task": "Child", "parent_id": parent.ID})
+
+	stream := openEventStream(t, srv, "")
+	ready := stream.next()
+	var readyRevision int64
+	if _, err := fmt.Sscan(ready.ID, &readyRevision); ready.Event != "ready" || err != nil {
+		t.Fatalf("expected a ready event with a revision as the id first, got %+v", ready)
+	}
+
+	decodeTodo(t, patchTodo(t, srv, parent.ID, `{"task": "Streamed"}`))
+	srv.NotifyTodoEvents()
+	updated, e := stream.nextEvent("updated")
+	if e.TodoID != parent.ID || e.After == nil || e.After.Task != "Streamed" || updated.ID != fmt.Sprint(e.Revision) || e.Revision <= readyRevision {
+		t.Errorf("expected the update with its revision as the id, got %+v with %+v", updated, e)
+	}
+	// Who made a change is for its history, not for every client watching.
+	for _, field := range []string{`"actor"`, `"request_id"`, `"trace_id"`} {
+		if strings.Contains(updated.Data, field) {
+			t.Errorf("expected no %s in streamed events, got %s", field, updated.Data)
+		}
+	}
+
+	// A cascading delete is one change: only its last event has an id.
+	if w := deleteTodo(t, srv, parent.ID, "cascade=true"); w.Code != http.StatusNoContent {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusNoContent, w.Code, w.Body.String())
+	}
+	srv.NotifyTodoEvents()
+	first, e1 := stream.nextEvent("deleted")
+	last, e2 := stream.nextEvent("deleted")
+	if ids := []int{e1.TodoID, e2.TodoID}; !slices.Equal(ids, []int{parent.ID, child.ID}) {
+		t.Errorf("expected the parent and child deleted, got todos %v", ids)
+	}
+	if first.ID != "" || last.ID != fmt.Sprint(e2.Revision) || e1.Revision != e2.Revision {
+		t.Errorf("expected one id after both deletes, got %+v then %+v", first, last)
+	}
+
+	// Resuming replays what came after the id, without a ready event.
+	resumed := openEventStream(t, srv, ready.ID)
+	if msg, _ := resumed.nextEvent("updated"); msg != updated {
+		t.Errorf("expected the update replayed as %+v, got %+v", updated, msg)
+	}
+	resumed.nextEvent("deleted")
+	if msg, _ := resumed.nextEvent("deleted"); msg != last {
+		t.Errorf("expected the delete replayed as %+v, got %+v", last, msg)
+	}
+
+	// Restored todos reappear.
+	decodeTodo(t, restoreTodo(t, srv, parent.ID))
+	srv.NotifyTodoEvents()
+	for _, s := range []*eventStream{stream, resumed} {
+		if _, e := s.nextEvent("created"); e.Action != app.EventRestore || e.TodoID != parent.ID {
+			t.Errorf("expected the parent restored, got %+v", e)
+		}
+	}
+
+	// Renaming a tag updates the todos it is on.
+	tag := createTag(t, srv, "streamed")
+	decodeTodo(t, setTag(t, srv, http.MethodPut, parent.ID, tag.ID))
+	if w := serveTags(t, srv, http.MethodPatch, fmt.Sprintf("/tags/%d", tag.ID), `{"name": "renamed"}`); w.Code != http.StatusOK {
+		t.Fatalf("failed to rename tag: status %d, body %q", w.Code, w.Body.String())
+	}
+	srv.NotifyTodoEvents()
+	for _, s := range []*eventStream{stream, resumed} {
+		s.nextEvent("created") // the child, restored with the parent
+		s.nextEvent("updated") // tagged
+		if _, e := s.nextEvent("updated"); e.TodoID != parent.ID || e.After == nil || !slices.Equal(tagNames(*e.After), []string{"renamed"}) {
+			t.Errorf("expected the parent updated with the renamed tag, got %+v", e)
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/todos/events", nil)
+	w := httptest.NewRecorder()
+	srv.HandleTodoEvents(w, req)
+	expectProblem(t, w, http.StatusMethodNotAllowed, app.CodeMethodNotAllowed)
+}
+
+// testFullWorkflow tests a complete workflow
+func testFullWorkflow(t *testing.T, srv *app.Server) {
+	// 1. Start with empty list
+	if todos := listTodos(t, srv); len(todos) != 0 {
+		t.Errorf("expected 0 todos initially, got %d", len(todos))
+	}
+
+	// 2. Add a todo
+	created := addTodo(t, srv, "Buy groceries")
+
+	// 3. Verify it appears in the list
+	if todos := listTodos(t, srv); len(todos) != 1 {
+		t.Errorf("expected 1 todo after adding, got %d", len(todos))
+	}
+
+	// 4. Mark it as completed
+	setCompleted(t, srv, created, true)
+
+	// 5. Verify it's completed
+	if todos := listTodos(t, srv); len(todos) != 1 || !todos[0].Completed {
+		t.Error("expected todo to be completed")
+	}
+
+	// 6. Delete it
+	req := httptest.NewRequest(http.MethodDelete, fmt.Sprintf("/todos/%d", created.ID), nil)
+	w := httptest.NewRecorder()
+	srv.DeleteTodo(w, req, created.ID)
+
+	// 7. Verify it's gone
+	if todos := listTodos(t, srv); len(todos) != 0 {
+		t.Errorf("expected 0 todos after deleting, got %d", len(todos))
+	}
+}
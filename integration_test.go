@@ -8,9 +8,8 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"database/sql"
-	"encoding/json"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
@@ -22,7 +21,10 @@ import (
 	_ "github.com/lib/pq"
 )
 
-var testDB *sql.DB
+var (
+	testDB  *sql.DB
+	testSrv *app.Server
+)
 
 // TestMain sets up and tears down the test database
 func TestMain(m *testing.M) {
@@ -75,282 +77,56 @@ func TestMain(m *testing.M) {
 		os.Exit(1)
 	}
 
-	// Create test table
-	_, err = testDB.Exec(`
-		CREATE TABLE IF NOT EXISTS todos (
-			id SERIAL PRIMARY KEY,
-			task TEXT NOT NULL,
-			completed BOOLEAN DEFAULT FALSE
-		)
-	`)
+	// Apply the schema exactly as production does
+	migrator, err := app.NewMigrator(testDB, app.DialectPostgres)
+	if err == nil {
+		err = migrator.Up(context.Background())
+	}
 	if err != nil {
-		fmt.Printf("Failed to create test table: %v\n", err)
+		fmt.Printf("Failed to migrate test database: %v\n", err)
 		os.Exit(1)
 	}
 
-	// Set global db variables for handlers
-	app.DB = testDB
-	app.DBRead = testDB
+	// Handlers use the test database for both primary and replica
+	testSrv = app.NewServer(app.NewPostgresStore(testDB, testDB))
 
 	// Run tests
 	code := m.Run()
 
 	// Cleanup
-	testDB.Exec("DROP TABLE IF EXISTS todos")
+	if err := migrator.Down(context.Background(), migrator.Latest()); err != nil {
+		fmt.Printf("Failed to revert test migrations: %v\n", err)
+	}
 	testDB.Close()
 
 	os.Exit(code)
 }
 
-// cleanupTodos removes all todos from the test database
+// cleanupTodos removes all todos, lists and tags from the test database,
+// with their history and Idempotency-Keys, leaving only the default list
+// and revision 0 as the migrations created them
 func cleanupTodos(t *testing.T) {
-	_, err := testDB.Exec("DELETE FROM todos")
-	if err != nil {
-		t.Fatalf("failed to cleanup todos: %v", err)
-	}
-}
-
-// TestIntegrationGetTodosEmpty tests getting todos when database is empty
-func TestIntegrationGetTodosEmpty(t *testing.T) {
-	cleanupTodos(t)
-
-	req := httptest.NewRequest(http.MethodGet, "/todos", nil)
-	w := httptest.NewRecorder()
-
-	app.GetTodos(w, req)
-
-	if w.Code != http.StatusOK {
-		t.Errorf("expected status %d, got %d", http.StatusOK, w.Code)
-	}
-
-	var todos []app.Todo
-	if err := json.NewDecoder(w.Body).Decode(&todos); err != nil {
-		t.Fatalf("failed to decode response: %v", err)
-	}
-
-	if len(todos) != 0 {
-		t.Errorf("expected 0 todos, got %d", len(todos))
-	}
-}
-
-// TestIntegrationAddTodo tests adding a new todo
-func TestIntegrationAddTodo(t *testing.T) {
-	cleanupTodos(t)
-
-	newTodo := app.Todo{
-		Task: "Integration test todo",
-	}
-
-	body, _ := json.Marshal(newTodo)
-	req := httptest.NewRequest(http.MethodPost, "/todos", bytes.NewBuffer(body))
-	req.Header.Set("Content-Type", "application/json")
-	w := httptest.NewRecorder()
-
-	app.AddTodo(w, req)
-
-	if w.Code != http.StatusCreated {
-		t.Errorf("expected status %d, got %d", http.StatusCreated, w.Code)
-	}
-
-	var created app.Todo
-	if err := json.NewDecoder(w.Body).Decode(&created); err != nil {
-		t.Fatalf("failed to decode response: %v", err)
-	}
-
-	if created.ID == 0 {
-		t.Error("expected non-zero ID")
-	}
-
-	if created.Task != newTodo.Task {
-		t.Errorf("expected task %q, got %q", newTodo.Task, created.Task)
-	}
-
-	if created.Completed != false {
-		t.Errorf("expected completed to be false, got %v", created.Completed)
-	}
-}
-
-// TestIntegrationGetTodosWithData tests getting todos when database has data
-func TestIntegrationGetTodosWithData(t *testing.T) {
-	cleanupTodos(t)
-
-	// Insert test data
-	_, err := testDB.Exec("INSERT INTO todos (task, completed) VALUES ($1, $2)", "Test task 1", false)
-	if err != nil {
-		t.Fatalf("failed to insert test data: %v", err)
-	}
-	_, err = testDB.Exec("INSERT INTO todos (task, completed) VALUES ($1, $2)", "Test task 2", true)
-	if err != nil {
-		t.Fatalf("failed to insert test data: %v", err)
-	}
-
-	req := httptest.NewRequest(http.MethodGet, "/todos", nil)
-	w := httptest.NewRecorder()
-
-	app.GetTodos(w, req)
-
-	if w.Code != http.StatusOK {
-		t.Errorf("expected status %d, got %d", http.StatusOK, w.Code)
-	}
-
-	var todos []app.Todo
-	if err := json.NewDecoder(w.Body).Decode(&todos); err != nil {
-		t.Fatalf("failed to decode response: %v", err)
-	}
-
-	if len(todos) != 2 {
-		t.Errorf("expected 2 todos, got %d", len(todos))
-	}
-
-	if todos[0].Task != "Test task 1" {
-		t.Errorf("expected first task to be 'Test task 1', got %q", todos[0].Task)
-	}
-
-	if todos[1].Completed != true {
-		t.Errorf("expected second todo to be completed")
-	}
-}
-
-// TestIntegrationUpdateTodo tests updating a todo
-func TestIntegrationUpdateTodo(t *testing.T) {
-	cleanupTodos(t)
-
-	// Insert test data
-	var id int
-	err := testDB.QueryRow("INSERT INTO todos (task, completed) VALUES ($1, $2) RETURNING id",
-		"Test task", false).Scan(&id)
-	if err != nil {
-		t.Fatalf("failed to insert test data: %v", err)
-	}
-
-	// Update the todo
-	update := app.Todo{Completed: true}
-	body, _ := json.Marshal(update)
-	req := httptest.NewRequest(http.MethodPut, fmt.Sprintf("/todos/%d", id), bytes.NewBuffer(body))
-	req.Header.Set("Content-Type", "application/json")
-	w := httptest.NewRecorder()
-
-	app.UpdateTodo(w, req, id)
-
-	if w.Code != http.StatusOK {
-		t.Errorf("expected status %d, got %d", http.StatusOK, w.Code)
-	}
-
-	// Verify the update
-	var completed bool
-	err = testDB.QueryRow("SELECT completed FROM todos WHERE id = $1", id).Scan(&completed)
-	if err != nil {
-		t.Fatalf("failed to query updated todo: %v", err)
-	}
-
-	if !completed {
-		t.Error("expected todo to be completed")
-	}
-}
-
-// TestIntegrationDeleteTodo tests deleting a todo
-func TestIntegrationDeleteTodo(t *testing.T) {
-	cleanupTodos(t)
-
-	// Insert test data
-	var id int
-	err := testDB.QueryRow("INSERT INTO todos (task, completed) VALUES ($1, $2) RETURNING id",
-		"Test task", false).Scan(&id)
-	if err != nil {
-		t.Fatalf("failed to insert test data: %v", err)
-	}
-
-	// Delete the todo
-	req := httptest.NewRequest(http.MethodDelete, fmt.Sprintf("/todos/%d", id), nil)
-	w := httptest.NewRecorder()
-
-	app.DeleteTodo(w, req, id)
-
-	if w.Code != http.StatusNoContent {
-		t.Errorf("expected status %d, got %d", http.StatusNoContent, w.Code)
-	}
-
-	// Verify the deletion
-	var count int
-	err = testDB.QueryRow("SELECT COUNT(*) FROM todos WHERE id = $1", id).Scan(&count)
-	if err != nil {
-		t.Fatalf("failed to query deleted todo: %v", err)
-	}
-
-	if count != 0 {
-		t.Error("expected todo to be deleted")
+	for _, stmt := range []string{
+		"DELETE FROM idempotency_keys",
+		"DELETE FROM todo_events",
+		"UPDATE todos_revision SET revision = 0",
+		"DELETE FROM todos",
+		"DELETE FROM tags",
+		"DELETE FROM lists WHERE id <> 1",
+		"UPDATE lists SET name = 'Inbox', archived = FALSE WHERE id = 1",
+	} {
+		if _, err := testDB.Exec(stmt); err != nil {
+			t.Fatalf("failed to cleanup todos: %v", err)
+		}
 	}
 }
 
-// TestIntegrationFullWorkflow tests a complete workflow
-func TestIntegrationFullWorkflow(t *testing.T) {
-	cleanupTodos(t)
-
-	// 1. Start with empty list
-	req := httptest.NewRequest(http.MethodGet, "/todos", nil)
-	w := httptest.NewRecorder()
-	app.GetTodos(w, req)
-
-	var todos []app.Todo
-	json.NewDecoder(w.Body).Decode(&todos)
-	if len(todos) != 0 {
-		t.Errorf("expected 0 todos initially, got %d", len(todos))
-	}
-
-	// 2. Add a todo
-	newTodo := app.Todo{Task: "Buy groceries"}
-	body, _ := json.Marshal(newTodo)
-	req = httptest.NewRequest(http.MethodPost, "/todos", bytes.NewBuffer(body))
-	req.Header.Set("Content-Type", "application/json")
-	w = httptest.NewRecorder()
-	app.AddTodo(w, req)
-
-	var created app.Todo
-	json.NewDecoder(w.Body).Decode(&created)
-	todoID := created.ID
-
-	// 3. Verify it appears in the list
-	req = httptest.NewRequest(http.MethodGet, "/todos", nil)
-	w = httptest.NewRecorder()
-	app.GetTodos(w, req)
-
-	json.NewDecoder(w.Body).Decode(&todos)
-	if len(todos) != 1 {
-		t.Errorf("expected 1 todo after adding, got %d", len(todos))
-	}
-
-	// 4. Mark it as completed
-	update := app.Todo{Completed: true}
-	body, _ = json.Marshal(update)
-	req = httptest.NewRequest(http.MethodPut, fmt.Sprintf("/todos/%d", todoID), bytes.NewBuffer(body))
-	req.Header.Set("Content-Type", "application/json")
-	w = httptest.NewRecorder()
-	app.UpdateTodo(w, req, todoID)
-
-	// 5. Verify it's completed
-	req = httptest.NewRequest(http.MethodGet, "/todos", nil)
-	w = httptest.NewRecorder()
-	app.GetTodos(w, req)
-
-	json.NewDecoder(w.Body).Decode(&todos)
-	if !todos[0].Completed {
-		t.Error("expected todo to be completed")
-	}
-
-	// 6. Delete it
-	req = httptest.NewRequest(http.MethodDelete, fmt.Sprintf("/todos/%d", todoID), nil)
-	w = httptest.NewRecorder()
-	app.DeleteTodo(w, req, todoID)
-
-	// 7. Verify it's gone
-	req = httptest.NewRequest(http.MethodGet, "/todos", nil)
-	w = httptest.NewRecorder()
-	app.GetTodos(w, req)
-
-	json.NewDecoder(w.Body).Decode(&todos)
-	if len(todos) != 0 {
-		t.Errorf("expected 0 todos after deleting, got %d", len(todos))
-	}
+// TestIntegrationTodoBehavior runs the shared handler suite against Postgres.
+func TestIntegrationTodoBehavior(t *testing.T) {
+	runTodoBehaviorTests(t, func(t *testing.T) *app.Server {
+		cleanupTodos(t)
+		return testSrv
+	})
 }
 
 // TestIntegrationHealthCheck tests the health check with real database
@@ -358,7 +134,7 @@ func TestIntegrationHealthCheck(t *testing.T) {
 	req := httptest.NewRequest(http.MethodGet, "/healthz", nil)
 	w := httptest.NewRecorder()
 
-	app.HealthzHandler(w, req)
+	testSrv.HealthzHandler(w, req)
 
 	if w.Code != http.StatusOK {
 		t.Errorf("expected status %d, got %d", http.StatusOK, w.Code)
@@ -8,14 +8,18 @@ import (
 	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"html/template"
 	"log/slog"
 	"net/http"
+	"net/url"
 	"os"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
+	"unicode/utf8"
 
 	secretmanager "cloud.google.com/go/secretmanager/apiv1"
 	"cloud.google.com/go/secretmanager/apiv1/secretmanagerpb"
@@ -70,13 +74,67 @@ var (
 			Help: "Total number of todos deleted",
 		},
 	)
+	TodosPurged = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "todos_purged_total",
+			Help: "Total number of deleted todos purged from the trash",
+		},
+	)
+	IdempotentReplays = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "idempotent_replays_total",
+			Help: "Total number of todo creations replayed for a repeated Idempotency-Key",
+		},
+	)
 )
 
-// Todo represents a single todo item.
+// Todo represents a single todo item. CreatedAt, UpdatedAt, CompletedAt,
+// DeletedAt, ChildCount, OpenBlockers and Version are managed by the store,
+// Tags through /todos/{id}/tags and Position through /todos/{id}/move;
+// values sent by clients are ignored. ListID defaults to the parent's list, or the
+// default list, on create and to the current list on update.
+//
+// A todo with a ParentID is a subtask. If its parent has AutoComplete set,
+// the parent is completed when all its subtasks are and reopened when one is
+// reopened or added.
+//
+// OpenBlockers counts the incomplete todos, set through
+// /todos/{id}/blockers, that must be completed before this one can be.
+//
+// A todo with a Recurrence (an RRULE, see parseRecurrence) repeats from its
+// DueAt in RecurrenceTZ: completing it creates the next occurrence, which
+// takes over the rule.
+//
+// Position orders todos manually (sort=position); see positionBetween. New
+// todos go last.
+//
+// Deleting a todo moves it to the trash and sets DeletedAt; it can be
+// restored until PurgeTrash deletes it for good.
+//
+// Version starts at 1 and goes up by one with every change to the todo,
+// whenever its history gets an event. It is the todo's ETag, so clients can
+// make changes conditional on If-Match.
 type Todo struct {
-	ID        int    `json:"id"`
-	Task      string `json:"task"`
-	Completed bool   `json:"completed"`
+	ID           int        `json:"id"`
+	ListID       int        `json:"list_id"`
+	ParentID     *int       `json:"parent_id"`
+	Task         string     `json:"task"`
+	Completed    bool       `json:"completed"`
+	DueAt        *time.Time `json:"due_at"`
+	Priority     Priority   `json:"priority"`
+	Notes        string     `json:"notes"`
+	AutoComplete bool       `json:"auto_complete"`
+	Recurrence   string     `json:"recurrence"`
+	RecurrenceTZ string     `json:"recurrence_tz"`
+	Position     string     `json:"position"`
+	ChildCount   int        `json:"child_count"`
+	OpenBlockers int        `json:"open_blockers"`
+	CreatedAt    time.Time  `json:"created_at"`
+	UpdatedAt    time.Time  `json:"updated_at"`
+	CompletedAt  *time.Time `json:"completed_at"`
+	DeletedAt    *time.Time `json:"deleted_at"`
+	Tags         []Tag      `json:"tags"`
+	Version      int        `json:"version"`
 }
 
 // DBConfig holds database connection parameters.
@@ -93,15 +151,12 @@ type DBConfig struct {
 	DBReadPort string `json:"db_read_port"` // Read replica port (5433)
 }
 
-// Database connection pools:
-// - DB: Primary connection for writes (INSERT, UPDATE, DELETE) and failover reads
-// - DBRead: Read replica connection for SELECT queries (improves performance and availability)
-var (
-	DB     *sql.DB // Primary database connection
-	DBRead *sql.DB // Read replica connection (or falls back to primary if replica unavailable)
+// PrimaryURL returns the connection URL of the primary database.
+func (c DBConfig) PrimaryURL() string {
+	return fmt.Sprintf("postgres://%s:dummy-password@%s:%s/%s?sslmode=disable", c.DBUser, c.DBHost, c.DBPort, c.DBName)
+}
 
-	BackoffStrategy backoff.BackOff // Global variable to allow injecting a custom backoff for testing
-)
+var BackoffStrategy backoff.BackOff // Global variable to allow injecting a custom backoff for testing
 
 // Circuit Breaker provides fault tolerance by preventing requests to a failing service.
 // This protects the application from cascading failures when the database is consistently unavailable.
@@ -140,17 +195,44 @@ func init() {
 // 1. Circuit Breaker: Fails fast if database is consistently down (prevents cascading failures)
 // 2. Exponential Backoff: Retries transient errors with increasing delays
 //
+// Expected errors (see isExpected), such as a missing todo, are returned
+// immediately: they are answers, not signs of an unhealthy database, so they
+// are neither retried nor counted against the circuit breaker.
+//
 // Returns:
 // - nil on success
 // - gobreaker.ErrOpenState if circuit is open (HTTP handlers should return 503)
+// - an expected error from op, unchanged
 // - underlying error if retries exhausted
 func ExecuteWithRobustness(op func() error) error {
+	var expected error
 	_, err := CB.Execute(func() (interface{}, error) {
-		return nil, RetryOperation(op)
+		err := RetryOperation(func() error {
+			err := op()
+			if isExpected(err) {
+				return backoff.Permanent(err)
+			}
+			return err
+		})
+		if isExpected(err) {
+			expected = err
+			return nil, nil
+		}
+		return nil, err
 	})
+	if expected != nil {
+		return expected
+	}
 	return err
 }
 
+// isExpected reports whether err is a normal outcome of a request rather
+// than a storage failure.
+func isExpected(err error) bool {
+	return errors.Is(err, ErrNotFound) || errors.Is(err, ErrListNotFound) || errors.Is(err, ErrTagNotFound) ||
+		errors.Is(err, ErrInvalidInput) || errors.Is(err, ErrConflict) || errors.Is(err, ErrPreconditionFailed)
+}
+
 // RetryOperation implements exponential backoff retry logic for database operations.
 // This handles transient failures like:
 // - Network blips
@@ -227,16 +309,53 @@ func SecurityHeadersMiddleware(next http.Handler) http.Handler {
 		next.ServeHTTP(rw, r)
 		duration := time.Since(start).Seconds()
 
-		path := r.URL.Path
-		if strings.HasPrefix(path, "/todos/") && len(path) > 7 {
-			path = "/todos/:id"
-		}
+		path := metricPath(r.URL.Path)
 
 		HTTPRequestsTotal.WithLabelValues(path, r.Method, strconv.Itoa(rw.StatusCode)).Inc()
 		HTTPRequestDuration.WithLabelValues(path, r.Method).Observe(duration)
 	})
 }
 
+// apiRoutes are the routes below the API collections, with ids replaced by ":id".
+var apiRoutes = map[string]bool{
+	"/todos/:id":              true,
+	"/todos/search":           true,
+	"/todos/events":           true,
+	"/todos/:id/tags/:id":     true,
+	"/todos/:id/blockers":     true,
+	"/todos/:id/blockers/:id": true,
+	"/todos/:id/move":         true,
+	"/todos/:id/restore":      true,
+	"/todos/:id/history":      true,
+	"/lists/:id":              true,
+	"/lists/:id/todos":        true,
+	"/tags/:id":               true,
+}
+
+// apiCollections are the top-level API paths with subroutes.
+var apiCollections = map[string]bool{"todos": true, "lists": true, "tags": true}
+
+// metricPath normalizes a request path for the path label, replacing numeric
+// segments with ":id", e.g. /todos/42 -> /todos/:id. Unknown paths under a
+// collection such as /todos/ collapse to /todos/:id to keep the label's
+// cardinality bounded.
+func metricPath(path string) string {
+	collection, rest, ok := strings.Cut(strings.TrimPrefix(path, "/"), "/")
+	if !ok || rest == "" || !apiCollections[collection] {
+		return path
+	}
+	segments := strings.Split(path, "/")
+	for i, seg := range segments {
+		if seg != "" && strings.Trim(seg, "0123456789") == "" {
+			segments[i] = ":id"
+		}
+	}
+	if normalized := strings.Join(segments, "/"); apiRoutes[normalized] {
+		return normalized
+	}
+	return "/" + collection + "/:id"
+}
+
 type responseWriter struct {
 	http.ResponseWriter
 	StatusCode int // Exported
@@ -251,6 +370,12 @@ func (rw *responseWriter) WriteHeader(code int) {
 	rw.ResponseWriter.WriteHeader(code)
 }
 
+// Unwrap returns the wrapped writer, so http.ResponseController can flush
+// event streams through the middleware.
+func (rw *responseWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
+
 // InitDB establishes connections to both primary and read replica databases.
 // This dual-connection architecture provides:
 // - Write scaling: All writes go to primary
@@ -261,17 +386,17 @@ func (rw *responseWriter) WriteHeader(code int) {
 // - IAM authentication (no passwords needed)
 // - TLS encryption
 // - Connection pooling
-func InitDB(config DBConfig) {
-	var err error
-
+//
+// The returned replica pool is the primary itself when no replica is
+// configured or reachable.
+func InitDB(config DBConfig) (primary, replica *sql.DB, err error) {
 	dbUser := config.DBUser
 	dbName := config.DBName
-	dbHost := config.DBHost
 	dbPort := config.DBPort
 
 	// ===== PRIMARY DATABASE CONNECTION =====
 	// The primary database handles all writes and serves as fallback for reads
-	connStr := fmt.Sprintf("postgres://%s:dummy-password@%s:%s/%s?sslmode=disable", dbUser, dbHost, dbPort, dbName)
+	connStr := config.PrimaryURL()
 	slog.Info("Connecting to PRIMARY database", "url", connStr)
 
 	// Use longer retry timeout for initial connection (allows Cloud SQL Proxy to start)
@@ -279,11 +404,11 @@ func InitDB(config DBConfig) {
 	b.MaxElapsedTime = 2 * time.Minute
 
 	op := func() error {
-		DB, err = sql.Open("postgres", connStr)
+		primary, err = sql.Open("postgres", connStr)
 		if err != nil {
 			return err
 		}
-		return DB.Ping()
+		return primary.Ping()
 	}
 
 	err = backoff.RetryNotify(op, b, func(err error, d time.Duration) {
@@ -291,68 +416,116 @@ func InitDB(config DBConfig) {
 	})
 
 	if err != nil {
-		slog.Error("Could not connect to the PRIMARY database", "error", err)
-		os.Exit(1)
+		return nil, nil, fmt.Errorf("could not connect to the PRIMARY database: %w", err)
 	}
 	slog.Info("Successfully connected to PRIMARY database")
 
 	// ===== READ REPLICA CONNECTION (OPTIONAL) =====
 	// Read replica improves performance by offloading SELECT queries from primary.
 	// If connection fails, we gracefully fall back to primary for all operations.
-	if config.DBReadHost != "" {
-		dbReadHost := config.DBReadHost
-		dbReadPort := config.DBReadPort
-		if dbReadPort == "" {
-			dbReadPort = dbPort
-		}
+	if config.DBReadHost == "" {
+		// No read replica configured in secrets
+		slog.Info("No Read Replica configured, using PRIMARY for reads")
+		return primary, primary, nil
+	}
 
-		readConnStr := fmt.Sprintf("postgres://%s:dummy-password@%s:%s/%s?sslmode=disable", dbUser, dbReadHost, dbReadPort, dbName)
-		slog.Info("Connecting to READ REPLICA", "url", readConnStr)
+	dbReadHost := config.DBReadHost
+	dbReadPort := config.DBReadPort
+	if dbReadPort == "" {
+		dbReadPort = dbPort
+	}
 
-		opRead := func() error {
-			DBRead, err = sql.Open("postgres", readConnStr)
-			if err != nil {
-				return err
-			}
-			return DBRead.Ping()
+	readConnStr := fmt.Sprintf("postgres://%s:dummy-password@%s:%s/%s?sslmode=disable", dbUser, dbReadHost, dbReadPort, dbName)
+	slog.Info("Connecting to READ REPLICA", "url", readConnStr)
+
+	opRead := func() error {
+		replica, err = sql.Open("postgres", readConnStr)
+		if err != nil {
+			return err
 		}
+		return replica.Ping()
+	}
 
-		// We can be more lenient with Read Replica connection failure
-		// since we can fall back to primary
-		err = backoff.RetryNotify(opRead, b, func(err error, d time.Duration) {
-			slog.Warn("Could not connect to READ REPLICA, retrying...", "error", err, "duration", d)
-		})
+	// We can be more lenient with Read Replica connection failure
+	// since we can fall back to primary
+	err = backoff.RetryNotify(opRead, b, func(err error, d time.Duration) {
+		slog.Warn("Could not connect to READ REPLICA, retrying...", "error", err, "duration", d)
+	})
+
+	if err != nil {
+		// Read replica unavailable - not fatal, fall back to primary
+		slog.Error("Could not connect to READ REPLICA, falling back to PRIMARY", "error", err)
+		return primary, primary, nil
+	}
+	slog.Info("Successfully connected to READ REPLICA")
+	return primary, replica, nil
+}
 
+// ConnectURL opens a single Postgres connection pool from a URL such as
+// DATABASE_URL, retrying while the database comes up. It is used where
+// Secret Manager isn't available: docker-compose and the migrate job.
+func ConnectURL(connStr string) (*sql.DB, error) {
+	b := backoff.NewExponentialBackOff()
+	b.MaxElapsedTime = 2 * time.Minute
+
+	var db *sql.DB
+	op := func() error {
+		var err error
+		db, err = sql.Open("postgres", connStr)
 		if err != nil {
-			// Read replica unavailable - not fatal, fall back to primary
-			slog.Error("Could not connect to READ REPLICA, falling back to PRIMARY", "error", err)
-			DBRead = DB // Fallback to primary for reads
-		} else {
-			slog.Info("Successfully connected to READ REPLICA")
+			return err
 		}
-	} else {
-		// No read replica configured in secrets
-		slog.Info("No Read Replica configured, using PRIMARY for reads")
-		DBRead = DB
+		return db.Ping()
+	}
+
+	err := backoff.RetryNotify(op, b, func(err error, d time.Duration) {
+		slog.Warn("Could not connect to database, retrying...", "error", err, "duration", d)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not connect to the database: %w", err)
 	}
+	return db, nil
+}
+
+// Server holds the dependencies of the HTTP handlers.
+// Handlers are methods on Server so several independent instances (each
+// with its own Store) can coexist in one process. Each handler reaches the
+// store through the role it needs.
+type Server struct {
+	todos    TodoStore
+	search   SearchStore
+	keys     IdempotencyStore
+	trash    TrashStore
+	blockers BlockerStore
+	batch    BatchStore
+	history  EventStore
+	lists    ListStore
+	tags     TagStore
+	events   *eventHub
 }
 
-func HealthzHandler(w http.ResponseWriter, r *http.Request) {
-	if DB == nil {
-		http.Error(w, "Database connection not initialized", http.StatusInternalServerError)
+// NewServer creates a Server backed by the given store.
+func NewServer(store Store) *Server {
+	return &Server{
+		todos: store, search: store, keys: store, trash: store, blockers: store,
+		batch: store, history: store, lists: store, tags: store,
+		events: newEventHub(store),
+	}
+}
+
+func (s *Server) HealthzHandler(w http.ResponseWriter, r *http.Request) {
+	if s.todos == nil {
+		writeProblem(w, r, http.StatusServiceUnavailable, CodeDBUnavailable, "Database connection not initialized.")
 		return
 	}
-	if err := DB.Ping(); err != nil {
-		http.Error(w, "Database connection failed: "+err.Error(), http.StatusInternalServerError)
+	if err := s.todos.Ping(r.Context()); err != nil {
+		slog.Error("Health check ping failed", "error", err, "request_id", RequestIDFromContext(r.Context()))
+		writeProblem(w, r, http.StatusServiceUnavailable, CodeDBUnavailable, "Database connection failed.")
 		return
 	}
-	// Check Read Replica too if distinct
-	if DBRead != DB && DBRead != nil {
-		if err := DBRead.Ping(); err != nil {
-			slog.Warn("Read Replica ping failed", "error", err)
-			// Don't fail health check if only read replica is down?
-			// Or maybe we should? For now, let's just log it.
-		}
+	if r.URL.Query().Has("detail") {
+		s.writeHealthDetail(w, r)
+		return
 	}
 	w.WriteHeader(http.StatusOK)
 	if _, err := w.Write([]byte("OK")); err != nil {
@@ -360,6 +533,37 @@ func HealthzHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// HealthDetail is the body of /healthz?detail, for humans and dashboards.
+// Probes should keep using plain /healthz.
+type HealthDetail struct {
+	Status string        `json:"status"`
+	Schema *SchemaStatus `json:"schema,omitempty"`
+}
+
+// SchemaStatus reports the applied migration version against the newest one
+// this binary ships with.
+type SchemaStatus struct {
+	Version int `json:"version"`
+	Latest  int `json:"latest"`
+}
+
+func (s *Server) writeHealthDetail(w http.ResponseWriter, r *http.Request) {
+	detail := HealthDetail{Status: "ok"}
+	if reporter, ok := s.todos.(SchemaReporter); ok {
+		current, latest, err := reporter.SchemaVersion(r.Context())
+		if err != nil {
+			slog.Warn("Failed to read schema version", "error", err)
+		} else {
+			detail.Schema = &SchemaStatus{Version: current, Latest: latest}
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(detail); err != nil {
+		slog.Error("Failed to write health check response", "error", err)
+	}
+}
+
 type IndexData struct {
 	ClusterName string
 	Region      string
@@ -371,7 +575,7 @@ func ServeIndex(w http.ResponseWriter, r *http.Request) {
 	tmpl, err := template.ParseFiles("templates/index.html")
 	if err != nil {
 		slog.Error("Failed to parse template", "error", err)
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		writeProblem(w, r, http.StatusInternalServerError, CodeInternal, "")
 		return
 	}
 
@@ -392,159 +596,484 @@ func ServeIndex(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func HandleTodos(w http.ResponseWriter, r *http.Request) {
+func (s *Server) HandleTodos(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case http.MethodGet:
-		GetTodos(w, r)
+		s.GetTodos(w, r)
 	case http.MethodPost:
-		AddTodo(w, r)
+		s.AddTodo(w, r)
 	default:
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		writeMethodNotAllowed(w, r, http.MethodGet, http.MethodPost)
 	}
 }
 
-func HandleTodo(w http.ResponseWriter, r *http.Request) {
-	id, err := strconv.Atoi(r.URL.Path[len("/todos/"):])
+func (s *Server) HandleTodo(w http.ResponseWriter, r *http.Request) {
+	idPart, sub, _ := strings.Cut(r.URL.Path[len("/todos/"):], "/")
+	id, err := strconv.Atoi(idPart)
 	if err != nil {
-		http.Error(w, "Invalid todo ID", http.StatusBadRequest)
+		writeProblem(w, r, http.StatusBadRequest, CodeValidationFailed, "Todo id must be an integer.")
+		return
+	}
+	if sub != "" {
+		if tagPart, ok := strings.CutPrefix(sub, "tags/"); ok {
+			s.HandleTodoTag(w, r, id, tagPart)
+		} else if sub == "blockers" {
+			s.HandleTodoBlockers(w, r, id)
+		} else if blockerPart, ok := strings.CutPrefix(sub, "blockers/"); ok {
+			s.HandleTodoBlocker(w, r, id, blockerPart)
+		} else if sub == "move" {
+			s.HandleTodoMove(w, r, id)
+		} else if sub == "restore" {
+			s.HandleTodoRestore(w, r, id)
+		} else if sub == "history" {
+			s.HandleTodoHistory(w, r, id)
+		} else {
+			writeProblem(w, r, http.StatusNotFound, CodeNotFound, "")
+		}
 		return
 	}
 
 	switch r.Method {
+	case http.MethodGet:
+		s.GetTodo(w, r, id)
 	case http.MethodPut:
-		UpdateTodo(w, r, id)
+		s.UpdateTodo(w, r, id)
+	case http.MethodPatch:
+		s.PatchTodo(w, r, id)
 	case http.MethodDelete:
-		DeleteTodo(w, r, id)
+		s.DeleteTodo(w, r, id)
 	default:
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		writeMethodNotAllowed(w, r, http.MethodGet, http.MethodPut, http.MethodPatch, http.MethodDelete)
 	}
 }
 
-// GetTodos retrieves all todo items from the database.
-// Uses DBRead (read replica) to offload SELECT queries from the primary database.
-// This improves performance and allows the primary to focus on writes.
+// GetTodos retrieves a page of todo items from the store.
+// For Postgres this reads from the replica with primary fallback, with
+// automatic retries and circuit breaking handled by the store.
 //
-// Robustness features:
-// - Automatic retries on transient errors (network blips, etc.)
-// - Circuit breaker prevents cascading failures
-// - Falls back to primary if read replica is unavailable
-func GetTodos(w http.ResponseWriter, r *http.Request) {
-	var todos []Todo
-
-	err := ExecuteWithRobustness(func() error {
-		// Try read replica first
-		rows, err := DBRead.Query("SELECT id, task, completed FROM todos ORDER BY id")
+// The body is a JSON array; when more todos exist, the next page's cursor is
+// returned in X-Next-Cursor and as a Link header with rel="next".
+func (s *Server) GetTodos(w http.ResponseWriter, r *http.Request) {
+	opts, err := parseListOptions(r.URL.Query())
+	if err != nil {
+		writeInputError(w, r, err)
+		return
+	}
+	s.listTodos(w, r, opts)
+}
+
+// listTodos writes the page of todos selected by opts, with next links that
+// repeat the request's query. The page's ETag is the store's revision, and
+// its Last-Modified the time of that revision's change, so a client polling
+// with If-None-Match gets 304 from a single-row read until something
+// changes. A client that has seen a newer revision than a lagging replica's
+// is answered from the primary rather than sent back in time. Pages relative
+// to the current time, like overdue todos, change without any change to the
+// store, so they get neither.
+func (s *Server) listTodos(w http.ResponseWriter, r *http.Request, opts ListOptions) {
+	cacheable := opts.DueFrom == nil && opts.DueBefore == nil
+	if cacheable && r.Header.Get("If-None-Match") != "" {
+		revision, err := s.history.Revision(r.Context())
 		if err != nil {
-			slog.Warn("Read replica failed, falling back to primary", "error", err)
-			// If read replica fails, fall back to primary
-			if DBRead != DB {
-				rows, err = DB.Query("SELECT id, task, completed FROM todos ORDER BY id")
-			}
+			writeStoreError(w, r, err)
+			return
+		}
+		if etag := listETag(revision); ifNoneMatch(r, etag) {
+			writeNotModified(w, etag)
+			return
+		}
+		opts.MinRevision = knownRevision(r)
+	}
+
+	page, err := s.todos.List(r.Context(), opts)
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+	if cacheable && opts.MinRevision > 0 {
+		if etag := listETag(page.Revision); ifNoneMatch(r, etag) {
+			writeNotModified(w, etag)
+			return
+		}
+	}
+
+	if page.HasMore && len(page.Todos) > 0 {
+		next := NewCursor(opts.Sort, page.Todos[len(page.Todos)-1]).Encode()
+		q := r.URL.Query()
+		q.Set("cursor", next)
+		w.Header().Set("X-Next-Cursor", next)
+		w.Header().Set("Link", fmt.Sprintf(`<%s?%s>; rel="next"`, r.URL.Path, q.Encode()))
+	}
+	if cacheable {
+		w.Header().Set("ETag", listETag(page.Revision))
+		if !page.Modified.IsZero() {
+			w.Header().Set("Last-Modified", page.Modified.Format(http.TimeFormat))
+		}
+	}
+	// Todos are private, and caches must check they are current before
+	// reusing them.
+	w.Header().Set("Cache-Control", "private, no-cache")
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(page.Todos); err != nil {
+		slog.Error("Failed to encode todos", "error", err)
+	}
+}
+
+// writeNotModified answers a conditional list request whose copy is current.
+func writeNotModified(w http.ResponseWriter, etag string) {
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "private, no-cache")
+	w.WriteHeader(http.StatusNotModified)
+}
+
+// parseListOptions reads the GET /todos query parameters: limit, cursor,
+// list_id, parent_id, top_level, completed, ready, due, tz, tag, tag_mode, q
+// and sort. Every invalid parameter is reported in the
+// returned *ValidationError.
+func parseListOptions(q url.Values) (ListOptions, error) {
+	opts := ListOptions{Limit: DefaultPageSize, Query: strings.TrimSpace(q.Get("q"))}
+	var fields []FieldError
+
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > MaxPageSize {
+			fields = append(fields, FieldError{"limit", fmt.Sprintf("must be an integer from 1 to %d", MaxPageSize)})
+		} else {
+			opts.Limit = n
+		}
+	}
+
+	if v := q.Get("list_id"); v != "" {
+		id, err := strconv.Atoi(v)
+		if err != nil || id < 1 {
+			fields = append(fields, FieldError{"list_id", "must be a positive integer"})
+		} else {
+			opts.ListID = id
 		}
+	}
 
+	if v := q.Get("parent_id"); v != "" {
+		id, err := strconv.Atoi(v)
+		if err != nil || id < 1 {
+			fields = append(fields, FieldError{"parent_id", "must be a positive integer"})
+		} else {
+			opts.ParentID = &id
+		}
+	}
+	if v := q.Get("top_level"); v != "" {
+		topLevel, err := strconv.ParseBool(v)
+		switch {
+		case err != nil:
+			fields = append(fields, FieldError{"top_level", "must be true or false"})
+		case topLevel && opts.ParentID != nil:
+			fields = append(fields, FieldError{"top_level", "can't be combined with parent_id"})
+		default:
+			opts.TopLevel = topLevel
+		}
+	}
+
+	if v := q.Get("completed"); v != "" {
+		completed, err := strconv.ParseBool(v)
 		if err != nil {
-			return err
+			fields = append(fields, FieldError{"completed", "must be true or false"})
+		} else {
+			opts.Completed = &completed
+		}
+	}
+	if v := q.Get("ready"); v != "" {
+		ready, err := strconv.ParseBool(v)
+		if err != nil {
+			fields = append(fields, FieldError{"ready", "must be true or false"})
+		} else {
+			opts.Ready = &ready
 		}
-		defer rows.Close()
+	}
 
-		todos = []Todo{} // Reset slice on retry to avoid duplicates
-		for rows.Next() {
-			var t Todo
-			if err := rows.Scan(&t.ID, &t.Task, &t.Completed); err != nil {
-				return err
-			}
-			todos = append(todos, t)
+	for _, name := range q["tag"] {
+		if name = normalizeTagName(name); name != "" && !slices.Contains(opts.Tags, name) {
+			opts.Tags = append(opts.Tags, name)
 		}
-		return rows.Err()
-	})
+	}
+	if len(opts.Tags) > MaxFilterTags {
+		fields = append(fields, FieldError{"tag", fmt.Sprintf("must be given at most %d times", MaxFilterTags)})
+	}
+	switch q.Get("tag_mode") {
+	case "", "all":
+	case "any":
+		opts.AnyTag = true
+	default:
+		fields = append(fields, FieldError{"tag_mode", "must be all or any"})
+	}
+
+	if utf8.RuneCountInString(opts.Query) > MaxTaskLength {
+		fields = append(fields, FieldError{"q", fmt.Sprintf("must be at most %d characters", MaxTaskLength)})
+	}
 
+	loc := time.UTC
+	if v := q.Get("tz"); v != "" {
+		var err error
+		if loc, err = time.LoadLocation(v); err != nil {
+			loc = time.UTC
+			fields = append(fields, FieldError{"tz", "must be an IANA time zone name"})
+		}
+	}
+	switch due := q.Get("due"); due {
+	case "":
+	case "overdue":
+		// Completed todos are never overdue.
+		if opts.Completed != nil && *opts.Completed {
+			fields = append(fields, FieldError{"due", "overdue todos are never completed"})
+		}
+		incomplete, before := false, now()
+		opts.Completed, opts.DueBefore = &incomplete, &before
+	case "this_week":
+		from, before := weekOf(now().In(loc))
+		opts.DueFrom, opts.DueBefore = &from, &before
+	default:
+		fields = append(fields, FieldError{"due", "must be overdue or this_week"})
+	}
+
+	sort, err := ParseSort(q.Get("sort"))
 	if err != nil {
-		if err == gobreaker.ErrOpenState {
-			http.Error(w, "Service Unavailable (Circuit Breaker Open)", http.StatusServiceUnavailable)
+		fields = append(fields, FieldError{"sort", err.Error()})
+	} else {
+		opts.Sort = sort
+		if v := q.Get("cursor"); v != "" {
+			if opts.After, err = DecodeCursor(v, sort); err != nil {
+				fields = append(fields, FieldError{"cursor", err.Error()})
+			}
+		}
+	}
+
+	if len(fields) > 0 {
+		return opts, &ValidationError{Fields: fields}
+	}
+	return opts, nil
+}
+
+// weekOf returns the start of the week (Monday 00:00) containing t, in t's
+// location, and the start of the following week, both in UTC.
+func weekOf(t time.Time) (start, next time.Time) {
+	daysSinceMonday := (int(t.Weekday()) + 6) % 7
+	y, m, d := t.Date()
+	monday := time.Date(y, m, d-daysSinceMonday, 0, 0, 0, 0, t.Location())
+	return monday.UTC(), monday.AddDate(0, 0, 7).UTC()
+}
+
+// SearchTodos handles GET /todos/search?q=, returning ranked matches with
+// highlighted snippets. Like GetTodos it reads from the replica with primary
+// fallback, behind the same retries and circuit breaker.
+func (s *Server) SearchTodos(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeMethodNotAllowed(w, r, http.MethodGet)
+		return
+	}
+
+	q := r.URL.Query()
+	query := strings.TrimSpace(q.Get("q"))
+	limit := DefaultSearchLimit
+	var fields []FieldError
+	if query == "" {
+		fields = append(fields, FieldError{"q", "must not be empty"})
+	} else if utf8.RuneCountInString(query) > MaxTaskLength {
+		fields = append(fields, FieldError{"q", fmt.Sprintf("must be at most %d characters", MaxTaskLength)})
+	}
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > MaxPageSize {
+			fields = append(fields, FieldError{"limit", fmt.Sprintf("must be an integer from 1 to %d", MaxPageSize)})
 		} else {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			limit = n
 		}
+	}
+	if len(fields) > 0 {
+		writeInputError(w, r, &ValidationError{Fields: fields})
+		return
+	}
+
+	results, err := s.search.Search(r.Context(), query, limit)
+	if err != nil {
+		writeStoreError(w, r, err)
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(todos); err != nil {
-		slog.Error("Failed to encode todos", "error", err)
+	if err := json.NewEncoder(w).Encode(results); err != nil {
+		slog.Error("Failed to encode search results", "error", err)
 	}
 }
 
-func AddTodo(w http.ResponseWriter, r *http.Request) {
+// GetTodo retrieves a single todo item. Like GetTodos it reads from the
+// replica with primary fallback, behind the same retries and circuit breaker.
+func (s *Server) GetTodo(w http.ResponseWriter, r *http.Request, id int) {
+	t, err := s.todos.Get(r.Context(), id)
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+
+	w.Header().Set("ETag", todoETag(t.Version))
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(t); err != nil {
+		slog.Error("Failed to encode todo", "error", err)
+	}
+}
+
+func (s *Server) AddTodo(w http.ResponseWriter, r *http.Request) {
+	s.addTodo(w, r, 0)
+}
+
+// addTodo creates a todo from the request body, in listID if it is non-zero
+// and otherwise in the list the body names, or the default list. Requests
+// with an Idempotency-Key create their todo only once.
+func (s *Server) addTodo(w http.ResponseWriter, r *http.Request, listID int) {
 	slog.Info("addTodo called", "method", r.Method, "path", r.URL.Path)
 
+	key, ok := idempotencyKey(r)
+	if !ok {
+		writeProblem(w, r, http.StatusBadRequest, CodeValidationFailed,
+			"Idempotency-Key must be 1 to 255 visible ASCII characters.")
+		return
+	}
 	var t Todo
-	if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
-		slog.Error("Failed to decode request body", "error", err)
-		http.Error(w, err.Error(), http.StatusBadRequest)
+	if err := decodeTodo(w, r, &t); err != nil {
+		slog.Warn("Rejected todo", "error", err)
+		writeInputError(w, r, err)
 		return
 	}
+	if listID != 0 {
+		t.ListID = listID
+	}
 
 	slog.Info("Decoded todo", "task", t.Task)
 
-	err := ExecuteWithRobustness(func() error {
-		return DB.QueryRow("INSERT INTO todos (task) VALUES ($1) RETURNING id, completed", t.Task).Scan(&t.ID, &t.Completed)
-	})
-
+	if key != "" {
+		s.addTodoOnce(w, r, key, t)
+		return
+	}
+	t, err := s.todos.Create(r.Context(), t)
 	if err != nil {
 		slog.Error("Failed to insert todo", "error", err, "task", t.Task)
-		if err == gobreaker.ErrOpenState {
-			http.Error(w, "Service Unavailable (Circuit Breaker Open)", http.StatusServiceUnavailable)
-		} else {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-		}
+		writeStoreError(w, r, err)
 		return
 	}
 
 	slog.Info("Successfully added todo", "id", t.ID, "task", t.Task)
+	writeCreatedTodo(w, t)
+	TodosAdded.Inc()
+}
+
+func writeCreatedTodo(w http.ResponseWriter, t Todo) {
+	w.Header().Set("ETag", todoETag(t.Version))
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusCreated)
 	if err := json.NewEncoder(w).Encode(t); err != nil {
 		slog.Error("Failed to encode todo", "error", err)
 	}
-	TodosAdded.Inc()
 }
 
-func UpdateTodo(w http.ResponseWriter, r *http.Request, id int) {
-	var t Todo
-	if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+// decodeTodo reads, strictly decodes and validates a Todo request body.
+func decodeTodo(w http.ResponseWriter, r *http.Request, t *Todo) error {
+	data, err := readBody(w, r)
+	if err != nil {
+		return err
+	}
+	if err := decodeStrict(data, t); err != nil {
+		return err
+	}
+	return t.Validate()
+}
+
+// UpdateTodo replaces all mutable fields of a todo (PUT semantics) and
+// returns the updated todo. With If-Match, a todo whose ETag doesn't match
+// is left alone and 412 returned.
+func (s *Server) UpdateTodo(w http.ResponseWriter, r *http.Request, id int) {
+	var body Todo
+	if err := decodeTodo(w, r, &body); err != nil {
+		writeInputError(w, r, err)
 		return
 	}
 
-	err := ExecuteWithRobustness(func() error {
-		_, err := DB.Exec("UPDATE todos SET completed = $1 WHERE id = $2", t.Completed, id)
-		return err
+	cond := ifMatch(r)
+	t, err := s.todos.Update(r.Context(), id, func(t *Todo) error {
+		if err := cond.check(t.Version); err != nil {
+			return err
+		}
+		t.ListID = body.ListID
+		t.ParentID = body.ParentID
+		t.AutoComplete = body.AutoComplete
+		t.Recurrence, t.RecurrenceTZ = body.Recurrence, body.RecurrenceTZ
+		t.Task = body.Task
+		t.Completed = body.Completed
+		t.DueAt = body.DueAt
+		t.Priority = body.Priority
+		t.Notes = body.Notes
+		return nil
 	})
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
 
+	writeUpdatedTodo(w, t)
+}
+
+// PatchTodo updates only the fields present in a JSON Merge Patch body
+// (RFC 7396) and returns the updated todo. If-Match works as for
+// UpdateTodo.
+func (s *Server) PatchTodo(w http.ResponseWriter, r *http.Request, id int) {
+	data, err := readBody(w, r)
 	if err != nil {
-		if err == gobreaker.ErrOpenState {
-			http.Error(w, "Service Unavailable (Circuit Breaker Open)", http.StatusServiceUnavailable)
-		} else {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeInputError(w, r, err)
+		return
+	}
+	patch, err := ParseMergePatch(data)
+	if err != nil {
+		writeProblem(w, r, http.StatusBadRequest, CodeMalformedRequest, "Request body must be a JSON merge patch object.")
+		return
+	}
+
+	cond := ifMatch(r)
+	t, err := s.todos.Update(r.Context(), id, func(t *Todo) error {
+		if err := cond.check(t.Version); err != nil {
+			return err
 		}
+		return patch.Apply(t)
+	})
+	if err != nil {
+		writeStoreError(w, r, err)
 		return
 	}
 
+	writeUpdatedTodo(w, t)
+}
+
+func writeUpdatedTodo(w http.ResponseWriter, t Todo) {
+	w.Header().Set("ETag", todoETag(t.Version))
+	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(t); err != nil {
+		slog.Error("Failed to encode todo", "error", err)
+	}
 	TodosUpdated.Inc()
 }
 
-func DeleteTodo(w http.ResponseWriter, r *http.Request, id int) {
-	err := ExecuteWithRobustness(func() error {
-		_, err := DB.Exec("DELETE FROM todos WHERE id = $1", id)
-		return err
-	})
-
-	if err != nil {
-		if err == gobreaker.ErrOpenState {
-			http.Error(w, "Service Unavailable (Circuit Breaker Open)", http.StatusServiceUnavailable)
-		} else {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+// DeleteTodo moves a todo to the trash, from which it can be restored. A
+// todo with subtasks is only deleted, together with all its subtasks, if the
+// request says ?cascade=true; otherwise it is rejected with 409 so subtasks
+// are never deleted by surprise. If-Match works as for UpdateTodo.
+func (s *Server) DeleteTodo(w http.ResponseWriter, r *http.Request, id int) {
+	cascade := false
+	if v := r.URL.Query().Get("cascade"); v != "" {
+		var err error
+		if cascade, err = strconv.ParseBool(v); err != nil {
+			writeInputError(w, r, &ValidationError{Fields: []FieldError{{"cascade", "must be true or false"}}})
+			return
 		}
+	}
+
+	if err := s.todos.Delete(r.Context(), id, cascade, ifMatch(r)); err != nil {
+		writeStoreError(w, r, err)
 		return
 	}
 
@@ -0,0 +1,334 @@
+// Written by Gemini CLI
+// This file is licensed under the MIT License.
+// See the LICENSE file for details.
+
+package app
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+)
+
+// Operations in BatchOp.Op, and in the "op" member of a batch request.
+const (
+	BatchCreate         = "create"
+	BatchUpdate         = "update"
+	BatchDelete         = "delete"
+	BatchClearCompleted = "clear_completed"
+	BatchCompleteAll    = "complete_all"
+)
+
+// MaxBatchOperations caps the operations in one batch, so a batch can't
+// hold its transaction, and the rows it locks, for long.
+const MaxBatchOperations = 100
+
+// BatchOp is one operation of BatchStore.Batch. Which fields apply depends on
+// Op:
+//   - create inserts Todo, like Create.
+//   - update applies Update to the todo with ID, like Update.
+//   - delete trashes the todo with ID, like Delete with Cascade.
+//   - clear_completed trashes the completed todos in ListID, or in every
+//     list if it is 0, along with their subtasks. Completed todos with open
+//     subtasks are left alone.
+//   - complete_all completes the open todos in ListID. Todos still blocked
+//     by open todos it doesn't complete are left open, as are parents whose
+//     completion follows their subtasks.
+type BatchOp struct {
+	Op      string
+	ID      int
+	Todo    Todo
+	Update  UpdateFunc
+	Cascade bool
+	ListID  int
+}
+
+// BatchResult is the outcome of one BatchOp: the todo it created or
+// updated, the number of todos it cleared or completed, or the error it
+// failed with, in which case it changed nothing.
+type BatchResult struct {
+	Todo  *Todo
+	Count int
+	Err   error
+}
+
+// BatchError is the failure of an operation of an atomic batch, which rolled
+// the whole batch back. It matches whatever Err matches with errors.Is.
+type BatchError struct {
+	Index int
+	Err   error
+}
+
+func (e *BatchError) Error() string {
+	return fmt.Sprintf("batch operation %d: %v", e.Index, e.Err)
+}
+
+func (e *BatchError) Unwrap() error {
+	return e.Err
+}
+
+// errNothingToDo is returned by completeTodo for todos complete_all skips.
+var errNothingToDo = errors.New("nothing to do")
+
+// completeTodo is the UpdateFunc of complete_all.
+func completeTodo(t *Todo) error {
+	if t.Completed || (t.AutoComplete && t.ChildCount > 0) {
+		return errNothingToDo
+	}
+	t.Completed = true
+	return nil
+}
+
+// completeAll completes the todos with the given ids by calling update with
+// completeTodo, and returns how many it completed. Todos blocked by others
+// among them are retried once a round completes nothing new, so the order of
+// ids doesn't matter.
+func completeAll(ids []int, update func(id int, fn UpdateFunc) error) (int, error) {
+	n := 0
+	for len(ids) > 0 {
+		var blocked []int
+		for _, id := range ids {
+			err := update(id, completeTodo)
+			switch {
+			case err == nil:
+				n++
+			case errors.Is(err, ErrConflict):
+				blocked = append(blocked, id)
+			case !errors.Is(err, errNothingToDo):
+				return n, err
+			}
+		}
+		if len(blocked) == len(ids) {
+			break
+		}
+		ids = blocked
+	}
+	return n, nil
+}
+
+// clearRoots returns, in id order, the todos clear_completed trashes along
+// with their subtasks: those of the candidates, given by id with their
+// parent ids, whose parent isn't a candidate too.
+func clearRoots(candidates map[int]*int) []int {
+	var roots []int
+	for id, parentID := range candidates {
+		if parentID != nil {
+			if _, ok := candidates[*parentID]; ok {
+				continue
+			}
+		}
+		roots = append(roots, id)
+	}
+	slices.Sort(roots)
+	return roots
+}
+
+// batchRequest is the body of POST /todos:batch.
+type batchRequest struct {
+	Mode       string           `json:"mode"`
+	Operations []batchOperation `json:"operations"`
+}
+
+// batchOperation is one operation of a batchRequest. Todo is the todo to
+// create and Patch the JSON Merge Patch to update with.
+type batchOperation struct {
+	Op      string          `json:"op"`
+	ID      int             `json:"id"`
+	Todo    json.RawMessage `json:"todo"`
+	Patch   json.RawMessage `json:"patch"`
+	Cascade bool            `json:"cascade"`
+	ListID  int             `json:"list_id"`
+}
+
+// Batch modes, in the "mode" member of a batch request.
+const (
+	batchAtomic  = "atomic"
+	batchPerItem = "per_item"
+)
+
+// decodeBatch reads and validates the body of a batch, returning its
+// operations and whether it is atomic. Every operation is checked before
+// any runs, and invalid ones are reported together as a *ValidationError
+// with fields like "operations[2].id".
+func decodeBatch(w http.ResponseWriter, r *http.Request) ([]BatchOp, bool, error) {
+	data, err := readBody(w, r)
+	if err != nil {
+		return nil, false, err
+	}
+	var req batchRequest
+	if err := decodeStrict(data, &req); err != nil {
+		return nil, false, err
+	}
+
+	var fields []FieldError
+	switch req.Mode {
+	case "", batchAtomic, batchPerItem:
+	default:
+		fields = append(fields, FieldError{"mode", fmt.Sprintf("must be %q or %q", batchAtomic, batchPerItem)})
+	}
+	switch {
+	case len(req.Operations) == 0:
+		fields = append(fields, FieldError{"operations", "must not be empty"})
+	case len(req.Operations) > MaxBatchOperations:
+		fields = append(fields, FieldError{"operations", fmt.Sprintf("must have at most %d operations", MaxBatchOperations)})
+	}
+	ops := make([]BatchOp, len(req.Operations))
+	for i, o := range req.Operations {
+		var errs []FieldError
+		ops[i], errs = o.batchOp()
+		for _, f := range errs {
+			f.Field = fmt.Sprintf("operations[%d].%s", i, f.Field)
+			fields = append(fields, f)
+		}
+	}
+	if len(fields) > 0 {
+		return nil, false, &ValidationError{Fields: fields}
+	}
+	return ops, req.Mode != batchPerItem, nil
+}
+
+// batchOp checks the operation and converts it for the store, returning its
+// invalid fields if any.
+func (o batchOperation) batchOp() (BatchOp, []FieldError) {
+	op := BatchOp{Op: o.Op, ID: o.ID, Cascade: o.Cascade, ListID: o.ListID}
+	var fields []FieldError
+	// allowed lists the members that apply to the operation, besides op.
+	var allowed []string
+	switch o.Op {
+	case BatchCreate:
+		allowed = []string{"todo"}
+		if isJSONNull(o.Todo) {
+			fields = append(fields, FieldError{"todo", "must be set"})
+			break
+		}
+		if err := decodeStrict(o.Todo, &op.Todo); err != nil {
+			var verr *ValidationError
+			if !errors.As(err, &verr) {
+				fields = append(fields, FieldError{"todo", "must be a JSON object"})
+				break
+			}
+			fields = append(fields, prefixFields("todo.", verr.Fields)...)
+		} else if err := op.Todo.Validate(); err != nil {
+			fields = append(fields, prefixFields("todo.", err.(*ValidationError).Fields)...)
+		}
+	case BatchUpdate:
+		allowed = []string{"id", "patch"}
+		if isJSONNull(o.Patch) {
+			fields = append(fields, FieldError{"patch", "must be set"})
+		} else if patch, err := ParseMergePatch(o.Patch); err != nil {
+			fields = append(fields, FieldError{"patch", "must be a JSON merge patch object"})
+		} else {
+			op.Update = patch.Apply
+		}
+	case BatchDelete:
+		allowed = []string{"id", "cascade"}
+	case BatchClearCompleted:
+		allowed = []string{"list_id"}
+	case BatchCompleteAll:
+		allowed = []string{"list_id"}
+		if o.ListID == 0 {
+			fields = append(fields, FieldError{"list_id", "must be set"})
+		}
+	default:
+		return op, []FieldError{{"op", fmt.Sprintf("must be one of %v", []string{
+			BatchCreate, BatchUpdate, BatchDelete, BatchClearCompleted, BatchCompleteAll})}}
+	}
+
+	if slices.Contains(allowed, "id") && o.ID <= 0 {
+		fields = append(fields, FieldError{"id", "must be a positive integer"})
+	}
+	set := map[string]bool{
+		"id": o.ID != 0, "todo": !isJSONNull(o.Todo), "patch": !isJSONNull(o.Patch),
+		"cascade": o.Cascade, "list_id": o.ListID != 0,
+	}
+	for _, name := range []string{"id", "todo", "patch", "cascade", "list_id"} {
+		if set[name] && !slices.Contains(allowed, name) {
+			fields = append(fields, FieldError{name, "does not apply to " + o.Op})
+		}
+	}
+	return op, fields
+}
+
+// isJSONNull reports whether a member is absent or null.
+func isJSONNull(data json.RawMessage) bool {
+	return len(data) == 0 || string(data) == "null"
+}
+
+func prefixFields(prefix string, fields []FieldError) []FieldError {
+	prefixed := make([]FieldError, len(fields))
+	for i, f := range fields {
+		prefixed[i] = FieldError{prefix + f.Field, f.Message}
+	}
+	return prefixed
+}
+
+// batchResult is the outcome of one operation in the response to a batch:
+// the status the operation would have had as a request of its own, and the
+// todo, count or problem it would have returned.
+type batchResult struct {
+	Status  int      `json:"status"`
+	Todo    *Todo    `json:"todo,omitempty"`
+	Count   *int     `json:"count,omitempty"`
+	Problem *Problem `json:"problem,omitempty"`
+}
+
+// HandleTodosBatch serves POST /todos:batch, which runs a list of
+// operations on todos in a single transaction, retried and circuit broken
+// as one. In the default "atomic" mode the first operation to fail rolls
+// back the whole batch, and its problem is returned with the operation's
+// index; in "per_item" mode each failed operation is rolled back on its own
+// and the others still commit. Either way a successful batch returns 200
+// with a result per operation.
+func (s *Server) HandleTodosBatch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeMethodNotAllowed(w, r, http.MethodPost)
+		return
+	}
+	ops, atomic, err := decodeBatch(w, r)
+	if err != nil {
+		writeInputError(w, r, err)
+		return
+	}
+
+	results, err := s.batch.Batch(r.Context(), ops, atomic)
+	var batchErr *BatchError
+	if errors.As(err, &batchErr) {
+		p := storeProblem(r, batchErr.Err)
+		p.Operation = &batchErr.Index
+		writeProblemBody(w, p)
+		return
+	}
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+
+	body := make([]batchResult, len(results))
+	for i, res := range results {
+		switch {
+		case res.Err != nil:
+			p := storeProblem(r, res.Err)
+			body[i] = batchResult{Status: p.Status, Problem: &p}
+		case ops[i].Op == BatchCreate:
+			body[i] = batchResult{Status: http.StatusCreated, Todo: res.Todo}
+			TodosAdded.Inc()
+		case ops[i].Op == BatchUpdate:
+			body[i] = batchResult{Status: http.StatusOK, Todo: res.Todo}
+			TodosUpdated.Inc()
+		case ops[i].Op == BatchDelete:
+			body[i] = batchResult{Status: http.StatusNoContent}
+			TodosDeleted.Inc()
+		case ops[i].Op == BatchClearCompleted:
+			body[i] = batchResult{Status: http.StatusOK, Count: &res.Count}
+			TodosDeleted.Add(float64(res.Count))
+		default:
+			body[i] = batchResult{Status: http.StatusOK, Count: &res.Count}
+			TodosUpdated.Add(float64(res.Count))
+		}
+	}
+	writeJSON(w, http.StatusOK, struct {
+		Results []batchResult `json:"results"`
+	}{body})
+}
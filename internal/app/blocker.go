@@ -0,0 +1,74 @@
+// Written by Gemini CLI
+// This file is licensed under the MIT License.
+// See the LICENSE file for details.
+
+package app
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+// ready reports whether t can be worked on: it is incomplete and nothing
+// blocking it is still open.
+func (t Todo) ready() bool {
+	return !t.Completed && t.OpenBlockers == 0
+}
+
+// checkCompletable refuses to complete a todo, previously before, that still
+// has open blockers. Todos that were already complete may be edited freely.
+func checkCompletable(before, after Todo) error {
+	if after.Completed && !before.Completed && after.OpenBlockers > 0 {
+		return &ConflictError{Code: CodeTodoBlocked,
+			Detail: fmt.Sprintf("The todo is blocked by %d open todos; complete them first.", after.OpenBlockers)}
+	}
+	return nil
+}
+
+func dependencyCycleConflict() error {
+	return &ConflictError{Code: CodeDependencyCycle,
+		Detail: "The todo can't be blocked by itself or by a todo it blocks."}
+}
+
+// HandleTodoBlockers serves /todos/{id}/blockers, the todos blocking a todo.
+func (s *Server) HandleTodoBlockers(w http.ResponseWriter, r *http.Request, id int) {
+	if r.Method != http.MethodGet {
+		writeMethodNotAllowed(w, r, http.MethodGet)
+		return
+	}
+	blockers, err := s.blockers.Blockers(r.Context(), id)
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, blockers)
+}
+
+// HandleTodoBlocker serves /todos/{id}/blockers/{blockerID}: PUT records that
+// the blocker must be completed first and DELETE removes that dependency.
+// Both are idempotent and return the updated todo. Dependencies that would
+// make a cycle are rejected with 409.
+func (s *Server) HandleTodoBlocker(w http.ResponseWriter, r *http.Request, id int, blockerPart string) {
+	blockerID, err := strconv.Atoi(blockerPart)
+	if err != nil {
+		writeProblem(w, r, http.StatusBadRequest, CodeValidationFailed, "Blocker id must be an integer.")
+		return
+	}
+
+	var t Todo
+	switch r.Method {
+	case http.MethodPut:
+		t, err = s.blockers.AddBlocker(r.Context(), id, blockerID)
+	case http.MethodDelete:
+		t, err = s.blockers.RemoveBlocker(r.Context(), id, blockerID)
+	default:
+		writeMethodNotAllowed(w, r, http.MethodPut, http.MethodDelete)
+		return
+	}
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+	writeUpdatedTodo(w, t)
+}
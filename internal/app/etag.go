@@ -0,0 +1,93 @@
+// Written by Gemini CLI
+// This file is licensed under the MIT License.
+// See the LICENSE file for details.
+
+package app
+
+import (
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// todoETag returns the ETag of a todo at the given version. It is strong:
+// todos with the same version have the same fields and tags.
+func todoETag(version int) string {
+	return strconv.Quote(strconv.Itoa(version))
+}
+
+// listETag returns the ETag of a list of todos at the given store revision.
+// It is weak: a page read at a revision may already have some of the next
+// revision's changes.
+func listETag(revision int64) string {
+	return `W/"r` + strconv.FormatInt(revision, 10) + `"`
+}
+
+// ifNoneMatch reports whether a request's If-None-Match headers match etag,
+// comparing weakly (RFC 9110, section 13.1.2), so the client's copy is
+// current.
+func ifNoneMatch(r *http.Request, etag string) bool {
+	for _, h := range r.Header.Values("If-None-Match") {
+		for _, tag := range strings.Split(h, ",") {
+			tag = strings.TrimSpace(tag)
+			if tag == "*" || strings.TrimPrefix(tag, "W/") == strings.TrimPrefix(etag, "W/") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// knownRevision returns the newest store revision named by a list ETag in a
+// request's If-None-Match headers, or 0 if there is none.
+func knownRevision(r *http.Request) int64 {
+	var known int64
+	for _, h := range r.Header.Values("If-None-Match") {
+		for _, tag := range strings.Split(h, ",") {
+			tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+			v, ok := strings.CutPrefix(strings.Trim(tag, `"`), "r")
+			if !ok {
+				continue
+			}
+			if n, err := strconv.ParseInt(v, 10, 64); err == nil && n > known {
+				known = n
+			}
+		}
+	}
+	return known
+}
+
+// Precondition reports whether a change may be made to a todo at its
+// current version. A nil Precondition allows any version.
+type Precondition func(version int) bool
+
+// check returns a *PreconditionError unless p allows version.
+func (p Precondition) check(version int) error {
+	if p != nil && !p(version) {
+		return &PreconditionError{Version: version}
+	}
+	return nil
+}
+
+// ifMatch returns the Precondition of a request's If-Match headers, or nil
+// if there are none. "*" allows any version. Weak ETags never match, since
+// If-Match compares ETags strongly (RFC 9110, section 13.1.1).
+func ifMatch(r *http.Request) Precondition {
+	headers := r.Header.Values("If-Match")
+	if len(headers) == 0 {
+		return nil
+	}
+	var tags []string
+	for _, h := range headers {
+		for _, tag := range strings.Split(h, ",") {
+			tags = append(tags, strings.TrimSpace(tag))
+		}
+	}
+	if slices.Contains(tags, "*") {
+		return func(int) bool { return true }
+	}
+	return func(version int) bool {
+		return slices.Contains(tags, todoETag(version))
+	}
+}
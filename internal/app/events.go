@@ -0,0 +1,420 @@
+// Written by Gemini CLI
+// This file is licensed under the MIT License.
+// See the LICENSE file for details.
+
+package app
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// todoEventsChannel is the Postgres channel a trigger notifies with the new
+// revision whenever a change to the todos commits.
+const todoEventsChannel = "todo_events"
+
+const (
+	// eventPollInterval is how often the event hub checks the store when
+	// nothing notifies it of changes: with SQLite or the memory store, or
+	// while the Postgres listener is reconnecting.
+	eventPollInterval = time.Second
+	// eventKeepAlive is how long an event stream goes without writing before
+	// it sends a comment, so proxies don't close it as idle. The hub checks
+	// the store at least this often even when notified of changes, in case a
+	// notification was lost.
+	eventKeepAlive = 15 * time.Second
+	// maxEventRevisions caps the changes read from the store at once, so a
+	// client resuming after a long time catches up in pages.
+	maxEventRevisions = 100
+	// maxHubEvents caps the recent events the hub keeps for its streams.
+	// Streams further behind read the store themselves until they catch up.
+	maxHubEvents = 1000
+)
+
+// streamEventTypes maps the actions of events to the types they are streamed
+// as: the todo appeared, changed or disappeared.
+var streamEventTypes = map[string]string{
+	EventCreate:  "created",
+	EventRestore: "created",
+	EventUpdate:  "updated",
+	EventDelete:  "deleted",
+	EventPurge:   "deleted",
+}
+
+// streamedEvent is a TodoEvent as streamed to every client. Who made the
+// change, and the request and trace it came from, are left out: they are
+// for the todo's history, not for everyone watching.
+type streamedEvent struct {
+	ID        int64     `json:"id"`
+	Revision  int64     `json:"revision"`
+	TodoID    int       `json:"todo_id"`
+	Action    string    `json:"action"`
+	Before    *Todo     `json:"before"`
+	After     *Todo     `json:"after"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// eventHub reads new events from the store once for all of a server's event
+// streams, keeps the recent ones, and wakes the streams to write them. It
+// reads while any stream is open, when notified of a change or else every
+// pollInterval. The zero value is not usable; use newEventHub.
+type eventHub struct {
+	store EventStore
+	// changed is signalled by notify.
+	changed chan struct{}
+	// listening is set while a listener notifies the hub of every change.
+	listening atomic.Bool
+
+	mu sync.Mutex
+	// streams counts the open streams, and stop ends the reads when the
+	// last one closes.
+	streams int
+	stop    context.CancelFunc
+	// events are every event after revision from, up to revision, in
+	// revision and id order.
+	events         []TodoEvent
+	from, revision int64
+	// wake is closed, and replaced, whenever events are added.
+	wake chan struct{}
+}
+
+func newEventHub(store EventStore) *eventHub {
+	return &eventHub{store: store, changed: make(chan struct{}, 1), wake: make(chan struct{})}
+}
+
+// subscribe counts a new stream, starting to read if it is the first, and
+// returns the revision the hub has read up to.
+func (h *eventHub) subscribe(ctx context.Context) (int64, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.streams == 0 {
+		revision, err := h.store.EventsRevision(ctx)
+		if err != nil {
+			return 0, err
+		}
+		h.events, h.from, h.revision = nil, revision, revision
+		readCtx, stop := context.WithCancel(context.Background())
+		h.stop = stop
+		go h.run(readCtx)
+	}
+	h.streams++
+	return h.revision, nil
+}
+
+// unsubscribe counts a closed stream, stopping the reads if it was the last.
+func (h *eventHub) unsubscribe() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.streams--
+	if h.streams == 0 {
+		h.stop()
+		h.events = nil
+	}
+}
+
+// run reads new events whenever notified, and every pollInterval, until
+// ctx is done.
+func (h *eventHub) run(ctx context.Context) {
+	for {
+		timer := time.NewTimer(h.pollInterval())
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-h.changed:
+		case <-timer.C:
+		}
+		timer.Stop()
+		h.read(ctx)
+	}
+}
+
+// read adds the events after the hub's revision, a page at a time, waking
+// the streams after each page.
+func (h *eventHub) read(ctx context.Context) {
+	for {
+		h.mu.Lock()
+		after := h.revision
+		h.mu.Unlock()
+		events, err := h.store.Events(ctx, after, maxEventRevisions)
+		if err != nil {
+			// The streams wait for the next read; the store retried already.
+			if ctx.Err() == nil {
+				slog.Error("Failed to read todo events", "error", err)
+			}
+			return
+		}
+		if len(events) == 0 {
+			return
+		}
+
+		h.mu.Lock()
+		if ctx.Err() != nil {
+			// The last stream closed, so a new one may have reset the hub.
+			h.mu.Unlock()
+			return
+		}
+		h.add(events)
+		close(h.wake)
+		h.wake = make(chan struct{})
+		h.mu.Unlock()
+
+		if countRevisions(events) < maxEventRevisions {
+			return
+		}
+	}
+}
+
+// add appends events after the hub's revision, dropping the oldest whole
+// changes beyond maxHubEvents. The caller must hold h.mu.
+func (h *eventHub) add(events []TodoEvent) {
+	h.events = append(h.events, events...)
+	h.revision = events[len(events)-1].Revision
+	drop := len(h.events) - maxHubEvents
+	if drop <= 0 {
+		return
+	}
+	for drop < len(h.events) && h.events[drop].Revision == h.events[drop-1].Revision {
+		drop++
+	}
+	h.from = h.events[drop-1].Revision
+	// Copy, as streams may still be writing the events dropped.
+	h.events = slices.Clone(h.events[drop:])
+}
+
+// since returns the events the hub has read after the given revision, or
+// false if it no longer has them all. The events must not be modified.
+func (h *eventHub) since(after int64) ([]TodoEvent, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if after < h.from {
+		return nil, false
+	}
+	i, _ := slices.BinarySearchFunc(h.events, after+1, func(e TodoEvent, revision int64) int {
+		return cmp.Compare(e.Revision, revision)
+	})
+	return h.events[i:], true
+}
+
+// wait returns a channel that is closed when the hub next adds events.
+func (h *eventHub) wait() <-chan struct{} {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.wake
+}
+
+// notify makes the hub read the store now rather than at its next poll.
+func (h *eventHub) notify() {
+	select {
+	case h.changed <- struct{}{}:
+	default:
+	}
+}
+
+// pollInterval returns how long the hub waits for a notification before
+// checking the store anyway.
+func (h *eventHub) pollInterval() time.Duration {
+	if h.listening.Load() {
+		return eventKeepAlive
+	}
+	return eventPollInterval
+}
+
+// countRevisions returns the number of changes events belong to, given in
+// revision order.
+func countRevisions(events []TodoEvent) int {
+	n := 0
+	for i, e := range events {
+		if i == 0 || events[i-1].Revision != e.Revision {
+			n++
+		}
+	}
+	return n
+}
+
+// NotifyTodoEvents makes the server's event streams check the store for new
+// events. ListenForTodoEvents calls it for every change on Postgres; without
+// it, the streams' hub polls.
+func (s *Server) NotifyTodoEvents() {
+	s.events.notify()
+}
+
+// ListenForTodoEvents listens on the Postgres channel that is notified
+// whenever a change to the todos commits, on any replica of the service, and
+// has s's event streams check for it, until ctx is done. While the
+// connection is down the streams poll instead, and once it is back they
+// check in case they missed a change.
+func ListenForTodoEvents(ctx context.Context, connStr string, s *Server) {
+	listener := pq.NewListener(connStr, time.Second, time.Minute, func(ev pq.ListenerEventType, err error) {
+		switch ev {
+		case pq.ListenerEventReconnected:
+			slog.Info("Reconnected the todo events listener")
+			s.events.listening.Store(true)
+			s.NotifyTodoEvents()
+		case pq.ListenerEventDisconnected, pq.ListenerEventConnectionAttemptFailed:
+			slog.Warn("Todo events listener disconnected; streams will poll", "error", err)
+			s.events.listening.Store(false)
+		}
+	})
+	defer listener.Close()
+	defer s.events.listening.Store(false)
+
+	if err := listener.Listen(todoEventsChannel); err != nil {
+		slog.Error("Failed to listen for todo events; streams will poll", "error", err)
+		return
+	}
+	s.events.listening.Store(true)
+	slog.Info("Listening for todo events", "channel", todoEventsChannel)
+
+	// Ping now and then, as lib/pq recommends, to notice a dead connection.
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-listener.Notify:
+			// A nil notification follows a reconnect; checking the store
+			// is right either way.
+			s.NotifyTodoEvents()
+		case <-ticker.C:
+			if err := listener.Ping(); err != nil {
+				slog.Warn("Todo events listener ping failed", "error", err)
+			}
+		}
+	}
+}
+
+// lastEventID returns the revision in a request's Last-Event-ID header, which
+// EventSource sends when it reconnects, and whether there is a valid one.
+func lastEventID(r *http.Request) (int64, bool) {
+	id, err := strconv.ParseInt(r.Header.Get("Last-Event-ID"), 10, 64)
+	return id, err == nil && id >= 0
+}
+
+// writeTodoEvent writes e as a Server-Sent Event. The last event of a change
+// carries its revision as the event id, so a client that reconnects resumes
+// after whole changes only.
+func writeTodoEvent(w io.Writer, e TodoEvent, last bool) error {
+	data, err := json.Marshal(streamedEvent{
+		ID: e.ID, Revision: e.Revision, TodoID: e.TodoID, Action: e.Action,
+		Before: e.Before, After: e.After, CreatedAt: e.CreatedAt,
+	})
+	if err != nil {
+		return err
+	}
+	if last {
+		if _, err := fmt.Fprintf(w, "id: %d\n", e.Revision); err != nil {
+			return err
+		}
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", streamEventTypes[e.Action], data)
+	return err
+}
+
+// HandleTodoEvents serves GET /todos/events, a stream of Server-Sent Events
+// for every change to a todo, made through any replica of the service, in
+// commit order. Each event is "created", "updated" or "deleted", with the
+// TodoEvent, less who made it and their request and trace, as its data;
+// events are read from the same history as GET /todos/{id}/history, once
+// for all of the server's streams.
+//
+// A new stream starts with a "ready" event whose id is the current revision,
+// after which the client should (re)load the todos it shows; events follow
+// from there. A client that reconnects with Last-Event-ID, as EventSource
+// does, gets the events it missed instead.
+func (s *Server) HandleTodoEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeMethodNotAllowed(w, r, http.MethodGet)
+		return
+	}
+	ctx := r.Context()
+	revision, err := s.events.subscribe(ctx)
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+	defer s.events.unsubscribe()
+	after, resumed := lastEventID(r)
+	if !resumed {
+		after = revision
+	}
+
+	// Streams outlive the server's write timeout.
+	rc := http.NewResponseController(w)
+	if err := rc.SetWriteDeadline(time.Time{}); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		slog.Warn("Failed to clear the write deadline of an event stream", "error", err)
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-store")
+	// Stop nginx-style proxies from buffering the stream.
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	if !resumed {
+		fmt.Fprintf(w, "event: ready\nid: %d\ndata: {\"revision\":%d}\n\n", after, after)
+	}
+	rc.Flush()
+	slog.Info("Streaming todo events", "after", after, "resumed", resumed)
+
+	for {
+		// Take the wake channel before reading, so events added during the
+		// read still wake the stream.
+		wake := s.events.wait()
+		events, ok := s.events.since(after)
+		caughtUp := true
+		if !ok {
+			// Too far behind for the hub: catch up from the store.
+			events, err = s.history.Events(ctx, after, maxEventRevisions)
+			if err != nil {
+				// The client reconnects, resuming with Last-Event-ID.
+				if ctx.Err() == nil {
+					slog.Error("Failed to read todo events", "error", err)
+				}
+				return
+			}
+			caughtUp = countRevisions(events) < maxEventRevisions
+		}
+		for i, e := range events {
+			last := i == len(events)-1 || events[i+1].Revision != e.Revision
+			if err := writeTodoEvent(w, e, last); err != nil {
+				return
+			}
+			if last {
+				after = e.Revision
+			}
+		}
+		if len(events) > 0 {
+			rc.Flush()
+		}
+		if !caughtUp {
+			continue
+		}
+
+		timer := time.NewTimer(eventKeepAlive)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-wake:
+		case <-timer.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+			rc.Flush()
+		}
+		timer.Stop()
+	}
+}
@@ -0,0 +1,170 @@
+// Written by Gemini CLI
+// This file is licensed under the MIT License.
+// See the LICENSE file for details.
+
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+	"unicode"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Actions recorded in TodoEvent.Action.
+const (
+	EventCreate  = "create"
+	EventUpdate  = "update"
+	EventDelete  = "delete"
+	EventRestore = "restore"
+	EventPurge   = "purge"
+)
+
+// TodoEvent is one entry in a todo's history: a change to the todo, written
+// in the same transaction as the change itself. Before is the todo as it
+// was, and After as it became; Before is null for a create and After for a
+// purge. Every todo a request changes gets an event, including parents
+// whose completion rolls up and subtasks deleted with their parent, so
+// Action is what happened to this todo, not necessarily what the request
+// asked for.
+//
+// Revision is the revision (see EventStore.Revision) of the change the event
+// is part of, shared by all of that change's events. Events recorded before
+// revisions were have 0.
+type TodoEvent struct {
+	ID        int64     `json:"id"`
+	Revision  int64     `json:"revision"`
+	TodoID    int       `json:"todo_id"`
+	Action    string    `json:"action"`
+	Before    *Todo     `json:"before"`
+	After     *Todo     `json:"after"`
+	Actor     string    `json:"actor"`
+	RequestID string    `json:"request_id"`
+	TraceID   string    `json:"trace_id"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// ActorHeader carries the user making a request, as set by Identity-Aware
+// Proxy ("accounts.google.com:" followed by the email). Without a proxy in
+// front of the service it is whatever the client sends, so it is only
+// trusted when the deployment says IAP is there.
+const ActorHeader = "X-Goog-Authenticated-User-Email"
+
+const (
+	// AnonymousActor is recorded for requests without a trusted ActorHeader.
+	AnonymousActor = "anonymous"
+	// SystemActor is recorded for changes made outside any request, like
+	// purging the trash.
+	SystemActor = "system"
+)
+
+type actorKey struct{}
+
+// ActorMiddleware records who is making each request, for the history of
+// the todos it changes and to scope its Idempotency-Key. The actor is read
+// from ActorHeader only if trustHeader is set, which must only be done
+// behind Identity-Aware Proxy, as it replaces the header; otherwise anyone
+// could claim to be anyone, and every request is AnonymousActor.
+func ActorMiddleware(next http.Handler, trustHeader bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		actor := ""
+		if trustHeader {
+			actor = strings.TrimPrefix(r.Header.Get(ActorHeader), "accounts.google.com:")
+		}
+		if actor == "" || len(actor) > 320 || strings.ContainsFunc(actor, unicode.IsControl) {
+			actor = AnonymousActor
+		}
+		next.ServeHTTP(w, r.WithContext(WithActor(r.Context(), actor)))
+	})
+}
+
+// WithActor returns a copy of ctx whose changes are recorded as made by
+// actor.
+func WithActor(ctx context.Context, actor string) context.Context {
+	return context.WithValue(ctx, actorKey{}, actor)
+}
+
+// eventContext returns who is making the change ctx belongs to, and the
+// request and trace it is part of, if any.
+func eventContext(ctx context.Context) (actor, requestID, traceID string) {
+	actor, _ = ctx.Value(actorKey{}).(string)
+	if actor == "" {
+		actor = SystemActor
+	}
+	if sc := trace.SpanContextFromContext(ctx); sc.HasTraceID() {
+		traceID = sc.TraceID().String()
+	}
+	return actor, RequestIDFromContext(ctx), traceID
+}
+
+// changeSet collects the todos an operation changes, each with the action
+// and its state before the first change, so the store can write one event
+// per todo once the operation is done. The zero value is empty.
+type changeSet struct {
+	ids    []int
+	action map[int]string
+	before map[int]*Todo
+}
+
+// has reports whether the todo with id has already been added.
+func (c *changeSet) has(id int) bool {
+	_, ok := c.action[id]
+	return ok
+}
+
+// add records that the todo with id, currently before (nil if it is new),
+// changes. Only the first call for a todo counts.
+func (c *changeSet) add(id int, action string, before *Todo) {
+	if c.has(id) {
+		return
+	}
+	if c.action == nil {
+		c.action, c.before = make(map[int]string), make(map[int]*Todo)
+	}
+	c.ids = append(c.ids, id)
+	c.action[id], c.before[id] = action, before
+}
+
+// count returns how many todos were added with action.
+func (c *changeSet) count(action string) int {
+	n := 0
+	for _, a := range c.action {
+		if a == action {
+			n++
+		}
+	}
+	return n
+}
+
+// eventJSON encodes an event's before or after state for storage, with nil
+// for none.
+func eventJSON(t *Todo) (any, error) {
+	if t == nil {
+		return nil, nil
+	}
+	data, err := json.Marshal(t)
+	if err != nil {
+		return nil, err
+	}
+	return string(data), nil
+}
+
+// HandleTodoHistory serves GET /todos/{id}/history, the events of a todo,
+// oldest first. The history outlives the todo, so it is served for trashed
+// and purged todos too.
+func (s *Server) HandleTodoHistory(w http.ResponseWriter, r *http.Request, id int) {
+	if r.Method != http.MethodGet {
+		writeMethodNotAllowed(w, r, http.MethodGet)
+		return
+	}
+	events, err := s.history.History(r.Context(), id)
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, events)
+}
@@ -0,0 +1,122 @@
+// Written by Gemini CLI
+// This file is licensed under the MIT License.
+// See the LICENSE file for details.
+
+package app
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// DefaultIdempotencyWindow is how long Idempotency-Keys are kept, and
+// repeats of a request replayed, unless configured otherwise.
+const DefaultIdempotencyWindow = 24 * time.Hour
+
+// maxIdempotencyKeyLength caps the length of an Idempotency-Key, which is
+// long enough for a UUID or a hash with room to spare.
+const maxIdempotencyKeyLength = 255
+
+// IdempotencyKey is an Idempotency-Key as kept by the store: the key, a
+// fingerprint of the request it was first sent with, the todo that request
+// created and when.
+type IdempotencyKey struct {
+	Key         string
+	Fingerprint string
+	Todo        Todo
+	CreatedAt   time.Time
+}
+
+// idempotencyKey returns the Idempotency-Key header of a request, or "" if
+// there is none, and whether it is valid: 1 to 255 visible ASCII
+// characters.
+func idempotencyKey(r *http.Request) (string, bool) {
+	if _, ok := r.Header["Idempotency-Key"]; !ok {
+		return "", true
+	}
+	key := r.Header.Get("Idempotency-Key")
+	if key == "" || len(key) > maxIdempotencyKeyLength {
+		return key, false
+	}
+	for i := 0; i < len(key); i++ {
+		if key[i] < '!' || key[i] > '~' {
+			return key, false
+		}
+	}
+	return key, true
+}
+
+// requestFingerprint identifies a create request by its path and decoded
+// todo, so a repeat with the same key matches even if the JSON is formatted
+// differently.
+func requestFingerprint(r *http.Request, t Todo) (string, error) {
+	data, err := json.Marshal(t)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	h.Write([]byte(r.URL.Path))
+	h.Write([]byte{0})
+	h.Write(data)
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// addTodoOnce creates t for a request with an Idempotency-Key. The first
+// request with the key creates the todo; repeats of it get the same 201
+// response, marked with Idempotent-Replayed, without creating anything. Using
+// the key for a different request is refused with 422.
+func (s *Server) addTodoOnce(w http.ResponseWriter, r *http.Request, key string, t Todo) {
+	fingerprint, err := requestFingerprint(r, t)
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+	stored, created, err := s.keys.CreateIdempotent(r.Context(), IdempotencyKey{Key: key, Fingerprint: fingerprint}, t)
+	if err != nil {
+		slog.Error("Failed to insert todo", "error", err, "task", t.Task)
+		writeStoreError(w, r, err)
+		return
+	}
+	if stored.Fingerprint != fingerprint {
+		writeProblem(w, r, http.StatusUnprocessableEntity, CodeIdempotencyKeyReused,
+			"The Idempotency-Key was already used for a different request.")
+		return
+	}
+
+	if !created {
+		slog.Info("Replayed todo", "id", stored.Todo.ID, "idempotency_key", key)
+		w.Header().Set("Idempotent-Replayed", "true")
+		IdempotentReplays.Inc()
+	} else {
+		slog.Info("Successfully added todo", "id", stored.Todo.ID, "task", stored.Todo.Task)
+		TodosAdded.Inc()
+	}
+	writeCreatedTodo(w, stored.Todo)
+}
+
+// ExpireIdempotencyKeys deletes Idempotency-Keys kept for longer than
+// window, once straight away and then every interval, until ctx is done.
+// Keys are replayed for at least window, and at most one interval longer.
+func ExpireIdempotencyKeys(ctx context.Context, store IdempotencyStore, window, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		n, err := store.PurgeIdempotencyKeys(ctx, now().Add(-window))
+		if err != nil {
+			slog.Error("Failed to expire idempotency keys", "error", err)
+		} else if n > 0 {
+			slog.Info("Expired idempotency keys", "keys", n)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
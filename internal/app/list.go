@@ -0,0 +1,256 @@
+// Written by Gemini CLI
+// This file is licensed under the MIT License.
+// See the LICENSE file for details.
+
+package app
+
+import (
+	"cmp"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultPageSize is the number of todos returned when no limit is given.
+	DefaultPageSize = 50
+	// MaxPageSize is the largest limit a client may ask for.
+	MaxPageSize = 200
+)
+
+// ListOptions filters, sorts and paginates TodoStore.List.
+type ListOptions struct {
+	// Limit caps the number of todos returned; 0 means no limit.
+	Limit int
+	// After resumes listing after the todo the cursor was taken from.
+	After *Cursor
+	// Trashed lists the todos in the trash instead of the others.
+	Trashed bool
+	// ListID, if set, only matches todos in that list.
+	ListID int
+	// ParentID, if set, only matches subtasks of that todo; TopLevel only
+	// matches todos that aren't subtasks.
+	ParentID *int
+	TopLevel bool
+	// Tags, if set, only matches todos carrying every one of these tag
+	// names, or any one of them if AnyTag is set.
+	Tags   []string
+	AnyTag bool
+	// Completed, if set, only matches todos with that completion state.
+	Completed *bool
+	// Ready, if set, only matches todos that are (or aren't) ready to work
+	// on: incomplete, with no open blockers.
+	Ready *bool
+	// Query, if set, only matches todos whose task contains it, ignoring case.
+	Query string
+	// DueFrom and DueBefore, if set, only match todos due in
+	// [DueFrom, DueBefore). Todos without a due date never match.
+	DueFrom, DueBefore *time.Time
+	// Sort orders the results. Ties are broken by id in the same direction.
+	Sort Sort
+	// MinRevision, if set, is a revision the caller has already seen, so a
+	// page from an older revision (say, a lagging replica's) is no use.
+	MinRevision int64
+}
+
+// TodoPage is one page of TodoStore.List results.
+type TodoPage struct {
+	Todos []Todo
+	// HasMore reports whether todos exist beyond this page.
+	HasMore bool
+	// Revision is the store's Revision as of the page. The page may
+	// already have changes from the next revisions, but never lacks one
+	// its revision counts.
+	Revision int64
+	// Modified is when the change Revision counts was made, or zero before
+	// the first change.
+	Modified time.Time
+}
+
+// Sort is a sort order for listing todos.
+type Sort struct {
+	Field string
+	Desc  bool
+}
+
+// sortField describes a sortable Todo field.
+type sortField struct {
+	// column is the SQL column holding the field.
+	column string
+	// compare orders two todos by the field, for the memory store.
+	compare func(a, b Todo) int
+	// key and setKey convert the field to and from the JSON stored in a
+	// cursor. They are nil for id, which every cursor carries anyway.
+	key    func(t Todo) any
+	setKey func(t *Todo, key json.RawMessage) error
+}
+
+var sortFields = map[string]sortField{
+	"id": {
+		column:  "id",
+		compare: func(a, b Todo) int { return cmp.Compare(a.ID, b.ID) },
+	},
+	"task": {
+		column:  "task",
+		compare: func(a, b Todo) int { return strings.Compare(a.Task, b.Task) },
+		key:     func(t Todo) any { return t.Task },
+		setKey:  func(t *Todo, key json.RawMessage) error { return json.Unmarshal(key, &t.Task) },
+	},
+	"position": {
+		column:  "position",
+		compare: func(a, b Todo) int { return strings.Compare(a.Position, b.Position) },
+		key:     func(t Todo) any { return t.Position },
+		setKey:  func(t *Todo, key json.RawMessage) error { return json.Unmarshal(key, &t.Position) },
+	},
+}
+
+// ParseSort parses a sort parameter: a field name, optionally prefixed with
+// "-" for descending order. The empty string sorts by id.
+func ParseSort(s string) (Sort, error) {
+	if s == "" {
+		return Sort{Field: "id"}, nil
+	}
+	sort := Sort{Field: strings.TrimPrefix(s, "-"), Desc: strings.HasPrefix(s, "-")}
+	if _, ok := sortFields[sort.Field]; !ok {
+		return Sort{}, fmt.Errorf("unknown sort field %q", sort.Field)
+	}
+	return sort, nil
+}
+
+func (s Sort) String() string {
+	if s.Desc {
+		return "-" + s.Field
+	}
+	return s.Field
+}
+
+// field returns the sortField for s, defaulting to id.
+func (s Sort) field() sortField {
+	if f, ok := sortFields[s.Field]; ok {
+		return f
+	}
+	return sortFields["id"]
+}
+
+// compare orders two todos by s, breaking ties by id.
+func (s Sort) compare(a, b Todo) int {
+	c := s.field().compare(a, b)
+	if c == 0 {
+		c = cmp.Compare(a.ID, b.ID)
+	}
+	if s.Desc {
+		return -c
+	}
+	return c
+}
+
+// Cursor marks a position in a sorted todo listing: the sort key and id of
+// the last todo on the previous page. Clients only see it encoded, as an
+// opaque string.
+type Cursor struct {
+	Sort string          `json:"s"`
+	Key  json.RawMessage `json:"k,omitempty"`
+	ID   int             `json:"i"`
+}
+
+// NewCursor returns the cursor for the page that follows t under sort.
+func NewCursor(sort Sort, t Todo) *Cursor {
+	c := &Cursor{Sort: sort.String(), ID: t.ID}
+	if key := sort.field().key; key != nil {
+		c.Key, _ = json.Marshal(key(t))
+	}
+	return c
+}
+
+// Encode returns the opaque form of c used in URLs.
+func (c *Cursor) Encode() string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+var errInvalidCursor = errors.New("invalid cursor")
+
+// DecodeCursor parses an encoded cursor, which must have been issued for the
+// given sort order.
+func DecodeCursor(s string, sort Sort) (*Cursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, errInvalidCursor
+	}
+	var c Cursor
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, errInvalidCursor
+	}
+	if c.Sort != sort.String() {
+		return nil, fmt.Errorf("%w: cursor is for sort %q", errInvalidCursor, c.Sort)
+	}
+	if _, err := c.todo(); err != nil {
+		return nil, errInvalidCursor
+	}
+	return &c, nil
+}
+
+// todo returns a Todo holding the cursor's sort key and id, for comparing
+// against other todos.
+func (c *Cursor) todo() (Todo, error) {
+	t := Todo{ID: c.ID}
+	sort, err := ParseSort(c.Sort)
+	if err != nil {
+		return t, err
+	}
+	if setKey := sort.field().setKey; setKey != nil {
+		if err := setKey(&t, c.Key); err != nil {
+			return t, err
+		}
+	}
+	return t, nil
+}
+
+// matches reports whether t passes the filters in o.
+func (o ListOptions) matches(t Todo) bool {
+	if (t.DeletedAt != nil) != o.Trashed {
+		return false
+	}
+	if o.ListID != 0 && t.ListID != o.ListID {
+		return false
+	}
+	if o.ParentID != nil && (t.ParentID == nil || *t.ParentID != *o.ParentID) {
+		return false
+	}
+	if o.TopLevel && t.ParentID != nil {
+		return false
+	}
+	if o.Completed != nil && t.Completed != *o.Completed {
+		return false
+	}
+	if o.Ready != nil && t.ready() != *o.Ready {
+		return false
+	}
+	if o.DueFrom != nil && (t.DueAt == nil || t.DueAt.Before(*o.DueFrom)) {
+		return false
+	}
+	if o.DueBefore != nil && (t.DueAt == nil || !t.DueAt.Before(*o.DueBefore)) {
+		return false
+	}
+	if o.Query != "" && !strings.Contains(strings.ToLower(t.Task), strings.ToLower(o.Query)) {
+		return false
+	}
+	if len(o.Tags) > 0 {
+		hasTag := func(name string) bool {
+			return slices.ContainsFunc(t.Tags, func(g Tag) bool { return g.Name == name })
+		}
+		if o.AnyTag {
+			return slices.ContainsFunc(o.Tags, hasTag)
+		}
+		for _, name := range o.Tags {
+			if !hasTag(name) {
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,1356 @@
+// Written by Gemini CLI
+// This file is licensed under the MIT License.
+// See the LICENSE file for details.
+
+package app
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"maps"
+	"slices"
+	"sync"
+	"time"
+)
+
+// FaultFunc decides whether a MemoryStore operation should fail. It is called
+// with the operation name ("list", "search", "get", "create", "update",
+// "delete", "restore", "purge", "move", "batch", "blockers", "add_blocker",
+// "remove_blocker", "history", "events", "events_revision",
+// "purge_idempotency_keys", "revision", "lists", "get_list", "create_list",
+// "update_list", "delete_list", "tags", "get_tag", "create_tag",
+// "rename_tag", "delete_tag", "tag_todo", "untag_todo" or "ping") and returns the error to inject, or nil
+// to let the operation run.
+type FaultFunc func(op string) error
+
+// MemoryStore is a concurrency-safe Store that keeps everything in process
+// memory. It is meant for hermetic tests and throwaway preview environments:
+// nothing survives a restart.
+//
+// Operations go through ExecuteWithRobustness just like the SQL store, so
+// faults injected with SetFault exercise the real retry and circuit breaker
+// paths.
+type MemoryStore struct {
+	mu         sync.RWMutex
+	todos      map[int]Todo
+	nextID     int
+	lists      map[int]TodoList
+	nextListID int
+	tags       map[int]Tag
+	nextTagID  int
+	// tagged holds the ids of the tags attached to each todo, by todo id.
+	tagged map[int]map[int]bool
+	// blockers holds the ids of the todos blocking each todo, by todo id.
+	blockers map[int]map[int]bool
+	// events is the history of every todo, in id order.
+	events []TodoEvent
+	// revision counts the changes to what List returns.
+	revision int64
+	// keys holds the Idempotency-Keys used by each actor.
+	keys map[actorIdempotencyKey]IdempotencyKey
+
+	faultMu sync.RWMutex
+	latency time.Duration
+	fault   FaultFunc
+}
+
+// NewMemoryStore creates an in-memory store with no todos and only the
+// default list.
+func NewMemoryStore() *MemoryStore {
+	at := now()
+	return &MemoryStore{
+		todos:      make(map[int]Todo),
+		nextID:     1,
+		lists:      map[int]TodoList{DefaultListID: {ID: DefaultListID, Name: "Inbox", CreatedAt: at, UpdatedAt: at}},
+		nextListID: DefaultListID + 1,
+		tags:       make(map[int]Tag),
+		nextTagID:  1,
+		tagged:     make(map[int]map[int]bool),
+		blockers:   make(map[int]map[int]bool),
+		keys:       make(map[actorIdempotencyKey]IdempotencyKey),
+	}
+}
+
+// actorIdempotencyKey identifies an Idempotency-Key, which belongs to the
+// actor that sent it.
+type actorIdempotencyKey struct {
+	actor, key string
+}
+
+// SetLatency delays every subsequent operation by d, simulating a slow backend.
+func (m *MemoryStore) SetLatency(d time.Duration) {
+	m.faultMu.Lock()
+	defer m.faultMu.Unlock()
+	m.latency = d
+}
+
+// SetFault installs fn to inject errors into subsequent operations.
+// Pass nil to clear it.
+func (m *MemoryStore) SetFault(fn FaultFunc) {
+	m.faultMu.Lock()
+	defer m.faultMu.Unlock()
+	m.fault = fn
+}
+
+// inject applies the configured latency and fault for op.
+func (m *MemoryStore) inject(ctx context.Context, op string) error {
+	m.faultMu.RLock()
+	latency, fault := m.latency, m.fault
+	m.faultMu.RUnlock()
+
+	if latency > 0 {
+		select {
+		case <-time.After(latency):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	if fault != nil {
+		return fault(op)
+	}
+	return nil
+}
+
+// Close is a no-op; it exists so MemoryStore can be swapped for SQLStore.
+func (m *MemoryStore) Close() error {
+	return nil
+}
+
+// List returns a page of todos matching opts.
+func (m *MemoryStore) List(ctx context.Context, opts ListOptions) (TodoPage, error) {
+	var page TodoPage
+	err := ExecuteWithRobustness(func() error {
+		if err := m.inject(ctx, "list"); err != nil {
+			return err
+		}
+		m.mu.RLock()
+		defer m.mu.RUnlock()
+
+		var after *Todo
+		if opts.After != nil {
+			t, err := opts.After.todo()
+			if err != nil {
+				return err
+			}
+			after = &t
+		}
+
+		counts := m.childCounts()
+		todos := make([]Todo, 0, len(m.todos))
+		for _, t := range m.todos {
+			t = m.populate(t, counts)
+			if opts.matches(t) && (after == nil || opts.Sort.compare(t, *after) > 0) {
+				todos = append(todos, t)
+			}
+		}
+		slices.SortFunc(todos, opts.Sort.compare)
+
+		page = TodoPage{Todos: todos, Revision: m.revision}
+		if n := len(m.events); n > 0 {
+			page.Modified = m.events[n-1].CreatedAt
+		}
+		if opts.Limit > 0 && len(todos) > opts.Limit {
+			page.Todos, page.HasMore = todos[:opts.Limit], true
+		}
+		return nil
+	})
+	return page, err
+}
+
+// Revision returns the number of changes to what List returns so far.
+func (m *MemoryStore) Revision(ctx context.Context) (int64, error) {
+	var revision int64
+	err := ExecuteWithRobustness(func() error {
+		if err := m.inject(ctx, "revision"); err != nil {
+			return err
+		}
+		m.mu.RLock()
+		defer m.mu.RUnlock()
+
+		revision = m.revision
+		return nil
+	})
+	return revision, err
+}
+
+// Search matches todos containing every query term, like SQLStore's
+// fallback for non-Postgres databases.
+func (m *MemoryStore) Search(ctx context.Context, query string, limit int) ([]SearchResult, error) {
+	var results []SearchResult
+	err := ExecuteWithRobustness(func() error {
+		if err := m.inject(ctx, "search"); err != nil {
+			return err
+		}
+		m.mu.RLock()
+		defer m.mu.RUnlock()
+
+		terms := searchTerms(query)
+		counts := m.childCounts()
+		results = []SearchResult{}
+		for _, t := range m.todos {
+			if t.DeletedAt != nil {
+				continue
+			}
+			if r, ok := matchTerms(m.populate(t, counts), terms); ok {
+				results = append(results, r)
+			}
+		}
+		return nil
+	})
+	return rankResults(results, limit), err
+}
+
+// Get returns a single todo, or ErrNotFound.
+func (m *MemoryStore) Get(ctx context.Context, id int) (Todo, error) {
+	var t Todo
+	found := false
+	err := ExecuteWithRobustness(func() error {
+		if err := m.inject(ctx, "get"); err != nil {
+			return err
+		}
+		m.mu.RLock()
+		defer m.mu.RUnlock()
+
+		t, found = m.live(id)
+		t = m.populate(t, m.childCounts())
+		return nil
+	})
+	if err == nil && !found {
+		err = ErrNotFound
+	}
+	return t, err
+}
+
+// Create assigns the next id and stores the todo, reopening its parent if
+// the parent's completion follows its subtasks.
+func (m *MemoryStore) Create(ctx context.Context, t Todo) (Todo, error) {
+	var created Todo
+	err := ExecuteWithRobustness(func() error {
+		if err := m.inject(ctx, "create"); err != nil {
+			return err
+		}
+		m.mu.Lock()
+		defer m.mu.Unlock()
+
+		var cs changeSet
+		var err error
+		created, err = m.insert(&cs, t, now())
+		if err != nil {
+			return err
+		}
+		m.record(ctx, &cs)
+		return nil
+	})
+	return created, err
+}
+
+// CreateIdempotent creates a todo, unless the actor already used the key.
+func (m *MemoryStore) CreateIdempotent(ctx context.Context, key IdempotencyKey, t Todo) (IdempotencyKey, bool, error) {
+	var stored IdempotencyKey
+	var created bool
+	err := ExecuteWithRobustness(func() error {
+		if err := m.inject(ctx, "create"); err != nil {
+			return err
+		}
+		m.mu.Lock()
+		defer m.mu.Unlock()
+
+		actor, _, _ := eventContext(ctx)
+		scope := actorIdempotencyKey{actor, key.Key}
+		if existing, ok := m.keys[scope]; ok {
+			stored, created = existing, false
+			return nil
+		}
+		var cs changeSet
+		todo, err := m.insert(&cs, t, now())
+		if err != nil {
+			return err
+		}
+		m.record(ctx, &cs)
+		key.Todo, key.CreatedAt = todo, todo.CreatedAt
+		m.keys[scope] = key
+		stored, created = key, true
+		return nil
+	})
+	return stored, created, err
+}
+
+// PurgeIdempotencyKeys deletes Idempotency-Keys kept before the given time.
+func (m *MemoryStore) PurgeIdempotencyKeys(ctx context.Context, before time.Time) (int, error) {
+	n := 0
+	err := ExecuteWithRobustness(func() error {
+		if err := m.inject(ctx, "purge_idempotency_keys"); err != nil {
+			return err
+		}
+		m.mu.Lock()
+		defer m.mu.Unlock()
+
+		n = 0
+		for scope, key := range m.keys {
+			if key.CreatedAt.Before(before) {
+				delete(m.keys, scope)
+				n++
+			}
+		}
+		return nil
+	})
+	return n, err
+}
+
+// insert stores a new, incomplete todo last, checking its list and parent
+// exist before changing anything, and adds it to cs. The caller must hold
+// m.mu.
+func (m *MemoryStore) insert(cs *changeSet, t Todo, at time.Time) (Todo, error) {
+	t.ID, t.Completed = m.nextID, false
+	var last string
+	for _, other := range m.todos {
+		last = max(last, other.Position)
+	}
+	position, err := positionBetween(last, "")
+	if err != nil {
+		return Todo{}, err
+	}
+	t.Position = position
+	if t.ParentID != nil {
+		parent, ok := m.live(*t.ParentID)
+		if !ok {
+			return Todo{}, unknownParentError()
+		}
+		if t.ListID == 0 {
+			t.ListID = parent.ListID
+		}
+	}
+	t.stampCreated(at)
+	if _, ok := m.lists[t.ListID]; !ok {
+		return Todo{}, unknownListError()
+	}
+	m.todos[t.ID] = t
+	m.nextID++
+	cs.add(t.ID, EventCreate, nil)
+	m.rollup(cs, t.ParentID, at)
+	return t, nil
+}
+
+// Update applies fn to a copy of the todo and stores the result, then rolls
+// completion up to its old and new parents. Completing a recurring todo
+// creates its next occurrence, with the same tags.
+func (m *MemoryStore) Update(ctx context.Context, id int, fn UpdateFunc) (Todo, error) {
+	var t Todo
+	err := ExecuteWithRobustness(func() error {
+		if err := m.inject(ctx, "update"); err != nil {
+			return err
+		}
+		m.mu.Lock()
+		defer m.mu.Unlock()
+
+		var cs changeSet
+		var err error
+		if t, err = m.update(&cs, id, fn); err != nil {
+			return err
+		}
+		m.record(ctx, &cs)
+		return nil
+	})
+	return t, err
+}
+
+// update is Update without the locking and history, adding the todos it
+// changes to cs. Nothing changes unless it succeeds. The caller must hold
+// m.mu.
+func (m *MemoryStore) update(cs *changeSet, id int, fn UpdateFunc) (Todo, error) {
+	existing, ok := m.live(id)
+	if !ok {
+		return Todo{}, ErrNotFound
+	}
+	t := m.populate(existing, m.childCounts())
+	at := now()
+	if err := applyUpdate(&t, fn, at); err != nil {
+		return Todo{}, err
+	}
+	if err := checkCompletable(existing, t); err != nil {
+		return Todo{}, err
+	}
+	if _, ok := m.lists[t.ListID]; !ok {
+		return Todo{}, unknownListError()
+	}
+	moved := !equalParent(t.ParentID, existing.ParentID)
+	if moved && t.ParentID != nil {
+		if _, ok := m.live(*t.ParentID); !ok {
+			return Todo{}, unknownParentError()
+		}
+		for p := t.ParentID; p != nil; p = m.todos[*p].ParentID {
+			if *p == id {
+				return Todo{}, parentCycleError()
+			}
+		}
+	}
+	children, completed := m.subtasks(id)
+	rollupCompletion(&t, children, completed, at)
+	next, recurring := advanceRecurrence(existing, &t, at)
+	m.touch(cs, id, EventUpdate)
+	t = m.put(t)
+	m.rollup(cs, t.ParentID, at)
+	if moved {
+		m.rollup(cs, existing.ParentID, at)
+	}
+	if recurring {
+		// The list and parent were checked above, so this can't fail.
+		created, err := m.insert(cs, next, at)
+		if err != nil {
+			return Todo{}, err
+		}
+		if tagIDs := m.tagged[id]; len(tagIDs) > 0 {
+			m.tagged[created.ID] = maps.Clone(tagIDs)
+		}
+	}
+	return t, nil
+}
+
+// Delete moves a todo to the trash, or returns ErrNotFound. With cascade it
+// trashes the todo's subtasks, and theirs, too.
+func (m *MemoryStore) Delete(ctx context.Context, id int, cascade bool, cond Precondition) error {
+	return ExecuteWithRobustness(func() error {
+		if err := m.inject(ctx, "delete"); err != nil {
+			return err
+		}
+		m.mu.Lock()
+		defer m.mu.Unlock()
+
+		var cs changeSet
+		if err := m.delete(&cs, id, cascade, cond); err != nil {
+			return err
+		}
+		m.record(ctx, &cs)
+		return nil
+	})
+}
+
+// delete is Delete without the locking and history, adding the todos it
+// changes to cs. The caller must hold m.mu.
+func (m *MemoryStore) delete(cs *changeSet, id int, cascade bool, cond Precondition) error {
+	t, ok := m.live(id)
+	if !ok {
+		return ErrNotFound
+	}
+	if err := cond.check(t.Version); err != nil {
+		return err
+	}
+	if n := m.childCounts()[id]; n > 0 && !cascade {
+		return hasSubtasksConflict(n)
+	}
+	at := now()
+	m.setDeletedAt(cs, EventDelete, id, nil, &at)
+	m.rollup(cs, t.ParentID, at)
+	return nil
+}
+
+// Restore takes a todo out of the trash, with the subtasks trashed along
+// with it.
+func (m *MemoryStore) Restore(ctx context.Context, id int) (Todo, error) {
+	var t Todo
+	err := ExecuteWithRobustness(func() error {
+		if err := m.inject(ctx, "restore"); err != nil {
+			return err
+		}
+		m.mu.Lock()
+		defer m.mu.Unlock()
+
+		existing, ok := m.todos[id]
+		if !ok {
+			return ErrNotFound
+		}
+		if existing.DeletedAt != nil {
+			if existing.ParentID != nil {
+				if _, ok := m.live(*existing.ParentID); !ok {
+					return parentTrashedConflict()
+				}
+			}
+			var cs changeSet
+			m.setDeletedAt(&cs, EventRestore, id, existing.DeletedAt, nil)
+			m.rollup(&cs, existing.ParentID, now())
+			m.record(ctx, &cs)
+		}
+		t = m.populate(m.todos[id], m.childCounts())
+		return nil
+	})
+	return t, err
+}
+
+// setDeletedAt sets the DeletedAt of a todo, and of its subtasks, and
+// theirs, whose DeletedAt equals from, adding each to cs with action. The
+// caller must hold m.mu.
+func (m *MemoryStore) setDeletedAt(cs *changeSet, action string, id int, from, to *time.Time) {
+	m.touch(cs, id, action)
+	t := m.todos[id]
+	t.DeletedAt = to
+	m.todos[id] = t
+	for _, child := range m.todos {
+		if child.ParentID != nil && *child.ParentID == id && equalTime(child.DeletedAt, from) {
+			m.setDeletedAt(cs, action, child.ID, from, to)
+		}
+	}
+}
+
+// Purge permanently deletes todos trashed before the given time.
+func (m *MemoryStore) Purge(ctx context.Context, before time.Time) (int, error) {
+	n := 0
+	err := ExecuteWithRobustness(func() error {
+		if err := m.inject(ctx, "purge"); err != nil {
+			return err
+		}
+		m.mu.Lock()
+		defer m.mu.Unlock()
+
+		var expired []int
+		for id, t := range m.todos {
+			if t.DeletedAt != nil && t.DeletedAt.Before(before) {
+				expired = append(expired, id)
+			}
+		}
+		// Subtasks are trashed no later than their parents, so deleting a
+		// parent's tree only deletes todos that have expired too.
+		var cs changeSet
+		for _, id := range expired {
+			m.deleteTree(&cs, id)
+		}
+		m.record(ctx, &cs)
+		n = len(expired)
+		return nil
+	})
+	return n, err
+}
+
+// Batch runs ops on a copy of the store's state for each op, or for the
+// whole batch if atomic is set, to roll back to if it fails.
+func (m *MemoryStore) Batch(ctx context.Context, ops []BatchOp, atomic bool) ([]BatchResult, error) {
+	var results []BatchResult
+	err := ExecuteWithRobustness(func() error {
+		if err := m.inject(ctx, "batch"); err != nil {
+			return err
+		}
+		m.mu.Lock()
+		defer m.mu.Unlock()
+
+		results = make([]BatchResult, len(ops))
+		start := m.save()
+		from := len(m.events)
+		for i, op := range ops {
+			saved := start
+			if !atomic {
+				saved = m.save()
+			}
+			var cs changeSet
+			res, err := m.batchOp(&cs, op)
+			switch {
+			case err == nil:
+				m.appendEvents(ctx, &cs)
+			case !isExpected(err):
+				m.restore(start)
+				return err
+			case atomic:
+				m.restore(start)
+				return &BatchError{Index: i, Err: err}
+			default:
+				m.restore(saved)
+				res = BatchResult{Err: err}
+			}
+			results[i] = res
+		}
+		m.countChange(from)
+		return nil
+	})
+	return results, err
+}
+
+// batchOp runs a single op of a batch, adding the todos it changes to cs.
+// The caller must hold m.mu.
+func (m *MemoryStore) batchOp(cs *changeSet, op BatchOp) (BatchResult, error) {
+	switch op.Op {
+	case BatchCreate:
+		t, err := m.insert(cs, op.Todo, now())
+		return BatchResult{Todo: &t}, err
+	case BatchUpdate:
+		t, err := m.update(cs, op.ID, op.Update)
+		return BatchResult{Todo: &t}, err
+	case BatchDelete:
+		return BatchResult{}, m.delete(cs, op.ID, op.Cascade, nil)
+	case BatchClearCompleted:
+		if _, ok := m.lists[op.ListID]; op.ListID != 0 && !ok {
+			return BatchResult{}, unknownListError()
+		}
+		for _, id := range clearRoots(m.clearable(op.ListID)) {
+			if err := m.delete(cs, id, true, nil); err != nil {
+				return BatchResult{}, err
+			}
+		}
+		return BatchResult{Count: cs.count(EventDelete)}, nil
+	case BatchCompleteAll:
+		if _, ok := m.lists[op.ListID]; !ok {
+			return BatchResult{}, unknownListError()
+		}
+		var ids []int
+		for id, t := range m.todos {
+			if t.ListID == op.ListID && !t.Completed && t.DeletedAt == nil {
+				ids = append(ids, id)
+			}
+		}
+		slices.Sort(ids)
+		n, err := completeAll(ids, func(id int, fn UpdateFunc) error {
+			_, err := m.update(cs, id, fn)
+			return err
+		})
+		return BatchResult{Count: n}, err
+	}
+	return BatchResult{}, fmt.Errorf("%w: unknown batch operation %q", ErrInvalidInput, op.Op)
+}
+
+// clearable returns the completed todos in listID, or in every list if it
+// is 0, that have no open subtasks anywhere below them, by id with their
+// parent ids. The caller must hold m.mu.
+func (m *MemoryStore) clearable(listID int) map[int]*int {
+	open := make(map[int]bool)
+	for _, t := range m.todos {
+		if t.DeletedAt != nil || t.Completed {
+			continue
+		}
+		for p := t.ParentID; p != nil && !open[*p]; p = m.todos[*p].ParentID {
+			open[*p] = true
+		}
+	}
+	candidates := make(map[int]*int)
+	for id, t := range m.todos {
+		if t.Completed && t.DeletedAt == nil && (listID == 0 || t.ListID == listID) && !open[id] {
+			candidates[id] = t.ParentID
+		}
+	}
+	return candidates
+}
+
+// memoryState is a copy of everything a batch op can change, to roll back
+// to if it fails.
+type memoryState struct {
+	todos    map[int]Todo
+	nextID   int
+	tagged   map[int]map[int]bool
+	blockers map[int]map[int]bool
+	events   int
+	revision int64
+}
+
+// save copies the state batch ops can change. The caller must hold m.mu.
+func (m *MemoryStore) save() memoryState {
+	return memoryState{
+		todos:    maps.Clone(m.todos),
+		nextID:   m.nextID,
+		tagged:   cloneSets(m.tagged),
+		blockers: cloneSets(m.blockers),
+		events:   len(m.events),
+		revision: m.revision,
+	}
+}
+
+// restore rolls the store back to a saved state. The caller must hold m.mu.
+func (m *MemoryStore) restore(s memoryState) {
+	m.todos, m.nextID = s.todos, s.nextID
+	m.tagged, m.blockers = s.tagged, s.blockers
+	m.events, m.revision = m.events[:s.events], s.revision
+}
+
+func cloneSets(sets map[int]map[int]bool) map[int]map[int]bool {
+	clone := make(map[int]map[int]bool, len(sets))
+	for id, set := range sets {
+		clone[id] = maps.Clone(set)
+	}
+	return clone
+}
+
+// live returns the todo with the given id unless it is missing or trashed.
+// The caller must hold m.mu.
+func (m *MemoryStore) live(id int) (Todo, bool) {
+	t, ok := m.todos[id]
+	if !ok || t.DeletedAt != nil {
+		return Todo{}, false
+	}
+	return t, true
+}
+
+// Move places a todo next to another by giving it a position between the
+// other todo and that todo's neighbour.
+func (m *MemoryStore) Move(ctx context.Context, id int, mv Move) (Todo, error) {
+	var t Todo
+	err := ExecuteWithRobustness(func() error {
+		if err := m.inject(ctx, "move"); err != nil {
+			return err
+		}
+		m.mu.Lock()
+		defer m.mu.Unlock()
+
+		existing, ok := m.live(id)
+		if !ok {
+			return ErrNotFound
+		}
+		anchor, ok := m.live(mv.anchor())
+		if !ok {
+			return unknownAnchorError(mv)
+		}
+		var neighbour string
+		for _, other := range m.todos {
+			if other.ID == id {
+				continue
+			}
+			if mv.Before != nil && other.Position < anchor.Position {
+				neighbour = max(neighbour, other.Position)
+			}
+			if mv.After != nil && other.Position > anchor.Position && (neighbour == "" || other.Position < neighbour) {
+				neighbour = other.Position
+			}
+		}
+		position, err := mv.position(anchor.Position, neighbour)
+		if err != nil {
+			return err
+		}
+		var cs changeSet
+		m.touch(&cs, id, EventUpdate)
+		existing.Position, existing.UpdatedAt = position, now()
+		existing = m.put(existing)
+		m.record(ctx, &cs)
+		t = m.populate(existing, m.childCounts())
+		return nil
+	})
+	return t, err
+}
+
+// deleteTree removes a todo and all its subtasks, adding them to cs. The
+// caller must hold m.mu.
+func (m *MemoryStore) deleteTree(cs *changeSet, id int) {
+	m.touch(cs, id, EventPurge)
+	delete(m.todos, id)
+	delete(m.tagged, id)
+	delete(m.blockers, id)
+	for _, blockerIDs := range m.blockers {
+		delete(blockerIDs, id)
+	}
+	for _, t := range m.todos {
+		if t.ParentID != nil && *t.ParentID == id {
+			m.deleteTree(cs, t.ID)
+		}
+	}
+}
+
+// subtasks counts a todo's untrashed subtasks and how many of them are
+// complete. The caller must hold m.mu.
+func (m *MemoryStore) subtasks(id int) (children, completed int) {
+	for _, t := range m.todos {
+		if t.ParentID != nil && *t.ParentID == id && t.DeletedAt == nil {
+			children++
+			if t.Completed {
+				completed++
+			}
+		}
+	}
+	return children, completed
+}
+
+// rollup recomputes the completion of the todo with the given id, if any,
+// from its subtasks, and of its ancestors as long as that changes anything,
+// adding the todos it changes to cs. The caller must hold m.mu.
+func (m *MemoryStore) rollup(cs *changeSet, id *int, at time.Time) {
+	for id != nil {
+		t, ok := m.todos[*id]
+		if !ok {
+			return
+		}
+		children, completed := m.subtasks(*id)
+		if !rollupCompletion(&t, children, completed, at) {
+			return
+		}
+		m.touch(cs, *id, EventUpdate)
+		m.put(t)
+		id = t.ParentID
+	}
+}
+
+// Blockers returns the todos blocking a todo, in id order.
+func (m *MemoryStore) Blockers(ctx context.Context, id int) ([]Todo, error) {
+	var blockers []Todo
+	err := ExecuteWithRobustness(func() error {
+		if err := m.inject(ctx, "blockers"); err != nil {
+			return err
+		}
+		m.mu.RLock()
+		defer m.mu.RUnlock()
+
+		if _, ok := m.live(id); !ok {
+			return ErrNotFound
+		}
+		counts := m.childCounts()
+		blockers = []Todo{}
+		for blockerID := range m.blockers[id] {
+			if blocker, ok := m.live(blockerID); ok {
+				blockers = append(blockers, m.populate(blocker, counts))
+			}
+		}
+		slices.SortFunc(blockers, func(a, b Todo) int { return cmp.Compare(a.ID, b.ID) })
+		return nil
+	})
+	return blockers, err
+}
+
+// AddBlocker records that blockerID blocks todoID.
+func (m *MemoryStore) AddBlocker(ctx context.Context, todoID, blockerID int) (Todo, error) {
+	return m.setBlocker(ctx, "add_blocker", todoID, blockerID, true)
+}
+
+// RemoveBlocker removes the dependency of todoID on blockerID.
+func (m *MemoryStore) RemoveBlocker(ctx context.Context, todoID, blockerID int) (Todo, error) {
+	return m.setBlocker(ctx, "remove_blocker", todoID, blockerID, false)
+}
+
+// setBlocker adds or removes a dependency, touching the todo's UpdatedAt
+// only if that changes anything.
+func (m *MemoryStore) setBlocker(ctx context.Context, op string, todoID, blockerID int, add bool) (Todo, error) {
+	var t Todo
+	err := ExecuteWithRobustness(func() error {
+		if err := m.inject(ctx, op); err != nil {
+			return err
+		}
+		m.mu.Lock()
+		defer m.mu.Unlock()
+
+		existing, ok := m.live(todoID)
+		if !ok {
+			return ErrNotFound
+		}
+		if _, ok := m.live(blockerID); !ok {
+			return ErrNotFound
+		}
+		if m.blockers[todoID][blockerID] != add {
+			var cs changeSet
+			m.touch(&cs, todoID, EventUpdate)
+			if add {
+				if m.blockedBy(blockerID, todoID) {
+					return dependencyCycleConflict()
+				}
+				if m.blockers[todoID] == nil {
+					m.blockers[todoID] = make(map[int]bool)
+				}
+				m.blockers[todoID][blockerID] = true
+			} else {
+				delete(m.blockers[todoID], blockerID)
+			}
+			existing.UpdatedAt = now()
+			existing = m.put(existing)
+			m.record(ctx, &cs)
+		}
+		t = m.populate(existing, m.childCounts())
+		return nil
+	})
+	return t, err
+}
+
+// blockedBy reports whether the todo with id is, or is transitively blocked
+// by, blockerID. The caller must hold m.mu.
+func (m *MemoryStore) blockedBy(id, blockerID int) bool {
+	seen := make(map[int]bool)
+	pending := []int{id}
+	for len(pending) > 0 {
+		id, pending = pending[len(pending)-1], pending[:len(pending)-1]
+		if id == blockerID {
+			return true
+		}
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		for next := range m.blockers[id] {
+			pending = append(pending, next)
+		}
+	}
+	return false
+}
+
+// History returns the events of a todo, oldest first.
+func (m *MemoryStore) History(ctx context.Context, id int) ([]TodoEvent, error) {
+	var events []TodoEvent
+	err := ExecuteWithRobustness(func() error {
+		if err := m.inject(ctx, "history"); err != nil {
+			return err
+		}
+		m.mu.RLock()
+		defer m.mu.RUnlock()
+
+		events = []TodoEvent{}
+		for _, e := range m.events {
+			if e.TodoID == id {
+				events = append(events, e)
+			}
+		}
+		if _, ok := m.todos[id]; !ok && len(events) == 0 {
+			return ErrNotFound
+		}
+		return nil
+	})
+	return events, err
+}
+
+// Events returns the events of the first limit revisions after the given
+// one, in revision and id order.
+func (m *MemoryStore) Events(ctx context.Context, after int64, limit int) ([]TodoEvent, error) {
+	var events []TodoEvent
+	err := ExecuteWithRobustness(func() error {
+		if err := m.inject(ctx, "events"); err != nil {
+			return err
+		}
+		m.mu.RLock()
+		defer m.mu.RUnlock()
+
+		// Events are appended in revision order.
+		events = []TodoEvent{}
+		revisions := 0
+		for _, e := range m.events {
+			if e.Revision <= after {
+				continue
+			}
+			if len(events) == 0 || e.Revision != events[len(events)-1].Revision {
+				if revisions == limit {
+					break
+				}
+				revisions++
+			}
+			events = append(events, e)
+		}
+		return nil
+	})
+	return events, err
+}
+
+// EventsRevision returns the revision; the memory store has no replicas.
+func (m *MemoryStore) EventsRevision(ctx context.Context) (int64, error) {
+	var revision int64
+	err := ExecuteWithRobustness(func() error {
+		if err := m.inject(ctx, "events_revision"); err != nil {
+			return err
+		}
+		m.mu.RLock()
+		defer m.mu.RUnlock()
+
+		revision = m.revision
+		return nil
+	})
+	return revision, err
+}
+
+// snapshot returns the todo with id as events record it, or nil if it
+// doesn't exist. The caller must hold m.mu.
+func (m *MemoryStore) snapshot(id int) *Todo {
+	t, ok := m.todos[id]
+	if !ok {
+		return nil
+	}
+	t = m.populate(t, m.childCounts())
+	return &t
+}
+
+// touch adds the todo with id, as it is before changing, to cs, and bumps
+// its version. The caller must hold m.mu.
+func (m *MemoryStore) touch(cs *changeSet, id int, action string) {
+	if cs.has(id) {
+		return
+	}
+	cs.add(id, action, m.snapshot(id))
+	if t, ok := m.todos[id]; ok {
+		t.Version++
+		m.todos[id] = t
+	}
+}
+
+// put stores a changed todo, keeping the version touch gave it, and returns
+// it as stored. The caller must hold m.mu.
+func (m *MemoryStore) put(t Todo) Todo {
+	t.Version = m.todos[t.ID].Version
+	m.todos[t.ID] = t
+	return t
+}
+
+// record appends an event for each todo in cs, with its current state as
+// the after state, as one change. The caller must hold m.mu.
+func (m *MemoryStore) record(ctx context.Context, cs *changeSet) {
+	from := len(m.events)
+	m.appendEvents(ctx, cs)
+	m.countChange(from)
+}
+
+// appendEvents appends an event for each todo in cs, with its current state
+// as the after state, without a revision yet. The caller must hold m.mu.
+func (m *MemoryStore) appendEvents(ctx context.Context, cs *changeSet) {
+	actor, requestID, traceID := eventContext(ctx)
+	at := now()
+	for _, id := range cs.ids {
+		m.events = append(m.events, TodoEvent{
+			ID: int64(len(m.events) + 1), TodoID: id, Action: cs.action[id],
+			Before: cs.before[id], After: m.snapshot(id),
+			Actor: actor, RequestID: requestID, TraceID: traceID, CreatedAt: at,
+		})
+	}
+}
+
+// countChange counts the events appended since index from, if any, as one
+// change in the revision, and gives them that revision. The caller must
+// hold m.mu.
+func (m *MemoryStore) countChange(from int) {
+	if len(m.events) == from {
+		return
+	}
+	m.revision++
+	for i := from; i < len(m.events); i++ {
+		m.events[i].Revision = m.revision
+	}
+}
+
+// Lists returns the lists in id order.
+func (m *MemoryStore) Lists(ctx context.Context, includeArchived bool) ([]TodoList, error) {
+	var lists []TodoList
+	err := ExecuteWithRobustness(func() error {
+		if err := m.inject(ctx, "lists"); err != nil {
+			return err
+		}
+		m.mu.RLock()
+		defer m.mu.RUnlock()
+
+		lists = make([]TodoList, 0, len(m.lists))
+		for _, l := range m.lists {
+			if includeArchived || !l.Archived {
+				lists = append(lists, l)
+			}
+		}
+		slices.SortFunc(lists, func(a, b TodoList) int { return cmp.Compare(a.ID, b.ID) })
+		return nil
+	})
+	return lists, err
+}
+
+// GetList returns a single list, or ErrListNotFound.
+func (m *MemoryStore) GetList(ctx context.Context, id int) (TodoList, error) {
+	var l TodoList
+	err := ExecuteWithRobustness(func() error {
+		if err := m.inject(ctx, "get_list"); err != nil {
+			return err
+		}
+		m.mu.RLock()
+		defer m.mu.RUnlock()
+
+		var ok bool
+		if l, ok = m.lists[id]; !ok {
+			return ErrListNotFound
+		}
+		return nil
+	})
+	return l, err
+}
+
+// CreateList assigns the next list id and stores the list.
+func (m *MemoryStore) CreateList(ctx context.Context, l TodoList) (TodoList, error) {
+	var created TodoList
+	err := ExecuteWithRobustness(func() error {
+		if err := m.inject(ctx, "create_list"); err != nil {
+			return err
+		}
+		m.mu.Lock()
+		defer m.mu.Unlock()
+
+		at := now()
+		created = l
+		created.ID, created.CreatedAt, created.UpdatedAt = m.nextListID, at, at
+		m.lists[created.ID] = created
+		m.nextListID++
+		return nil
+	})
+	return created, err
+}
+
+// UpdateList applies fn to a copy of the list and stores the result.
+func (m *MemoryStore) UpdateList(ctx context.Context, id int, fn ListUpdateFunc) (TodoList, error) {
+	var l TodoList
+	err := ExecuteWithRobustness(func() error {
+		if err := m.inject(ctx, "update_list"); err != nil {
+			return err
+		}
+		m.mu.Lock()
+		defer m.mu.Unlock()
+
+		existing, ok := m.lists[id]
+		if !ok {
+			return ErrListNotFound
+		}
+		l = existing
+		if err := applyListUpdate(&l, fn, now()); err != nil {
+			return err
+		}
+		m.lists[id] = l
+		return nil
+	})
+	return l, err
+}
+
+// DeleteList removes an empty list other than the default list, along with
+// any todos of it in the trash.
+func (m *MemoryStore) DeleteList(ctx context.Context, id int) error {
+	return ExecuteWithRobustness(func() error {
+		if err := m.inject(ctx, "delete_list"); err != nil {
+			return err
+		}
+		m.mu.Lock()
+		defer m.mu.Unlock()
+
+		if _, ok := m.lists[id]; !ok {
+			return ErrListNotFound
+		}
+		if id == DefaultListID {
+			return defaultListConflict()
+		}
+		n := 0
+		for _, t := range m.todos {
+			if t.ListID == id && t.DeletedAt == nil {
+				n++
+			}
+		}
+		if n > 0 {
+			return listNotEmptyConflict(n)
+		}
+		var cs changeSet
+		for _, t := range m.todos {
+			if t.ListID == id {
+				m.deleteTree(&cs, t.ID)
+			}
+		}
+		m.record(ctx, &cs)
+		delete(m.lists, id)
+		return nil
+	})
+}
+
+// childCounts returns the number of subtasks of each todo that has any, by
+// todo id, leaving out trashed subtasks. The caller must hold m.mu.
+func (m *MemoryStore) childCounts() map[int]int {
+	counts := make(map[int]int)
+	for _, t := range m.todos {
+		if t.ParentID != nil && t.DeletedAt == nil {
+			counts[*t.ParentID]++
+		}
+	}
+	return counts
+}
+
+// populate returns t with its tags, open blockers and child count, from
+// counts, filled in. The caller must hold m.mu.
+func (m *MemoryStore) populate(t Todo, counts map[int]int) Todo {
+	t.ChildCount = counts[t.ID]
+	t.OpenBlockers = 0
+	for id := range m.blockers[t.ID] {
+		if blocker, ok := m.live(id); ok && !blocker.Completed {
+			t.OpenBlockers++
+		}
+	}
+	t.Tags = []Tag{}
+	for id := range m.tagged[t.ID] {
+		t.Tags = append(t.Tags, m.tags[id])
+	}
+	sortTags(t.Tags)
+	return t
+}
+
+// Tags returns every tag, ordered by name.
+func (m *MemoryStore) Tags(ctx context.Context) ([]Tag, error) {
+	var tags []Tag
+	err := ExecuteWithRobustness(func() error {
+		if err := m.inject(ctx, "tags"); err != nil {
+			return err
+		}
+		m.mu.RLock()
+		defer m.mu.RUnlock()
+
+		tags = make([]Tag, 0, len(m.tags))
+		for _, g := range m.tags {
+			tags = append(tags, g)
+		}
+		sortTags(tags)
+		return nil
+	})
+	return tags, err
+}
+
+// GetTag returns a single tag, or ErrTagNotFound.
+func (m *MemoryStore) GetTag(ctx context.Context, id int) (Tag, error) {
+	var g Tag
+	err := ExecuteWithRobustness(func() error {
+		if err := m.inject(ctx, "get_tag"); err != nil {
+			return err
+		}
+		m.mu.RLock()
+		defer m.mu.RUnlock()
+
+		var ok bool
+		if g, ok = m.tags[id]; !ok {
+			return ErrTagNotFound
+		}
+		return nil
+	})
+	return g, err
+}
+
+// tagNamed returns the id of the tag with the given name, or 0. The caller
+// must hold m.mu.
+func (m *MemoryStore) tagNamed(name string) int {
+	for id, g := range m.tags {
+		if g.Name == name {
+			return id
+		}
+	}
+	return 0
+}
+
+// CreateTag assigns the next tag id and stores the tag.
+func (m *MemoryStore) CreateTag(ctx context.Context, name string) (Tag, error) {
+	var g Tag
+	err := ExecuteWithRobustness(func() error {
+		if err := m.inject(ctx, "create_tag"); err != nil {
+			return err
+		}
+		m.mu.Lock()
+		defer m.mu.Unlock()
+
+		if m.tagNamed(name) != 0 {
+			return tagExistsConflict(name)
+		}
+		g = Tag{ID: m.nextTagID, Name: name}
+		m.tags[g.ID] = g
+		m.nextTagID++
+		return nil
+	})
+	return g, err
+}
+
+// RenameTag renames a tag unless another tag has the name.
+func (m *MemoryStore) RenameTag(ctx context.Context, id int, name string) (Tag, error) {
+	var g Tag
+	err := ExecuteWithRobustness(func() error {
+		if err := m.inject(ctx, "rename_tag"); err != nil {
+			return err
+		}
+		m.mu.Lock()
+		defer m.mu.Unlock()
+
+		if _, ok := m.tags[id]; !ok {
+			return ErrTagNotFound
+		}
+		if other := m.tagNamed(name); other != 0 && other != id {
+			return tagExistsConflict(name)
+		}
+		g = Tag{ID: id, Name: name}
+		if m.tags[id] == g {
+			return nil
+		}
+		// Todos are shown with their tags' names, so renaming a tag changes
+		// each todo it is attached to.
+		cs := m.touchTagged(id)
+		m.tags[id] = g
+		m.record(ctx, &cs)
+		return nil
+	})
+	return g, err
+}
+
+// DeleteTag removes a tag and detaches it from every todo.
+func (m *MemoryStore) DeleteTag(ctx context.Context, id int) error {
+	return ExecuteWithRobustness(func() error {
+		if err := m.inject(ctx, "delete_tag"); err != nil {
+			return err
+		}
+		m.mu.Lock()
+		defer m.mu.Unlock()
+
+		if _, ok := m.tags[id]; !ok {
+			return ErrTagNotFound
+		}
+		cs := m.touchTagged(id)
+		delete(m.tags, id)
+		for _, tagIDs := range m.tagged {
+			delete(tagIDs, id)
+		}
+		m.record(ctx, &cs)
+		return nil
+	})
+}
+
+// touchTagged records an update of each todo not in the trash that has the
+// tag, stamping its UpdatedAt, and returns the change set. The caller must
+// hold m.mu.
+func (m *MemoryStore) touchTagged(tagID int) changeSet {
+	var cs changeSet
+	at := now()
+	for _, todoID := range slices.Sorted(maps.Keys(m.tagged)) {
+		t, ok := m.live(todoID)
+		if !ok || !m.tagged[todoID][tagID] {
+			continue
+		}
+		m.touch(&cs, todoID, EventUpdate)
+		t.UpdatedAt = at
+		m.put(t)
+	}
+	return cs
+}
+
+// TagTodo attaches a tag to a todo.
+func (m *MemoryStore) TagTodo(ctx context.Context, todoID, tagID int) (Todo, error) {
+	return m.setTag(ctx, "tag_todo", todoID, tagID, true)
+}
+
+// UntagTodo detaches a tag from a todo.
+func (m *MemoryStore) UntagTodo(ctx context.Context, todoID, tagID int) (Todo, error) {
+	return m.setTag(ctx, "untag_todo", todoID, tagID, false)
+}
+
+// setTag attaches or detaches a tag, touching the todo's UpdatedAt only if
+// that changes anything.
+func (m *MemoryStore) setTag(ctx context.Context, op string, todoID, tagID int, attach bool) (Todo, error) {
+	var t Todo
+	err := ExecuteWithRobustness(func() error {
+		if err := m.inject(ctx, op); err != nil {
+			return err
+		}
+		m.mu.Lock()
+		defer m.mu.Unlock()
+
+		existing, ok := m.live(todoID)
+		if !ok {
+			return ErrNotFound
+		}
+		if _, ok := m.tags[tagID]; !ok {
+			return ErrTagNotFound
+		}
+		if m.tagged[todoID][tagID] != attach {
+			var cs changeSet
+			m.touch(&cs, todoID, EventUpdate)
+			if m.tagged[todoID] == nil {
+				m.tagged[todoID] = make(map[int]bool)
+			}
+			if attach {
+				m.tagged[todoID][tagID] = true
+			} else {
+				delete(m.tagged[todoID], tagID)
+			}
+			existing.UpdatedAt = now()
+			existing = m.put(existing)
+			m.record(ctx, &cs)
+		}
+		t = m.populate(existing, m.childCounts())
+		return nil
+	})
+	return t, err
+}
+
+// Ping reports an injected "ping" fault, if any.
+func (m *MemoryStore) Ping(ctx context.Context) error {
+	return m.inject(ctx, "ping")
+}
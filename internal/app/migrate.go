@@ -0,0 +1,283 @@
+// Written by Gemini CLI
+// This file is licensed under the MIT License.
+// See the LICENSE file for details.
+
+package app
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Dialect identifies the SQL flavor of a database connection.
+type Dialect string
+
+const (
+	DialectPostgres Dialect = "postgres"
+	DialectSQLite   Dialect = "sqlite"
+)
+
+// ErrSchemaTooNew is returned when the database has migrations applied that
+// this binary does not know about, e.g. after rolling back a deployment.
+// Serving in that state risks writing data the newer schema doesn't expect.
+var ErrSchemaTooNew = errors.New("database schema is newer than this binary supports")
+
+// migrationLockID is the Postgres advisory lock key held while migrating,
+// so replicas starting at the same time don't race to apply migrations.
+const migrationLockID = 0x746f646f // "todo"
+
+//go:embed migrations
+var migrationFiles embed.FS
+
+var migrationFileRe = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+// Migration is one versioned schema change.
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+// Migrator applies the embedded migrations for one dialect and records them
+// in the schema_migrations table.
+type Migrator struct {
+	db         *sql.DB
+	dialect    Dialect
+	migrations []Migration
+}
+
+// NewMigrator loads the embedded migrations for dialect.
+func NewMigrator(db *sql.DB, dialect Dialect) (*Migrator, error) {
+	migrations, err := loadMigrations(dialect)
+	if err != nil {
+		return nil, err
+	}
+	return &Migrator{db: db, dialect: dialect, migrations: migrations}, nil
+}
+
+// loadMigrations reads migrations/<dialect>/NNNN_name.{up,down}.sql, ordered by version.
+func loadMigrations(dialect Dialect) ([]Migration, error) {
+	dir := path.Join("migrations", string(dialect))
+	entries, err := fs.ReadDir(migrationFiles, dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s migrations: %w", dialect, err)
+	}
+
+	byVersion := map[int]*Migration{}
+	for _, e := range entries {
+		m := migrationFileRe.FindStringSubmatch(e.Name())
+		if m == nil {
+			return nil, fmt.Errorf("unexpected migration file name %q", e.Name())
+		}
+		version, _ := strconv.Atoi(m[1])
+		body, err := migrationFiles.ReadFile(path.Join(dir, e.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		mig, ok := byVersion[version]
+		if !ok {
+			mig = &Migration{Version: version, Name: m[2]}
+			byVersion[version] = mig
+		} else if mig.Name != m[2] {
+			return nil, fmt.Errorf("migration %d has conflicting names %q and %q", version, mig.Name, m[2])
+		}
+		if m[3] == "up" {
+			mig.Up = string(body)
+		} else {
+			mig.Down = string(body)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, mig := range byVersion {
+		if mig.Up == "" {
+			return nil, fmt.Errorf("migration %d_%s has no up script", mig.Version, mig.Name)
+		}
+		migrations = append(migrations, *mig)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	for i, mig := range migrations {
+		if mig.Version != i+1 {
+			return nil, fmt.Errorf("migrations must be numbered consecutively from 1; found %d at position %d", mig.Version, i+1)
+		}
+	}
+	return migrations, nil
+}
+
+// Latest returns the highest migration version this binary knows about.
+func (m *Migrator) Latest() int {
+	return len(m.migrations)
+}
+
+// Version returns the highest migration version applied to the database,
+// or 0 for a database that has never been migrated.
+func (m *Migrator) Version(ctx context.Context) (int, error) {
+	return m.version(ctx, m.db)
+}
+
+type queryRower interface {
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+func (m *Migrator) version(ctx context.Context, q queryRower) (int, error) {
+	var exists bool
+	var err error
+	switch m.dialect {
+	case DialectPostgres:
+		err = q.QueryRowContext(ctx, "SELECT to_regclass('schema_migrations') IS NOT NULL").Scan(&exists)
+	default:
+		err = q.QueryRowContext(ctx, "SELECT COUNT(*) > 0 FROM sqlite_master WHERE type = 'table' AND name = 'schema_migrations'").Scan(&exists)
+	}
+	if err != nil || !exists {
+		return 0, err
+	}
+
+	var version int
+	err = q.QueryRowContext(ctx, "SELECT COALESCE(MAX(version), 0) FROM schema_migrations").Scan(&version)
+	return version, err
+}
+
+// Check returns ErrSchemaTooNew if the database is ahead of this binary.
+// A database that is behind only logs a warning, since the migrate job may
+// still be running.
+func (m *Migrator) Check(ctx context.Context) error {
+	version, err := m.Version(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to read schema version: %w", err)
+	}
+	if version > m.Latest() {
+		return fmt.Errorf("%w: database is at version %d, binary supports up to %d", ErrSchemaTooNew, version, m.Latest())
+	}
+	if version < m.Latest() {
+		slog.Warn("Database schema is behind; run the migrate command", "version", version, "latest", m.Latest())
+	}
+	return nil
+}
+
+// Up applies all pending migrations, each in its own transaction.
+func (m *Migrator) Up(ctx context.Context) error {
+	return m.locked(ctx, func(conn *sql.Conn) error {
+		version, err := m.version(ctx, conn)
+		if err != nil {
+			return err
+		}
+		if version > m.Latest() {
+			return fmt.Errorf("%w: database is at version %d, binary supports up to %d", ErrSchemaTooNew, version, m.Latest())
+		}
+		for _, mig := range m.migrations[version:] {
+			slog.Info("Applying migration", "version", mig.Version, "name", mig.Name)
+			err := m.apply(ctx, conn, mig.Up, "INSERT INTO schema_migrations (version, name, applied_at) VALUES ($1, $2, $3)", mig.Version, mig.Name, time.Now().UTC())
+			if err != nil {
+				return fmt.Errorf("migration %d_%s failed: %w", mig.Version, mig.Name, err)
+			}
+		}
+		return nil
+	})
+}
+
+// Down reverts the most recent steps migrations.
+func (m *Migrator) Down(ctx context.Context, steps int) error {
+	return m.locked(ctx, func(conn *sql.Conn) error {
+		version, err := m.version(ctx, conn)
+		if err != nil {
+			return err
+		}
+		if version > m.Latest() {
+			return fmt.Errorf("%w: cannot revert migrations this binary does not have", ErrSchemaTooNew)
+		}
+		for ; steps > 0 && version > 0; steps, version = steps-1, version-1 {
+			mig := m.migrations[version-1]
+			if mig.Down == "" {
+				return fmt.Errorf("migration %d_%s is irreversible", mig.Version, mig.Name)
+			}
+			slog.Info("Reverting migration", "version", mig.Version, "name", mig.Name)
+			if err := m.apply(ctx, conn, mig.Down, "DELETE FROM schema_migrations WHERE version = $1", mig.Version); err != nil {
+				return fmt.Errorf("reverting migration %d_%s failed: %w", mig.Version, mig.Name, err)
+			}
+		}
+		return nil
+	})
+}
+
+// apply runs a migration script and its schema_migrations bookkeeping atomically.
+func (m *Migrator) apply(ctx context.Context, conn *sql.Conn, script, record string, args ...any) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, script); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, record, args...); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// locked runs fn on a dedicated connection that holds the migration lock and
+// has the schema_migrations table in place.
+func (m *Migrator) locked(ctx context.Context, fn func(conn *sql.Conn) error) error {
+	conn, err := m.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	// Advisory locks are session scoped, so lock and unlock on the same conn.
+	// SQLite needs no lock: write transactions are already serialized.
+	if m.dialect == DialectPostgres {
+		slog.Info("Waiting for migration lock")
+		if _, err := conn.ExecContext(ctx, "SELECT pg_advisory_lock($1)", migrationLockID); err != nil {
+			return fmt.Errorf("failed to acquire migration lock: %w", err)
+		}
+		defer func() {
+			if _, err := conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock($1)", migrationLockID); err != nil {
+				slog.Error("Failed to release migration lock", "error", err)
+			}
+		}()
+	}
+
+	_, err = conn.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INTEGER PRIMARY KEY,
+		name TEXT NOT NULL,
+		applied_at TIMESTAMP NOT NULL
+	)`)
+	if err != nil {
+		return fmt.Errorf("failed to create schema_migrations: %w", err)
+	}
+	return fn(conn)
+}
+
+// GrantAll gives role full access to every table and sequence, so the
+// application's IAM user can use objects created by the migration user.
+func (m *Migrator) GrantAll(ctx context.Context, role string) error {
+	if m.dialect != DialectPostgres {
+		return nil
+	}
+	role = pq.QuoteIdentifier(role)
+	for _, stmt := range []string{
+		"GRANT ALL PRIVILEGES ON ALL TABLES IN SCHEMA public TO " + role,
+		"GRANT ALL PRIVILEGES ON ALL SEQUENCES IN SCHEMA public TO " + role,
+	} {
+		if _, err := m.db.ExecContext(ctx, stmt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
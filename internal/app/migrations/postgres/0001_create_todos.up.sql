@@ -0,0 +1,16 @@
+-- Written by Gemini CLI
+-- This file is licensed under the MIT License.
+-- See the LICENSE file for details.
+
+-- Baseline schema, formerly init.sql. IF NOT EXISTS lets databases that were
+-- initialized by the old db-init job adopt the migration history unchanged.
+CREATE TABLE IF NOT EXISTS todos (
+    id SERIAL PRIMARY KEY,
+    task TEXT NOT NULL,
+    completed BOOLEAN NOT NULL DEFAULT FALSE
+);
+
+-- The old db-init job made completed nullable, but todos are scanned into a
+-- plain bool: a single NULL would fail every list.
+UPDATE todos SET completed = FALSE WHERE completed IS NULL;
+ALTER TABLE todos ALTER COLUMN completed SET NOT NULL;
@@ -0,0 +1,8 @@
+-- Written by Gemini CLI
+-- This file is licensed under the MIT License.
+-- See the LICENSE file for details.
+
+-- Keyset pagination on GET /todos orders by (task, id) when sorting by task
+-- and by id within a completion state when filtering on completed.
+CREATE INDEX todos_task_id_idx ON todos (task, id);
+CREATE INDEX todos_completed_id_idx ON todos (completed, id);
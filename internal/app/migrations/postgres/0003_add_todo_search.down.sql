@@ -0,0 +1,6 @@
+-- Written by Gemini CLI
+-- This file is licensed under the MIT License.
+-- See the LICENSE file for details.
+
+DROP INDEX IF EXISTS todos_search_idx;
+ALTER TABLE todos DROP COLUMN IF EXISTS search;
@@ -0,0 +1,9 @@
+-- Written by Gemini CLI
+-- This file is licensed under the MIT License.
+-- See the LICENSE file for details.
+
+-- Full-text search for GET /todos/search. The generated column keeps the
+-- tsvector in sync with task without triggers.
+ALTER TABLE todos
+    ADD COLUMN search tsvector GENERATED ALWAYS AS (to_tsvector('english', task)) STORED;
+CREATE INDEX todos_search_idx ON todos USING GIN (search);
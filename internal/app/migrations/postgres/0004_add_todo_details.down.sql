@@ -0,0 +1,12 @@
+-- Written by Gemini CLI
+-- This file is licensed under the MIT License.
+-- See the LICENSE file for details.
+
+DROP INDEX IF EXISTS todos_due_at_idx;
+ALTER TABLE todos
+    DROP COLUMN IF EXISTS completed_at,
+    DROP COLUMN IF EXISTS updated_at,
+    DROP COLUMN IF EXISTS created_at,
+    DROP COLUMN IF EXISTS notes,
+    DROP COLUMN IF EXISTS priority,
+    DROP COLUMN IF EXISTS due_at;
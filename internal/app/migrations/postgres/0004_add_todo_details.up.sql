@@ -0,0 +1,18 @@
+-- Written by Gemini CLI
+-- This file is licensed under the MIT License.
+-- See the LICENSE file for details.
+
+-- Due dates, priorities, notes and lifecycle timestamps. Existing todos get
+-- the migration time as created_at/updated_at; when existing completed todos
+-- were finished is unknown, so their completed_at stays NULL.
+ALTER TABLE todos
+    ADD COLUMN due_at TIMESTAMPTZ,
+    ADD COLUMN priority TEXT NOT NULL DEFAULT 'normal'
+        CHECK (priority IN ('low', 'normal', 'high', 'urgent')),
+    ADD COLUMN notes TEXT NOT NULL DEFAULT '',
+    ADD COLUMN created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    ADD COLUMN updated_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    ADD COLUMN completed_at TIMESTAMPTZ;
+
+-- Serves the overdue and this_week filters on GET /todos.
+CREATE INDEX todos_due_at_idx ON todos (due_at);
@@ -0,0 +1,21 @@
+-- Written by Gemini CLI
+-- This file is licensed under the MIT License.
+-- See the LICENSE file for details.
+
+-- Named lists of todos. Every existing todo moves into the default list,
+-- which keeps id 1 (DefaultListID) and can't be deleted.
+CREATE TABLE lists (
+    id SERIAL PRIMARY KEY,
+    name TEXT NOT NULL,
+    archived BOOLEAN NOT NULL DEFAULT FALSE,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+INSERT INTO lists (id, name) VALUES (1, 'Inbox');
+SELECT setval(pg_get_serial_sequence('lists', 'id'), 1);
+
+ALTER TABLE todos ADD COLUMN list_id INTEGER NOT NULL DEFAULT 1 REFERENCES lists (id);
+
+-- Serves GET /lists/{id}/todos and the todo count when deleting a list.
+CREATE INDEX todos_list_id_idx ON todos (list_id, id);
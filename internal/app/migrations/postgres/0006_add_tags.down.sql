@@ -0,0 +1,6 @@
+-- Written by Gemini CLI
+-- This file is licensed under the MIT License.
+-- See the LICENSE file for details.
+
+DROP TABLE IF EXISTS todo_tags;
+DROP TABLE IF EXISTS tags;
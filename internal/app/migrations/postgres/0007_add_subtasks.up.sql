@@ -0,0 +1,13 @@
+-- Written by Gemini CLI
+-- This file is licensed under the MIT License.
+-- See the LICENSE file for details.
+
+-- Subtasks: a todo may have a parent todo. Deleting a parent deletes its
+-- subtasks, though the store refuses unless the client asks for that.
+ALTER TABLE todos ADD COLUMN parent_id INTEGER REFERENCES todos (id) ON DELETE CASCADE;
+
+-- Whether the todo's completion follows its subtasks.
+ALTER TABLE todos ADD COLUMN auto_complete BOOLEAN NOT NULL DEFAULT FALSE;
+
+-- Serves child counts, completion rollup and cascading deletes.
+CREATE INDEX todos_parent_id_idx ON todos (parent_id);
@@ -0,0 +1,8 @@
+-- Written by Gemini CLI
+-- This file is licensed under the MIT License.
+-- See the LICENSE file for details.
+
+-- Recurring todos: an RRULE subset and the IANA time zone its occurrences
+-- are computed in. Empty for todos that don't repeat.
+ALTER TABLE todos ADD COLUMN recurrence TEXT NOT NULL DEFAULT '';
+ALTER TABLE todos ADD COLUMN recurrence_tz TEXT NOT NULL DEFAULT '';
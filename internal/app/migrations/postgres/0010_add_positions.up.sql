@@ -0,0 +1,15 @@
+-- Written by Gemini CLI
+-- This file is licensed under the MIT License.
+-- See the LICENSE file for details.
+
+-- Manual ordering. position is a fractional index key (see PositionBetween),
+-- compared byte by byte, hence the "C" collation. Existing todos keep their
+-- id order: their keys share the integer part a0, with the zero-padded id as
+-- the fraction, so todos created afterwards go after them.
+ALTER TABLE todos ADD COLUMN position TEXT COLLATE "C" NOT NULL DEFAULT '';
+UPDATE todos SET position = 'a0' || LPAD(id::text, 10, '0') || 'V';
+ALTER TABLE todos ALTER COLUMN position DROP DEFAULT;
+
+-- Serves sort=position on GET /todos and finding a moved todo's neighbours.
+-- Unique, so concurrent moves into the same gap can't both take its key.
+CREATE UNIQUE INDEX todos_position_idx ON todos (position);
@@ -0,0 +1,9 @@
+-- Written by Gemini CLI
+-- This file is licensed under the MIT License.
+-- See the LICENSE file for details.
+
+-- Trashed todos would come back to life without the column, so they are
+-- deleted for good first.
+DELETE FROM todos WHERE deleted_at IS NOT NULL;
+DROP INDEX IF EXISTS todos_deleted_at_idx;
+ALTER TABLE todos DROP COLUMN deleted_at;
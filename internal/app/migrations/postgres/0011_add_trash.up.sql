@@ -0,0 +1,10 @@
+-- Written by Gemini CLI
+-- This file is licensed under the MIT License.
+-- See the LICENSE file for details.
+
+-- Soft deletes. Deleting a todo sets deleted_at, moving it to the trash
+-- until it is restored or purged; NULL for every other todo.
+ALTER TABLE todos ADD COLUMN deleted_at TIMESTAMPTZ;
+
+-- Serves GET /trash and the purge. Partial, since few todos are trashed.
+CREATE INDEX todos_deleted_at_idx ON todos (deleted_at) WHERE deleted_at IS NOT NULL;
@@ -0,0 +1,5 @@
+-- Written by Gemini CLI
+-- This file is licensed under the MIT License.
+-- See the LICENSE file for details.
+
+DROP TABLE IF EXISTS todo_events;
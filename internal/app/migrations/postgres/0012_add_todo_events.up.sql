@@ -0,0 +1,22 @@
+-- Written by Gemini CLI
+-- This file is licensed under the MIT License.
+-- See the LICENSE file for details.
+
+-- The history of every todo: one row per change, written in the same
+-- transaction and never updated. There is no foreign key, since the history
+-- outlives purged todos. before_state and after_state hold the todo as JSON,
+-- NULL for a create and a purge respectively.
+CREATE TABLE todo_events (
+    id BIGSERIAL PRIMARY KEY,
+    todo_id INTEGER NOT NULL,
+    action TEXT NOT NULL,
+    before_state JSONB,
+    after_state JSONB,
+    actor TEXT NOT NULL,
+    request_id TEXT NOT NULL,
+    trace_id TEXT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL
+);
+
+-- Serves GET /todos/{id}/history.
+CREATE INDEX todo_events_todo_id_idx ON todo_events (todo_id, id);
@@ -0,0 +1,14 @@
+-- Written by Gemini CLI
+-- This file is licensed under the MIT License.
+-- See the LICENSE file for details.
+
+-- A single counter that every transaction changing how todos are listed
+-- increments just before it commits, so GET /todos can tell whether anything
+-- changed without listing. Unlike a sequence, it goes up in commit order:
+-- writers take turns on the row.
+CREATE TABLE todos_revision (
+    id INTEGER PRIMARY KEY CHECK (id = 1),
+    revision BIGINT NOT NULL
+);
+
+INSERT INTO todos_revision (id, revision) VALUES (1, 0);
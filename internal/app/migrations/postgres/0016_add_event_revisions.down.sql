@@ -0,0 +1,8 @@
+-- Written by Gemini CLI
+-- This file is licensed under the MIT License.
+-- See the LICENSE file for details.
+
+DROP TRIGGER IF EXISTS todos_revision_notify ON todos_revision;
+DROP FUNCTION IF EXISTS notify_todos_revision();
+DROP INDEX IF EXISTS todo_events_revision_id_idx;
+ALTER TABLE todo_events DROP COLUMN IF EXISTS revision;
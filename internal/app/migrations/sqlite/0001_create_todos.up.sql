@@ -0,0 +1,14 @@
+-- Written by Gemini CLI
+-- This file is licensed under the MIT License.
+-- See the LICENSE file for details.
+
+CREATE TABLE IF NOT EXISTS todos (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    task TEXT NOT NULL,
+    completed BOOLEAN NOT NULL DEFAULT FALSE
+);
+
+-- Like Postgres, no todo may have a NULL completed. SQLite can't add NOT
+-- NULL to an existing column without rebuilding the table, and every write
+-- sets it, so databases created without it are only backfilled.
+UPDATE todos SET completed = FALSE WHERE completed IS NULL;
@@ -0,0 +1,6 @@
+-- Written by Gemini CLI
+-- This file is licensed under the MIT License.
+-- See the LICENSE file for details.
+
+DROP INDEX IF EXISTS todos_completed_id_idx;
+DROP INDEX IF EXISTS todos_task_id_idx;
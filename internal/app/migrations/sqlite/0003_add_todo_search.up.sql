@@ -0,0 +1,6 @@
+-- Written by Gemini CLI
+-- This file is licensed under the MIT License.
+-- See the LICENSE file for details.
+
+-- Intentionally empty: SQLite searches with LIKE (see SQLStore.Search), so
+-- there is no search column. The version exists to keep dialects in lockstep.
@@ -0,0 +1,21 @@
+-- Written by Gemini CLI
+-- This file is licensed under the MIT License.
+-- See the LICENSE file for details.
+
+-- Due dates, priorities, notes and lifecycle timestamps. SQLite only allows
+-- constant defaults on added columns, so existing rows are stamped with the
+-- migration time afterwards, in the format OpenSQLite's driver writes.
+ALTER TABLE todos ADD COLUMN due_at TIMESTAMP;
+ALTER TABLE todos ADD COLUMN priority TEXT NOT NULL DEFAULT 'normal'
+    CHECK (priority IN ('low', 'normal', 'high', 'urgent'));
+ALTER TABLE todos ADD COLUMN notes TEXT NOT NULL DEFAULT '';
+ALTER TABLE todos ADD COLUMN created_at TIMESTAMP NOT NULL DEFAULT '1970-01-01 00:00:00+00:00';
+ALTER TABLE todos ADD COLUMN updated_at TIMESTAMP NOT NULL DEFAULT '1970-01-01 00:00:00+00:00';
+ALTER TABLE todos ADD COLUMN completed_at TIMESTAMP;
+
+UPDATE todos SET
+    created_at = strftime('%Y-%m-%d %H:%M:%f+00:00', 'now'),
+    updated_at = strftime('%Y-%m-%d %H:%M:%f+00:00', 'now');
+
+-- Serves the overdue and this_week filters on GET /todos.
+CREATE INDEX todos_due_at_idx ON todos (due_at);
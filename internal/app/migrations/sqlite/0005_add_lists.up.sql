@@ -0,0 +1,25 @@
+-- Written by Gemini CLI
+-- This file is licensed under the MIT License.
+-- See the LICENSE file for details.
+
+-- Named lists of todos. Every existing todo moves into the default list,
+-- which keeps id 1 (DefaultListID) and can't be deleted.
+CREATE TABLE lists (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    name TEXT NOT NULL,
+    archived BOOLEAN NOT NULL DEFAULT FALSE,
+    created_at TIMESTAMP NOT NULL,
+    updated_at TIMESTAMP NOT NULL
+);
+
+INSERT INTO lists (id, name, created_at, updated_at) VALUES (
+    1, 'Inbox',
+    strftime('%Y-%m-%d %H:%M:%f+00:00', 'now'),
+    strftime('%Y-%m-%d %H:%M:%f+00:00', 'now'));
+
+-- SQLite can't add a REFERENCES column with a non-NULL default while foreign
+-- keys are enforced, so the store checks list_id itself.
+ALTER TABLE todos ADD COLUMN list_id INTEGER NOT NULL DEFAULT 1;
+
+-- Serves GET /lists/{id}/todos and the todo count when deleting a list.
+CREATE INDEX todos_list_id_idx ON todos (list_id, id);
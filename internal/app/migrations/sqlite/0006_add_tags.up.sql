@@ -0,0 +1,20 @@
+-- Written by Gemini CLI
+-- This file is licensed under the MIT License.
+-- See the LICENSE file for details.
+
+-- Tags and their many-to-many assignment to todos. Names are stored in
+-- lower case, so the unique constraint is case-insensitive in effect.
+CREATE TABLE tags (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    name TEXT NOT NULL UNIQUE
+);
+
+CREATE TABLE todo_tags (
+    todo_id INTEGER NOT NULL REFERENCES todos (id) ON DELETE CASCADE,
+    tag_id INTEGER NOT NULL REFERENCES tags (id) ON DELETE CASCADE,
+    PRIMARY KEY (todo_id, tag_id)
+);
+
+-- The primary key serves loading a page's tags; this serves the tag filter
+-- on GET /todos and cascading tag deletes.
+CREATE INDEX todo_tags_tag_id_idx ON todo_tags (tag_id, todo_id);
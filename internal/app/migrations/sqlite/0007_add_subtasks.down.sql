@@ -0,0 +1,7 @@
+-- Written by Gemini CLI
+-- This file is licensed under the MIT License.
+-- See the LICENSE file for details.
+
+DROP INDEX IF EXISTS todos_parent_id_idx;
+ALTER TABLE todos DROP COLUMN auto_complete;
+ALTER TABLE todos DROP COLUMN parent_id;
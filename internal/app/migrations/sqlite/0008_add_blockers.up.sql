@@ -0,0 +1,16 @@
+-- Written by Gemini CLI
+-- This file is licensed under the MIT License.
+-- See the LICENSE file for details.
+
+-- Dependencies between todos: todo_id can't be completed until blocker_id
+-- is. The store keeps the graph free of cycles.
+CREATE TABLE todo_blockers (
+    todo_id INTEGER NOT NULL REFERENCES todos (id) ON DELETE CASCADE,
+    blocker_id INTEGER NOT NULL REFERENCES todos (id) ON DELETE CASCADE,
+    PRIMARY KEY (todo_id, blocker_id),
+    CHECK (todo_id <> blocker_id)
+);
+
+-- The primary key serves open blocker counts and walking dependencies; this
+-- serves cascading deletes of blockers.
+CREATE INDEX todo_blockers_blocker_id_idx ON todo_blockers (blocker_id, todo_id);
@@ -0,0 +1,6 @@
+-- Written by Gemini CLI
+-- This file is licensed under the MIT License.
+-- See the LICENSE file for details.
+
+ALTER TABLE todos DROP COLUMN recurrence_tz;
+ALTER TABLE todos DROP COLUMN recurrence;
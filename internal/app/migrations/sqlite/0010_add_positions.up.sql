@@ -0,0 +1,14 @@
+-- Written by Gemini CLI
+-- This file is licensed under the MIT License.
+-- See the LICENSE file for details.
+
+-- Manual ordering. position is a fractional index key (see PositionBetween),
+-- which SQLite's default BINARY collation compares byte by byte. Existing
+-- todos keep their id order: their keys share the integer part a0, with the
+-- zero-padded id as the fraction, so todos created afterwards go after them.
+ALTER TABLE todos ADD COLUMN position TEXT NOT NULL DEFAULT '';
+UPDATE todos SET position = 'a0' || substr('0000000000' || id, -10) || 'V';
+
+-- Serves sort=position on GET /todos and finding a moved todo's neighbours.
+-- Unique, so concurrent moves into the same gap can't both take its key.
+CREATE UNIQUE INDEX todos_position_idx ON todos (position);
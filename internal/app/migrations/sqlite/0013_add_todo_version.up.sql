@@ -0,0 +1,7 @@
+-- Written by Gemini CLI
+-- This file is licensed under the MIT License.
+-- See the LICENSE file for details.
+
+-- Optimistic concurrency. Incremented by every change to the todo, and
+-- served as its ETag for If-Match.
+ALTER TABLE todos ADD COLUMN version INTEGER NOT NULL DEFAULT 1;
@@ -0,0 +1,20 @@
+-- Written by Gemini CLI
+-- This file is licensed under the MIT License.
+-- See the LICENSE file for details.
+
+-- The Idempotency-Key of each POST /todos, written in the same transaction as
+-- the todo it created, so a retried request replays the response instead of
+-- creating a duplicate. Keys belong to the actor that sent them. fingerprint
+-- identifies the request the key was first used with, and response holds the
+-- todo returned for it as JSON.
+CREATE TABLE idempotency_keys (
+    actor TEXT NOT NULL,
+    idempotency_key TEXT NOT NULL,
+    fingerprint TEXT NOT NULL,
+    response TEXT NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    PRIMARY KEY (actor, idempotency_key)
+);
+
+-- Serves expiring keys once their window has passed.
+CREATE INDEX idempotency_keys_created_at_idx ON idempotency_keys (created_at);
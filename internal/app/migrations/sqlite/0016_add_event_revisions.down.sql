@@ -0,0 +1,6 @@
+-- Written by Gemini CLI
+-- This file is licensed under the MIT License.
+-- See the LICENSE file for details.
+
+DROP INDEX IF EXISTS todo_events_revision_id_idx;
+ALTER TABLE todo_events DROP COLUMN revision;
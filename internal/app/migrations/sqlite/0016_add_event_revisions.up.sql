@@ -0,0 +1,9 @@
+-- Written by Gemini CLI
+-- This file is licensed under the MIT License.
+-- See the LICENSE file for details.
+
+-- The revision of the change each event is part of, so GET /todos/events can
+-- stream events in commit order and resume after the last one a client saw.
+-- Events recorded before this have revision 0.
+ALTER TABLE todo_events ADD COLUMN revision BIGINT NOT NULL DEFAULT 0;
+CREATE INDEX todo_events_revision_id_idx ON todo_events (revision, id);
@@ -0,0 +1,92 @@
+// Written by Gemini CLI
+// This file is licensed under the MIT License.
+// See the LICENSE file for details.
+
+package app
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// MergePatch is a JSON Merge Patch (RFC 7396) document for a Todo or TodoList.
+type MergePatch map[string]json.RawMessage
+
+// ParseMergePatch decodes a merge patch, which must be a JSON object.
+func ParseMergePatch(data []byte) (MergePatch, error) {
+	var p MergePatch
+	if err := json.Unmarshal(data, &p); err != nil {
+		return nil, err
+	}
+	if p == nil {
+		return nil, fmt.Errorf("merge patch must be a JSON object")
+	}
+	return p, nil
+}
+
+// Apply merges the patch into t: members present in the patch replace the
+// corresponding fields, null members reset them to their zero value, and
+// absent members are left alone. Since Todo is a flat object this is the
+// whole of RFC 7396. The result must pass Todo.Validate, and members that
+// aren't Todo fields are rejected.
+func (p MergePatch) Apply(t *Todo) error {
+	var patched Todo
+	if err := p.mergeInto(t, &patched, "todo"); err != nil {
+		return err
+	}
+	if err := patched.Validate(); err != nil {
+		return err
+	}
+	patched.ID = t.ID
+	*t = patched
+	return nil
+}
+
+// ApplyList merges the patch into l, like Apply does for todos.
+func (p MergePatch) ApplyList(l *TodoList) error {
+	var patched TodoList
+	if err := p.mergeInto(l, &patched, "list"); err != nil {
+		return err
+	}
+	if err := patched.Validate(); err != nil {
+		return err
+	}
+	patched.ID = l.ID
+	*l = patched
+	return nil
+}
+
+// mergeInto applies the patch to the JSON form of current and strictly
+// decodes the result into dst. kind names the resource in errors.
+func (p MergePatch) mergeInto(current, dst any, kind string) error {
+	data, err := json.Marshal(current)
+	if err != nil {
+		return err
+	}
+	var doc map[string]json.RawMessage
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return err
+	}
+
+	for k, v := range p {
+		if bytes.Equal(bytes.TrimSpace(v), []byte("null")) {
+			delete(doc, k)
+		} else {
+			doc[k] = v
+		}
+	}
+
+	merged, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	if err := decodeStrict(merged, dst); err != nil {
+		if errors.Is(err, errMalformedBody) {
+			return fmt.Errorf("%w: patch does not fit a %s", ErrInvalidInput, kind)
+		}
+		return err
+	}
+	return nil
+}
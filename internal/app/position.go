@@ -0,0 +1,298 @@
+// Written by Gemini CLI
+// This file is licensed under the MIT License.
+// See the LICENSE file for details.
+
+package app
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Todos are ordered manually by Position, a fractional index: a string key
+// compared byte by byte, so a key can always be made between any two others
+// and moving a todo rewrites only that todo. Keys are base-62 digits
+// (0-9A-Za-z, in byte order). They start with an integer part, whose first
+// character gives its length (a-z for 2 to 27 characters, A-Z for the
+// negative integers), followed by an optional fraction without trailing
+// zeros. Appending keeps incrementing the integer, so keys grow
+// logarithmically rather than by a character every few todos.
+const positionDigits = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// smallestInteger is the lowest integer part. No key may be just it, so
+// there is always room for another key before the first.
+var smallestInteger = "A" + strings.Repeat("0", 26)
+
+var errInvalidPosition = errors.New("invalid position key")
+
+// positionBetween returns a position key that sorts strictly between before
+// and after. An empty before or after leaves that side open, so
+// positionBetween("", "") is the first key of an empty list and
+// positionBetween(last, "") appends.
+func positionBetween(before, after string) (string, error) {
+	if before != "" {
+		if err := validatePosition(before); err != nil {
+			return "", err
+		}
+	}
+	if after != "" {
+		if err := validatePosition(after); err != nil {
+			return "", err
+		}
+	}
+	if before != "" && after != "" && before >= after {
+		return "", fmt.Errorf("%w: %q does not sort before %q", errInvalidPosition, before, after)
+	}
+
+	switch {
+	case before == "" && after == "":
+		return "a0", nil
+	case before == "":
+		ib := integerPart(after)
+		if ib == smallestInteger {
+			return ib + midpoint("", after[len(ib):]), nil
+		}
+		if ib < after {
+			return ib, nil
+		}
+		if res, ok := decrementInteger(ib); ok {
+			return res, nil
+		}
+		return "", fmt.Errorf("%w: no room before %q", errInvalidPosition, after)
+	case after == "":
+		ia := integerPart(before)
+		if res, ok := incrementInteger(ia); ok {
+			return res, nil
+		}
+		return ia + midpoint(before[len(ia):], ""), nil
+	}
+
+	ia, ib := integerPart(before), integerPart(after)
+	if ia == ib {
+		return ia + midpoint(before[len(ia):], after[len(ib):]), nil
+	}
+	res, ok := incrementInteger(ia)
+	if !ok {
+		return "", fmt.Errorf("%w: no room after %q", errInvalidPosition, before)
+	}
+	if res < after {
+		return res, nil
+	}
+	return ia + midpoint(before[len(ia):], ""), nil
+}
+
+// integerLength returns the length of an integer part starting with head,
+// or 0 if head can't start one.
+func integerLength(head byte) int {
+	switch {
+	case head >= 'a' && head <= 'z':
+		return int(head-'a') + 2
+	case head >= 'A' && head <= 'Z':
+		return int('Z'-head) + 2
+	}
+	return 0
+}
+
+// integerPart returns the integer part of a validated key.
+func integerPart(key string) string {
+	return key[:integerLength(key[0])]
+}
+
+func validatePosition(key string) error {
+	n := integerLength(key[0])
+	switch {
+	case n == 0 || len(key) < n || key == smallestInteger:
+		return fmt.Errorf("%w: %q", errInvalidPosition, key)
+	case strings.Trim(key[1:], positionDigits) != "":
+		return fmt.Errorf("%w: %q", errInvalidPosition, key)
+	case len(key) > n && key[len(key)-1] == positionDigits[0]:
+		return fmt.Errorf("%w: %q has a trailing zero", errInvalidPosition, key)
+	}
+	return nil
+}
+
+// midpoint returns a fraction between fractions a and b, where an empty b
+// means 1. Neither may end in a zero digit.
+func midpoint(a, b string) string {
+	if b != "" {
+		// Keep the common prefix, reading a as padded with zeros.
+		n := 0
+		for n < len(b) && digitAt(a, n, 0) == strings.IndexByte(positionDigits, b[n]) {
+			n++
+		}
+		if n > 0 {
+			return b[:n] + midpoint(tail(a, n), b[n:])
+		}
+	}
+	da := digitAt(a, 0, 0)
+	db := digitAt(b, 0, len(positionDigits))
+	if db-da > 1 {
+		return string(positionDigits[(da+db+1)/2])
+	}
+	// The first digits are consecutive.
+	if len(b) > 1 {
+		return b[:1]
+	}
+	return string(positionDigits[da]) + midpoint(tail(a, 1), "")
+}
+
+// digitAt returns the value of the digit at s[i], or missing past its end.
+func digitAt(s string, i, missing int) int {
+	if i < len(s) {
+		return strings.IndexByte(positionDigits, s[i])
+	}
+	return missing
+}
+
+// tail returns s[i:], or "" if s is shorter.
+func tail(s string, i int) string {
+	if i < len(s) {
+		return s[i:]
+	}
+	return ""
+}
+
+// incrementInteger returns the integer part following x, reporting false
+// if x is the largest.
+func incrementInteger(x string) (string, bool) {
+	head, digits := x[0], []byte(x[1:])
+	for i := len(digits) - 1; i >= 0; i-- {
+		d := strings.IndexByte(positionDigits, digits[i]) + 1
+		if d < len(positionDigits) {
+			digits[i] = positionDigits[d]
+			return string(head) + string(digits), true
+		}
+		digits[i] = positionDigits[0]
+	}
+	switch head {
+	case 'Z':
+		return "a0", true
+	case 'z':
+		return "", false
+	}
+	head++
+	if head > 'a' {
+		digits = append(digits, positionDigits[0])
+	} else {
+		digits = digits[:len(digits)-1]
+	}
+	return string(head) + string(digits), true
+}
+
+// decrementInteger returns the integer part preceding x, reporting false if
+// x is the smallest.
+func decrementInteger(x string) (string, bool) {
+	head, digits := x[0], []byte(x[1:])
+	last := positionDigits[len(positionDigits)-1]
+	for i := len(digits) - 1; i >= 0; i-- {
+		d := strings.IndexByte(positionDigits, digits[i]) - 1
+		if d >= 0 {
+			digits[i] = positionDigits[d]
+			return string(head) + string(digits), true
+		}
+		digits[i] = last
+	}
+	switch head {
+	case 'a':
+		return "Z" + string(last), true
+	case 'A':
+		return "", false
+	}
+	head--
+	if head < 'Z' {
+		digits = append(digits, last)
+	} else {
+		digits = digits[:len(digits)-1]
+	}
+	return string(head) + string(digits), true
+}
+
+// Move says where a todo goes: immediately before or immediately after
+// another todo. Exactly one of Before and After is set.
+type Move struct {
+	Before *int `json:"before"`
+	After  *int `json:"after"`
+}
+
+// Validate checks the move names exactly one other todo than id.
+func (mv Move) Validate(id int) error {
+	var fields []FieldError
+	switch {
+	case mv.Before == nil && mv.After == nil:
+		fields = append(fields, FieldError{"before", "must be set, or after must be"})
+	case mv.Before != nil && mv.After != nil:
+		fields = append(fields, FieldError{"after", "can't be combined with before"})
+	case mv.Before != nil && *mv.Before == id, mv.After != nil && *mv.After == id:
+		fields = append(fields, FieldError{mv.field(), "must be another todo"})
+	}
+	if len(fields) > 0 {
+		return &ValidationError{Fields: fields}
+	}
+	return nil
+}
+
+// anchor returns the id of the todo the move is relative to.
+func (mv Move) anchor() int {
+	if mv.Before != nil {
+		return *mv.Before
+	}
+	return *mv.After
+}
+
+// field names the field holding the anchor, for errors.
+func (mv Move) field() string {
+	if mv.Before != nil {
+		return "before"
+	}
+	return "after"
+}
+
+func unknownAnchorError(mv Move) error {
+	return &ValidationError{Fields: []FieldError{{mv.field(), "must be an existing todo"}}}
+}
+
+// position returns the key placing a todo next to the anchor, whose key is
+// anchor; neighbour is the key of the todo on the other side of the gap, or
+// "" if the anchor is first or last.
+func (mv Move) position(anchor, neighbour string) (string, error) {
+	if mv.Before != nil {
+		return positionBetween(neighbour, anchor)
+	}
+	return positionBetween(anchor, neighbour)
+}
+
+// decodeMove reads and validates the body of a move of todo id.
+func decodeMove(w http.ResponseWriter, r *http.Request, mv *Move, id int) error {
+	data, err := readBody(w, r)
+	if err != nil {
+		return err
+	}
+	if err := decodeStrict(data, mv); err != nil {
+		return err
+	}
+	return mv.Validate(id)
+}
+
+// HandleTodoMove serves POST /todos/{id}/move, which reorders a todo to
+// just before or after another, given as {"before": id} or {"after": id}.
+// Only the moved todo's position changes. It returns the updated todo.
+func (s *Server) HandleTodoMove(w http.ResponseWriter, r *http.Request, id int) {
+	if r.Method != http.MethodPost {
+		writeMethodNotAllowed(w, r, http.MethodPost)
+		return
+	}
+	var mv Move
+	if err := decodeMove(w, r, &mv, id); err != nil {
+		writeInputError(w, r, err)
+		return
+	}
+
+	t, err := s.todos.Move(r.Context(), id, mv)
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+	writeUpdatedTodo(w, t)
+}
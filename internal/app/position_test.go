@@ -0,0 +1,95 @@
+// Written by Gemini CLI
+// This file is licensed under the MIT License.
+// See the LICENSE file for details.
+
+package app
+
+import "testing"
+
+// TestPositionBetween tests that generated keys sort strictly between their
+// bounds
+func TestPositionBetween(t *testing.T) {
+	tests := []struct {
+		before, after string
+		want          string
+	}{
+		{"", "", "a0"},
+		{"a0", "", "a1"},
+		{"az", "", "b00"},
+		{"", "a0", "Zz"},
+		{"", "a0V", "a0"},
+		{"a0", "a1", "a0V"},
+		{"a0", "a0V", "a0G"},
+		{"a1", "a2", "a1V"},
+		{"a0V", "a1", "a0l"},
+		{"Zz", "a01", "a0"},
+		{"a0000000001V", "a0000000002V", "a0000000002"},
+		{"a0000000009V", "", "a1"},
+	}
+	for _, tt := range tests {
+		got, err := positionBetween(tt.before, tt.after)
+		if err != nil {
+			t.Errorf("(%q, %q): unexpected error: %v", tt.before, tt.after, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("(%q, %q): expected %q, got %q", tt.before, tt.after, tt.want, got)
+		}
+	}
+}
+
+// TestPositionBetweenInvalid tests that malformed or misordered bounds are
+// rejected
+func TestPositionBetweenInvalid(t *testing.T) {
+	tests := []struct{ before, after string }{
+		{"a1", "a0"},
+		{"a0", "a0"},
+		{"a", ""},
+		{"a00", ""},
+		{"a0-", ""},
+		{"0a", ""},
+		{"", "A00000000000000000000000000"},
+	}
+	for _, tt := range tests {
+		if got, err := positionBetween(tt.before, tt.after); err == nil {
+			t.Errorf("(%q, %q): expected an error, got %q", tt.before, tt.after, got)
+		}
+	}
+}
+
+// TestPositionBetweenGrowth tests that keys stay short when todos are
+// repeatedly appended, prepended or inserted into the same gap
+func TestPositionBetweenGrowth(t *testing.T) {
+	next := func(before, after string) string {
+		t.Helper()
+		key, err := positionBetween(before, after)
+		if err != nil {
+			t.Fatalf("(%q, %q): %v", before, after, err)
+		}
+		if (before != "" && key <= before) || (after != "" && key >= after) {
+			t.Fatalf("(%q, %q): %q is out of order", before, after, key)
+		}
+		return key
+	}
+
+	last, first := "", ""
+	for range 10000 {
+		last = next(last, "")
+		first = next("", first)
+	}
+	if len(last) > 4 || len(first) > 4 {
+		t.Errorf("expected 10000 appends and prepends to need at most 4 characters, got %q and %q", last, first)
+	}
+
+	lo, hi := "a0", "a1"
+	for i := range 1000 {
+		if i%2 == 0 {
+			lo = next(lo, hi)
+		} else {
+			hi = next(lo, hi)
+		}
+	}
+	if len(lo) > 200 || len(hi) > 200 {
+		t.Errorf("expected keys to grow by about a character per 6 splits, got %d and %d", len(lo), len(hi))
+	}
+}
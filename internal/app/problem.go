@@ -0,0 +1,176 @@
+// Written by Gemini CLI
+// This file is licensed under the MIT License.
+// See the LICENSE file for details.
+
+package app
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/sony/gobreaker"
+)
+
+// Stable, machine-readable error codes. Clients should switch on these rather
+// than on titles or details, which are meant for humans and may change.
+const (
+	CodeValidationFailed     = "validation_failed"
+	CodeMalformedRequest     = "malformed_request"
+	CodePayloadTooLarge      = "payload_too_large"
+	CodeNotFound             = "not_found"
+	CodeMethodNotAllowed     = "method_not_allowed"
+	CodeListNotEmpty         = "list_not_empty"
+	CodeDefaultList          = "default_list"
+	CodeTagExists            = "tag_exists"
+	CodeHasSubtasks          = "todo_has_subtasks"
+	CodeTodoBlocked          = "todo_blocked"
+	CodeDependencyCycle      = "dependency_cycle"
+	CodeParentTrashed        = "parent_trashed"
+	CodePreconditionFailed   = "precondition_failed"
+	CodeIdempotencyKeyReused = "idempotency_key_reused"
+	CodeCircuitOpen          = "circuit_open"
+	CodeDBUnavailable        = "db_unavailable"
+	CodeInternal             = "internal_error"
+)
+
+// ProblemContentType is the media type of error responses.
+const ProblemContentType = "application/problem+json"
+
+// Problem is an RFC 7807 problem details object, the body of every API error
+// response. Type is always "about:blank", so Title is the HTTP status text;
+// Code and RequestID are extension members.
+type Problem struct {
+	Type      string `json:"type"`
+	Title     string `json:"title"`
+	Status    int    `json:"status"`
+	Detail    string `json:"detail,omitempty"`
+	Instance  string `json:"instance,omitempty"`
+	Code      string `json:"code"`
+	RequestID string `json:"request_id,omitempty"`
+	// Errors lists the invalid fields of a validation_failed problem.
+	Errors []FieldError `json:"errors,omitempty"`
+	// Operation is the index of the operation that failed an atomic batch.
+	Operation *int `json:"operation,omitempty"`
+}
+
+// writeProblem writes a problem+json response. detail is shown to clients,
+// so it must never contain raw errors from the store or driver.
+func writeProblem(w http.ResponseWriter, r *http.Request, status int, code, detail string) {
+	writeProblemBody(w, newProblem(r, status, code, detail))
+}
+
+// writeValidationProblem writes a 422 listing the invalid fields.
+func writeValidationProblem(w http.ResponseWriter, r *http.Request, verr *ValidationError) {
+	writeProblemBody(w, validationProblem(r, verr))
+}
+
+func validationProblem(r *http.Request, verr *ValidationError) Problem {
+	p := newProblem(r, http.StatusUnprocessableEntity, CodeValidationFailed, "One or more fields are invalid.")
+	p.Errors = verr.Fields
+	return p
+}
+
+func newProblem(r *http.Request, status int, code, detail string) Problem {
+	return Problem{
+		Type:      "about:blank",
+		Title:     http.StatusText(status),
+		Status:    status,
+		Detail:    detail,
+		Instance:  r.URL.Path,
+		Code:      code,
+		RequestID: RequestIDFromContext(r.Context()),
+	}
+}
+
+func writeProblemBody(w http.ResponseWriter, p Problem) {
+	w.Header().Set("Content-Type", ProblemContentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(p.Status)
+	if err := json.NewEncoder(w).Encode(p); err != nil {
+		slog.Error("Failed to encode problem response", "error", err)
+	}
+}
+
+// writeMethodNotAllowed writes a 405 listing the allowed methods.
+func writeMethodNotAllowed(w http.ResponseWriter, r *http.Request, allowed ...string) {
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
+	writeProblem(w, r, http.StatusMethodNotAllowed, CodeMethodNotAllowed, "")
+}
+
+// writeStoreError maps a Store error onto a problem response. Unexpected
+// errors are logged with the request id and reported as db_unavailable
+// without their text.
+func writeStoreError(w http.ResponseWriter, r *http.Request, err error) {
+	// A failed precondition comes with the todo's current ETag, so the client
+	// knows whether its refetch is fresh.
+	var perr *PreconditionError
+	if errors.As(err, &perr) {
+		w.Header().Set("ETag", todoETag(perr.Version))
+	}
+	writeProblemBody(w, storeProblem(r, err))
+}
+
+// storeProblem is the problem writeStoreError writes for err.
+func storeProblem(r *http.Request, err error) Problem {
+	var verr *ValidationError
+	var conflict *ConflictError
+	switch {
+	case errors.Is(err, gobreaker.ErrOpenState):
+		return newProblem(r, http.StatusServiceUnavailable, CodeCircuitOpen,
+			"The database circuit breaker is open; retry later.")
+	case errors.Is(err, ErrNotFound):
+		return newProblem(r, http.StatusNotFound, CodeNotFound, "Todo not found.")
+	case errors.Is(err, ErrListNotFound):
+		return newProblem(r, http.StatusNotFound, CodeNotFound, "List not found.")
+	case errors.Is(err, ErrTagNotFound):
+		return newProblem(r, http.StatusNotFound, CodeNotFound, "Tag not found.")
+	case errors.As(err, &conflict):
+		return newProblem(r, http.StatusConflict, conflict.Code, conflict.Detail)
+	case errors.Is(err, ErrPreconditionFailed):
+		return newProblem(r, http.StatusPreconditionFailed, CodePreconditionFailed,
+			"The todo has changed since it was read; fetch it again and retry.")
+	case errors.As(err, &verr):
+		return validationProblem(r, verr)
+	case errors.Is(err, ErrInvalidInput):
+		return newProblem(r, http.StatusBadRequest, CodeValidationFailed, err.Error())
+	default:
+		slog.Error("Store operation failed", "error", err, "request_id", RequestIDFromContext(r.Context()))
+		return newProblem(r, http.StatusServiceUnavailable, CodeDBUnavailable,
+			"The database is unavailable; retry later.")
+	}
+}
+
+// RequestIDHeader carries the request id in both directions.
+const RequestIDHeader = "X-Request-ID"
+
+type requestIDKey struct{}
+
+// validRequestID bounds what we accept from clients, since the id ends up
+// in logs and response headers.
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._-]{1,128}$`)
+
+// RequestIDMiddleware assigns every request an id, reusing a well-formed
+// X-Request-ID from the client or load balancer, and echoes it back in the
+// response so error reports can be matched to logs.
+func RequestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(RequestIDHeader)
+		if !validRequestID.MatchString(id) {
+			id = rand.Text()
+		}
+		w.Header().Set(RequestIDHeader, id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+	})
+}
+
+// RequestIDFromContext returns the id assigned by RequestIDMiddleware, or "".
+func RequestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
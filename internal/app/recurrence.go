@@ -0,0 +1,305 @@
+// Written by Gemini CLI
+// This file is licensed under the MIT License.
+// See the LICENSE file for details.
+
+package app
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	// The runtime image has no zoneinfo of its own; recurrence_tz and the
+	// tz query parameter both need it.
+	_ "time/tzdata"
+)
+
+// Frequency is how often a Recurrence repeats, before its interval.
+type Frequency string
+
+const (
+	Daily   Frequency = "DAILY"
+	Weekly  Frequency = "WEEKLY"
+	Monthly Frequency = "MONTHLY"
+)
+
+// Recurrence is a repeating schedule, written as the subset of an iCalendar
+// RRULE (RFC 5545) made of FREQ (DAILY, WEEKLY or MONTHLY), INTERVAL, BYDAY
+// (weekly rules only, without ordinals), and UNTIL or COUNT. For example,
+// "FREQ=WEEKLY;INTERVAL=2;BYDAY=MO,TH" is every other Monday and Thursday.
+//
+// Occurrences keep the wall-clock time of the first one in the rule's time
+// zone, so a 09:00 chore stays at 09:00 across daylight saving changes.
+type Recurrence struct {
+	Freq Frequency
+	// Interval is the number of days, weeks or months between repeats; at
+	// least 1.
+	Interval int
+	// ByDay lists the weekdays a weekly rule falls on, Monday first. Empty
+	// means the weekday of the previous occurrence.
+	ByDay []time.Weekday
+	// Until, if set, is the last time an occurrence may fall on. If
+	// UntilDate is set it is a date in UTC, and occurrences may fall
+	// anywhere on it in the rule's time zone.
+	Until     *time.Time
+	UntilDate bool
+	// Count, if positive, is the number of occurrences left, including the
+	// current one.
+	Count int
+}
+
+// rruleDays are the BYDAY codes, indexed by time.Weekday.
+var rruleDays = []string{"SU", "MO", "TU", "WE", "TH", "FR", "SA"}
+
+// parseRecurrence parses an RRULE in the subset Recurrence supports. Parts
+// may come in any order and case, with or without an "RRULE:" prefix. The
+// error reads as a description of the field, e.g. "must set FREQ".
+func parseRecurrence(s string) (Recurrence, error) {
+	r := Recurrence{Interval: 1}
+	s = strings.TrimPrefix(strings.ToUpper(strings.TrimSpace(s)), "RRULE:")
+	seen := make(map[string]bool)
+	for part := range strings.SplitSeq(s, ";") {
+		key, value, ok := strings.Cut(part, "=")
+		if !ok || value == "" {
+			return Recurrence{}, fmt.Errorf("must be NAME=VALUE parts separated by semicolons, not %q", part)
+		}
+		if seen[key] {
+			return Recurrence{}, fmt.Errorf("must not repeat %s", key)
+		}
+		seen[key] = true
+
+		switch key {
+		case "FREQ":
+			r.Freq = Frequency(value)
+			if r.Freq != Daily && r.Freq != Weekly && r.Freq != Monthly {
+				return Recurrence{}, errors.New("must set FREQ to DAILY, WEEKLY or MONTHLY")
+			}
+		case "INTERVAL":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 1 || n > 1000 {
+				return Recurrence{}, errors.New("must set INTERVAL to an integer from 1 to 1000")
+			}
+			r.Interval = n
+		case "COUNT":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 1 {
+				return Recurrence{}, errors.New("must set COUNT to a positive integer")
+			}
+			r.Count = n
+		case "UNTIL":
+			until, date, err := parseUntil(value)
+			if err != nil {
+				return Recurrence{}, errors.New("must set UNTIL to a date (20261231) or UTC time (20261231T170000Z)")
+			}
+			r.Until, r.UntilDate = &until, date
+		case "BYDAY":
+			for code := range strings.SplitSeq(value, ",") {
+				day := slices.Index(rruleDays, code)
+				if day < 0 {
+					return Recurrence{}, fmt.Errorf("must list BYDAY as two-letter weekdays (MO to SU), not %q", code)
+				}
+				if !slices.Contains(r.ByDay, time.Weekday(day)) {
+					r.ByDay = append(r.ByDay, time.Weekday(day))
+				}
+			}
+			slices.SortFunc(r.ByDay, func(a, b time.Weekday) int { return mondayFirst(a) - mondayFirst(b) })
+		default:
+			return Recurrence{}, fmt.Errorf("must not use %s, which isn't supported", key)
+		}
+	}
+
+	switch {
+	case r.Freq == "":
+		return Recurrence{}, errors.New("must set FREQ")
+	case len(r.ByDay) > 0 && r.Freq != Weekly:
+		return Recurrence{}, errors.New("must only use BYDAY with FREQ=WEEKLY")
+	case r.Until != nil && r.Count > 0:
+		return Recurrence{}, errors.New("must not set both UNTIL and COUNT")
+	}
+	return r, nil
+}
+
+// parseUntil parses an UNTIL value, reporting whether it is a date.
+func parseUntil(value string) (until time.Time, date bool, err error) {
+	if until, err = time.Parse("20060102", value); err == nil {
+		return until, true, nil
+	}
+	until, err = time.Parse("20060102T150405Z", value)
+	return until, false, err
+}
+
+// mondayFirst numbers weekdays from Monday (0) to Sunday (6), the RRULE
+// default week start.
+func mondayFirst(d time.Weekday) int {
+	return (int(d) + 6) % 7
+}
+
+// String returns the rule in canonical RRULE form, which parseRecurrence
+// reads back unchanged.
+func (r Recurrence) String() string {
+	parts := []string{"FREQ=" + string(r.Freq)}
+	if r.Interval > 1 {
+		parts = append(parts, "INTERVAL="+strconv.Itoa(r.Interval))
+	}
+	if len(r.ByDay) > 0 {
+		codes := make([]string, len(r.ByDay))
+		for i, d := range r.ByDay {
+			codes[i] = rruleDays[d]
+		}
+		parts = append(parts, "BYDAY="+strings.Join(codes, ","))
+	}
+	switch {
+	case r.Until != nil && r.UntilDate:
+		parts = append(parts, "UNTIL="+r.Until.Format("20060102"))
+	case r.Until != nil:
+		parts = append(parts, "UNTIL="+r.Until.UTC().Format("20060102T150405Z"))
+	}
+	if r.Count > 0 {
+		parts = append(parts, "COUNT="+strconv.Itoa(r.Count))
+	}
+	return strings.Join(parts, ";")
+}
+
+// Next returns the occurrence following prev, which must itself be an
+// occurrence, computed in loc. It reports false if the rule ends first;
+// COUNT is left to the caller, since only it knows which occurrence prev is.
+func (r Recurrence) Next(prev time.Time, loc *time.Location) (time.Time, bool) {
+	local := prev.In(loc)
+	interval := max(r.Interval, 1)
+	var next time.Time
+	switch r.Freq {
+	case Daily:
+		next = local.AddDate(0, 0, interval)
+	case Weekly:
+		next = nextWeekly(local, interval, r.ByDay)
+	case Monthly:
+		// Months without the day, such as February for the 30th, are
+		// skipped rather than clamped, as RFC 5545 specifies.
+		year, month, day := local.Date()
+		for i := 1; ; i++ {
+			if i > 48 {
+				return time.Time{}, false
+			}
+			next = time.Date(year, month+time.Month(i*interval), day,
+				local.Hour(), local.Minute(), local.Second(), local.Nanosecond(), loc)
+			if next.Day() == day {
+				break
+			}
+		}
+	default:
+		return time.Time{}, false
+	}
+
+	if r.Until != nil {
+		if r.UntilDate {
+			year, month, day := next.Date()
+			if time.Date(year, month, day, 0, 0, 0, 0, time.UTC).After(*r.Until) {
+				return time.Time{}, false
+			}
+		} else if next.After(*r.Until) {
+			return time.Time{}, false
+		}
+	}
+	return next.UTC().Truncate(time.Microsecond), true
+}
+
+// nextWeekly returns the next of days after local, moving interval weeks
+// (starting on Monday) ahead once the current week's days are used up.
+func nextWeekly(local time.Time, interval int, days []time.Weekday) time.Time {
+	if len(days) == 0 {
+		return local.AddDate(0, 0, 7*interval)
+	}
+	today := mondayFirst(local.Weekday())
+	for _, d := range days {
+		if day := mondayFirst(d); day > today {
+			return local.AddDate(0, 0, day-today)
+		}
+	}
+	return local.AddDate(0, 0, 7*interval-today+mondayFirst(days[0]))
+}
+
+// validateRecurrence checks and normalizes a todo's recurrence fields,
+// appending any problems to fields. A recurring todo needs a due date to
+// count from, and its time zone defaults to UTC.
+func (t *Todo) validateRecurrence(fields []FieldError) []FieldError {
+	t.Recurrence = strings.TrimSpace(t.Recurrence)
+	if t.Recurrence == "" {
+		t.RecurrenceTZ = ""
+		return fields
+	}
+	r, err := parseRecurrence(t.Recurrence)
+	if err != nil {
+		return append(fields, FieldError{"recurrence", err.Error()})
+	}
+	t.Recurrence = r.String()
+	if t.DueAt == nil {
+		fields = append(fields, FieldError{"due_at", "must be set for a recurring todo"})
+	}
+	if t.RecurrenceTZ == "" {
+		t.RecurrenceTZ = "UTC"
+	} else if _, err := time.LoadLocation(t.RecurrenceTZ); err != nil {
+		fields = append(fields, FieldError{"recurrence_tz", "must be an IANA time zone name"})
+	}
+	return fields
+}
+
+// nextOccurrence returns the todo to create when a recurring todo t is
+// completed at the given time, or false if its series has ended.
+// Occurrences that have already passed by then are skipped, and count
+// against COUNT, so a chore finished late isn't immediately overdue again.
+func nextOccurrence(t Todo, at time.Time) (Todo, bool) {
+	r, err := parseRecurrence(t.Recurrence)
+	if err != nil || t.DueAt == nil {
+		return Todo{}, false
+	}
+	loc, err := time.LoadLocation(t.RecurrenceTZ)
+	if err != nil {
+		loc = time.UTC
+	}
+
+	due := *t.DueAt
+	for {
+		if r.Count == 1 {
+			return Todo{}, false
+		}
+		next, ok := r.Next(due, loc)
+		if !ok {
+			return Todo{}, false
+		}
+		if r.Count > 0 {
+			r.Count--
+		}
+		due = next
+		if due.After(at) {
+			break
+		}
+	}
+	return Todo{
+		ListID:       t.ListID,
+		ParentID:     t.ParentID,
+		Task:         t.Task,
+		DueAt:        &due,
+		Priority:     t.Priority,
+		Notes:        t.Notes,
+		AutoComplete: t.AutoComplete,
+		Recurrence:   r.String(),
+		RecurrenceTZ: t.RecurrenceTZ,
+	}, true
+}
+
+// advanceRecurrence returns the next occurrence to create if an update,
+// from before to t, completed a recurring todo. The rule moves on to the
+// next occurrence, so reopening and completing t again doesn't repeat it.
+func advanceRecurrence(before Todo, t *Todo, at time.Time) (Todo, bool) {
+	if !t.Completed || before.Completed || t.Recurrence == "" {
+		return Todo{}, false
+	}
+	next, ok := nextOccurrence(*t, at)
+	if ok {
+		t.Recurrence, t.RecurrenceTZ = "", ""
+	}
+	return next, ok
+}
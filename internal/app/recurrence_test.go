@@ -0,0 +1,147 @@
+// Written by Gemini CLI
+// This file is licensed under the MIT License.
+// See the LICENSE file for details.
+
+package app
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+// TestParseRecurrence tests parsing rules into canonical form
+func TestParseRecurrence(t *testing.T) {
+	tests := []struct {
+		rule string
+		want string
+	}{
+		{"FREQ=DAILY", "FREQ=DAILY"},
+		{"rrule:freq=daily;interval=1", "FREQ=DAILY"},
+		{"FREQ=WEEKLY;BYDAY=FR,MO,WE,MO", "FREQ=WEEKLY;BYDAY=MO,WE,FR"},
+		{"BYDAY=SU,SA;FREQ=WEEKLY;INTERVAL=2", "FREQ=WEEKLY;INTERVAL=2;BYDAY=SA,SU"},
+		{"FREQ=MONTHLY;COUNT=12", "FREQ=MONTHLY;COUNT=12"},
+		{"FREQ=DAILY;UNTIL=20261231", "FREQ=DAILY;UNTIL=20261231"},
+		{"FREQ=DAILY;UNTIL=20261231T170000Z", "FREQ=DAILY;UNTIL=20261231T170000Z"},
+	}
+	for _, tt := range tests {
+		r, err := parseRecurrence(tt.rule)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tt.rule, err)
+			continue
+		}
+		if got := r.String(); got != tt.want {
+			t.Errorf("%s: expected %q, got %q", tt.rule, tt.want, got)
+		}
+		if again, err := parseRecurrence(r.String()); err != nil || again.String() != r.String() {
+			t.Errorf("%s: expected canonical form to round-trip, got %q (err %v)", tt.rule, again.String(), err)
+		}
+	}
+}
+
+// TestParseRecurrenceInvalid tests that rules outside the supported subset
+// are rejected
+func TestParseRecurrenceInvalid(t *testing.T) {
+	for _, rule := range []string{
+		"",
+		"INTERVAL=2",
+		"FREQ=YEARLY",
+		"FREQ=HOURLY",
+		"FREQ=DAILY;FREQ=WEEKLY",
+		"FREQ=DAILY;INTERVAL=0",
+		"FREQ=DAILY;INTERVAL=x",
+		"FREQ=DAILY;COUNT=-1",
+		"FREQ=DAILY;COUNT=2;UNTIL=20261231",
+		"FREQ=DAILY;UNTIL=2026-12-31",
+		"FREQ=DAILY;BYDAY=MO",
+		"FREQ=WEEKLY;BYDAY=1MO",
+		"FREQ=WEEKLY;BYDAY=",
+		"FREQ=MONTHLY;BYMONTHDAY=15",
+		"FREQ=DAILY;",
+		"FREQ",
+	} {
+		if r, err := parseRecurrence(rule); err == nil {
+			t.Errorf("%q: expected an error, got %q", rule, r.String())
+		}
+	}
+}
+
+// TestRecurrenceNext tests computing occurrences, including across month
+// ends, week boundaries and daylight saving changes
+func TestRecurrenceNext(t *testing.T) {
+	london, err := time.LoadLocation("Europe/London")
+	if err != nil {
+		t.Fatalf("failed to load time zone: %v", err)
+	}
+	tokyo, err := time.LoadLocation("Asia/Tokyo")
+	if err != nil {
+		t.Fatalf("failed to load time zone: %v", err)
+	}
+	utc := func(s string) time.Time {
+		t.Helper()
+		v, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			t.Fatalf("bad time %q: %v", s, err)
+		}
+		return v
+	}
+
+	tests := []struct {
+		name string
+		rule string
+		loc  *time.Location
+		from string
+		want []string // successive occurrences; fewer than 3 means the rule ends
+	}{
+		{"daily", "FREQ=DAILY", time.UTC, "2026-01-30T09:00:00Z",
+			[]string{"2026-01-31T09:00:00Z", "2026-02-01T09:00:00Z", "2026-02-02T09:00:00Z"}},
+		{"every 3 days", "FREQ=DAILY;INTERVAL=3", time.UTC, "2026-01-01T09:00:00Z",
+			[]string{"2026-01-04T09:00:00Z", "2026-01-07T09:00:00Z", "2026-01-10T09:00:00Z"}},
+		{"weekly", "FREQ=WEEKLY", time.UTC, "2026-01-05T09:00:00Z",
+			[]string{"2026-01-12T09:00:00Z", "2026-01-19T09:00:00Z", "2026-01-26T09:00:00Z"}},
+		// 2026-01-07 is a Wednesday.
+		{"weekdays", "FREQ=WEEKLY;BYDAY=MO,WE,FR", time.UTC, "2026-01-07T09:00:00Z",
+			[]string{"2026-01-09T09:00:00Z", "2026-01-12T09:00:00Z", "2026-01-14T09:00:00Z"}},
+		{"every other week", "FREQ=WEEKLY;INTERVAL=2;BYDAY=TU,TH", time.UTC, "2026-01-08T09:00:00Z",
+			[]string{"2026-01-20T09:00:00Z", "2026-01-22T09:00:00Z", "2026-02-03T09:00:00Z"}},
+		{"weekly on Sunday", "FREQ=WEEKLY;BYDAY=SU", time.UTC, "2026-01-11T09:00:00Z",
+			[]string{"2026-01-18T09:00:00Z", "2026-01-25T09:00:00Z", "2026-02-01T09:00:00Z"}},
+		{"monthly skips short months", "FREQ=MONTHLY", time.UTC, "2026-01-31T09:00:00Z",
+			[]string{"2026-03-31T09:00:00Z", "2026-05-31T09:00:00Z", "2026-07-31T09:00:00Z"}},
+		{"quarterly", "FREQ=MONTHLY;INTERVAL=3", time.UTC, "2026-11-15T09:00:00Z",
+			[]string{"2027-02-15T09:00:00Z", "2027-05-15T09:00:00Z", "2027-08-15T09:00:00Z"}},
+		{"leap day", "FREQ=MONTHLY;INTERVAL=12", time.UTC, "2024-02-29T09:00:00Z",
+			[]string{"2028-02-29T09:00:00Z", "2032-02-29T09:00:00Z", "2036-02-29T09:00:00Z"}},
+		// British Summer Time starts on 2026-03-29; 09:00 local moves from
+		// 09:00 to 08:00 UTC.
+		{"daylight saving", "FREQ=DAILY", london, "2026-03-28T09:00:00Z",
+			[]string{"2026-03-29T08:00:00Z", "2026-03-30T08:00:00Z", "2026-03-31T08:00:00Z"}},
+		// 23:30 UTC on Sunday 2026-01-04 is already Monday in Tokyo, so the
+		// next Monday there is a week later, not the next day.
+		{"weekday in zone", "FREQ=WEEKLY;BYDAY=MO", tokyo, "2026-01-04T23:30:00Z",
+			[]string{"2026-01-11T23:30:00Z", "2026-01-18T23:30:00Z", "2026-01-25T23:30:00Z"}},
+		{"until time", "FREQ=DAILY;UNTIL=20260103T090000Z", time.UTC, "2026-01-01T09:00:00Z",
+			[]string{"2026-01-02T09:00:00Z", "2026-01-03T09:00:00Z"}},
+		{"until date", "FREQ=DAILY;UNTIL=20260102", time.UTC, "2026-01-01T23:00:00Z",
+			[]string{"2026-01-02T23:00:00Z"}},
+	}
+	for _, tt := range tests {
+		r, err := parseRecurrence(tt.rule)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		prev := utc(tt.from)
+		var got []string
+		for range 3 {
+			next, ok := r.Next(prev, tt.loc)
+			if !ok {
+				break
+			}
+			got = append(got, next.Format(time.RFC3339))
+			prev = next
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("%s: expected %q, got %q", tt.name, tt.want, got)
+		}
+	}
+}
@@ -0,0 +1,133 @@
+// Written by Gemini CLI
+// This file is licensed under the MIT License.
+// See the LICENSE file for details.
+
+package app
+
+import (
+	"cmp"
+	"html"
+	"slices"
+	"strings"
+)
+
+// DefaultSearchLimit is the number of results returned when no limit is given.
+const DefaultSearchLimit = 20
+
+// SearchResult is a todo matched by SearchStore.Search.
+type SearchResult struct {
+	Todo
+	// Rank orders results by relevance; higher is better. Values are only
+	// comparable within one response.
+	Rank float64 `json:"rank"`
+	// Snippet is the HTML-escaped task with matches wrapped in <mark>, safe
+	// to insert into a page as markup.
+	Snippet string `json:"snippet"`
+}
+
+// Placeholders for highlight boundaries. They survive HTML escaping and are
+// swapped for <mark> tags afterwards, so task text can never inject markup.
+// Tasks are highlighted with any placeholders of their own removed, lest
+// they unbalance the tags.
+const (
+	markStart = "\ue000"
+	markStop  = "\ue001"
+)
+
+// markStripper removes the placeholders from text before highlighting.
+var markStripper = strings.NewReplacer(markStart, "", markStop, "")
+
+// markSnippet HTML-escapes a snippet delimited with markStart/markStop and
+// converts the delimiters to <mark> tags.
+func markSnippet(s string) string {
+	s = html.EscapeString(s)
+	s = strings.ReplaceAll(s, markStart, "<mark>")
+	return strings.ReplaceAll(s, markStop, "</mark>")
+}
+
+// searchTerms splits a query into the lowercase terms matched by the
+// fallback search, ignoring quotes and web-search operators.
+func searchTerms(q string) []string {
+	var terms []string
+	for _, f := range strings.Fields(strings.ToLower(q)) {
+		f = strings.Trim(f, `"`)
+		if f != "" && f != "or" && !strings.HasPrefix(f, "-") {
+			terms = append(terms, f)
+		}
+	}
+	return terms
+}
+
+// matchTerms is the fallback used by backends without full-text search. A
+// todo matches if its task contains every term, ignoring case; it is ranked
+// by how many times the terms occur, relative to the task length.
+func matchTerms(t Todo, terms []string) (SearchResult, bool) {
+	if len(terms) == 0 {
+		return SearchResult{}, false
+	}
+	lower := strings.ToLower(t.Task)
+	hits := 0
+	for _, term := range terms {
+		n := strings.Count(lower, term)
+		if n == 0 {
+			return SearchResult{}, false
+		}
+		hits += n
+	}
+	return SearchResult{
+		Todo:    t,
+		Rank:    float64(hits) / float64(len(strings.Fields(lower))+1),
+		Snippet: highlightTerms(t.Task, terms),
+	}, true
+}
+
+// highlightTerms marks every case-insensitive occurrence of terms in task.
+func highlightTerms(task string, terms []string) string {
+	task = markStripper.Replace(task)
+	lower := strings.ToLower(task)
+	if len(lower) != len(task) {
+		// Lowercasing changed byte offsets; skip highlighting rather than
+		// mark the wrong text.
+		return html.EscapeString(task)
+	}
+
+	marked := make([]bool, len(task))
+	for _, term := range terms {
+		for i := 0; ; {
+			j := strings.Index(lower[i:], term)
+			if j < 0 {
+				break
+			}
+			for k := i + j; k < i+j+len(term); k++ {
+				marked[k] = true
+			}
+			i += j + len(term)
+		}
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(task); i++ {
+		if marked[i] && (i == 0 || !marked[i-1]) {
+			b.WriteString(markStart)
+		}
+		b.WriteByte(task[i])
+		if marked[i] && (i == len(task)-1 || !marked[i+1]) {
+			b.WriteString(markStop)
+		}
+	}
+	return markSnippet(b.String())
+}
+
+// rankResults sorts fallback results by rank, then id, and applies limit.
+func rankResults(results []SearchResult, limit int) []SearchResult {
+	slices.SortFunc(results, func(a, b SearchResult) int {
+		if c := cmp.Compare(b.Rank, a.Rank); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.ID, b.ID)
+	})
+	if limit > 0 && len(results) > limit {
+		results = results[:limit]
+	}
+	return results
+}
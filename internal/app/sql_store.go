@@ -0,0 +1,1948 @@
+// Written by Gemini CLI
+// This file is licensed under the MIT License.
+// See the LICENSE file for details.
+
+package app
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+)
+
+// SQLStore is a Store backed by a database/sql connection. The same
+// queries serve both PostgreSQL (production) and SQLite (local development),
+// since both accept $N placeholders and RETURNING clauses.
+//
+// It routes queries across two connection pools:
+// - primary: handles all writes (INSERT, UPDATE, DELETE) and failover reads
+// - replica: handles SELECT queries (may be the same pool as primary)
+//
+// Every operation is wrapped in ExecuteWithRobustness, so callers get
+// retries and circuit breaking without having to think about it.
+type SQLStore struct {
+	primary *sql.DB
+	replica *sql.DB
+	dialect Dialect
+}
+
+// NewPostgresStore creates a store using the given primary and read replica pools.
+// If replica is nil, reads are served by the primary.
+func NewPostgresStore(primary, replica *sql.DB) *SQLStore {
+	if replica == nil {
+		replica = primary
+	}
+	return &SQLStore{primary: primary, replica: replica, dialect: DialectPostgres}
+}
+
+// Close closes both connection pools.
+func (s *SQLStore) Close() error {
+	err := s.primary.Close()
+	if s.replica != s.primary {
+		if rerr := s.replica.Close(); err == nil {
+			err = rerr
+		}
+	}
+	return err
+}
+
+// queryRead runs a SELECT against the read replica, falling back to the
+// primary if the replica query fails.
+func (s *SQLStore) queryRead(ctx context.Context, query string, args ...any) (*sql.Rows, error) {
+	// Try read replica first
+	rows, err := s.replica.QueryContext(ctx, query, args...)
+	if err != nil {
+		slog.Warn("Read replica failed, falling back to primary", "error", err)
+		// If read replica fails, fall back to primary
+		if s.replica != s.primary {
+			rows, err = s.primary.QueryContext(ctx, query, args...)
+		}
+	}
+	return rows, err
+}
+
+// inTx runs fn in a transaction on the primary, wrapped in
+// ExecuteWithRobustness so the whole transaction is retried as one unit.
+func (s *SQLStore) inTx(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	return ExecuteWithRobustness(func() error {
+		tx, err := s.primary.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		if err := fn(tx); err != nil {
+			return err
+		}
+		return tx.Commit()
+	})
+}
+
+// forUpdate returns the row locking clause for SELECTs inside a transaction.
+// SQLite has no row locks; its transactions take the database write lock up
+// front (see OpenSQLite), which serializes them anyway.
+func (s *SQLStore) forUpdate() string {
+	if s.dialect == DialectPostgres {
+		return " FOR UPDATE"
+	}
+	return ""
+}
+
+// forShare is forUpdate's shared counterpart, for rows a transaction relies
+// on but doesn't modify.
+func (s *SQLStore) forShare() string {
+	if s.dialect == DialectPostgres {
+		return " FOR SHARE"
+	}
+	return ""
+}
+
+// positionLockID is the Postgres advisory lock key held by transactions
+// appending todos, so concurrent creates each see the other's position.
+const positionLockID = 0x706f7369 // "posi"
+
+// lockPositions serializes appends to the position order until tx ends. A
+// row lock on the last todo wouldn't do: under READ COMMITTED, a waiter
+// rechecks only that row and misses the todo the holder appended. SQLite
+// transactions already hold the write lock.
+func (s *SQLStore) lockPositions(ctx context.Context, tx *sql.Tx) error {
+	if s.dialect != DialectPostgres {
+		return nil
+	}
+	_, err := tx.ExecContext(ctx, "SELECT pg_advisory_xact_lock($1)", positionLockID)
+	return err
+}
+
+// checkList returns a *ValidationError unless the list exists, locking it so
+// it can't be deleted before the transaction commits.
+func (s *SQLStore) checkList(ctx context.Context, tx *sql.Tx, id int) error {
+	var found int
+	err := tx.QueryRowContext(ctx, "SELECT id FROM lists WHERE id = $1"+s.forShare(), id).Scan(&found)
+	if err == sql.ErrNoRows {
+		return unknownListError()
+	}
+	return err
+}
+
+// checkParent returns a *ValidationError unless the parent todo exists, and
+// otherwise its list. The parent is locked so it can't be deleted, or its
+// completion rolled up, before the transaction commits.
+func (s *SQLStore) checkParent(ctx context.Context, tx *sql.Tx, id int) (listID int, err error) {
+	err = tx.QueryRowContext(ctx, "SELECT list_id FROM todos WHERE id = $1 AND deleted_at IS NULL"+s.forUpdate(), id).Scan(&listID)
+	if err == sql.ErrNoRows {
+		return 0, unknownParentError()
+	}
+	return listID, err
+}
+
+// openBlockers counts the incomplete, untrashed todos blocking the todos row.
+const openBlockers = "(SELECT COUNT(*) FROM todo_blockers tb JOIN todos b ON b.id = tb.blocker_id " +
+	"WHERE tb.todo_id = todos.id AND NOT b.completed AND b.deleted_at IS NULL)"
+
+// todoColumns are the columns scanned by scanTodo, in order. child_count and
+// open_blockers are computed, using todos_parent_id_idx and the todo_blockers
+// primary key.
+const todoColumns = "id, list_id, parent_id, task, completed, due_at, priority, notes, auto_complete, recurrence, recurrence_tz, " +
+	"position, created_at, updated_at, completed_at, deleted_at, version, " +
+	"(SELECT COUNT(*) FROM todos c WHERE c.parent_id = todos.id AND c.deleted_at IS NULL) AS child_count, " +
+	openBlockers + " AS open_blockers"
+
+// scanTodo scans todoColumns, followed by any extra columns, into t.
+func scanTodo(row interface{ Scan(...any) error }, t *Todo, extra ...any) error {
+	dest := []any{&t.ID, &t.ListID, &t.ParentID, &t.Task, &t.Completed, &t.DueAt, &t.Priority, &t.Notes, &t.AutoComplete,
+		&t.Recurrence, &t.RecurrenceTZ, &t.Position, &t.CreatedAt, &t.UpdatedAt, &t.CompletedAt, &t.DeletedAt, &t.Version, &t.ChildCount, &t.OpenBlockers}
+	if err := row.Scan(append(dest, extra...)...); err != nil {
+		return err
+	}
+	// Drivers return times in the session or a fixed zone; keep them in UTC.
+	t.CreatedAt, t.UpdatedAt = t.CreatedAt.UTC(), t.UpdatedAt.UTC()
+	t.DueAt, t.CompletedAt, t.DeletedAt = normalizeTime(t.DueAt), normalizeTime(t.CompletedAt), normalizeTime(t.DeletedAt)
+	return nil
+}
+
+// queryFunc runs a query returning rows; both SQLStore.queryRead and
+// (*sql.Tx).QueryContext are queryFuncs.
+type queryFunc func(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+
+// loadTags fills in the tags of todos with a single query, however many
+// todos there are, so listing never costs a query per todo.
+func loadTags(ctx context.Context, query queryFunc, todos []*Todo) error {
+	if len(todos) == 0 {
+		return nil
+	}
+	byID := make(map[int]*Todo, len(todos))
+	params := make([]string, len(todos))
+	args := make([]any, len(todos))
+	for i, t := range todos {
+		t.Tags = []Tag{}
+		byID[t.ID] = t
+		params[i] = fmt.Sprintf("$%d", i+1)
+		args[i] = t.ID
+	}
+
+	rows, err := query(ctx, `
+		SELECT tt.todo_id, g.id, g.name
+		FROM todo_tags tt JOIN tags g ON g.id = tt.tag_id
+		WHERE tt.todo_id IN (`+strings.Join(params, ", ")+`)
+		ORDER BY g.name, g.id`, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var todoID int
+		var g Tag
+		if err := rows.Scan(&todoID, &g.ID, &g.Name); err != nil {
+			return err
+		}
+		if t := byID[todoID]; t != nil {
+			t.Tags = append(t.Tags, g)
+		}
+	}
+	return rows.Err()
+}
+
+// todoPtrs returns pointers to the elements of todos, for loadTags.
+func todoPtrs(todos []Todo) []*Todo {
+	ptrs := make([]*Todo, len(todos))
+	for i := range todos {
+		ptrs[i] = &todos[i]
+	}
+	return ptrs
+}
+
+// List retrieves a page of todo items.
+// Uses the read replica to offload SELECT queries from the primary database.
+// This improves performance and allows the primary to focus on writes.
+// Pagination is keyset-based, so deep pages cost the same as the first.
+func (s *SQLStore) List(ctx context.Context, opts ListOptions) (TodoPage, error) {
+	var page TodoPage
+	query, args := listQuery(opts)
+
+	err := ExecuteWithRobustness(func() error {
+		// Read the revision first: if the replica catches up in between, the
+		// page has changes its revision doesn't count, never the reverse.
+		// That only holds within one database, so every read goes to the
+		// one the revision came from.
+		db, revision, err := s.revisionDB(ctx, opts.MinRevision)
+		if err != nil {
+			return err
+		}
+		modified, err := revisionTime(ctx, db.QueryContext, revision)
+		if err != nil {
+			return err
+		}
+		rows, err := db.QueryContext(ctx, query, args...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		page = TodoPage{Todos: []Todo{}, Revision: revision, Modified: modified} // Reset on retry to avoid duplicates
+		for rows.Next() {
+			var t Todo
+			if err := scanTodo(rows, &t); err != nil {
+				return err
+			}
+			page.Todos = append(page.Todos, t)
+		}
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		if opts.Limit > 0 && len(page.Todos) > opts.Limit {
+			page.Todos, page.HasMore = page.Todos[:opts.Limit], true
+		}
+		return loadTags(ctx, db.QueryContext, todoPtrs(page.Todos))
+	})
+	return page, err
+}
+
+// revisionDB reads the revision from the read replica, falling back to the
+// primary, and returns it with the database it came from. A replica that
+// fails, or is behind minRevision, is passed over for the primary.
+func (s *SQLStore) revisionDB(ctx context.Context, minRevision int64) (*sql.DB, int64, error) {
+	revision, err := readRevision(ctx, s.replica.QueryContext)
+	if s.replica == s.primary || (err == nil && revision >= minRevision) {
+		return s.replica, revision, err
+	}
+	if err != nil {
+		slog.Warn("Read replica failed, falling back to primary", "error", err)
+	}
+	revision, err = readRevision(ctx, s.primary.QueryContext)
+	return s.primary, revision, err
+}
+
+// Revision reads the revision from the read replica, falling back to the
+// primary, the same way List does.
+func (s *SQLStore) Revision(ctx context.Context) (int64, error) {
+	var revision int64
+	err := ExecuteWithRobustness(func() error {
+		var err error
+		_, revision, err = s.revisionDB(ctx, 0)
+		return err
+	})
+	return revision, err
+}
+
+// EventsRevision reads the revision from the primary, like Events.
+func (s *SQLStore) EventsRevision(ctx context.Context) (int64, error) {
+	var revision int64
+	err := ExecuteWithRobustness(func() error {
+		var err error
+		revision, err = readRevision(ctx, s.primary.QueryContext)
+		return err
+	})
+	return revision, err
+}
+
+// readRevision reads the revision with query.
+func readRevision(ctx context.Context, query queryFunc) (int64, error) {
+	rows, err := query(ctx, "SELECT revision FROM todos_revision")
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	var revision int64
+	if rows.Next() {
+		if err := rows.Scan(&revision); err != nil {
+			return 0, err
+		}
+	}
+	return revision, rows.Err()
+}
+
+// revisionTime returns when the change counted as revision was made, from
+// its events, or the zero time for revision 0.
+func revisionTime(ctx context.Context, query queryFunc, revision int64) (time.Time, error) {
+	var at time.Time
+	if revision == 0 {
+		return at, nil
+	}
+	rows, err := query(ctx, "SELECT created_at FROM todo_events WHERE revision = $1 ORDER BY id LIMIT 1", revision)
+	if err != nil {
+		return at, err
+	}
+	defer rows.Close()
+	if rows.Next() {
+		if err := rows.Scan(&at); err != nil {
+			return at, err
+		}
+	}
+	return at.UTC(), rows.Err()
+}
+
+// listQuery builds the SELECT for List. It fetches one row beyond the limit
+// so List can tell whether another page exists.
+func listQuery(opts ListOptions) (string, []any) {
+	var where []string
+	var args []any
+	arg := func(v any) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+
+	if opts.Trashed {
+		where = append(where, "deleted_at IS NOT NULL")
+	} else {
+		where = append(where, "deleted_at IS NULL")
+	}
+	if opts.ListID != 0 {
+		where = append(where, "list_id = "+arg(opts.ListID))
+	}
+	if opts.ParentID != nil {
+		where = append(where, "parent_id = "+arg(*opts.ParentID))
+	}
+	if opts.TopLevel {
+		where = append(where, "parent_id IS NULL")
+	}
+	if opts.Completed != nil {
+		where = append(where, "completed = "+arg(*opts.Completed))
+	}
+	if opts.Ready != nil {
+		if *opts.Ready {
+			where = append(where, "(NOT completed AND "+openBlockers+" = 0)")
+		} else {
+			where = append(where, "(completed OR "+openBlockers+" > 0)")
+		}
+	}
+	if opts.DueFrom != nil {
+		where = append(where, "due_at >= "+arg(*opts.DueFrom))
+	}
+	if opts.DueBefore != nil {
+		where = append(where, "due_at < "+arg(*opts.DueBefore))
+	}
+	if opts.Query != "" {
+		pattern := "%" + likeEscaper.Replace(strings.ToLower(opts.Query)) + "%"
+		where = append(where, "LOWER(task) LIKE "+arg(pattern)+` ESCAPE '\'`)
+	}
+	if len(opts.Tags) > 0 {
+		names := slices.Compact(slices.Sorted(slices.Values(opts.Tags)))
+		params := make([]string, len(names))
+		for i, name := range names {
+			params[i] = arg(name)
+		}
+		tagged := "SELECT tt.todo_id FROM todo_tags tt JOIN tags g ON g.id = tt.tag_id WHERE g.name IN (" +
+			strings.Join(params, ", ") + ")"
+		if !opts.AnyTag {
+			tagged += " GROUP BY tt.todo_id HAVING COUNT(*) = " + arg(len(names))
+		}
+		where = append(where, "id IN ("+tagged+")")
+	}
+
+	field := opts.Sort.field()
+	dir, op := "ASC", ">"
+	if opts.Sort.Desc {
+		dir, op = "DESC", "<"
+	}
+	if opts.After != nil {
+		// DecodeCursor has already checked the key parses.
+		after, _ := opts.After.todo()
+		if field.key == nil {
+			where = append(where, fmt.Sprintf("id %s %s", op, arg(after.ID)))
+		} else {
+			key, id := arg(field.key(after)), arg(after.ID)
+			where = append(where, fmt.Sprintf("(%[1]s %[2]s %[3]s OR (%[1]s = %[3]s AND id %[2]s %[4]s))",
+				field.column, op, key, id))
+		}
+	}
+
+	query := "SELECT " + todoColumns + " FROM todos WHERE " + strings.Join(where, " AND ")
+	if field.column == "id" {
+		query += " ORDER BY id " + dir
+	} else {
+		query += fmt.Sprintf(" ORDER BY %s %s, id %s", field.column, dir, dir)
+	}
+	if opts.Limit > 0 {
+		query += " LIMIT " + arg(opts.Limit+1)
+	}
+	return query, args
+}
+
+// likeEscaper escapes LIKE wildcards so user input matches literally.
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// headlineOptions make ts_headline highlight with markSnippet's
+// placeholders, over the whole task since tasks are short. Search removes
+// the placeholders from the task first, with translate.
+const headlineOptions = "StartSel=" + markStart + ", StopSel=" + markStop + ", HighlightAll=true"
+
+// Search finds todos matching a web-search style query, reading from the
+// replica with primary fallback. Postgres uses the full-text index; other
+// dialects fall back to matching every term with LIKE.
+func (s *SQLStore) Search(ctx context.Context, query string, limit int) ([]SearchResult, error) {
+	if s.dialect != DialectPostgres {
+		return s.searchLike(ctx, query, limit)
+	}
+
+	var results []SearchResult
+	err := ExecuteWithRobustness(func() error {
+		rows, err := s.queryRead(ctx, `
+			SELECT `+todoColumns+`, ts_rank(search, q) AS rank, ts_headline('english', translate(task, $4, ''), q, $3)
+			FROM todos, websearch_to_tsquery('english', $1) AS q
+			WHERE search @@ q AND deleted_at IS NULL
+			ORDER BY rank DESC, id
+			LIMIT $2`, query, limit, headlineOptions, markStart+markStop)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		results = []SearchResult{} // Reset on retry to avoid duplicates
+		for rows.Next() {
+			var r SearchResult
+			if err := scanTodo(rows, &r.Todo, &r.Rank, &r.Snippet); err != nil {
+				return err
+			}
+			r.Snippet = markSnippet(r.Snippet)
+			results = append(results, r)
+		}
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		return loadTags(ctx, s.queryRead, resultTodos(results))
+	})
+	return results, err
+}
+
+// resultTodos returns pointers to the todos in results, for loadTags.
+func resultTodos(results []SearchResult) []*Todo {
+	ptrs := make([]*Todo, len(results))
+	for i := range results {
+		ptrs[i] = &results[i].Todo
+	}
+	return ptrs
+}
+
+// searchLike narrows candidates to tasks containing every term with LIKE,
+// then ranks and highlights them in Go. It scans every todo, which is fine
+// for the local development databases it serves.
+func (s *SQLStore) searchLike(ctx context.Context, query string, limit int) ([]SearchResult, error) {
+	terms := searchTerms(query)
+	if len(terms) == 0 {
+		return []SearchResult{}, nil
+	}
+	where := []string{"deleted_at IS NULL"}
+	var args []any
+	for _, term := range terms {
+		args = append(args, "%"+likeEscaper.Replace(term)+"%")
+		where = append(where, fmt.Sprintf(`LOWER(task) LIKE $%d ESCAPE '\'`, len(args)))
+	}
+
+	var results []SearchResult
+	err := ExecuteWithRobustness(func() error {
+		rows, err := s.queryRead(ctx,
+			"SELECT "+todoColumns+" FROM todos WHERE "+strings.Join(where, " AND "), args...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		results = []SearchResult{} // Reset on retry to avoid duplicates
+		for rows.Next() {
+			var t Todo
+			if err := scanTodo(rows, &t); err != nil {
+				return err
+			}
+			// LOWER only folds ASCII in SQLite, so recheck in Go.
+			if r, ok := matchTerms(t, terms); ok {
+				results = append(results, r)
+			}
+		}
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		results = rankResults(results, limit)
+		return loadTags(ctx, s.queryRead, resultTodos(results))
+	})
+	return results, err
+}
+
+// Get retrieves a single todo item, reading from the replica with primary fallback.
+func (s *SQLStore) Get(ctx context.Context, id int) (Todo, error) {
+	var t Todo
+	found := false
+
+	err := ExecuteWithRobustness(func() error {
+		rows, err := s.queryRead(ctx, "SELECT "+todoColumns+" FROM todos WHERE id = $1 AND deleted_at IS NULL", id)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		found = rows.Next()
+		if !found {
+			return rows.Err()
+		}
+		if err := scanTodo(rows, &t); err != nil {
+			return err
+		}
+		rows.Close()
+		return loadTags(ctx, s.queryRead, []*Todo{&t})
+	})
+	if err == nil && !found {
+		err = ErrNotFound
+	}
+	return t, err
+}
+
+// Create inserts a todo on the primary, checking its list and parent exist
+// and rolling completion up to the parent in the same transaction.
+func (s *SQLStore) Create(ctx context.Context, t Todo) (Todo, error) {
+	in := t
+	err := s.inTx(ctx, func(tx *sql.Tx) error {
+		t = in // Reset on retry, since the list may have come from the parent
+		var cs changeSet
+		if err := s.insertTodo(ctx, tx, &cs, &t, now()); err != nil {
+			return err
+		}
+		return writeEvents(ctx, tx, &cs)
+	})
+	return t, err
+}
+
+// CreateIdempotent creates a todo on the primary, unless the actor already
+// used the key. The key is claimed before the todo is inserted, so a
+// concurrent request with it waits for this one's transaction and then
+// finds the key taken (PostgreSQL), or runs entirely before or after it
+// (SQLite).
+func (s *SQLStore) CreateIdempotent(ctx context.Context, key IdempotencyKey, t Todo) (IdempotencyKey, bool, error) {
+	in := t
+	var stored IdempotencyKey
+	var created bool
+	err := s.inTx(ctx, func(tx *sql.Tx) error {
+		t = in
+		actor, _, _ := eventContext(ctx)
+		at := now()
+		res, err := tx.ExecContext(ctx, `
+			INSERT INTO idempotency_keys (actor, idempotency_key, fingerprint, response, created_at)
+			VALUES ($1, $2, $3, $4, $5)
+			ON CONFLICT DO NOTHING`,
+			actor, key.Key, key.Fingerprint, "{}", at)
+		if err != nil {
+			return err
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			var response string
+			stored, created = IdempotencyKey{Key: key.Key}, false
+			err := tx.QueryRowContext(ctx, `
+				SELECT fingerprint, response, created_at FROM idempotency_keys
+				WHERE actor = $1 AND idempotency_key = $2`,
+				actor, key.Key).Scan(&stored.Fingerprint, &response, &stored.CreatedAt)
+			if err != nil {
+				return err
+			}
+			stored.CreatedAt = stored.CreatedAt.UTC()
+			return json.Unmarshal([]byte(response), &stored.Todo)
+		}
+
+		var cs changeSet
+		if err := s.insertTodo(ctx, tx, &cs, &t, at); err != nil {
+			return err
+		}
+		if err := writeEvents(ctx, tx, &cs); err != nil {
+			return err
+		}
+		response, err := json.Marshal(t)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx,
+			"UPDATE idempotency_keys SET response = $1 WHERE actor = $2 AND idempotency_key = $3",
+			string(response), actor, key.Key)
+		if err != nil {
+			return err
+		}
+		key.Todo, key.CreatedAt = t, at
+		stored, created = key, true
+		return nil
+	})
+	return stored, created, err
+}
+
+// PurgeIdempotencyKeys deletes Idempotency-Keys kept before the given time
+// on the primary.
+func (s *SQLStore) PurgeIdempotencyKeys(ctx context.Context, before time.Time) (int, error) {
+	var n int64
+	err := s.inTx(ctx, func(tx *sql.Tx) error {
+		res, err := tx.ExecContext(ctx, "DELETE FROM idempotency_keys WHERE created_at < $1", before)
+		if err != nil {
+			return err
+		}
+		n, err = res.RowsAffected()
+		return err
+	})
+	return int(n), err
+}
+
+// insertTodo inserts t, incomplete and last, in tx, fills in its
+// server-assigned fields and adds it to cs. Concurrent inserts take turns
+// picking the last position (see lockPositions), so they never collide on
+// the unique index.
+func (s *SQLStore) insertTodo(ctx context.Context, tx *sql.Tx, cs *changeSet, t *Todo, at time.Time) error {
+	t.Completed = false
+	if t.ParentID != nil {
+		listID, err := s.checkParent(ctx, tx, *t.ParentID)
+		if err != nil {
+			return err
+		}
+		if t.ListID == 0 {
+			t.ListID = listID
+		}
+	}
+	t.stampCreated(at)
+	if err := s.checkList(ctx, tx, t.ListID); err != nil {
+		return err
+	}
+	if err := s.lockPositions(ctx, tx); err != nil {
+		return err
+	}
+	var last sql.NullString
+	if err := tx.QueryRowContext(ctx, "SELECT MAX(position) FROM todos").Scan(&last); err != nil {
+		return err
+	}
+	position, err := positionBetween(last.String, "")
+	if err != nil {
+		return err
+	}
+	t.Position = position
+	err = tx.QueryRowContext(ctx, `
+		INSERT INTO todos (list_id, parent_id, task, completed, due_at, priority, notes, auto_complete,
+			recurrence, recurrence_tz, position, created_at, updated_at, completed_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14)
+		RETURNING id`,
+		t.ListID, t.ParentID, t.Task, t.Completed, t.DueAt, t.Priority, t.Notes, t.AutoComplete,
+		t.Recurrence, t.RecurrenceTZ, t.Position, t.CreatedAt, t.UpdatedAt, t.CompletedAt,
+	).Scan(&t.ID)
+	if err != nil {
+		return err
+	}
+	cs.add(t.ID, EventCreate, nil)
+	return s.rollup(ctx, tx, cs, t.ParentID, at)
+}
+
+// Update reads, modifies and writes back a todo in a single transaction on
+// the primary. The row is locked for the duration, so concurrent updates
+// can't overwrite each other's changes. The next occurrence of a recurring
+// todo is created, with the same tags, in the same transaction.
+func (s *SQLStore) Update(ctx context.Context, id int, fn UpdateFunc) (Todo, error) {
+	var t Todo
+	err := s.inTx(ctx, func(tx *sql.Tx) error {
+		var cs changeSet
+		var err error
+		if t, err = s.update(ctx, tx, &cs, id, fn); err != nil {
+			return err
+		}
+		return writeEvents(ctx, tx, &cs)
+	})
+	return t, err
+}
+
+// update is Update within tx, adding the todos it changes to cs. Every
+// check comes before the first write.
+func (s *SQLStore) update(ctx context.Context, tx *sql.Tx, cs *changeSet, id int, fn UpdateFunc) (Todo, error) {
+	var t Todo
+	err := scanTodo(tx.QueryRowContext(ctx,
+		"SELECT "+todoColumns+" FROM todos WHERE id = $1 AND deleted_at IS NULL"+s.forUpdate(), id), &t)
+	if err == sql.ErrNoRows {
+		return Todo{}, ErrNotFound
+	}
+	if err != nil {
+		return Todo{}, err
+	}
+	if err := loadTags(ctx, tx.QueryContext, []*Todo{&t}); err != nil {
+		return Todo{}, err
+	}
+
+	before := t
+	at := now()
+	if err := applyUpdate(&t, fn, at); err != nil {
+		return Todo{}, err
+	}
+	if err := checkCompletable(before, t); err != nil {
+		return Todo{}, err
+	}
+	if t.ListID != before.ListID {
+		if err := s.checkList(ctx, tx, t.ListID); err != nil {
+			return Todo{}, err
+		}
+	}
+	moved := !equalParent(t.ParentID, before.ParentID)
+	if moved && t.ParentID != nil {
+		if err := s.checkNewParent(ctx, tx, id, *t.ParentID); err != nil {
+			return Todo{}, err
+		}
+	}
+	children, completed, err := subtasks(ctx, tx, id)
+	if err != nil {
+		return Todo{}, err
+	}
+	rollupCompletion(&t, children, completed, at)
+	next, recurring := advanceRecurrence(before, &t, at)
+
+	if !cs.has(id) {
+		cs.add(id, EventUpdate, &before)
+		// writeEvents bumps the stored version.
+		t.Version++
+	}
+	_, err = tx.ExecContext(ctx, `
+		UPDATE todos
+		SET list_id = $1, parent_id = $2, task = $3, completed = $4, due_at = $5, priority = $6, notes = $7,
+			auto_complete = $8, recurrence = $9, recurrence_tz = $10, updated_at = $11, completed_at = $12
+		WHERE id = $13`,
+		t.ListID, t.ParentID, t.Task, t.Completed, t.DueAt, t.Priority, t.Notes,
+		t.AutoComplete, t.Recurrence, t.RecurrenceTZ, t.UpdatedAt, t.CompletedAt, id)
+	if err != nil {
+		return Todo{}, err
+	}
+	if err := s.rollup(ctx, tx, cs, t.ParentID, at); err != nil {
+		return Todo{}, err
+	}
+	if moved {
+		if err := s.rollup(ctx, tx, cs, before.ParentID, at); err != nil {
+			return Todo{}, err
+		}
+	}
+	if recurring {
+		if err := s.insertTodo(ctx, tx, cs, &next, at); err != nil {
+			return Todo{}, err
+		}
+		_, err = tx.ExecContext(ctx,
+			"INSERT INTO todo_tags (todo_id, tag_id) SELECT $1, tag_id FROM todo_tags WHERE todo_id = $2", next.ID, id)
+		if err != nil {
+			return Todo{}, err
+		}
+	}
+	return t, nil
+}
+
+// checkNewParent checks a todo can be moved under parentID: the parent must
+// exist and must not be the todo or one of its subtasks, which would make a
+// cycle. The parent's ancestors are walked with a recursive query.
+func (s *SQLStore) checkNewParent(ctx context.Context, tx *sql.Tx, id, parentID int) error {
+	if _, err := s.checkParent(ctx, tx, parentID); err != nil {
+		return err
+	}
+	var n int
+	err := tx.QueryRowContext(ctx, `
+		WITH RECURSIVE ancestors (id, parent_id) AS (
+			SELECT id, parent_id FROM todos WHERE id = $1
+			UNION ALL
+			SELECT t.id, t.parent_id FROM todos t JOIN ancestors a ON t.id = a.parent_id
+		)
+		SELECT COUNT(*) FROM ancestors WHERE id = $2`, parentID, id).Scan(&n)
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		return parentCycleError()
+	}
+	return nil
+}
+
+// subtasks counts a todo's untrashed subtasks and how many of them are
+// complete.
+func subtasks(ctx context.Context, tx *sql.Tx, id int) (children, completed int, err error) {
+	err = tx.QueryRowContext(ctx, `
+		SELECT COUNT(*), COALESCE(SUM(CASE WHEN completed THEN 1 ELSE 0 END), 0)
+		FROM todos WHERE parent_id = $1 AND deleted_at IS NULL`, id).Scan(&children, &completed)
+	return children, completed, err
+}
+
+// rollup recomputes the completion of the todo with the given id, if any,
+// from its subtasks, and of its ancestors as long as that changes anything,
+// adding the todos it changes to cs. Each todo is locked before its
+// subtasks are counted.
+func (s *SQLStore) rollup(ctx context.Context, tx *sql.Tx, cs *changeSet, id *int, at time.Time) error {
+	for id != nil {
+		var t Todo
+		err := tx.QueryRowContext(ctx,
+			"SELECT parent_id, completed, auto_complete FROM todos WHERE id = $1"+s.forUpdate(), *id,
+		).Scan(&t.ParentID, &t.Completed, &t.AutoComplete)
+		if err == sql.ErrNoRows {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		children, completed, err := subtasks(ctx, tx, *id)
+		if err != nil {
+			return err
+		}
+		if !rollupCompletion(&t, children, completed, at) {
+			return nil
+		}
+		if err := touch(ctx, tx, cs, *id, EventUpdate); err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, "UPDATE todos SET completed = $1, completed_at = $2, updated_at = $3 WHERE id = $4",
+			t.Completed, t.CompletedAt, t.UpdatedAt, *id)
+		if err != nil {
+			return err
+		}
+		id = t.ParentID
+	}
+	return nil
+}
+
+// Delete moves a todo to the trash on the primary, with all its subtasks if
+// cascade is set, and rolls completion up to its parent in the same
+// transaction.
+func (s *SQLStore) Delete(ctx context.Context, id int, cascade bool, cond Precondition) error {
+	return s.inTx(ctx, func(tx *sql.Tx) error {
+		var cs changeSet
+		if err := s.delete(ctx, tx, &cs, id, cascade, cond); err != nil {
+			return err
+		}
+		return writeEvents(ctx, tx, &cs)
+	})
+}
+
+// delete is Delete within tx, adding the todos it changes to cs.
+func (s *SQLStore) delete(ctx context.Context, tx *sql.Tx, cs *changeSet, id int, cascade bool, cond Precondition) error {
+	var parentID *int
+	var version int
+	err := tx.QueryRowContext(ctx,
+		"SELECT parent_id, version FROM todos WHERE id = $1 AND deleted_at IS NULL"+s.forUpdate(), id).Scan(&parentID, &version)
+	if err == sql.ErrNoRows {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if err := cond.check(version); err != nil {
+		return err
+	}
+	children, _, err := subtasks(ctx, tx, id)
+	if err != nil {
+		return err
+	}
+	if children > 0 && !cascade {
+		return hasSubtasksConflict(children)
+	}
+
+	ids, err := queryIDs(ctx, tx, `
+		WITH RECURSIVE subtree (id) AS (
+			SELECT id FROM todos WHERE id = $1
+			UNION ALL
+			SELECT t.id FROM todos t JOIN subtree s ON t.parent_id = s.id WHERE t.deleted_at IS NULL
+		)
+		SELECT id FROM subtree`, id)
+	if err != nil {
+		return err
+	}
+	at := now()
+	if err := setDeletedAt(ctx, tx, cs, EventDelete, ids, &at); err != nil {
+		return err
+	}
+	return s.rollup(ctx, tx, cs, parentID, at)
+}
+
+// Batch runs ops in one transaction on the primary. Without atomic, each op
+// runs under a savepoint, which is rolled back if the op fails.
+func (s *SQLStore) Batch(ctx context.Context, ops []BatchOp, atomic bool) ([]BatchResult, error) {
+	var results []BatchResult
+	err := s.inTx(ctx, func(tx *sql.Tx) error {
+		results = make([]BatchResult, len(ops))
+		var events []TodoEvent
+		for i, op := range ops {
+			if !atomic {
+				if _, err := tx.ExecContext(ctx, "SAVEPOINT batch_op"); err != nil {
+					return err
+				}
+			}
+			var cs changeSet
+			res, err := s.batchOp(ctx, tx, &cs, op)
+			var opEvents []TodoEvent
+			if err == nil {
+				opEvents, err = collectEvents(ctx, tx, &cs)
+			}
+			switch {
+			case err == nil:
+			case !isExpected(err):
+				return err
+			case atomic:
+				return &BatchError{Index: i, Err: err}
+			default:
+				if _, err := tx.ExecContext(ctx, "ROLLBACK TO SAVEPOINT batch_op"); err != nil {
+					return err
+				}
+				res = BatchResult{Err: err}
+			}
+			if !atomic {
+				if _, err := tx.ExecContext(ctx, "RELEASE SAVEPOINT batch_op"); err != nil {
+					return err
+				}
+			}
+			results[i] = res
+			if err == nil {
+				events = append(events, opEvents...)
+			}
+		}
+		// Insert the events as one change, last, so the batch doesn't hold
+		// the revision row while locking todos.
+		return insertEvents(ctx, tx, events)
+	})
+	return results, err
+}
+
+// batchOp runs a single op of a batch within tx, adding the todos it
+// changes to cs.
+func (s *SQLStore) batchOp(ctx context.Context, tx *sql.Tx, cs *changeSet, op BatchOp) (BatchResult, error) {
+	switch op.Op {
+	case BatchCreate:
+		t := op.Todo
+		err := s.insertTodo(ctx, tx, cs, &t, now())
+		return BatchResult{Todo: &t}, err
+	case BatchUpdate:
+		t, err := s.update(ctx, tx, cs, op.ID, op.Update)
+		return BatchResult{Todo: &t}, err
+	case BatchDelete:
+		return BatchResult{}, s.delete(ctx, tx, cs, op.ID, op.Cascade, nil)
+	case BatchClearCompleted:
+		candidates, err := s.clearable(ctx, tx, op.ListID)
+		if err != nil {
+			return BatchResult{}, err
+		}
+		for _, id := range clearRoots(candidates) {
+			if err := s.delete(ctx, tx, cs, id, true, nil); err != nil {
+				return BatchResult{}, err
+			}
+		}
+		return BatchResult{Count: cs.count(EventDelete)}, nil
+	case BatchCompleteAll:
+		if err := s.checkList(ctx, tx, op.ListID); err != nil {
+			return BatchResult{}, err
+		}
+		ids, err := queryIDs(ctx, tx,
+			"SELECT id FROM todos WHERE list_id = $1 AND NOT completed AND deleted_at IS NULL ORDER BY id"+s.forUpdate(), op.ListID)
+		if err != nil {
+			return BatchResult{}, err
+		}
+		n, err := completeAll(ids, func(id int, fn UpdateFunc) error {
+			_, err := s.update(ctx, tx, cs, id, fn)
+			return err
+		})
+		return BatchResult{Count: n}, err
+	}
+	return BatchResult{}, fmt.Errorf("%w: unknown batch operation %q", ErrInvalidInput, op.Op)
+}
+
+// clearable returns the completed todos in listID, or in every list if it
+// is 0, that have no open subtasks anywhere below them, by id with their
+// parent ids, and locks them. The todos with open subtasks are found by
+// walking up from every open subtask.
+func (s *SQLStore) clearable(ctx context.Context, tx *sql.Tx, listID int) (map[int]*int, error) {
+	query := `
+		WITH RECURSIVE has_open (id) AS (
+			SELECT parent_id FROM todos WHERE parent_id IS NOT NULL AND NOT completed AND deleted_at IS NULL
+			UNION
+			SELECT t.parent_id FROM todos t JOIN has_open h ON t.id = h.id WHERE t.parent_id IS NOT NULL
+		)
+		SELECT id, parent_id FROM todos
+		WHERE completed AND deleted_at IS NULL AND id NOT IN (SELECT id FROM has_open)`
+	var args []any
+	if listID != 0 {
+		if err := s.checkList(ctx, tx, listID); err != nil {
+			return nil, err
+		}
+		query += " AND list_id = $1"
+		args = append(args, listID)
+	}
+	rows, err := tx.QueryContext(ctx, query+" ORDER BY id"+s.forUpdate(), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	candidates := make(map[int]*int)
+	for rows.Next() {
+		var id int
+		var parentID *int
+		if err := rows.Scan(&id, &parentID); err != nil {
+			return nil, err
+		}
+		candidates[id] = parentID
+	}
+	return candidates, rows.Err()
+}
+
+// queryIDs returns the ids selected by query.
+func queryIDs(ctx context.Context, tx *sql.Tx, query string, args ...any) ([]int, error) {
+	rows, err := tx.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// setDeletedAt sets deleted_at of the todos with the given ids, adding them
+// to cs with action. They are all added first, so each before state is
+// from before any of them changed.
+func setDeletedAt(ctx context.Context, tx *sql.Tx, cs *changeSet, action string, ids []int, at *time.Time) error {
+	for _, id := range ids {
+		if err := touch(ctx, tx, cs, id, action); err != nil {
+			return err
+		}
+	}
+	for _, id := range ids {
+		if _, err := tx.ExecContext(ctx, "UPDATE todos SET deleted_at = $1 WHERE id = $2", at, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Restore takes a todo out of the trash on the primary, with the subtasks
+// trashed at the same time, and rolls completion up to its parent in the
+// same transaction.
+func (s *SQLStore) Restore(ctx context.Context, id int) (Todo, error) {
+	var t Todo
+	err := s.inTx(ctx, func(tx *sql.Tx) error {
+		var parentID *int
+		var deletedAt *time.Time
+		err := tx.QueryRowContext(ctx, "SELECT parent_id, deleted_at FROM todos WHERE id = $1"+s.forUpdate(), id).Scan(&parentID, &deletedAt)
+		if err == sql.ErrNoRows {
+			return ErrNotFound
+		}
+		if err != nil {
+			return err
+		}
+
+		if deletedAt != nil {
+			if parentID != nil {
+				var parentDeletedAt *time.Time
+				err := tx.QueryRowContext(ctx, "SELECT deleted_at FROM todos WHERE id = $1"+s.forUpdate(), *parentID).Scan(&parentDeletedAt)
+				if err != nil {
+					return err
+				}
+				if parentDeletedAt != nil {
+					return parentTrashedConflict()
+				}
+			}
+			// Subtasks trashed along with the todo share its deleted_at;
+			// compare the columns rather than round-tripping the time.
+			ids, err := queryIDs(ctx, tx, `
+				WITH RECURSIVE subtree (id) AS (
+					SELECT id FROM todos WHERE id = $1
+					UNION ALL
+					SELECT t.id FROM todos t JOIN subtree s ON t.parent_id = s.id
+					WHERE t.deleted_at = (SELECT deleted_at FROM todos WHERE id = $1)
+				)
+				SELECT id FROM subtree`, id)
+			if err != nil {
+				return err
+			}
+			var cs changeSet
+			if err := setDeletedAt(ctx, tx, &cs, EventRestore, ids, nil); err != nil {
+				return err
+			}
+			if err := s.rollup(ctx, tx, &cs, parentID, now()); err != nil {
+				return err
+			}
+			if err := writeEvents(ctx, tx, &cs); err != nil {
+				return err
+			}
+		}
+
+		if err := scanTodo(tx.QueryRowContext(ctx, "SELECT "+todoColumns+" FROM todos WHERE id = $1", id), &t); err != nil {
+			return err
+		}
+		return loadTags(ctx, tx.QueryContext, []*Todo{&t})
+	})
+	return t, err
+}
+
+// Purge permanently deletes todos trashed before the given time on the
+// primary. Their tags and dependencies go with them (ON DELETE CASCADE).
+func (s *SQLStore) Purge(ctx context.Context, before time.Time) (int, error) {
+	var n int
+	err := s.inTx(ctx, func(tx *sql.Tx) error {
+		ids, err := queryIDs(ctx, tx, "SELECT id FROM todos WHERE deleted_at < $1 ORDER BY id"+s.forUpdate(), before)
+		if err != nil {
+			return err
+		}
+		// Subtasks are trashed no later than their parents, so those that go
+		// by ON DELETE CASCADE are among ids too.
+		n = len(ids)
+		return s.purge(ctx, tx, ids)
+	})
+	return n, err
+}
+
+// purge permanently deletes the todos with the given ids, recording a purge
+// event for each.
+func (s *SQLStore) purge(ctx context.Context, tx *sql.Tx, ids []int) error {
+	var cs changeSet
+	for _, id := range ids {
+		if err := touch(ctx, tx, &cs, id, EventPurge); err != nil {
+			return err
+		}
+	}
+	for _, id := range ids {
+		if _, err := tx.ExecContext(ctx, "DELETE FROM todos WHERE id = $1", id); err != nil {
+			return err
+		}
+	}
+	return writeEvents(ctx, tx, &cs)
+}
+
+// Move places a todo next to another in a transaction on the primary. The
+// todo, the other todo and its neighbour on the far side are locked, so
+// moves into the same gap wait for each other; if one still reads a stale
+// neighbour, its key collides with the other move's under the unique index
+// and inTx retries it against the new order.
+func (s *SQLStore) Move(ctx context.Context, id int, mv Move) (Todo, error) {
+	var t Todo
+	err := s.inTx(ctx, func(tx *sql.Tx) error {
+		err := scanTodo(tx.QueryRowContext(ctx,
+			"SELECT "+todoColumns+" FROM todos WHERE id = $1 AND deleted_at IS NULL"+s.forUpdate(), id), &t)
+		if err == sql.ErrNoRows {
+			return ErrNotFound
+		}
+		if err != nil {
+			return err
+		}
+		var anchor string
+		err = tx.QueryRowContext(ctx,
+			"SELECT position FROM todos WHERE id = $1 AND deleted_at IS NULL"+s.forUpdate(), mv.anchor()).Scan(&anchor)
+		if err == sql.ErrNoRows {
+			return unknownAnchorError(mv)
+		}
+		if err != nil {
+			return err
+		}
+
+		// Trashed todos keep their positions, so they count as neighbours.
+		query := "SELECT position FROM todos WHERE position > $1 AND id <> $2 ORDER BY position LIMIT 1"
+		if mv.Before != nil {
+			query = "SELECT position FROM todos WHERE position < $1 AND id <> $2 ORDER BY position DESC LIMIT 1"
+		}
+		var neighbour string
+		err = tx.QueryRowContext(ctx, query+s.forUpdate(), anchor, id).Scan(&neighbour)
+		if err != nil && err != sql.ErrNoRows {
+			return err
+		}
+		position, err := mv.position(anchor, neighbour)
+		if err != nil {
+			return err
+		}
+
+		var cs changeSet
+		if err := touch(ctx, tx, &cs, id, EventUpdate); err != nil {
+			return err
+		}
+		t.Position, t.UpdatedAt, t.Version = position, now(), t.Version+1
+		_, err = tx.ExecContext(ctx, "UPDATE todos SET position = $1, updated_at = $2 WHERE id = $3",
+			t.Position, t.UpdatedAt, id)
+		if err != nil {
+			return err
+		}
+		if err := writeEvents(ctx, tx, &cs); err != nil {
+			return err
+		}
+		return loadTags(ctx, tx.QueryContext, []*Todo{&t})
+	})
+	return t, err
+}
+
+// Blockers retrieves the todos blocking a todo, reading from the replica
+// with primary fallback.
+func (s *SQLStore) Blockers(ctx context.Context, id int) ([]Todo, error) {
+	var blockers []Todo
+	err := ExecuteWithRobustness(func() error {
+		rows, err := s.queryRead(ctx, "SELECT id FROM todos WHERE id = $1 AND deleted_at IS NULL", id)
+		if err != nil {
+			return err
+		}
+		found := rows.Next()
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		if !found {
+			return ErrNotFound
+		}
+
+		rows, err = s.queryRead(ctx, "SELECT "+todoColumns+
+			" FROM todos WHERE id IN (SELECT blocker_id FROM todo_blockers WHERE todo_id = $1) AND deleted_at IS NULL ORDER BY id", id)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		blockers = []Todo{} // Reset on retry to avoid duplicates
+		for rows.Next() {
+			var t Todo
+			if err := scanTodo(rows, &t); err != nil {
+				return err
+			}
+			blockers = append(blockers, t)
+		}
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		rows.Close()
+		return loadTags(ctx, s.queryRead, todoPtrs(blockers))
+	})
+	return blockers, err
+}
+
+// AddBlocker records a dependency on the primary, refusing any that would
+// make a cycle.
+func (s *SQLStore) AddBlocker(ctx context.Context, todoID, blockerID int) (Todo, error) {
+	return s.setBlocker(ctx, todoID, blockerID, true)
+}
+
+// RemoveBlocker removes a dependency on the primary.
+func (s *SQLStore) RemoveBlocker(ctx context.Context, todoID, blockerID int) (Todo, error) {
+	return s.setBlocker(ctx, todoID, blockerID, false)
+}
+
+// setBlocker adds or removes a dependency in a transaction with the todo
+// locked, touching its updated_at only if that changed anything, like
+// setTag.
+func (s *SQLStore) setBlocker(ctx context.Context, todoID, blockerID int, add bool) (Todo, error) {
+	var t Todo
+	err := s.inTx(ctx, func(tx *sql.Tx) error {
+		if add && s.dialect == DialectPostgres {
+			// Locking the two todos isn't enough to keep concurrent additions
+			// from closing a longer cycle, so serialize additions. The mode
+			// conflicts with itself but not with reads.
+			if _, err := tx.ExecContext(ctx, "LOCK TABLE todo_blockers IN SHARE ROW EXCLUSIVE MODE"); err != nil {
+				return err
+			}
+		}
+		var found int
+		err := tx.QueryRowContext(ctx, "SELECT id FROM todos WHERE id = $1 AND deleted_at IS NULL"+s.forUpdate(), todoID).Scan(&found)
+		if err == sql.ErrNoRows {
+			return ErrNotFound
+		}
+		if err != nil {
+			return err
+		}
+		err = tx.QueryRowContext(ctx, "SELECT id FROM todos WHERE id = $1 AND deleted_at IS NULL"+s.forShare(), blockerID).Scan(&found)
+		if err == sql.ErrNoRows {
+			return ErrNotFound
+		}
+		if err != nil {
+			return err
+		}
+
+		stmt := "DELETE FROM todo_blockers WHERE todo_id = $1 AND blocker_id = $2"
+		if add {
+			if err := checkNoCycle(ctx, tx, todoID, blockerID); err != nil {
+				return err
+			}
+			stmt = "INSERT INTO todo_blockers (todo_id, blocker_id) VALUES ($1, $2) ON CONFLICT DO NOTHING"
+		}
+		var cs changeSet
+		if err := touch(ctx, tx, &cs, todoID, EventUpdate); err != nil {
+			return err
+		}
+		res, err := tx.ExecContext(ctx, stmt, todoID, blockerID)
+		if err != nil {
+			return err
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if n > 0 {
+			if _, err := tx.ExecContext(ctx, "UPDATE todos SET updated_at = $1 WHERE id = $2", now(), todoID); err != nil {
+				return err
+			}
+			if err := writeEvents(ctx, tx, &cs); err != nil {
+				return err
+			}
+		}
+
+		if err := scanTodo(tx.QueryRowContext(ctx, "SELECT "+todoColumns+" FROM todos WHERE id = $1", todoID), &t); err != nil {
+			return err
+		}
+		return loadTags(ctx, tx.QueryContext, []*Todo{&t})
+	})
+	return t, err
+}
+
+// checkNoCycle returns a *ConflictError if blockerID is todoID, or is
+// already blocked by it, directly or through other todos. The dependencies
+// are walked with a recursive query.
+func checkNoCycle(ctx context.Context, tx *sql.Tx, todoID, blockerID int) error {
+	if todoID == blockerID {
+		return dependencyCycleConflict()
+	}
+	var n int
+	err := tx.QueryRowContext(ctx, `
+		WITH RECURSIVE upstream (id) AS (
+			SELECT blocker_id FROM todo_blockers WHERE todo_id = $1
+			UNION
+			SELECT tb.blocker_id FROM todo_blockers tb JOIN upstream u ON tb.todo_id = u.id
+		)
+		SELECT COUNT(*) FROM upstream WHERE id = $2`, blockerID, todoID).Scan(&n)
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		return dependencyCycleConflict()
+	}
+	return nil
+}
+
+// snapshot reads a todo, with its tags, as events record it, or nil if it
+// doesn't exist.
+func snapshot(ctx context.Context, tx *sql.Tx, id int) (*Todo, error) {
+	var t Todo
+	err := scanTodo(tx.QueryRowContext(ctx, "SELECT "+todoColumns+" FROM todos WHERE id = $1", id), &t)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := loadTags(ctx, tx.QueryContext, []*Todo{&t}); err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// touch adds the todo with id, as it is before changing, to cs.
+func touch(ctx context.Context, tx *sql.Tx, cs *changeSet, id int, action string) error {
+	if cs.has(id) {
+		return nil
+	}
+	before, err := snapshot(ctx, tx, id)
+	if err != nil {
+		return err
+	}
+	cs.add(id, action, before)
+	return nil
+}
+
+// writeEvents inserts an event for each todo in cs. Since that locks the
+// revision row until the transaction ends, it should come last.
+func writeEvents(ctx context.Context, tx *sql.Tx, cs *changeSet) error {
+	events, err := collectEvents(ctx, tx, cs)
+	if err != nil {
+		return err
+	}
+	return insertEvents(ctx, tx, events)
+}
+
+// bumpRevision counts a change to what List returns, and returns the new
+// revision. On Postgres, a trigger notifies the todo_events channel of it.
+func bumpRevision(ctx context.Context, tx *sql.Tx) (int64, error) {
+	var revision int64
+	err := tx.QueryRowContext(ctx, "UPDATE todos_revision SET revision = revision + 1 RETURNING revision").Scan(&revision)
+	return revision, err
+}
+
+// collectEvents returns an event for each todo in cs, reading its state back
+// as the after state. Each todo that existed before gets its version bumped
+// first, so a todo's version moves exactly when it gets an event.
+func collectEvents(ctx context.Context, tx *sql.Tx, cs *changeSet) ([]TodoEvent, error) {
+	actor, requestID, traceID := eventContext(ctx)
+	at := now()
+	events := make([]TodoEvent, 0, len(cs.ids))
+	for _, id := range cs.ids {
+		if cs.before[id] != nil {
+			if _, err := tx.ExecContext(ctx, "UPDATE todos SET version = version + 1 WHERE id = $1", id); err != nil {
+				return nil, err
+			}
+		}
+		after, err := snapshot(ctx, tx, id)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, TodoEvent{
+			TodoID: id, Action: cs.action[id], Before: cs.before[id], After: after,
+			Actor: actor, RequestID: requestID, TraceID: traceID, CreatedAt: at,
+		})
+	}
+	return events, nil
+}
+
+// insertEvents inserts events as one change, bumping the revision for them
+// if there are any.
+func insertEvents(ctx context.Context, tx *sql.Tx, events []TodoEvent) error {
+	if len(events) == 0 {
+		return nil
+	}
+	revision, err := bumpRevision(ctx, tx)
+	if err != nil {
+		return err
+	}
+	for _, e := range events {
+		beforeState, err := eventJSON(e.Before)
+		if err != nil {
+			return err
+		}
+		afterState, err := eventJSON(e.After)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, `
+			INSERT INTO todo_events (todo_id, action, before_state, after_state, actor, request_id, trace_id, created_at, revision)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`,
+			e.TodoID, e.Action, beforeState, afterState, e.Actor, e.RequestID, e.TraceID, e.CreatedAt, revision)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// eventColumns are the columns scanned by scanEvent, in order.
+const eventColumns = "id, revision, todo_id, action, before_state, after_state, actor, request_id, trace_id, created_at"
+
+// scanEvent scans eventColumns into e.
+func scanEvent(row interface{ Scan(...any) error }, e *TodoEvent) error {
+	var before, after sql.NullString
+	if err := row.Scan(&e.ID, &e.Revision, &e.TodoID, &e.Action, &before, &after, &e.Actor, &e.RequestID, &e.TraceID, &e.CreatedAt); err != nil {
+		return err
+	}
+	e.CreatedAt = e.CreatedAt.UTC()
+	if before.Valid {
+		if err := json.Unmarshal([]byte(before.String), &e.Before); err != nil {
+			return err
+		}
+	}
+	if after.Valid {
+		return json.Unmarshal([]byte(after.String), &e.After)
+	}
+	return nil
+}
+
+// History retrieves the events of a todo, reading from the replica with
+// primary fallback.
+func (s *SQLStore) History(ctx context.Context, id int) ([]TodoEvent, error) {
+	var events []TodoEvent
+	err := ExecuteWithRobustness(func() error {
+		rows, err := s.queryRead(ctx, "SELECT "+eventColumns+" FROM todo_events WHERE todo_id = $1 ORDER BY id", id)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		events = []TodoEvent{} // Reset on retry to avoid duplicates
+		for rows.Next() {
+			var e TodoEvent
+			if err := scanEvent(rows, &e); err != nil {
+				return err
+			}
+			events = append(events, e)
+		}
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		rows.Close()
+		if len(events) > 0 {
+			return nil
+		}
+
+		// Todos created before the history was recorded have none.
+		rows, err = s.queryRead(ctx, "SELECT id FROM todos WHERE id = $1", id)
+		if err != nil {
+			return err
+		}
+		found := rows.Next()
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		if !found {
+			return ErrNotFound
+		}
+		return nil
+	})
+	return events, err
+}
+
+// Events returns the events of the first limit revisions after the given
+// one, reading from the primary so a stream woken by a notification finds
+// the change that sent it.
+func (s *SQLStore) Events(ctx context.Context, after int64, limit int) ([]TodoEvent, error) {
+	var events []TodoEvent
+	err := ExecuteWithRobustness(func() error {
+		rows, err := s.primary.QueryContext(ctx, `
+			SELECT `+eventColumns+` FROM todo_events
+			WHERE revision IN (
+				SELECT DISTINCT revision FROM todo_events WHERE revision > $1 ORDER BY revision LIMIT $2
+			)
+			ORDER BY revision, id`, after, limit)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		events = []TodoEvent{} // Reset on retry to avoid duplicates
+		for rows.Next() {
+			var e TodoEvent
+			if err := scanEvent(rows, &e); err != nil {
+				return err
+			}
+			events = append(events, e)
+		}
+		return rows.Err()
+	})
+	return events, err
+}
+
+// listColumns are the columns scanned by scanList, in order.
+const listColumns = "id, name, archived, created_at, updated_at"
+
+// scanList scans listColumns into l.
+func scanList(row interface{ Scan(...any) error }, l *TodoList) error {
+	if err := row.Scan(&l.ID, &l.Name, &l.Archived, &l.CreatedAt, &l.UpdatedAt); err != nil {
+		return err
+	}
+	l.CreatedAt, l.UpdatedAt = l.CreatedAt.UTC(), l.UpdatedAt.UTC()
+	return nil
+}
+
+// Lists retrieves lists in id order, reading from the replica with primary fallback.
+func (s *SQLStore) Lists(ctx context.Context, includeArchived bool) ([]TodoList, error) {
+	query := "SELECT " + listColumns + " FROM lists"
+	if !includeArchived {
+		query += " WHERE NOT archived"
+	}
+	query += " ORDER BY id"
+
+	var lists []TodoList
+	err := ExecuteWithRobustness(func() error {
+		rows, err := s.queryRead(ctx, query)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		lists = []TodoList{} // Reset on retry to avoid duplicates
+		for rows.Next() {
+			var l TodoList
+			if err := scanList(rows, &l); err != nil {
+				return err
+			}
+			lists = append(lists, l)
+		}
+		return rows.Err()
+	})
+	return lists, err
+}
+
+// GetList retrieves a single list, reading from the replica with primary fallback.
+func (s *SQLStore) GetList(ctx context.Context, id int) (TodoList, error) {
+	var l TodoList
+	found := false
+
+	err := ExecuteWithRobustness(func() error {
+		rows, err := s.queryRead(ctx, "SELECT "+listColumns+" FROM lists WHERE id = $1", id)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		found = rows.Next()
+		if found {
+			if err := scanList(rows, &l); err != nil {
+				return err
+			}
+		}
+		return rows.Err()
+	})
+	if err == nil && !found {
+		err = ErrListNotFound
+	}
+	return l, err
+}
+
+// CreateList inserts a list on the primary.
+func (s *SQLStore) CreateList(ctx context.Context, l TodoList) (TodoList, error) {
+	at := now()
+	l.CreatedAt, l.UpdatedAt = at, at
+	err := ExecuteWithRobustness(func() error {
+		return s.primary.QueryRowContext(ctx, `
+			INSERT INTO lists (name, archived, created_at, updated_at)
+			VALUES ($1, $2, $3, $4)
+			RETURNING id`,
+			l.Name, l.Archived, l.CreatedAt, l.UpdatedAt,
+		).Scan(&l.ID)
+	})
+	return l, err
+}
+
+// UpdateList reads, modifies and writes back a list in a single transaction
+// on the primary, like Update.
+func (s *SQLStore) UpdateList(ctx context.Context, id int, fn ListUpdateFunc) (TodoList, error) {
+	var l TodoList
+	err := s.inTx(ctx, func(tx *sql.Tx) error {
+		err := scanList(tx.QueryRowContext(ctx, "SELECT "+listColumns+" FROM lists WHERE id = $1"+s.forUpdate(), id), &l)
+		if err == sql.ErrNoRows {
+			return ErrListNotFound
+		}
+		if err != nil {
+			return err
+		}
+
+		if err := applyListUpdate(&l, fn, now()); err != nil {
+			return err
+		}
+
+		_, err = tx.ExecContext(ctx, "UPDATE lists SET name = $1, archived = $2, updated_at = $3 WHERE id = $4",
+			l.Name, l.Archived, l.UpdatedAt, id)
+		return err
+	})
+	return l, err
+}
+
+// DeleteList removes an empty list on the primary, and any of its todos in
+// the trash. The list row is locked first, so todos can't be added to it
+// between the count and the delete.
+func (s *SQLStore) DeleteList(ctx context.Context, id int) error {
+	return s.inTx(ctx, func(tx *sql.Tx) error {
+		var found int
+		err := tx.QueryRowContext(ctx, "SELECT id FROM lists WHERE id = $1"+s.forUpdate(), id).Scan(&found)
+		if err == sql.ErrNoRows {
+			return ErrListNotFound
+		}
+		if err != nil {
+			return err
+		}
+		if id == DefaultListID {
+			return defaultListConflict()
+		}
+
+		var n int
+		err = tx.QueryRowContext(ctx, "SELECT COUNT(*) FROM todos WHERE list_id = $1 AND deleted_at IS NULL", id).Scan(&n)
+		if err != nil {
+			return err
+		}
+		if n > 0 {
+			return listNotEmptyConflict(n)
+		}
+		ids, err := queryIDs(ctx, tx, "SELECT id FROM todos WHERE list_id = $1 ORDER BY id", id)
+		if err != nil {
+			return err
+		}
+		if err := s.purge(ctx, tx, ids); err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, "DELETE FROM lists WHERE id = $1", id)
+		return err
+	})
+}
+
+// Tags retrieves every tag, reading from the replica with primary fallback.
+func (s *SQLStore) Tags(ctx context.Context) ([]Tag, error) {
+	var tags []Tag
+	err := ExecuteWithRobustness(func() error {
+		rows, err := s.queryRead(ctx, "SELECT id, name FROM tags ORDER BY name, id")
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		tags = []Tag{} // Reset on retry to avoid duplicates
+		for rows.Next() {
+			var g Tag
+			if err := rows.Scan(&g.ID, &g.Name); err != nil {
+				return err
+			}
+			tags = append(tags, g)
+		}
+		return rows.Err()
+	})
+	return tags, err
+}
+
+// GetTag retrieves a single tag, reading from the replica with primary fallback.
+func (s *SQLStore) GetTag(ctx context.Context, id int) (Tag, error) {
+	var g Tag
+	found := false
+	err := ExecuteWithRobustness(func() error {
+		rows, err := s.queryRead(ctx, "SELECT id, name FROM tags WHERE id = $1", id)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		found = rows.Next()
+		if found {
+			if err := rows.Scan(&g.ID, &g.Name); err != nil {
+				return err
+			}
+		}
+		return rows.Err()
+	})
+	if err == nil && !found {
+		err = ErrTagNotFound
+	}
+	return g, err
+}
+
+// CreateTag inserts a tag on the primary. The insert is skipped rather than
+// failing when the name is taken, so the conflict is detected atomically.
+func (s *SQLStore) CreateTag(ctx context.Context, name string) (Tag, error) {
+	g := Tag{Name: name}
+	err := ExecuteWithRobustness(func() error {
+		err := s.primary.QueryRowContext(ctx,
+			"INSERT INTO tags (name) VALUES ($1) ON CONFLICT (name) DO NOTHING RETURNING id", name,
+		).Scan(&g.ID)
+		if err == sql.ErrNoRows {
+			return tagExistsConflict(name)
+		}
+		return err
+	})
+	return g, err
+}
+
+// RenameTag renames a tag in a transaction on the primary.
+func (s *SQLStore) RenameTag(ctx context.Context, id int, name string) (Tag, error) {
+	g := Tag{ID: id, Name: name}
+	err := s.inTx(ctx, func(tx *sql.Tx) error {
+		var current string
+		err := tx.QueryRowContext(ctx, "SELECT name FROM tags WHERE id = $1"+s.forUpdate(), id).Scan(&current)
+		if err == sql.ErrNoRows {
+			return ErrTagNotFound
+		}
+		if err != nil {
+			return err
+		}
+		if current == name {
+			return nil
+		}
+
+		var found int
+		err = tx.QueryRowContext(ctx, "SELECT id FROM tags WHERE name = $1 AND id <> $2", name, id).Scan(&found)
+		if err == nil {
+			return tagExistsConflict(name)
+		}
+		if err != sql.ErrNoRows {
+			return err
+		}
+
+		// Todos are shown with their tags' names, so renaming a tag changes
+		// each todo it is attached to.
+		cs, err := touchTagged(ctx, tx, id)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, "UPDATE tags SET name = $1 WHERE id = $2", name, id); err != nil {
+			return err
+		}
+		return writeEvents(ctx, tx, &cs)
+	})
+	return g, err
+}
+
+// DeleteTag removes a tag in a transaction on the primary. Its todo_tags
+// rows go with it (ON DELETE CASCADE), recorded as an update of each todo.
+func (s *SQLStore) DeleteTag(ctx context.Context, id int) error {
+	return s.inTx(ctx, func(tx *sql.Tx) error {
+		var found int
+		err := tx.QueryRowContext(ctx, "SELECT id FROM tags WHERE id = $1"+s.forUpdate(), id).Scan(&found)
+		if err == sql.ErrNoRows {
+			return ErrTagNotFound
+		}
+		if err != nil {
+			return err
+		}
+		cs, err := touchTagged(ctx, tx, id)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, "DELETE FROM tags WHERE id = $1", id); err != nil {
+			return err
+		}
+		return writeEvents(ctx, tx, &cs)
+	})
+}
+
+// touchTagged records an update of each todo not in the trash that has the
+// tag, stamping its updated_at, and returns the change set.
+func touchTagged(ctx context.Context, tx *sql.Tx, tagID int) (changeSet, error) {
+	var cs changeSet
+	ids, err := queryIDs(ctx, tx,
+		"SELECT t.id FROM todos t JOIN todo_tags tt ON tt.todo_id = t.id WHERE tt.tag_id = $1 AND t.deleted_at IS NULL ORDER BY t.id", tagID)
+	if err != nil {
+		return cs, err
+	}
+	for _, todoID := range ids {
+		if err := touch(ctx, tx, &cs, todoID, EventUpdate); err != nil {
+			return cs, err
+		}
+	}
+	if len(ids) > 0 {
+		_, err = tx.ExecContext(ctx,
+			"UPDATE todos SET updated_at = $1 WHERE deleted_at IS NULL AND id IN (SELECT todo_id FROM todo_tags WHERE tag_id = $2)", now(), tagID)
+	}
+	return cs, err
+}
+
+// TagTodo attaches a tag to a todo on the primary.
+func (s *SQLStore) TagTodo(ctx context.Context, todoID, tagID int) (Todo, error) {
+	return s.setTag(ctx, todoID, tagID,
+		"INSERT INTO todo_tags (todo_id, tag_id) VALUES ($1, $2) ON CONFLICT DO NOTHING")
+}
+
+// UntagTodo detaches a tag from a todo on the primary.
+func (s *SQLStore) UntagTodo(ctx context.Context, todoID, tagID int) (Todo, error) {
+	return s.setTag(ctx, todoID, tagID,
+		"DELETE FROM todo_tags WHERE todo_id = $1 AND tag_id = $2")
+}
+
+// setTag runs stmt, which attaches or detaches tagID, in a transaction with
+// the todo locked, touching its updated_at only if the statement changed
+// anything.
+func (s *SQLStore) setTag(ctx context.Context, todoID, tagID int, stmt string) (Todo, error) {
+	var t Todo
+	err := s.inTx(ctx, func(tx *sql.Tx) error {
+		err := scanTodo(tx.QueryRowContext(ctx,
+			"SELECT "+todoColumns+" FROM todos WHERE id = $1 AND deleted_at IS NULL"+s.forUpdate(), todoID), &t)
+		if err == sql.ErrNoRows {
+			return ErrNotFound
+		}
+		if err != nil {
+			return err
+		}
+		var found int
+		err = tx.QueryRowContext(ctx, "SELECT id FROM tags WHERE id = $1"+s.forShare(), tagID).Scan(&found)
+		if err == sql.ErrNoRows {
+			return ErrTagNotFound
+		}
+		if err != nil {
+			return err
+		}
+
+		var cs changeSet
+		if err := touch(ctx, tx, &cs, todoID, EventUpdate); err != nil {
+			return err
+		}
+		res, err := tx.ExecContext(ctx, stmt, todoID, tagID)
+		if err != nil {
+			return err
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if n > 0 {
+			t.UpdatedAt, t.Version = now(), t.Version+1
+			if _, err := tx.ExecContext(ctx, "UPDATE todos SET updated_at = $1 WHERE id = $2", t.UpdatedAt, todoID); err != nil {
+				return err
+			}
+			if err := writeEvents(ctx, tx, &cs); err != nil {
+				return err
+			}
+		}
+		return loadTags(ctx, tx.QueryContext, []*Todo{&t})
+	})
+	return t, err
+}
+
+// Ping checks the primary connection. A failing read replica is logged but
+// not reported, since reads fall back to the primary.
+func (s *SQLStore) Ping(ctx context.Context) error {
+	if s.primary == nil {
+		return errors.New("database connection not initialized")
+	}
+	if err := s.primary.PingContext(ctx); err != nil {
+		return err
+	}
+	// Check Read Replica too if distinct
+	if s.replica != s.primary && s.replica != nil {
+		if err := s.replica.PingContext(ctx); err != nil {
+			slog.Warn("Read Replica ping failed", "error", err)
+		}
+	}
+	return nil
+}
+
+// SchemaVersion reports the applied and latest known migration versions.
+func (s *SQLStore) SchemaVersion(ctx context.Context) (current, latest int, err error) {
+	m, err := NewMigrator(s.primary, s.dialect)
+	if err != nil {
+		return 0, 0, err
+	}
+	current, err = m.Version(ctx)
+	return current, m.Latest(), err
+}
@@ -0,0 +1,72 @@
+// Written by Gemini CLI
+// This file is licensed under the MIT License.
+// See the LICENSE file for details.
+
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// openMigratedSQLite opens a fresh SQLite database with every migration
+// applied.
+func openMigratedSQLite(t *testing.T, name string) *SQLStore {
+	t.Helper()
+	db, err := OpenSQLite(filepath.Join(t.TempDir(), name))
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	migrator, err := NewMigrator(db, DialectSQLite)
+	if err == nil {
+		err = migrator.Up(context.Background())
+	}
+	if err != nil {
+		t.Fatalf("failed to migrate database: %v", err)
+	}
+	return NewSQLiteStore(db)
+}
+
+// TestListLaggingReplica tests that listing todos reads the replica, unless
+// the client has already seen a newer revision than the replica's, which
+// only the primary can answer
+func TestListLaggingReplica(t *testing.T) {
+	primary, replica := openMigratedSQLite(t, "primary.db"), openMigratedSQLite(t, "replica.db")
+	req := httptest.NewRequest(http.MethodPost, "/todos", strings.NewReader(`{"task": "Not replicated yet"}`))
+	w := httptest.NewRecorder()
+	NewServer(primary).HandleTodos(w, req)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("failed to create todo: status %d, body %q", w.Code, w.Body.String())
+	}
+	srv := NewServer(&SQLStore{primary: primary.primary, replica: replica.primary, dialect: DialectSQLite})
+	list := func(etag string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/todos", nil)
+		if etag != "" {
+			req.Header.Set("If-None-Match", etag)
+		}
+		w := httptest.NewRecorder()
+		srv.HandleTodos(w, req)
+		return w
+	}
+
+	if w := list(""); w.Code != http.StatusOK || w.Header().Get("ETag") != `W/"r0"` || w.Header().Get("Last-Modified") != "" {
+		t.Errorf("expected the replica's empty revision, got %d with %q", w.Code, w.Header())
+	}
+	if w := list(`W/"r1"`); w.Code != http.StatusNotModified || w.Header().Get("ETag") != `W/"r1"` {
+		t.Errorf("expected the primary to confirm the client's revision, got %d with %q", w.Code, w.Header())
+	}
+	w = list(`W/"r7"`)
+	if w.Code != http.StatusOK || w.Header().Get("ETag") != `W/"r1"` || w.Header().Get("Last-Modified") == "" {
+		t.Fatalf("expected the primary's revision for a client ahead of both, got %d with %q", w.Code, w.Header())
+	}
+	var todos []Todo
+	if err := json.NewDecoder(w.Body).Decode(&todos); err != nil || len(todos) != 1 {
+		t.Errorf("expected the primary's todo, got %+v (err %v)", todos, err)
+	}
+}
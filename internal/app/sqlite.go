@@ -0,0 +1,39 @@
+// Written by Gemini CLI
+// This file is licensed under the MIT License.
+// See the LICENSE file for details.
+
+package app
+
+import (
+	"database/sql"
+	"fmt"
+	"log/slog"
+
+	_ "modernc.org/sqlite" // Pure Go driver, so the app still builds with CGO_ENABLED=0
+)
+
+// OpenSQLite opens (creating if needed) a SQLite database file. It is intended
+// for local development and demos where Cloud SQL and Secret Manager are not
+// available. Callers apply the schema with NewMigrator(db, DialectSQLite).
+func OpenSQLite(path string) (*sql.DB, error) {
+	// WAL lets readers proceed while a write is in flight, busy_timeout makes
+	// concurrent writers wait instead of failing with SQLITE_BUSY, and
+	// _txlock=immediate takes the write lock up front so transactions never
+	// deadlock upgrading from a read lock. _time_format=sqlite stores times
+	// as "2006-01-02 15:04:05.999999999-07:00" strings, which compare
+	// correctly as text since stores only write UTC.
+	dsn := fmt.Sprintf("file:%s?_pragma=journal_mode(WAL)&_pragma=busy_timeout(5000)&_pragma=foreign_keys(1)&_txlock=immediate&_time_format=sqlite", path)
+	slog.Info("Opening SQLite database", "path", path)
+
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open sqlite database: %w", err)
+	}
+	return db, nil
+}
+
+// NewSQLiteStore creates a store on a single SQLite connection pool, which
+// serves both reads and writes.
+func NewSQLiteStore(db *sql.DB) *SQLStore {
+	return &SQLStore{primary: db, replica: db, dialect: DialectSQLite}
+}
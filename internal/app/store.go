@@ -0,0 +1,252 @@
+// Written by Gemini CLI
+// This file is licensed under the MIT License.
+// See the LICENSE file for details.
+
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+var (
+	// ErrNotFound is returned by a TodoStore when the requested todo does not exist.
+	ErrNotFound = errors.New("todo not found")
+	// ErrListNotFound is returned by a TodoStore when the requested list does not exist.
+	ErrListNotFound = errors.New("list not found")
+	// ErrTagNotFound is returned by a TodoStore when the requested tag does not exist.
+	ErrTagNotFound = errors.New("tag not found")
+	// ErrInvalidInput wraps errors caused by the request rather than the store,
+	// such as a patch that doesn't fit the Todo schema.
+	ErrInvalidInput = errors.New("invalid input")
+	// ErrConflict wraps errors for requests that conflict with the current
+	// state of the store, such as deleting a list that still has todos.
+	ErrConflict = errors.New("conflict")
+	// ErrPreconditionFailed wraps errors for changes whose Precondition
+	// doesn't hold, because the todo changed since the client read it.
+	ErrPreconditionFailed = errors.New("precondition failed")
+)
+
+// ConflictError is a request that can't be carried out in the store's
+// current state. Code is the problem code reported to clients, so they can
+// tell conflicts apart. It matches ErrConflict with errors.Is.
+type ConflictError struct {
+	Code   string
+	Detail string
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("%v: %s", ErrConflict, e.Detail)
+}
+
+func (e *ConflictError) Is(target error) bool {
+	return target == ErrConflict
+}
+
+// PreconditionError is a change refused because the todo is at Version,
+// which its Precondition doesn't allow. It matches ErrPreconditionFailed with
+// errors.Is.
+type PreconditionError struct {
+	Version int
+}
+
+func (e *PreconditionError) Error() string {
+	return fmt.Sprintf("%v: todo is at version %d", ErrPreconditionFailed, e.Version)
+}
+
+func (e *PreconditionError) Is(target error) bool {
+	return target == ErrPreconditionFailed
+}
+
+// UpdateFunc modifies a todo in place during TodoStore.Update. Returning an
+// error aborts the update without writing anything.
+type UpdateFunc func(t *Todo) error
+
+// ListUpdateFunc modifies a list in place during ListStore.UpdateList.
+// Returning an error aborts the update without writing anything.
+type ListUpdateFunc func(l *TodoList) error
+
+// Store is everything the Server needs from persistence, one interface per
+// role, so code (and test fakes) can depend on just the roles it uses.
+// Implementations own their own connection handling (e.g. primary/replica
+// routing) and robustness policy (retries, circuit breaking), so handlers
+// only deal with Todos and errors.
+//
+// Deleted todos go to the trash, where only List (with ListOptions.Trashed),
+// Restore and Purge see them; to every other method they don't exist. They
+// don't count as subtasks or blockers either.
+//
+// Every change to a todo is recorded as a TodoEvent in the same
+// transaction, attributed to the actor, request and trace in the context.
+type Store interface {
+	TodoStore
+	SearchStore
+	IdempotencyStore
+	TrashStore
+	BlockerStore
+	BatchStore
+	EventStore
+	ListStore
+	TagStore
+}
+
+// TodoStore reads and writes todos.
+type TodoStore interface {
+	// List returns a page of todos filtered and ordered by opts.
+	List(ctx context.Context, opts ListOptions) (TodoPage, error)
+	// Get returns a single todo, or ErrNotFound.
+	Get(ctx context.Context, id int) (Todo, error)
+	// Create inserts a new todo and returns it with server-assigned fields
+	// populated, and no tags. A zero ListID puts it in its parent's list, or
+	// the default list; a list or parent that doesn't exist is reported as a
+	// *ValidationError.
+	Create(ctx context.Context, t Todo) (Todo, error)
+	// Update atomically reads the todo, applies fn to it and writes back all
+	// mutable fields, returning the result or ErrNotFound. Concurrent updates
+	// of the same todo are serialized, so fn always sees the latest state.
+	// Changing ListID or ParentID moves the todo, which fails with a
+	// *ValidationError if the list or parent doesn't exist, or if the parent
+	// is the todo itself or one of its subtasks. Completing a todo with open
+	// blockers fails with a *ConflictError.
+	Update(ctx context.Context, id int, fn UpdateFunc) (Todo, error)
+	// Delete moves a todo to the trash, or returns ErrNotFound. A todo with
+	// subtasks is trashed together with all of them if cascade is set, and
+	// otherwise refused with a *ConflictError. A todo whose version cond
+	// doesn't allow is refused with a *PreconditionError.
+	Delete(ctx context.Context, id int, cascade bool, cond Precondition) error
+	// Move gives a todo the Position placing it immediately before or after
+	// another, without touching any other todo, and returns it. It returns
+	// ErrNotFound, or a *ValidationError if the other todo is missing.
+	// Concurrent moves are serialized, so todos never share a position.
+	Move(ctx context.Context, id int, mv Move) (Todo, error)
+	// Ping verifies the backing storage is reachable.
+	Ping(ctx context.Context) error
+}
+
+// SearchStore finds todos by their text.
+type SearchStore interface {
+	// Search returns up to limit todos matching a web-search style query
+	// (terms, "quoted phrases", -exclusions, OR), most relevant first.
+	// Backends without full-text search match tasks containing every term.
+	Search(ctx context.Context, query string, limit int) ([]SearchResult, error)
+}
+
+// IdempotencyStore creates todos for requests with an Idempotency-Key.
+type IdempotencyStore interface {
+	// CreateIdempotent is Create for a request with an Idempotency-Key,
+	// which belongs to the actor in the context. If the actor already used
+	// key.Key, it creates nothing and returns the key as kept, with the todo
+	// created for it, and false. Otherwise it creates the todo and keeps the
+	// key with it in the same transaction, so a create that committed is
+	// never repeated, and returns the new key and true. Concurrent requests
+	// with the same key create one todo.
+	CreateIdempotent(ctx context.Context, key IdempotencyKey, t Todo) (IdempotencyKey, bool, error)
+	// PurgeIdempotencyKeys deletes the Idempotency-Keys kept before the
+	// given time, returning how many there were.
+	PurgeIdempotencyKeys(ctx context.Context, before time.Time) (int, error)
+}
+
+// TrashStore restores and purges deleted todos.
+type TrashStore interface {
+	// Restore takes a todo out of the trash, together with the subtasks
+	// trashed along with it, and returns it; a todo that isn't trashed is
+	// returned unchanged. It returns ErrNotFound, or a *ConflictError if the
+	// todo's parent is still in the trash.
+	Restore(ctx context.Context, id int) (Todo, error)
+	// Purge permanently deletes the todos trashed before the given time,
+	// returning how many there were.
+	Purge(ctx context.Context, before time.Time) (int, error)
+}
+
+// BlockerStore records which todos block which.
+type BlockerStore interface {
+	// Blockers returns the todos blocking a todo, in id order, or
+	// ErrNotFound.
+	Blockers(ctx context.Context, id int) ([]Todo, error)
+	// AddBlocker records that blockerID blocks todoID, if it isn't already,
+	// and returns the todo. It returns ErrNotFound if either todo is
+	// missing, or a *ConflictError if the dependency would make a cycle.
+	AddBlocker(ctx context.Context, todoID, blockerID int) (Todo, error)
+	// RemoveBlocker removes a dependency, if recorded, like AddBlocker.
+	RemoveBlocker(ctx context.Context, todoID, blockerID int) (Todo, error)
+}
+
+// BatchStore runs several changes to todos as one.
+type BatchStore interface {
+	// Batch runs ops in order in a single transaction, retried and circuit
+	// broken as one operation, and returns a result for each. If atomic is
+	// set, the first op to fail rolls back the whole batch and is returned
+	// as a *BatchError; otherwise a failed op is rolled back on its own and
+	// reported in its result. Failures that aren't the op's fault, like a
+	// lost connection, fail the whole batch either way.
+	Batch(ctx context.Context, ops []BatchOp, atomic bool) ([]BatchResult, error)
+}
+
+// EventStore reads the record of changes to todos.
+type EventStore interface {
+	// Revision returns a number that goes up, in commit order, with every
+	// change to what List returns for any options, which is every change to
+	// a todo, including renaming one of its tags. It is read like List, so
+	// it may lag behind on a read replica, but no more than List does.
+	Revision(ctx context.Context) (int64, error)
+	// History returns the events of a todo, oldest first, or ErrNotFound
+	// if there is neither the todo nor any event for it.
+	History(ctx context.Context, id int) ([]TodoEvent, error)
+	// Events returns the events of every todo whose Revision is among the
+	// first limit after the given one, ordered by revision and then id, so
+	// each change's events come whole and in commit order. It reads the
+	// latest data, never a lagging replica.
+	Events(ctx context.Context, after int64, limit int) ([]TodoEvent, error)
+	// EventsRevision returns the current revision read like Events, from
+	// the latest data, so Events after it returns every later change.
+	EventsRevision(ctx context.Context) (int64, error)
+}
+
+// ListStore manages the lists todos belong to.
+type ListStore interface {
+	// Lists returns every list in id order, including archived lists only
+	// if includeArchived is set.
+	Lists(ctx context.Context, includeArchived bool) ([]TodoList, error)
+	// GetList returns a single list, or ErrListNotFound.
+	GetList(ctx context.Context, id int) (TodoList, error)
+	// CreateList inserts a new list and returns it with server-assigned fields populated.
+	CreateList(ctx context.Context, l TodoList) (TodoList, error)
+	// UpdateList atomically reads the list, applies fn to it and writes back
+	// all mutable fields, returning the result or ErrListNotFound.
+	UpdateList(ctx context.Context, id int, fn ListUpdateFunc) (TodoList, error)
+	// DeleteList removes an empty list, permanently deleting any of its
+	// todos in the trash. It returns ErrListNotFound, or a *ConflictError
+	// for the default list or a list that still has todos.
+	DeleteList(ctx context.Context, id int) error
+}
+
+// TagStore manages tags and which todos they are on.
+type TagStore interface {
+	// Tags returns every tag, ordered by name.
+	Tags(ctx context.Context) ([]Tag, error)
+	// GetTag returns a single tag, or ErrTagNotFound.
+	GetTag(ctx context.Context, id int) (Tag, error)
+	// CreateTag inserts a tag with an already normalized name, or returns a
+	// *ConflictError if the name is taken.
+	CreateTag(ctx context.Context, name string) (Tag, error)
+	// RenameTag renames a tag, recorded as an update of each todo it is
+	// attached to, returning ErrTagNotFound or a *ConflictError if another
+	// tag has the name.
+	RenameTag(ctx context.Context, id int, name string) (Tag, error)
+	// DeleteTag removes a tag and detaches it from every todo, or returns
+	// ErrTagNotFound.
+	DeleteTag(ctx context.Context, id int) error
+	// TagTodo attaches a tag to a todo, if it isn't already, and returns the
+	// todo. It returns ErrNotFound or ErrTagNotFound if either is missing.
+	TagTodo(ctx context.Context, todoID, tagID int) (Todo, error)
+	// UntagTodo detaches a tag from a todo, if attached, like TagTodo.
+	UntagTodo(ctx context.Context, todoID, tagID int) (Todo, error)
+}
+
+// SchemaReporter is implemented by stores with a versioned schema, so the
+// health check can report which migrations are applied.
+type SchemaReporter interface {
+	SchemaVersion(ctx context.Context) (current, latest int, err error)
+}
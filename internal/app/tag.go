@@ -0,0 +1,193 @@
+// Written by Gemini CLI
+// This file is licensed under the MIT License.
+// See the LICENSE file for details.
+
+package app
+
+import (
+	"cmp"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	// MaxTagNameLength is the longest tag name accepted, in characters.
+	MaxTagNameLength = 50
+	// MaxFilterTags caps the tags a single GET /todos may filter by.
+	MaxFilterTags = 20
+)
+
+// Tag is a label that can be attached to any number of todos. Names are
+// stored in lower case and are unique.
+type Tag struct {
+	ID   int    `json:"id"`
+	Name string `json:"name"`
+}
+
+// normalizeTagName returns the stored form of a tag name.
+func normalizeTagName(name string) string {
+	return strings.ToLower(strings.TrimSpace(name))
+}
+
+// Validate normalizes the tag's name in place and checks it, returning a
+// *ValidationError if it is invalid.
+func (g *Tag) Validate() error {
+	g.Name = normalizeTagName(g.Name)
+	switch {
+	case g.Name == "":
+		return &ValidationError{Fields: []FieldError{{"name", "must not be empty"}}}
+	case utf8.RuneCountInString(g.Name) > MaxTagNameLength:
+		return &ValidationError{Fields: []FieldError{{"name", fmt.Sprintf("must be at most %d characters", MaxTagNameLength)}}}
+	}
+	return nil
+}
+
+func tagExistsConflict(name string) error {
+	return &ConflictError{Code: CodeTagExists, Detail: fmt.Sprintf("A tag named %q already exists.", name)}
+}
+
+// sortTags orders a todo's tags by name, the order every store returns.
+func sortTags(tags []Tag) {
+	slices.SortFunc(tags, func(a, b Tag) int {
+		return cmp.Or(strings.Compare(a.Name, b.Name), cmp.Compare(a.ID, b.ID))
+	})
+}
+
+// HandleTags serves /tags.
+func (s *Server) HandleTags(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		s.GetTags(w, r)
+	case http.MethodPost:
+		s.AddTag(w, r)
+	default:
+		writeMethodNotAllowed(w, r, http.MethodGet, http.MethodPost)
+	}
+}
+
+// HandleTag serves /tags/{id}.
+func (s *Server) HandleTag(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.URL.Path[len("/tags/"):])
+	if err != nil {
+		writeProblem(w, r, http.StatusBadRequest, CodeValidationFailed, "Tag id must be an integer.")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		s.GetTag(w, r, id)
+	case http.MethodPatch:
+		s.RenameTag(w, r, id)
+	case http.MethodDelete:
+		s.DeleteTag(w, r, id)
+	default:
+		writeMethodNotAllowed(w, r, http.MethodGet, http.MethodPatch, http.MethodDelete)
+	}
+}
+
+// GetTags returns every tag, ordered by name.
+func (s *Server) GetTags(w http.ResponseWriter, r *http.Request) {
+	tags, err := s.tags.Tags(r.Context())
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, tags)
+}
+
+// AddTag creates a tag from a {"name": ...} body. Names that already exist
+// are rejected with 409.
+func (s *Server) AddTag(w http.ResponseWriter, r *http.Request) {
+	var g Tag
+	if err := decodeTag(w, r, &g); err != nil {
+		writeInputError(w, r, err)
+		return
+	}
+
+	g, err := s.tags.CreateTag(r.Context(), g.Name)
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+	slog.Info("Created tag", "id", g.ID, "name", g.Name)
+	writeJSON(w, http.StatusCreated, g)
+}
+
+// decodeTag reads, strictly decodes and validates a Tag request body.
+func decodeTag(w http.ResponseWriter, r *http.Request, g *Tag) error {
+	data, err := readBody(w, r)
+	if err != nil {
+		return err
+	}
+	if err := decodeStrict(data, g); err != nil {
+		return err
+	}
+	return g.Validate()
+}
+
+// GetTag returns a single tag.
+func (s *Server) GetTag(w http.ResponseWriter, r *http.Request, id int) {
+	g, err := s.tags.GetTag(r.Context(), id)
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, g)
+}
+
+// RenameTag renames a tag from a {"name": ...} body, which is the whole of
+// a tag's mutable state. The new name shows up on every todo carrying it.
+func (s *Server) RenameTag(w http.ResponseWriter, r *http.Request, id int) {
+	var g Tag
+	if err := decodeTag(w, r, &g); err != nil {
+		writeInputError(w, r, err)
+		return
+	}
+
+	g, err := s.tags.RenameTag(r.Context(), id, g.Name)
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, g)
+}
+
+// DeleteTag removes a tag, detaching it from every todo.
+func (s *Server) DeleteTag(w http.ResponseWriter, r *http.Request, id int) {
+	if err := s.tags.DeleteTag(r.Context(), id); err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandleTodoTag serves /todos/{id}/tags/{tagID}: PUT attaches the tag and
+// DELETE detaches it. Both are idempotent and return the updated todo.
+func (s *Server) HandleTodoTag(w http.ResponseWriter, r *http.Request, id int, tagPart string) {
+	tagID, err := strconv.Atoi(tagPart)
+	if err != nil {
+		writeProblem(w, r, http.StatusBadRequest, CodeValidationFailed, "Tag id must be an integer.")
+		return
+	}
+
+	var t Todo
+	switch r.Method {
+	case http.MethodPut:
+		t, err = s.tags.TagTodo(r.Context(), id, tagID)
+	case http.MethodDelete:
+		t, err = s.tags.UntagTodo(r.Context(), id, tagID)
+	default:
+		writeMethodNotAllowed(w, r, http.MethodPut, http.MethodDelete)
+		return
+	}
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+	writeUpdatedTodo(w, t)
+}
@@ -0,0 +1,124 @@
+// Written by Gemini CLI
+// This file is licensed under the MIT License.
+// See the LICENSE file for details.
+
+package app
+
+import (
+	"fmt"
+	"slices"
+	"time"
+)
+
+// Priority is how urgent a todo is.
+type Priority string
+
+const (
+	PriorityLow    Priority = "low"
+	PriorityNormal Priority = "normal"
+	PriorityHigh   Priority = "high"
+	PriorityUrgent Priority = "urgent"
+)
+
+// Priorities lists the valid priorities from least to most urgent.
+var Priorities = []Priority{PriorityLow, PriorityNormal, PriorityHigh, PriorityUrgent}
+
+// Valid reports whether p is one of Priorities.
+func (p Priority) Valid() bool {
+	return slices.Contains(Priorities, p)
+}
+
+// now returns the time stores stamp on todos: UTC, at the microsecond
+// precision Postgres keeps, so values round-trip through every backend.
+func now() time.Time {
+	return time.Now().UTC().Truncate(time.Microsecond)
+}
+
+// normalizeTime converts a client-supplied time to the form stores keep.
+func normalizeTime(t *time.Time) *time.Time {
+	if t == nil {
+		return nil
+	}
+	n := t.UTC().Truncate(time.Microsecond)
+	return &n
+}
+
+// stampCreated sets the server-managed fields of a todo about to be inserted.
+func (t *Todo) stampCreated(at time.Time) {
+	if t.ListID == 0 {
+		t.ListID = DefaultListID
+	}
+	t.CreatedAt, t.UpdatedAt, t.CompletedAt, t.DeletedAt = at, at, nil, nil
+	t.Tags, t.ChildCount, t.OpenBlockers, t.Version = []Tag{}, 0, 0, 1
+	if t.Completed {
+		t.CompletedAt = &at
+	}
+}
+
+// applyUpdate runs fn on t, then restores the fields fn may not change (and
+// the list, if fn cleared it) and stamps UpdatedAt, and CompletedAt when the
+// todo is completed or reopened.
+func applyUpdate(t *Todo, fn UpdateFunc, at time.Time) error {
+	before := *t
+	if err := fn(t); err != nil {
+		return err
+	}
+
+	t.ID, t.CreatedAt, t.UpdatedAt, t.Tags = before.ID, before.CreatedAt, at, before.Tags
+	t.Position, t.DeletedAt = before.Position, before.DeletedAt
+	t.ChildCount, t.OpenBlockers, t.Version = before.ChildCount, before.OpenBlockers, before.Version
+	if t.ListID == 0 {
+		t.ListID = before.ListID
+	}
+	switch {
+	case !t.Completed:
+		t.CompletedAt = nil
+	case !before.Completed:
+		t.CompletedAt = &at
+	default:
+		t.CompletedAt = before.CompletedAt
+	}
+	return nil
+}
+
+// rollupCompletion brings an AutoComplete todo's completion in line with its
+// subtasks, of which completed out of children are complete, and reports
+// whether that changed it. Todos without subtasks are left alone.
+func rollupCompletion(t *Todo, children, completed int, at time.Time) bool {
+	if !t.AutoComplete || children == 0 {
+		return false
+	}
+	done := completed == children
+	if t.Completed == done {
+		return false
+	}
+	t.Completed, t.UpdatedAt, t.CompletedAt = done, at, nil
+	if done {
+		t.CompletedAt = &at
+	}
+	return true
+}
+
+// equalParent reports whether two ParentIDs name the same parent, or both
+// none.
+func equalParent(a, b *int) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+func hasSubtasksConflict(children int) error {
+	return &ConflictError{Code: CodeHasSubtasks,
+		Detail: fmt.Sprintf("The todo has %d subtasks; delete with ?cascade=true to remove them too.", children)}
+}
+
+// unknownParentError reports a todo that names a parent that doesn't exist.
+func unknownParentError() error {
+	return &ValidationError{Fields: []FieldError{{"parent_id", "must refer to an existing todo"}}}
+}
+
+// parentCycleError reports a todo moved under itself or one of its subtasks.
+func parentCycleError() error {
+	return &ValidationError{Fields: []FieldError{{"parent_id", "must not be the todo itself or one of its subtasks"}}}
+}
@@ -0,0 +1,247 @@
+// Written by Gemini CLI
+// This file is licensed under the MIT License.
+// See the LICENSE file for details.
+
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	// DefaultListID is the list that holds todos created without one,
+	// including every todo from before lists existed. It can be renamed but
+	// not archived or deleted.
+	DefaultListID = 1
+	// MaxListNameLength is the longest list name accepted, in characters.
+	MaxListNameLength = 100
+)
+
+// TodoList is a named group of todos, such as a project or workstream.
+// Every todo belongs to exactly one list. CreatedAt and UpdatedAt are
+// managed by the store; values sent by clients are ignored.
+type TodoList struct {
+	ID        int       `json:"id"`
+	Name      string    `json:"name"`
+	Archived  bool      `json:"archived"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Validate normalizes l in place (trimming the name) and checks it,
+// returning a *ValidationError listing every invalid field.
+func (l *TodoList) Validate() error {
+	l.Name = strings.TrimSpace(l.Name)
+	switch {
+	case l.Name == "":
+		return &ValidationError{Fields: []FieldError{{"name", "must not be empty"}}}
+	case utf8.RuneCountInString(l.Name) > MaxListNameLength:
+		return &ValidationError{Fields: []FieldError{{"name", fmt.Sprintf("must be at most %d characters", MaxListNameLength)}}}
+	}
+	return nil
+}
+
+// applyListUpdate runs fn on l, then restores the fields fn may not change
+// and stamps UpdatedAt. The default list may not be archived.
+func applyListUpdate(l *TodoList, fn ListUpdateFunc, at time.Time) error {
+	before := *l
+	if err := fn(l); err != nil {
+		return err
+	}
+	l.ID, l.CreatedAt, l.UpdatedAt = before.ID, before.CreatedAt, at
+	if l.ID == DefaultListID && l.Archived {
+		return defaultListConflict()
+	}
+	return nil
+}
+
+func defaultListConflict() error {
+	return &ConflictError{Code: CodeDefaultList, Detail: "The default list can't be archived or deleted."}
+}
+
+func listNotEmptyConflict(todos int) error {
+	return &ConflictError{Code: CodeListNotEmpty,
+		Detail: fmt.Sprintf("The list still has %d todos; move or delete them first.", todos)}
+}
+
+// unknownListError reports a todo that names a list that doesn't exist.
+func unknownListError() error {
+	return &ValidationError{Fields: []FieldError{{"list_id", "must refer to an existing list"}}}
+}
+
+// HandleLists serves /lists.
+func (s *Server) HandleLists(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		s.GetLists(w, r)
+	case http.MethodPost:
+		s.AddList(w, r)
+	default:
+		writeMethodNotAllowed(w, r, http.MethodGet, http.MethodPost)
+	}
+}
+
+// HandleList serves /lists/{id} and the todos in it, /lists/{id}/todos.
+func (s *Server) HandleList(w http.ResponseWriter, r *http.Request) {
+	idPart, sub, _ := strings.Cut(r.URL.Path[len("/lists/"):], "/")
+	id, err := strconv.Atoi(idPart)
+	if err != nil {
+		writeProblem(w, r, http.StatusBadRequest, CodeValidationFailed, "List id must be an integer.")
+		return
+	}
+
+	switch sub {
+	case "":
+		switch r.Method {
+		case http.MethodGet:
+			s.GetList(w, r, id)
+		case http.MethodPatch:
+			s.PatchList(w, r, id)
+		case http.MethodDelete:
+			s.DeleteList(w, r, id)
+		default:
+			writeMethodNotAllowed(w, r, http.MethodGet, http.MethodPatch, http.MethodDelete)
+		}
+	case "todos":
+		switch r.Method {
+		case http.MethodGet:
+			s.GetListTodos(w, r, id)
+		case http.MethodPost:
+			s.AddListTodo(w, r, id)
+		default:
+			writeMethodNotAllowed(w, r, http.MethodGet, http.MethodPost)
+		}
+	default:
+		writeProblem(w, r, http.StatusNotFound, CodeNotFound, "")
+	}
+}
+
+// GetLists returns active lists, or every list with ?include_archived=true.
+func (s *Server) GetLists(w http.ResponseWriter, r *http.Request) {
+	includeArchived := false
+	if v := r.URL.Query().Get("include_archived"); v != "" {
+		var err error
+		if includeArchived, err = strconv.ParseBool(v); err != nil {
+			writeInputError(w, r, &ValidationError{Fields: []FieldError{{"include_archived", "must be true or false"}}})
+			return
+		}
+	}
+
+	lists, err := s.lists.Lists(r.Context(), includeArchived)
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, lists)
+}
+
+// AddList creates a list from a {"name": ...} body.
+func (s *Server) AddList(w http.ResponseWriter, r *http.Request) {
+	var l TodoList
+	if err := decodeList(w, r, &l); err != nil {
+		writeInputError(w, r, err)
+		return
+	}
+
+	l, err := s.lists.CreateList(r.Context(), l)
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+	slog.Info("Created list", "id", l.ID, "name", l.Name)
+	writeJSON(w, http.StatusCreated, l)
+}
+
+// decodeList reads, strictly decodes and validates a TodoList request body.
+func decodeList(w http.ResponseWriter, r *http.Request, l *TodoList) error {
+	data, err := readBody(w, r)
+	if err != nil {
+		return err
+	}
+	if err := decodeStrict(data, l); err != nil {
+		return err
+	}
+	return l.Validate()
+}
+
+// GetList returns a single list.
+func (s *Server) GetList(w http.ResponseWriter, r *http.Request, id int) {
+	l, err := s.lists.GetList(r.Context(), id)
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, l)
+}
+
+// PatchList renames or (un)archives a list with a JSON Merge Patch body.
+func (s *Server) PatchList(w http.ResponseWriter, r *http.Request, id int) {
+	data, err := readBody(w, r)
+	if err != nil {
+		writeInputError(w, r, err)
+		return
+	}
+	patch, err := ParseMergePatch(data)
+	if err != nil {
+		writeProblem(w, r, http.StatusBadRequest, CodeMalformedRequest, "Request body must be a JSON merge patch object.")
+		return
+	}
+
+	l, err := s.lists.UpdateList(r.Context(), id, patch.ApplyList)
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, l)
+}
+
+// DeleteList removes an empty list. Lists that still have todos are
+// rejected with 409, so todos are never deleted as a side effect.
+func (s *Server) DeleteList(w http.ResponseWriter, r *http.Request, id int) {
+	if err := s.lists.DeleteList(r.Context(), id); err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GetListTodos lists the todos in one list, taking the same parameters as
+// GET /todos.
+func (s *Server) GetListTodos(w http.ResponseWriter, r *http.Request, id int) {
+	if _, err := s.lists.GetList(r.Context(), id); err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+	opts, err := parseListOptions(r.URL.Query())
+	if err != nil {
+		writeInputError(w, r, err)
+		return
+	}
+	opts.ListID = id
+	s.listTodos(w, r, opts)
+}
+
+// AddListTodo creates a todo in the given list.
+func (s *Server) AddListTodo(w http.ResponseWriter, r *http.Request, id int) {
+	if _, err := s.lists.GetList(r.Context(), id); err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+	s.addTodo(w, r, id)
+}
+
+// writeJSON writes v as a JSON response with the given status.
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Error("Failed to encode response", "error", err)
+	}
+}
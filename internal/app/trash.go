@@ -0,0 +1,85 @@
+// Written by Gemini CLI
+// This file is licensed under the MIT License.
+// See the LICENSE file for details.
+
+package app
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// DefaultTrashRetention is how long deleted todos stay in the trash before
+// PurgeTrash deletes them for good.
+const DefaultTrashRetention = 30 * 24 * time.Hour
+
+func parentTrashedConflict() error {
+	return &ConflictError{Code: CodeParentTrashed,
+		Detail: "The todo's parent is in the trash; restore the parent first."}
+}
+
+// equalTime reports whether two optional times are the same instant, or both
+// unset.
+func equalTime(a, b *time.Time) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Equal(*b)
+}
+
+// HandleTrash serves GET /trash, the deleted todos that can still be
+// restored. It takes the same query parameters as GET /todos.
+func (s *Server) HandleTrash(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeMethodNotAllowed(w, r, http.MethodGet)
+		return
+	}
+	opts, err := parseListOptions(r.URL.Query())
+	if err != nil {
+		writeInputError(w, r, err)
+		return
+	}
+	opts.Trashed = true
+	s.listTodos(w, r, opts)
+}
+
+// HandleTodoRestore serves POST /todos/{id}/restore, which takes a todo out
+// of the trash, together with the subtasks deleted along with it, and
+// returns it. Restoring a todo that isn't in the trash changes nothing.
+func (s *Server) HandleTodoRestore(w http.ResponseWriter, r *http.Request, id int) {
+	if r.Method != http.MethodPost {
+		writeMethodNotAllowed(w, r, http.MethodPost)
+		return
+	}
+	t, err := s.trash.Restore(r.Context(), id)
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, t)
+}
+
+// PurgeTrash permanently deletes todos that have been in the trash for
+// longer than retention, once straight away and then every interval, until
+// ctx is done. Failures are logged and retried on the next round.
+func PurgeTrash(ctx context.Context, store TrashStore, retention, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		n, err := store.Purge(ctx, now().Add(-retention))
+		if err != nil {
+			slog.Error("Failed to purge trash", "error", err)
+		} else if n > 0 {
+			slog.Info("Purged trash", "todos", n)
+			TodosPurged.Add(float64(n))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
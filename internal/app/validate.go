@@ -0,0 +1,187 @@
+// Written by Gemini CLI
+// This file is licensed under the MIT License.
+// See the LICENSE file for details.
+
+package app
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"reflect"
+	"slices"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	// MaxTaskLength is the longest task accepted, in characters.
+	MaxTaskLength = 500
+	// MaxNotesLength is the longest notes accepted, in characters.
+	MaxNotesLength = 10000
+	// MaxRequestBodyBytes caps the size of request bodies read by the API.
+	MaxRequestBodyBytes = 64 << 10
+)
+
+// errMalformedBody is returned for request bodies that aren't valid JSON of
+// the expected shape at all, as opposed to ones with invalid fields.
+var errMalformedBody = errors.New("malformed request body")
+
+// FieldError describes a problem with a single field of a request.
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// ValidationError lists every invalid field of a request. It matches
+// ErrInvalidInput with errors.Is.
+type ValidationError struct {
+	Fields []FieldError
+}
+
+func (e *ValidationError) Error() string {
+	msgs := make([]string, len(e.Fields))
+	for i, f := range e.Fields {
+		msgs[i] = f.Field + ": " + f.Message
+	}
+	return fmt.Sprintf("%v: %s", ErrInvalidInput, strings.Join(msgs, "; "))
+}
+
+func (e *ValidationError) Is(target error) bool {
+	return target == ErrInvalidInput
+}
+
+// Validate normalizes t in place (trimming the task, defaulting the priority
+// and converting times to UTC) and checks it, returning a *ValidationError
+// listing every invalid field.
+func (t *Todo) Validate() error {
+	var fields []FieldError
+
+	t.Task = strings.TrimSpace(t.Task)
+	switch {
+	case t.Task == "":
+		fields = append(fields, FieldError{"task", "must not be empty"})
+	case utf8.RuneCountInString(t.Task) > MaxTaskLength:
+		fields = append(fields, FieldError{"task", fmt.Sprintf("must be at most %d characters", MaxTaskLength)})
+	}
+
+	if t.Priority == "" {
+		t.Priority = PriorityNormal
+	} else if !t.Priority.Valid() {
+		fields = append(fields, FieldError{"priority", fmt.Sprintf("must be one of %v", Priorities)})
+	}
+
+	if utf8.RuneCountInString(t.Notes) > MaxNotesLength {
+		fields = append(fields, FieldError{"notes", fmt.Sprintf("must be at most %d characters", MaxNotesLength)})
+	}
+
+	t.DueAt = normalizeTime(t.DueAt)
+	fields = t.validateRecurrence(fields)
+
+	if len(fields) > 0 {
+		return &ValidationError{Fields: fields}
+	}
+	return nil
+}
+
+// readBody reads the request body, failing with *http.MaxBytesError once it
+// exceeds MaxRequestBodyBytes.
+func readBody(w http.ResponseWriter, r *http.Request) ([]byte, error) {
+	return io.ReadAll(http.MaxBytesReader(w, r.Body, MaxRequestBodyBytes))
+}
+
+// decodeStrict decodes a single JSON value into dst, rejecting unknown
+// fields. Unknown or mistyped fields are reported as a *ValidationError;
+// anything else that doesn't parse is errMalformedBody.
+func decodeStrict(data []byte, dst any) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(dst); err != nil {
+		var typeErr *json.UnmarshalTypeError
+		if errors.As(err, &typeErr) && typeErr.Field != "" {
+			return &ValidationError{Fields: []FieldError{
+				{typeErr.Field, "must be a JSON " + jsonKind(typeErr.Type)},
+			}}
+		}
+		// encoding/json has no typed error for unknown fields.
+		if name, ok := strings.CutPrefix(err.Error(), "json: unknown field "); ok {
+			return &ValidationError{Fields: []FieldError{
+				{strings.Trim(name, `"`), "unknown field"},
+			}}
+		}
+		if fields := invalidFields(data, dst); len(fields) > 0 {
+			return &ValidationError{Fields: fields}
+		}
+		return fmt.Errorf("%w: %v", errMalformedBody, err)
+	}
+	if dec.More() {
+		return fmt.Errorf("%w: trailing data after JSON value", errMalformedBody)
+	}
+	return nil
+}
+
+// invalidFields finds the members of a JSON object that fail to decode into
+// dst on their own, for errors such as bad timestamps that encoding/json
+// doesn't attribute to a field.
+func invalidFields(data []byte, dst any) []FieldError {
+	var members map[string]json.RawMessage
+	if json.Unmarshal(data, &members) != nil {
+		return nil
+	}
+	typ := reflect.TypeOf(dst).Elem()
+
+	var fields []FieldError
+	for _, name := range slices.Sorted(maps.Keys(members)) {
+		single, _ := json.Marshal(map[string]json.RawMessage{name: members[name]})
+		err := json.Unmarshal(single, reflect.New(typ).Interface())
+		var parseErr *time.ParseError
+		switch {
+		case errors.As(err, &parseErr):
+			fields = append(fields, FieldError{name, "must be an RFC 3339 timestamp"})
+		case err != nil:
+			fields = append(fields, FieldError{name, "is invalid"})
+		}
+	}
+	return fields
+}
+
+// writeInputError maps an error from readBody, decodeStrict or Validate onto
+// a problem response: 413 for oversized bodies, 422 with per-field errors for
+// invalid fields, and 400 for bodies that don't parse.
+func writeInputError(w http.ResponseWriter, r *http.Request, err error) {
+	var maxErr *http.MaxBytesError
+	var verr *ValidationError
+	switch {
+	case errors.As(err, &maxErr):
+		writeProblem(w, r, http.StatusRequestEntityTooLarge, CodePayloadTooLarge,
+			fmt.Sprintf("Request body must be at most %d bytes.", maxErr.Limit))
+	case errors.As(err, &verr):
+		writeValidationProblem(w, r, verr)
+	default:
+		writeProblem(w, r, http.StatusBadRequest, CodeMalformedRequest, "Request body must be a JSON object.")
+	}
+}
+
+// jsonKind names the JSON type that decodes into t, for error messages that
+// shouldn't mention Go types.
+func jsonKind(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.Bool:
+		return "boolean"
+	case reflect.String:
+		return "string"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return "number"
+	case reflect.Slice, reflect.Array:
+		return "array"
+	default:
+		return "object"
+	}
+}
@@ -5,11 +5,18 @@
 package main
 
 import (
+	"context"
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log/slog"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"strconv"
 	"time"
 
 	"github.com/stevemcghee/go-to-production/internal/app"
@@ -44,6 +51,10 @@ func main() {
 		projectID = "smcghee-todo-p15n-38a6"
 	}
 
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		os.Exit(runMigrate(projectID, os.Args[2:]))
+	}
+
 	// Initialize Cloud Trace
 	shutdown, err := app.InitTracer(projectID)
 	if err != nil {
@@ -53,33 +64,46 @@ func main() {
 		defer shutdown()
 	}
 
-	secretName := fmt.Sprintf("projects/%s/secrets/todo-app-secret/versions/latest", projectID)
-
-	secretValue, err := app.AccessSecretVersion(secretName)
+	store, listenURL, err := openStore(context.Background(), projectID)
 	if err != nil {
-		slog.Error("Failed to fetch secret from Secret Manager", "error", err)
+		slog.Error("Failed to initialize storage", "error", err)
 		os.Exit(1)
-	} else {
-		slog.Info("Successfully fetched secret from Secret Manager")
 	}
+	defer store.Close()
 
-	var dbConfig app.DBConfig
-	if err := json.Unmarshal([]byte(secretValue), &dbConfig); err != nil {
-		slog.Error("Failed to parse secret JSON", "error", err)
+	retention, err := trashRetention()
+	if err != nil {
+		slog.Error("Invalid TRASH_RETENTION", "error", err)
 		os.Exit(1)
 	}
+	go app.PurgeTrash(context.Background(), store, retention, time.Hour)
+	window, err := idempotencyWindow()
+	if err != nil {
+		slog.Error("Invalid IDEMPOTENCY_WINDOW", "error", err)
+		os.Exit(1)
+	}
+	go app.ExpireIdempotencyKeys(context.Background(), store, window, time.Hour)
 
-	app.InitDB(dbConfig)
-	defer app.DB.Close()
-	if app.DBRead != app.DB {
-		defer app.DBRead.Close()
+	srv := app.NewServer(store)
+	// On Postgres, event streams are woken by notifications of changes made
+	// through any replica; otherwise they poll.
+	if listenURL != "" {
+		go app.ListenForTodoEvents(context.Background(), listenURL, srv)
 	}
 
 	mux := http.NewServeMux()
 	mux.HandleFunc("/", app.ServeIndex)
-	mux.HandleFunc("/todos", app.HandleTodos)
-	mux.HandleFunc("/todos/", app.HandleTodo)
-	mux.HandleFunc("/healthz", app.HealthzHandler)
+	mux.HandleFunc("/todos", srv.HandleTodos)
+	mux.HandleFunc("/todos/", srv.HandleTodo)
+	mux.HandleFunc("/todos/search", srv.SearchTodos)
+	mux.HandleFunc("/todos/events", srv.HandleTodoEvents)
+	mux.HandleFunc("/todos:batch", srv.HandleTodosBatch)
+	mux.HandleFunc("/lists", srv.HandleLists)
+	mux.HandleFunc("/lists/", srv.HandleList)
+	mux.HandleFunc("/tags", srv.HandleTags)
+	mux.HandleFunc("/tags/", srv.HandleTag)
+	mux.HandleFunc("/trash", srv.HandleTrash)
+	mux.HandleFunc("/healthz", srv.HealthzHandler)
 	mux.Handle("/metrics", promhttp.Handler())
 
 	fs := http.FileServer(http.Dir("./static"))
@@ -97,9 +121,12 @@ func main() {
 
 	slog.Info("Server starting", "port", port)
 
-	// Wrap handler with tracing and security middleware
+	// Wrap handler with tracing, request id, actor and security middleware.
+	// Set TRUST_IAP_HEADERS=true only behind Identity-Aware Proxy, which
+	// sets the user's email header; without it, clients could forge it.
+	trustIAP := os.Getenv("TRUST_IAP_HEADERS") == "true"
 	handler := otelhttp.NewHandler(
-		app.SecurityHeadersMiddleware(mux),
+		app.RequestIDMiddleware(app.ActorMiddleware(app.SecurityHeadersMiddleware(mux), trustIAP)),
 		"go-to-production",
 	)
 
@@ -115,4 +142,257 @@ func main() {
 		slog.Error("Server stopped unexpectedly", "error", err)
 		os.Exit(1)
 	}
-}
\ No newline at end of file
+}
+
+// closableStore is a Store that holds resources released on shutdown.
+type closableStore interface {
+	app.Store
+	io.Closer
+}
+
+// storageBackend returns the backend selected by STORAGE_BACKEND:
+//   - "sqlite": a local file at SQLITE_PATH, for laptops and demos
+//   - "memory": process memory only, for ephemeral preview environments
+//   - "postgres": Cloud SQL, with connection details read from Secret Manager
+//     (or DATABASE_URL or DB_USER/DB_PASSWORD/DB_NAME, when set)
+//
+// Unset, it defaults to "sqlite" for local development, but fails on
+// Kubernetes and Cloud Run, where a file inside the container would quietly
+// lose every todo on restart.
+func storageBackend() (string, error) {
+	if backend := os.Getenv("STORAGE_BACKEND"); backend != "" {
+		return backend, nil
+	}
+	if os.Getenv("KUBERNETES_SERVICE_HOST") != "" || os.Getenv("K_SERVICE") != "" {
+		return "", errors.New("STORAGE_BACKEND must be set when running on Kubernetes or Cloud Run")
+	}
+	return "sqlite", nil
+}
+
+// trashRetention returns how long deleted todos stay restorable, from
+// TRASH_RETENTION (a Go duration such as "168h"), defaulting to
+// app.DefaultTrashRetention.
+func trashRetention() (time.Duration, error) {
+	return envDuration("TRASH_RETENTION", app.DefaultTrashRetention)
+}
+
+// idempotencyWindow returns how long Idempotency-Keys are kept, from
+// IDEMPOTENCY_WINDOW, defaulting to app.DefaultIdempotencyWindow.
+func idempotencyWindow() (time.Duration, error) {
+	return envDuration("IDEMPOTENCY_WINDOW", app.DefaultIdempotencyWindow)
+}
+
+// envDuration parses the environment variable name as a positive Go
+// duration, or returns def if it is unset.
+func envDuration(name string, def time.Duration) (time.Duration, error) {
+	v := os.Getenv(name)
+	if v == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err == nil && d <= 0 {
+		err = fmt.Errorf("must be positive, got %s", d)
+	}
+	return d, err
+}
+
+// openStore builds the todo storage backend and makes sure its schema is
+// one this binary can serve. For Postgres it also returns the URL of the
+// primary, to listen for changes on.
+func openStore(ctx context.Context, projectID string) (closableStore, string, error) {
+	backend, err := storageBackend()
+	if err != nil {
+		return nil, "", err
+	}
+	slog.Info("Using storage backend", "backend", backend)
+
+	if backend == "memory" {
+		slog.Warn("Using in-memory storage; todos will be lost on restart")
+		return app.NewMemoryStore(), "", nil
+	}
+
+	primary, replica, url, err := openSQL(backend, projectID)
+	if err != nil {
+		return nil, "", err
+	}
+
+	var store *app.SQLStore
+	var migrator *app.Migrator
+	if backend == "sqlite" {
+		store = app.NewSQLiteStore(primary)
+		migrator, err = app.NewMigrator(primary, app.DialectSQLite)
+	} else {
+		store = app.NewPostgresStore(primary, replica)
+		migrator, err = app.NewMigrator(primary, app.DialectPostgres)
+	}
+	if err != nil {
+		store.Close()
+		return nil, "", err
+	}
+
+	// A local SQLite file has a single user, so it always migrates eagerly.
+	// Postgres replicas opt in, and serialize on an advisory lock.
+	if backend == "sqlite" || os.Getenv("MIGRATE_ON_STARTUP") == "true" {
+		if err := migrator.Up(ctx); err != nil {
+			store.Close()
+			return nil, "", err
+		}
+	}
+
+	// Refuse to serve against a schema from the future
+	if err := migrator.Check(ctx); err != nil {
+		store.Close()
+		return nil, "", err
+	}
+	return store, url, nil
+}
+
+// openSQL connects to a SQL backend, returning primary and read replica pools
+// (which are the same pool unless a Postgres replica is configured) and, for
+// Postgres, the URL of the primary.
+func openSQL(backend, projectID string) (primary, replica *sql.DB, url string, err error) {
+	switch backend {
+	case "sqlite":
+		path := os.Getenv("SQLITE_PATH")
+		if path == "" {
+			path = "todos.db"
+		}
+		db, err := app.OpenSQLite(path)
+		return db, db, "", err
+
+	case "postgres":
+		if url := databaseURL(); url != "" {
+			db, err := app.ConnectURL(url)
+			return db, db, url, err
+		}
+
+		secretName := fmt.Sprintf("projects/%s/secrets/todo-app-secret/versions/latest", projectID)
+
+		secretValue, err := app.AccessSecretVersion(secretName)
+		if err != nil {
+			return nil, nil, "", fmt.Errorf("failed to fetch secret from Secret Manager: %w", err)
+		}
+		slog.Info("Successfully fetched secret from Secret Manager")
+
+		var dbConfig app.DBConfig
+		if err := json.Unmarshal([]byte(secretValue), &dbConfig); err != nil {
+			return nil, nil, "", fmt.Errorf("failed to parse secret JSON: %w", err)
+		}
+
+		primary, replica, err := app.InitDB(dbConfig)
+		return primary, replica, dbConfig.PrimaryURL(), err
+
+	default:
+		return nil, nil, "", fmt.Errorf("unknown STORAGE_BACKEND %q (want sqlite, memory or postgres)", backend)
+	}
+}
+
+// databaseURL returns DATABASE_URL, or else a URL built from DB_USER,
+// DB_PASSWORD and DB_NAME (with DB_HOST and DB_PORT defaulting to a local
+// proxy), escaping the credentials so any password survives the trip.
+// It returns "" when neither is set.
+func databaseURL() string {
+	if u := os.Getenv("DATABASE_URL"); u != "" {
+		return u
+	}
+	user, name := os.Getenv("DB_USER"), os.Getenv("DB_NAME")
+	if user == "" || name == "" {
+		return ""
+	}
+	host := os.Getenv("DB_HOST")
+	if host == "" {
+		host = "127.0.0.1"
+	}
+	port := os.Getenv("DB_PORT")
+	if port == "" {
+		port = "5432"
+	}
+	u := url.URL{
+		Scheme:   "postgres",
+		User:     url.UserPassword(user, os.Getenv("DB_PASSWORD")),
+		Host:     net.JoinHostPort(host, port),
+		Path:     "/" + name,
+		RawQuery: "sslmode=disable",
+	}
+	return u.String()
+}
+
+const migrateUsage = `usage: main migrate <command>
+
+commands:
+  up          apply all pending migrations
+  down [N]    revert the last N migrations (default 1)
+  version     print the applied and latest migration versions
+
+The database is selected with the same STORAGE_BACKEND, SQLITE_PATH,
+DATABASE_URL and DB_USER/DB_PASSWORD/DB_NAME/DB_HOST/DB_PORT settings as
+the server. After "up", MIGRATE_GRANT_ROLE (if set)
+is granted access to all tables and sequences.`
+
+// runMigrate implements the migrate subcommand and returns the exit code.
+func runMigrate(projectID string, args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, migrateUsage)
+		return 2
+	}
+
+	backend, err := storageBackend()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	dialect := app.DialectPostgres
+	switch backend {
+	case "sqlite":
+		dialect = app.DialectSQLite
+	case "memory":
+		fmt.Fprintln(os.Stderr, "the memory backend has no schema to migrate")
+		return 1
+	}
+
+	db, _, _, err := openSQL(backend, projectID)
+	if err != nil {
+		slog.Error("Failed to connect for migration", "error", err)
+		return 1
+	}
+	defer db.Close()
+
+	migrator, err := app.NewMigrator(db, dialect)
+	if err != nil {
+		slog.Error("Failed to load migrations", "error", err)
+		return 1
+	}
+
+	ctx := context.Background()
+	switch args[0] {
+	case "up":
+		err = migrator.Up(ctx)
+		if role := os.Getenv("MIGRATE_GRANT_ROLE"); err == nil && role != "" {
+			err = migrator.GrantAll(ctx, role)
+		}
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			if steps, err = strconv.Atoi(args[1]); err != nil || steps < 1 {
+				fmt.Fprintln(os.Stderr, migrateUsage)
+				return 2
+			}
+		}
+		err = migrator.Down(ctx, steps)
+	case "version":
+		var version int
+		if version, err = migrator.Version(ctx); err == nil {
+			fmt.Printf("version %d (latest %d)\n", version, migrator.Latest())
+		}
+	default:
+		fmt.Fprintln(os.Stderr, migrateUsage)
+		return 2
+	}
+
+	if err != nil {
+		slog.Error("Migration failed", "command", args[0], "error", err)
+		return 1
+	}
+	slog.Info("Migration complete", "command", args[0])
+	return 0
+}
@@ -0,0 +1,163 @@
+// Written by Gemini CLI
+// This file is licensed under the MIT License.
+// See the LICENSE file for details.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stevemcghee/go-to-production/internal/app"
+)
+
+// TestMemoryTodoBehavior runs the shared handler suite against the in-memory store.
+func TestMemoryTodoBehavior(t *testing.T) {
+	runTodoBehaviorTests(t, func(t *testing.T) *app.Server {
+		return app.NewServer(app.NewMemoryStore())
+	})
+}
+
+// TestMemoryStoreConcurrentCreates tests that concurrent creates get unique ids
+func TestMemoryStoreConcurrentCreates(t *testing.T) {
+	store := app.NewMemoryStore()
+	srv := app.NewServer(store)
+
+	const n = 50
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if _, err := store.Create(context.Background(), app.Todo{Task: fmt.Sprintf("task %d", i)}); err != nil {
+				t.Errorf("create failed: %v", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	todos := listTodos(t, srv)
+	if len(todos) != n {
+		t.Fatalf("expected %d todos, got %d", n, len(todos))
+	}
+	for i, todo := range todos {
+		if todo.ID != i+1 {
+			t.Errorf("expected ids 1..%d in order, got %d at position %d", n, todo.ID, i)
+		}
+	}
+}
+
+// TestMemoryStoreFaultInjection tests that injected faults surface as errors
+// only for the targeted operation
+func TestMemoryStoreFaultInjection(t *testing.T) {
+	store := app.NewMemoryStore()
+	srv := app.NewServer(store)
+	store.SetFault(func(op string) error {
+		if op == "ping" {
+			return errors.New("injected")
+		}
+		return nil
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/healthz", nil)
+	w := httptest.NewRecorder()
+	srv.HealthzHandler(w, req)
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected status %d with ping fault, got %d", http.StatusServiceUnavailable, w.Code)
+	}
+
+	// Other operations are unaffected
+	addTodo(t, srv, "still works")
+
+	store.SetFault(nil)
+	w = httptest.NewRecorder()
+	srv.HealthzHandler(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("expected status %d after clearing fault, got %d", http.StatusOK, w.Code)
+	}
+}
+
+// TestMemoryStorePurge tests purging the trash of the in-memory store
+func TestMemoryStorePurge(t *testing.T) {
+	testPurgeTrash(t, app.NewMemoryStore())
+}
+
+// TestMemoryStorePurgeIdempotencyKeys tests expiring the Idempotency-Keys
+// of the in-memory store
+func TestMemoryStorePurgeIdempotencyKeys(t *testing.T) {
+	testPurgeIdempotencyKeys(t, app.NewMemoryStore())
+}
+
+// TestMemoryStoreEventsSince tests reading the events of the in-memory
+// store by revision
+func TestMemoryStoreEventsSince(t *testing.T) {
+	testEventsSince(t, app.NewMemoryStore())
+}
+
+// TestMemoryStoreBatchRetry tests that a batch is retried as a whole, as one
+// operation
+func TestMemoryStoreBatchRetry(t *testing.T) {
+	store := app.NewMemoryStore()
+	srv := app.NewServer(store)
+	calls := 0
+	store.SetFault(func(op string) error {
+		if op != "batch" {
+			return nil
+		}
+		calls++
+		if calls < 3 {
+			return errors.New("injected")
+		}
+		return nil
+	})
+
+	ops := []app.BatchOp{{Op: app.BatchCreate, Todo: app.Todo{Task: "A"}}, {Op: app.BatchCreate, Todo: app.Todo{Task: "B"}}}
+	results, err := store.Batch(context.Background(), ops, true)
+	if err != nil {
+		t.Fatalf("batch failed: %v", err)
+	}
+	if calls != 3 || len(results) != 2 {
+		t.Errorf("expected the batch to succeed on its third attempt, got %d attempts and %+v", calls, results)
+	}
+	if got := todoTasks(listTodos(t, srv)); !slices.Equal(got, []string{"A", "B"}) {
+		t.Errorf("expected each todo created once, got %q", got)
+	}
+}
+
+// TestMemoryStoreEventStreamsShareReads tests that event streams share the
+// server's reads of the store rather than each reading every change
+func TestMemoryStoreEventStreamsShareReads(t *testing.T) {
+	store := app.NewMemoryStore()
+	srv := app.NewServer(store)
+	var streams []*eventStream
+	for range 5 {
+		stream := openEventStream(t, srv, "")
+		stream.next() // ready
+		streams = append(streams, stream)
+	}
+
+	var reads atomic.Int32
+	store.SetFault(func(op string) error {
+		if op == "events" {
+			reads.Add(1)
+		}
+		return nil
+	})
+	todo := addTodo(t, srv, "Shared")
+	srv.NotifyTodoEvents()
+	for _, stream := range streams {
+		if _, e := stream.nextEvent("created"); e.TodoID != todo.ID {
+			t.Errorf("expected the todo created, got %+v", e)
+		}
+	}
+	if n := reads.Load(); n == 0 || n >= int32(len(streams)) {
+		t.Errorf("expected the change read once for all %d streams, got %d reads", len(streams), n)
+	}
+}
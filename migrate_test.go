@@ -0,0 +1,148 @@
+// Written by Gemini CLI
+// This file is licensed under the MIT License.
+// See the LICENSE file for details.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stevemcghee/go-to-production/internal/app"
+)
+
+// TestMigrationDialectsInLockstep tests that every migration exists for both
+// Postgres and SQLite, so the backends never drift apart
+func TestMigrationDialectsInLockstep(t *testing.T) {
+	pg, err := app.NewMigrator(nil, app.DialectPostgres)
+	if err != nil {
+		t.Fatalf("failed to load postgres migrations: %v", err)
+	}
+	lite, err := app.NewMigrator(nil, app.DialectSQLite)
+	if err != nil {
+		t.Fatalf("failed to load sqlite migrations: %v", err)
+	}
+	if pg.Latest() != lite.Latest() {
+		t.Errorf("postgres has %d migrations but sqlite has %d", pg.Latest(), lite.Latest())
+	}
+}
+
+// TestMigrateUpDown tests applying and reverting every migration
+func TestMigrateUpDown(t *testing.T) {
+	ctx := context.Background()
+	db, err := app.OpenSQLite(filepath.Join(t.TempDir(), "todos.db"))
+	if err != nil {
+		t.Fatalf("failed to open sqlite: %v", err)
+	}
+	defer db.Close()
+
+	migrator, err := app.NewMigrator(db, app.DialectSQLite)
+	if err != nil {
+		t.Fatalf("failed to load migrations: %v", err)
+	}
+
+	if v, err := migrator.Version(ctx); err != nil || v != 0 {
+		t.Fatalf("expected fresh database at version 0, got %d (err %v)", v, err)
+	}
+
+	// Up twice: the second run must be a no-op
+	for i := 0; i < 2; i++ {
+		if err := migrator.Up(ctx); err != nil {
+			t.Fatalf("up failed: %v", err)
+		}
+	}
+	if v, _ := migrator.Version(ctx); v != migrator.Latest() {
+		t.Errorf("expected version %d after up, got %d", migrator.Latest(), v)
+	}
+	if _, err := db.Exec("INSERT INTO todos (task) VALUES ('migrated')"); err != nil {
+		t.Errorf("expected todos table after up: %v", err)
+	}
+
+	if err := migrator.Down(ctx, migrator.Latest()); err != nil {
+		t.Fatalf("down failed: %v", err)
+	}
+	if v, _ := migrator.Version(ctx); v != 0 {
+		t.Errorf("expected version 0 after reverting everything, got %d", v)
+	}
+	if _, err := db.Exec("SELECT 1 FROM todos"); err == nil {
+		t.Error("expected todos table to be dropped after down")
+	}
+}
+
+// TestMigrateAdoptsInitSQLDatabase tests migrating a database created by the
+// old init.sql, whose completed column allowed NULL
+func TestMigrateAdoptsInitSQLDatabase(t *testing.T) {
+	ctx := context.Background()
+	db, err := app.OpenSQLite(filepath.Join(t.TempDir(), "todos.db"))
+	if err != nil {
+		t.Fatalf("failed to open sqlite: %v", err)
+	}
+	defer db.Close()
+
+	if _, err := db.Exec("CREATE TABLE todos (id INTEGER PRIMARY KEY AUTOINCREMENT, task TEXT NOT NULL, completed BOOLEAN DEFAULT FALSE)"); err != nil {
+		t.Fatalf("failed to create the old schema: %v", err)
+	}
+	if _, err := db.Exec("INSERT INTO todos (task, completed) VALUES ('Legacy', NULL)"); err != nil {
+		t.Fatalf("failed to insert a legacy todo: %v", err)
+	}
+
+	migrator, _ := app.NewMigrator(db, app.DialectSQLite)
+	if err := migrator.Up(ctx); err != nil {
+		t.Fatalf("up failed: %v", err)
+	}
+	todos := listTodos(t, app.NewServer(app.NewSQLiteStore(db)))
+	if len(todos) != 1 || todos[0].Task != "Legacy" || todos[0].Completed {
+		t.Errorf("expected the legacy todo, incomplete, got %+v", todos)
+	}
+}
+
+// TestMigrateRefusesNewerSchema tests that a binary refuses a database
+// migrated by a newer release
+func TestMigrateRefusesNewerSchema(t *testing.T) {
+	ctx := context.Background()
+	db := openSQLite(t, filepath.Join(t.TempDir(), "todos.db"))
+	defer db.Close()
+
+	migrator, _ := app.NewMigrator(db, app.DialectSQLite)
+	if err := migrator.Check(ctx); err != nil {
+		t.Fatalf("expected up-to-date schema to pass check, got %v", err)
+	}
+
+	_, err := db.Exec("INSERT INTO schema_migrations (version, name, applied_at) VALUES ($1, 'from_the_future', $2)", migrator.Latest()+1, time.Now())
+	if err != nil {
+		t.Fatalf("failed to fake a newer migration: %v", err)
+	}
+
+	if err := migrator.Check(ctx); !errors.Is(err, app.ErrSchemaTooNew) {
+		t.Errorf("expected ErrSchemaTooNew from check, got %v", err)
+	}
+	if err := migrator.Up(ctx); !errors.Is(err, app.ErrSchemaTooNew) {
+		t.Errorf("expected ErrSchemaTooNew from up, got %v", err)
+	}
+}
+
+// TestHealthzDetailReportsSchemaVersion tests the /healthz?detail output
+func TestHealthzDetailReportsSchemaVersion(t *testing.T) {
+	srv := newSQLiteServer(t)
+
+	req := httptest.NewRequest(http.MethodGet, "/healthz?detail", nil)
+	w := httptest.NewRecorder()
+	srv.HealthzHandler(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, w.Code)
+	}
+	var detail app.HealthDetail
+	if err := json.NewDecoder(w.Body).Decode(&detail); err != nil {
+		t.Fatalf("failed to decode health detail: %v", err)
+	}
+	if detail.Schema == nil || detail.Schema.Version == 0 || detail.Schema.Version != detail.Schema.Latest {
+		t.Errorf("expected current schema version in detail, got %+v", detail.Schema)
+	}
+}
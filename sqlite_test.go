@@ -0,0 +1,122 @@
+// Written by Gemini CLI
+// This file is licensed under the MIT License.
+// See the LICENSE file for details.
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/stevemcghee/go-to-production/internal/app"
+)
+
+// openSQLite opens and migrates a SQLite database at path.
+func openSQLite(t *testing.T, path string) *sql.DB {
+	t.Helper()
+	db, err := app.OpenSQLite(path)
+	if err != nil {
+		t.Fatalf("failed to open sqlite: %v", err)
+	}
+	migrator, err := app.NewMigrator(db, app.DialectSQLite)
+	if err != nil {
+		t.Fatalf("failed to load migrations: %v", err)
+	}
+	if err := migrator.Up(context.Background()); err != nil {
+		t.Fatalf("failed to migrate sqlite: %v", err)
+	}
+	return db
+}
+
+// newSQLiteServer returns a server backed by a fresh SQLite file in a temp dir.
+func newSQLiteServer(t *testing.T) *app.Server {
+	t.Helper()
+	db := openSQLite(t, filepath.Join(t.TempDir(), "todos.db"))
+	t.Cleanup(func() { db.Close() })
+	return app.NewServer(app.NewSQLiteStore(db))
+}
+
+// TestSQLiteTodoBehavior runs the shared handler suite against SQLite.
+func TestSQLiteTodoBehavior(t *testing.T) {
+	runTodoBehaviorTests(t, newSQLiteServer)
+}
+
+// TestSQLitePurge tests purging the trash of a SQLite store
+func TestSQLitePurge(t *testing.T) {
+	db := openSQLite(t, filepath.Join(t.TempDir(), "todos.db"))
+	defer db.Close()
+	testPurgeTrash(t, app.NewSQLiteStore(db))
+}
+
+// TestSQLitePurgeIdempotencyKeys tests expiring the Idempotency-Keys of a
+// SQLite store
+func TestSQLitePurgeIdempotencyKeys(t *testing.T) {
+	db := openSQLite(t, filepath.Join(t.TempDir(), "todos.db"))
+	defer db.Close()
+	testPurgeIdempotencyKeys(t, app.NewSQLiteStore(db))
+}
+
+// TestSQLiteEventsSince tests reading the events of a SQLite store by
+// revision
+func TestSQLiteEventsSince(t *testing.T) {
+	db := openSQLite(t, filepath.Join(t.TempDir(), "todos.db"))
+	defer db.Close()
+	testEventsSince(t, app.NewSQLiteStore(db))
+}
+
+// TestSQLitePersistence tests that todos survive reopening the database file
+func TestSQLitePersistence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "todos.db")
+
+	db := openSQLite(t, path)
+	addTodo(t, app.NewServer(app.NewSQLiteStore(db)), "Survives restart")
+	db.Close()
+
+	db = openSQLite(t, path)
+	defer db.Close()
+
+	todos := listTodos(t, app.NewServer(app.NewSQLiteStore(db)))
+	if len(todos) != 1 || todos[0].Task != "Survives restart" {
+		t.Errorf("expected persisted todo, got %+v", todos)
+	}
+}
+
+// TestSQLitePositionBackfill tests that todos created before positions
+// existed keep their id order, and can be moved like any other
+func TestSQLitePositionBackfill(t *testing.T) {
+	ctx := context.Background()
+	db := openSQLite(t, filepath.Join(t.TempDir(), "todos.db"))
+	defer db.Close()
+
+	// Go back to the schema before 0010_add_positions.
+	migrator, err := app.NewMigrator(db, app.DialectSQLite)
+	if err != nil {
+		t.Fatalf("failed to load migrations: %v", err)
+	}
+	if err := migrator.Down(ctx, migrator.Latest()-9); err != nil {
+		t.Fatalf("down failed: %v", err)
+	}
+	for _, id := range []int{300, 2, 10} {
+		if _, err := db.Exec("INSERT INTO todos (id, task) VALUES ($1, $2)", id, fmt.Sprintf("Todo %d", id)); err != nil {
+			t.Fatalf("failed to insert todo: %v", err)
+		}
+	}
+	if err := migrator.Up(ctx); err != nil {
+		t.Fatalf("up failed: %v", err)
+	}
+
+	srv := app.NewServer(app.NewSQLiteStore(db))
+	addTodo(t, srv, "New")
+	if got := listAllPages(t, srv, "sort=position"); !slices.Equal(got, []string{"Todo 2", "Todo 10", "Todo 300", "New"}) {
+		t.Errorf("expected existing todos in id order, then the new one, got %q", got)
+	}
+	decodeTodo(t, moveTodo(t, srv, 300, `{"after": 2}`))
+	decodeTodo(t, moveTodo(t, srv, 2, `{"before": 10}`))
+	if got := listAllPages(t, srv, "sort=position"); !slices.Equal(got, []string{"Todo 300", "Todo 2", "Todo 10", "New"}) {
+		t.Errorf("expected moved todos in their new places, got %q", got)
+	}
+}
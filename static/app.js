@@ -6,71 +6,414 @@ document.addEventListener('DOMContentLoaded', () => {
     const form = document.getElementById('todo-form');
     const input = document.getElementById('todo-input');
     const list = document.getElementById('todo-list');
+    const errorBanner = document.getElementById('error-banner');
+    const undoNotice = document.getElementById('undo-notice');
+    const undoButton = document.getElementById('undo-button');
+    const searchInput = document.getElementById('search-input');
+    const listSelect = document.getElementById('list-select');
+    const clearCompletedButton = document.getElementById('clear-completed');
+
+    // showProblem displays a problem+json error response. The code, not the
+    // wording, decides what to tell the user.
+    const showProblem = async (response) => {
+        let problem = {};
+        try {
+            problem = await response.json();
+        } catch (e) {
+            // Not a problem+json body (e.g. from a proxy); fall back to the status.
+        }
+        const messages = {
+            circuit_open: 'The service is recovering from database problems. Please try again shortly.',
+            db_unavailable: 'The database is unavailable. Please try again shortly.',
+            not_found: 'That todo no longer exists.',
+            list_not_empty: 'Move or delete the todos in that list first.',
+            todo_blocked: 'Complete the todos blocking that one first.',
+            parent_trashed: 'Restore its parent todo first.',
+            precondition_failed: 'That todo was changed elsewhere; showing the latest version.',
+        };
+        const fieldErrors = (problem.errors || []).map(e => `${e.field} ${e.message}`).join(', ');
+        errorBanner.textContent = messages[problem.code] || fieldErrors || problem.detail || `Request failed (${response.status}).`;
+        errorBanner.hidden = false;
+    };
+
+    const clearProblem = () => {
+        errorBanner.hidden = true;
+    };
+
+    // todosPath is where the selected list's todos are listed and created.
+    const todosPath = () => listSelect.value ? `/lists/${listSelect.value}/todos` : '/todos';
+
+    const fetchLists = async () => {
+        const response = await fetch('/lists');
+        if (!response.ok) {
+            await showProblem(response);
+            return;
+        }
+        const lists = await response.json();
+        lists.forEach(l => {
+            const option = document.createElement('option');
+            option.value = l.id;
+            option.textContent = l.name;
+            listSelect.appendChild(option);
+        });
+    };
+
+    listSelect.addEventListener('change', () => {
+        searchInput.value = '';
+        fetchTodos();
+    });
 
     const fetchTodos = async () => {
-        const response = await fetch('/todos');
-        const todos = await response.json();
-        list.innerHTML = '';
-        if (todos) {
-            todos.forEach(todo => {
-                renderTodo(todo);
-            });
+        // Follow next-page cursors until the whole list is loaded.
+        const todos = [];
+        const path = todosPath();
+        let url = `${path}?sort=position&limit=200`;
+        while (url) {
+            const response = await fetch(url);
+            if (!response.ok) {
+                await showProblem(response);
+                return;
+            }
+            todos.push(...await response.json());
+            const cursor = response.headers.get('X-Next-Cursor');
+            url = cursor ? `${path}?sort=position&limit=200&cursor=${encodeURIComponent(cursor)}` : null;
         }
+        clearProblem();
+        list.innerHTML = '';
+        todos.forEach(todo => {
+            renderTodo(todo);
+        });
     };
 
     const renderTodo = (todo) => {
+        list.appendChild(buildTodo(todo));
+    };
+
+    const searchTodos = async (q) => {
+        const response = await fetch(`/todos/search?q=${encodeURIComponent(q)}`);
+        if (!response.ok) {
+            await showProblem(response);
+            return;
+        }
+        clearProblem();
+        const results = await response.json();
+        // Ignore results for a query the user has already changed.
+        if (searchInput.value.trim() !== q) {
+            return;
+        }
+        list.innerHTML = '';
+        results.forEach(result => {
+            const item = buildTodo(result);
+            // Snippets are escaped by the server, apart from the <mark> tags.
+            item.querySelector('span').innerHTML = result.snippet;
+            list.appendChild(item);
+        });
+    };
+
+    let searchTimer = null;
+    searchInput.addEventListener('input', () => {
+        clearTimeout(searchTimer);
+        searchTimer = setTimeout(() => {
+            const q = searchInput.value.trim();
+            if (q) {
+                searchTodos(q);
+            } else {
+                fetchTodos();
+            }
+        }, 200);
+    });
+
+    const buildTodo = (todo) => {
         const item = document.createElement('li');
         item.dataset.id = todo.id;
+        item.dataset.version = todo.version;
+        item.dataset.position = todo.position;
+        item.draggable = true;
         if (todo.completed) {
             item.classList.add('completed');
         }
 
         const taskSpan = document.createElement('span');
         taskSpan.textContent = todo.task;
-        taskSpan.addEventListener('click', () => toggleComplete(todo));
+        taskSpan.title = 'Click to toggle, double-click to edit';
+        // Wait to see whether a click is the start of a double-click, so
+        // editing doesn't toggle the todo twice on the way.
+        let clickTimer = null;
+        taskSpan.addEventListener('click', () => {
+            clearTimeout(clickTimer);
+            clickTimer = setTimeout(() => toggleComplete(todo), 250);
+        });
+        taskSpan.addEventListener('dblclick', () => {
+            clearTimeout(clickTimer);
+            startEdit(item, taskSpan, todo);
+        });
 
         const deleteBtn = document.createElement('button');
         deleteBtn.textContent = '×';
         deleteBtn.className = 'delete-btn';
-        deleteBtn.addEventListener('click', () => deleteTodo(todo.id));
+        deleteBtn.addEventListener('click', () => deleteTodo(todo));
 
         item.appendChild(taskSpan);
+        if (todo.recurrence) {
+            const repeat = document.createElement('small');
+            repeat.className = 'recurring';
+            repeat.textContent = '↻';
+            repeat.title = todo.recurrence;
+            item.appendChild(repeat);
+        }
+        if (todo.open_blockers) {
+            const badge = document.createElement('small');
+            badge.className = 'blocked';
+            badge.textContent = 'blocked';
+            badge.title = `Waiting on ${todo.open_blockers} open todo${todo.open_blockers === 1 ? '' : 's'}`;
+            item.appendChild(badge);
+        }
+        if (todo.child_count) {
+            const count = document.createElement('small');
+            count.className = 'subtasks';
+            count.textContent = `${todo.child_count} subtask${todo.child_count === 1 ? '' : 's'}`;
+            item.appendChild(count);
+        }
+        (todo.tags || []).forEach(tag => {
+            const chip = document.createElement('small');
+            chip.className = 'tag';
+            chip.textContent = tag.name;
+            item.appendChild(chip);
+        });
         item.appendChild(deleteBtn);
-        list.appendChild(item);
+        return item;
+    };
+
+    // replaceTodo swaps a rendered todo for one built from the server's copy.
+    const replaceTodo = (item, todo) => {
+        item.replaceWith(buildTodo(todo));
+    };
+
+    // ifMatch makes a change apply only to the version of the todo on screen,
+    // so it can't silently overwrite a change made elsewhere.
+    const ifMatch = (todo) => ({ 'If-Match': `"${todo.version}"` });
+
+    const patchTodo = async (todo, patch) => {
+        const response = await fetch(`/todos/${todo.id}`, {
+            method: 'PATCH',
+            headers: { 'Content-Type': 'application/merge-patch+json', ...ifMatch(todo) },
+            body: JSON.stringify(patch),
+        });
+        if (!response.ok) {
+            await showProblem(response);
+            if (response.status === 412) {
+                // Someone else changed it first; show what they changed it to.
+                fetchTodos();
+            }
+            return null;
+        }
+        clearProblem();
+        return response.json();
+    };
+
+    const startEdit = (item, taskSpan, todo) => {
+        const editInput = document.createElement('input');
+        editInput.type = 'text';
+        editInput.className = 'edit-input';
+        editInput.value = todo.task;
+
+        let done = false;
+        const finish = async (save) => {
+            if (done) {
+                return;
+            }
+            done = true;
+            const task = editInput.value.trim();
+            if (save && task && task !== todo.task) {
+                const updated = await patchTodo(todo, { task });
+                if (updated) {
+                    replaceTodo(item, updated);
+                    return;
+                }
+            }
+            replaceTodo(item, todo);
+        };
+
+        editInput.addEventListener('keydown', (e) => {
+            if (e.key === 'Enter') {
+                finish(true);
+            } else if (e.key === 'Escape') {
+                finish(false);
+            }
+        });
+        editInput.addEventListener('blur', () => finish(true));
+
+        taskSpan.replaceWith(editInput);
+        editInput.focus();
+        editInput.select();
     };
 
     const addTodo = async (task) => {
-        const response = await fetch('/todos', {
+        const response = await fetch(todosPath(), {
             method: 'POST',
             headers: { 'Content-Type': 'application/json' },
             body: JSON.stringify({ task }),
         });
+        if (!response.ok) {
+            await showProblem(response);
+            return;
+        }
+        clearProblem();
         const newTodo = await response.json();
-        renderTodo(newTodo);
+        // The event stream may have shown it already.
+        if (!itemFor(newTodo.id)) {
+            renderTodo(newTodo);
+        }
     };
 
-    const toggleComplete = async (todo) => {
-        const response = await fetch(`/todos/${todo.id}`, {
-            method: 'PUT',
+    // Todos are reordered by dragging. The item moves as it is dragged over
+    // others, and when it is let go the server is told which todo it now
+    // follows (or, at the top, precedes).
+    let dragged = null;
+    let draggedFrom = null;
+    list.addEventListener('dragstart', (e) => {
+        dragged = e.target.closest('li');
+        draggedFrom = dragged.nextElementSibling;
+        dragged.classList.add('dragging');
+        e.dataTransfer.effectAllowed = 'move';
+    });
+    list.addEventListener('dragover', (e) => {
+        const target = e.target.closest('li');
+        // Search results are ranked, not in list order.
+        if (!dragged || !target || target === dragged || searchInput.value.trim()) {
+            return;
+        }
+        e.preventDefault();
+        const { top, height } = target.getBoundingClientRect();
+        if (e.clientY < top + height / 2) {
+            target.before(dragged);
+        } else {
+            target.after(dragged);
+        }
+    });
+    list.addEventListener('drop', (e) => e.preventDefault());
+    list.addEventListener('dragend', () => {
+        const item = dragged;
+        dragged = null;
+        item.classList.remove('dragging');
+        if (item.nextElementSibling !== draggedFrom) {
+            moveTodo(item);
+        }
+    });
+
+    const moveTodo = async (item) => {
+        const prev = item.previousElementSibling;
+        const next = item.nextElementSibling;
+        const body = prev ? { after: Number(prev.dataset.id) } : { before: Number(next.dataset.id) };
+        const response = await fetch(`/todos/${item.dataset.id}/move`, {
+            method: 'POST',
             headers: { 'Content-Type': 'application/json' },
-            body: JSON.stringify({ ...todo, completed: !todo.completed }),
+            body: JSON.stringify(body),
         });
-        if (response.ok) {
-            const li = document.querySelector(`[data-id='${todo.id}']`);
-            li.classList.toggle('completed');
+        if (!response.ok) {
+            await showProblem(response);
+            // Put everything back where the server has it.
+            fetchTodos();
+            return;
+        }
+        clearProblem();
+        replaceTodo(item, await response.json());
+    };
+
+    const toggleComplete = async (todo) => {
+        const updated = await patchTodo(todo, { completed: !todo.completed });
+        if (updated && todo.recurrence && updated.completed) {
+            // Completing a recurring todo created its next occurrence.
+            fetchTodos();
+            return;
+        }
+        const li = itemFor(todo.id);
+        if (updated && li) {
+            replaceTodo(li, updated);
         }
     };
 
-    const deleteTodo = async (id) => {
-        const response = await fetch(`/todos/${id}`, {
+    const deleteTodo = async (todo, cascade = false) => {
+        const id = todo.id;
+        const response = await fetch(cascade ? `/todos/${id}?cascade=true` : `/todos/${id}`, {
             method: 'DELETE',
+            headers: ifMatch(todo),
         });
+        // Subtasks are only deleted along with their parent if the user agrees.
+        if (response.status === 409 && !cascade) {
+            const problem = await response.clone().json().catch(() => ({}));
+            if (problem.code === 'todo_has_subtasks') {
+                if (confirm('Delete this todo and all its subtasks?')) {
+                    await deleteTodo(todo, true);
+                }
+                return;
+            }
+        }
+        // A 404 means someone else already deleted it.
+        if (!response.ok && response.status !== 404) {
+            await showProblem(response);
+            if (response.status === 412) {
+                fetchTodos();
+            }
+            return;
+        }
+        clearProblem();
         if (response.ok) {
-            const li = document.querySelector(`[data-id='${id}']`);
+            showUndo(id);
+        }
+        if (cascade) {
+            // Its subtasks may be anywhere in the list.
+            fetchTodos();
+            return;
+        }
+        const li = itemFor(id);
+        if (li) {
             li.remove();
         }
     };
 
+    // Deleted todos go to the trash, so the last delete can be undone by
+    // restoring it (with any subtasks deleted along with it).
+    let undoID = null;
+    let undoTimer = null;
+    const showUndo = (id) => {
+        undoID = id;
+        undoNotice.hidden = false;
+        clearTimeout(undoTimer);
+        undoTimer = setTimeout(() => { undoNotice.hidden = true; }, 10000);
+    };
+
+    undoButton.addEventListener('click', async () => {
+        undoNotice.hidden = true;
+        const response = await fetch(`/todos/${undoID}/restore`, { method: 'POST' });
+        if (!response.ok) {
+            await showProblem(response);
+            return;
+        }
+        clearProblem();
+        fetchTodos();
+    });
+
+    // Clearing completed todos is a single batch, so it trashes all of them
+    // or, if it fails, none.
+    clearCompletedButton.addEventListener('click', async () => {
+        const op = { op: 'clear_completed' };
+        if (listSelect.value) {
+            op.list_id = Number(listSelect.value);
+        }
+        const response = await fetch('/todos:batch', {
+            method: 'POST',
+            headers: { 'Content-Type': 'application/json' },
+            body: JSON.stringify({ operations: [op] }),
+        });
+        if (!response.ok) {
+            await showProblem(response);
+            return;
+        }
+        clearProblem();
+        fetchTodos();
+    });
+
     form.addEventListener('submit', (e) => {
         e.preventDefault();
         const task = input.value.trim();
@@ -80,5 +423,52 @@ document.addEventListener('DOMContentLoaded', () => {
         }
     });
 
+    // Changes made anywhere, in this tab or elsewhere, stream in from
+    // /todos/events and are applied to the list as they happen. If the
+    // connection drops, the browser reconnects and gets what it missed.
+    const itemFor = (id) => list.querySelector(`[data-id='${id}']`);
+
+    // placeTodo inserts an item where sort=position puts it.
+    const placeTodo = (item, todo) => {
+        const next = [...list.children].find(li => li !== item &&
+            (li.dataset.position > todo.position ||
+                (li.dataset.position === todo.position && Number(li.dataset.id) > todo.id)));
+        list.insertBefore(item, next || null);
+    };
+
+    const applyEvent = (message) => {
+        // Search results are ranked, and refreshed by searching again.
+        if (searchInput.value.trim()) {
+            return;
+        }
+        const event = JSON.parse(message.data);
+        const item = itemFor(event.todo_id);
+        const todo = message.type === 'deleted' ? null : event.after;
+        if (!todo || (listSelect.value && todo.list_id !== Number(listSelect.value))) {
+            if (item) {
+                item.remove();
+            }
+            return;
+        }
+        if (item) {
+            // Skip changes already shown, and don't disturb an edit.
+            if (Number(item.dataset.version) >= todo.version || item.querySelector('.edit-input')) {
+                return;
+            }
+            item.remove();
+        }
+        placeTodo(buildTodo(todo), todo);
+    };
+
+    const events = new EventSource('/todos/events');
+    // A new stream starts from the current state, so load it.
+    events.addEventListener('ready', () => {
+        if (!searchInput.value.trim()) {
+            fetchTodos();
+        }
+    });
+    ['created', 'updated', 'deleted'].forEach(type => events.addEventListener(type, applyEvent));
+
+    fetchLists();
     fetchTodos();
 });
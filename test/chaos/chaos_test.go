@@ -9,11 +9,13 @@ package chaos_test
 
 import (
 	"bytes"
-	"database/sql"
+	"database/sql/driver"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -25,84 +27,68 @@ import (
 )
 
 var (
-	mocksql sqlmock.Sqlmock
-	mockdb  *sql.DB
+	store *app.MemoryStore
+	srv   *app.Server
 )
 
-// TestMain sets up and tears down the test database using go-sqlmock.
-func TestMain(m *testing.M) {
-	var err error
-	// Use sqlmock.MonitorPingsOption(true) to allow ExpectPing
-	mockdb, mocksql, err = sqlmock.New(sqlmock.MonitorPingsOption(true))
-	if err != nil {
-		fmt.Printf("Failed to create sqlmock: %v\n", err)
-		os.Exit(1)
-	}
-	defer mockdb.Close() // Close mockdb at the end of TestMain
+// errSimulated is the fault injected into the in-memory store.
+var errSimulated = errors.New("simulated db query error")
 
-	// Save original app.DB, app.DBRead, and app.backoffStrategy state
-	originalAppDB := app.DB
-	originalAppDBRead := app.DBRead
+// TestMain points the handlers at an in-memory store whose faults each test
+// controls, so tests describe failures rather than script SQL statements.
+func TestMain(m *testing.M) {
+	// Save original app.backoffStrategy state
 	originalBackoffStrategy := app.BackoffStrategy
 
 	// Use a fixed backoff for testing: 1 initial attempt + 2 retries = 3 attempts total
-	app.BackoffStrategy = backoff.WithMaxRetries(backoff.NewConstantBackOff(1*time.Millisecond), 2) 
-
-	defer func() {
-		// Restore original app.DB, app.DBRead, and app.backoffStrategy state
-		app.DB = originalAppDB
-		app.DBRead = originalAppDBRead
-		app.BackoffStrategy = originalBackoffStrategy
-	}()
+	app.BackoffStrategy = backoff.WithMaxRetries(backoff.NewConstantBackOff(1*time.Millisecond), 2)
 
-	// Set app.DB variables for handlers to use mockdb
-	// These will be restored after all tests in this package run
-	app.DB = mockdb
-	app.DBRead = mockdb // Initially point both to mockdb
+	store = app.NewMemoryStore()
+	srv = app.NewServer(store)
 
 	// Run tests
 	code := m.Run()
 
-	// Ensure all expectations were met at the end of the entire test suite
-	// This captures any lingering expectations not cleared by individual tests
-	if err := mocksql.ExpectationsWereMet(); err != nil {
-		fmt.Printf("there were unfulfilled expectations at the end of TestMain: %s\n", err)
-	}
-	// mockdb.Close() is already deferred at the beginning of the function
+	// Restore original app.backoffStrategy state
+	app.BackoffStrategy = originalBackoffStrategy
 	os.Exit(code)
 }
 
-// TestChaosHealthzDBConnectionFailure tests /healthz when DB connection pings fail.
-func TestChaosHealthzDBConnectionFailure(t *testing.T) {
-	t.Cleanup(func() { // Ensures expectations are met even if test fails mid-way
-		if err := mocksql.ExpectationsWereMet(); err != nil {
-			t.Errorf("there were unfulfilled expectations at the end of TestChaosHealthzDBConnectionFailure: %s", err)
+// failOps returns a FaultFunc that fails the named operations with err.
+func failOps(err error, ops ...string) app.FaultFunc {
+	return func(op string) error {
+		for _, o := range ops {
+			if o == op {
+				return err
+			}
 		}
-	})
+		return nil
+	}
+}
 
-	// Simulate DB connection failure by making mockdb return an error on Ping
-	mocksql.ExpectPing().WillReturnError(fmt.Errorf("simulated db connection error"))
+// TestChaosHealthzDBConnectionFailure tests /healthz when DB connection pings fail.
+func TestChaosHealthzDBConnectionFailure(t *testing.T) {
+	// Simulate DB connection failure by making the store fail on Ping
+	store.SetFault(failOps(errors.New("simulated db connection error"), "ping"))
+	t.Cleanup(func() { store.SetFault(nil) })
 
 	req := httptest.NewRequest(http.MethodGet, "/healthz", nil)
 	w := httptest.NewRecorder()
-	app.HealthzHandler(w, req)
+	srv.HealthzHandler(w, req)
 
-	if w.Code != http.StatusInternalServerError {
-		t.Errorf("expected status %d on /healthz with db down, got %d", http.StatusInternalServerError, w.Code)
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected status %d on /healthz with db down, got %d", http.StatusServiceUnavailable, w.Code)
 	}
-	if !bytes.Contains(w.Body.Bytes(), []byte("Database connection failed")) {
-		t.Errorf("expected body to contain 'Database connection failed', got %q", w.Body.String())
+	if !bytes.Contains(w.Body.Bytes(), []byte(`"code":"db_unavailable"`)) {
+		t.Errorf("expected body to contain the db_unavailable code, got %q", w.Body.String())
+	}
+	if bytes.Contains(w.Body.Bytes(), []byte("simulated db connection error")) {
+		t.Errorf("expected the driver error not to leak to clients, got %q", w.Body.String())
 	}
 }
 
 // TestChaosGetTodosDBConnectionFailure tests /todos when DB queries fail due to connection issues.
 func TestChaosGetTodosDBConnectionFailure(t *testing.T) {
-	t.Cleanup(func() { // Ensures expectations are met even if test fails mid-way
-		if err := mocksql.ExpectationsWereMet(); err != nil {
-			t.Errorf("there were unfulfilled expectations at the end of TestChaosGetTodosDBConnectionFailure: %s", err)
-		}
-	})
-
 	// Save original app.CB state
 	originalAppCB := app.CB
 	defer func() {
@@ -119,44 +105,67 @@ func TestChaosGetTodosDBConnectionFailure(t *testing.T) {
 	})
 	app.CB = tempCB
 
-	// Simulate query failure multiple times (due to retry mechanism and fallback)
-	// app.RetryOperation retries up to MaxElapsedTime (5s). With InitialInterval=100ms, MaxInterval=2s.
-	// This means a maximum of about 7 attempts (initial + 6 retries) if each takes 100ms+. Plus fallback.
-	// Set enough expectations to cover both app.DBRead and app.DB attempts during a full retry cycle.
-	numExpectedFailures := 3
-	for i := 0; i < numExpectedFailures; i++ {
-		mocksql.ExpectQuery("SELECT (.+) FROM todos").WillReturnError(fmt.Errorf("simulated db query error"))
-	}
+	// Count attempts to verify every retry reaches the store
+	var attempts atomic.Int32
+	store.SetFault(func(op string) error {
+		if op == "list" {
+			attempts.Add(1)
+			return errSimulated
+		}
+		return nil
+	})
+	t.Cleanup(func() { store.SetFault(nil) })
 
 	req := httptest.NewRequest(http.MethodGet, "/todos", nil)
 	w := httptest.NewRecorder()
-	app.GetTodos(w, req)
+	srv.GetTodos(w, req)
 
-	// Due to retry mechanism, it should return 500
-	if w.Code != http.StatusInternalServerError {
-		t.Errorf("expected status %d on GetTodos with db down, got %d", http.StatusInternalServerError, w.Code)
+	// Once retries are exhausted, it should report the database as unavailable
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected status %d on GetTodos with db down, got %d", http.StatusServiceUnavailable, w.Code)
 	}
-	if !bytes.Contains(w.Body.Bytes(), []byte("simulated db query error")) {
-		t.Errorf("expected body to contain 'simulated db query error', got %q", w.Body.String())
+	if !bytes.Contains(w.Body.Bytes(), []byte(`"code":"db_unavailable"`)) {
+		t.Errorf("expected body to contain the db_unavailable code, got %q", w.Body.String())
+	}
+	if bytes.Contains(w.Body.Bytes(), []byte("simulated db query error")) {
+		t.Errorf("expected the driver error not to leak to clients, got %q", w.Body.String())
+	}
+	if got := attempts.Load(); got != 3 {
+		t.Errorf("expected 3 attempts (initial + 2 retries), got %d", got)
 	}
 }
 
+// TestChaosSlowDatabase tests that injected latency slows requests down but
+// does not fail them.
+func TestChaosSlowDatabase(t *testing.T) {
+	store.SetLatency(50 * time.Millisecond)
+	t.Cleanup(func() { store.SetLatency(0) })
+
+	start := time.Now()
+	req := httptest.NewRequest(http.MethodGet, "/todos", nil)
+	w := httptest.NewRecorder()
+	srv.GetTodos(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Errorf("expected status %d with a slow db, got %d", http.StatusOK, w.Code)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("expected request to take at least 50ms, took %v", elapsed)
+	}
+}
 
 // TestChaosCircuitBreakerOpensAndCloses simulates a scenario where the database becomes unavailable
 // and then available again, testing if the circuit breaker opens and then closes.
 func TestChaosCircuitBreakerOpensAndCloses(t *testing.T) {
-	t.Cleanup(func() { // Ensures expectations are met even if test fails mid-way
-		if err := mocksql.ExpectationsWereMet(); err != nil {
-			t.Errorf("there were unfulfilled expectations at the end of TestChaosCircuitBreakerOpensAndCloses: %s", err)
-		}
-	})
-
 	// Use a test-specific circuit breaker
 	var st gobreaker.Settings
 	st.Name = "TestChaosCB"
 	st.MaxRequests = 1
 	st.Interval = 1 * time.Second // Short interval to speed up test
 	st.Timeout = 2 * time.Second  // Short timeout to speed up test
+	st.OnStateChange = func(name string, from gobreaker.State, to gobreaker.State) {
+		t.Logf("Circuit Breaker state changed: %s from %s to %s", name, from, to)
+	}
 	st.ReadyToTrip = func(counts gobreaker.Counts) bool {
 		// Trip after 2 consecutive failures
 		return counts.ConsecutiveFailures >= 2
@@ -171,50 +180,43 @@ func TestChaosCircuitBreakerOpensAndCloses(t *testing.T) {
 	app.CB = testCB
 
 	// --- Phase 1: DB is down, trip the circuit breaker ---
-	numExpectedFailuresPerLogicalCall := 3 // (initial + 2 retries)
-	
-	// Add logging to circuit breaker state changes and ReadyToTrip for debugging
-	st.OnStateChange = func(name string, from gobreaker.State, to gobreaker.State) {
-		t.Logf("Circuit Breaker state changed: %s from %s to %s", name, from, to)
-	}
-	st.ReadyToTrip = func(counts gobreaker.Counts) bool {
-		t.Logf("ReadyToTrip: Requests=%d, TotalFailures=%d, ConsecutiveFailures=%d", counts.Requests, counts.TotalFailures, counts.ConsecutiveFailures)
-		return counts.ConsecutiveFailures >= 2
-	}
-	
+	store.SetFault(failOps(errors.New("simulated db query error CB"), "list"))
+	t.Cleanup(func() { store.SetFault(nil) })
+
 	// We need 2 logical failures to trip the CB (ReadyToTrip = ConsecutiveFailures >= 2).
-	// So, we need to make 2 logical calls to app.GetTodos, each failing after retries.
-	for i := 0; i < 2 * numExpectedFailuresPerLogicalCall; i++ {
-		mocksql.ExpectQuery("SELECT (.+) FROM todos").WillReturnError(fmt.Errorf("simulated db query error CB"))
+	// So, we need to make 2 logical calls to srv.GetTodos, each failing after retries.
+	for i := 0; i < 2; i++ {
+		req := httptest.NewRequest(http.MethodGet, "/todos", nil)
+		w := httptest.NewRecorder()
+		srv.GetTodos(w, req)
 	}
 
-	req := httptest.NewRequest(http.MethodGet, "/todos", nil)
-	w := httptest.NewRecorder()
-	app.GetTodos(w, req) // First logical failure from CB perspective
-
-		w = httptest.NewRecorder()
-
-		app.GetTodos(w, req) // Second logical failure from CB perspective
-
-	
-
-		// Check state immediately after the second failure that should trip it
-
-		if testCB.State() != gobreaker.StateOpen {
-
-			t.Fatalf("circuit breaker should be open after consecutive failures, state is %s", testCB.State().String())
-
-		}
+	// Check state immediately after the second failure that should trip it
+	if testCB.State() != gobreaker.StateOpen {
+		t.Fatalf("circuit breaker should be open after consecutive failures, state is %s", testCB.State().String())
+	}
 
 	// --- Phase 2: DB is still down, confirm requests are blocked ---
-	// Expect no query from mock as circuit is open. The CB will return ErrOpenState
-	req = httptest.NewRequest(http.MethodGet, "/todos", nil)
-	w = httptest.NewRecorder()
-	app.GetTodos(w, req) // This call should be blocked by CB
+	// The store is never reached while the circuit is open
+	var reached atomic.Bool
+	store.SetFault(func(op string) error {
+		reached.Store(true)
+		return errSimulated
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/todos", nil)
+	w := httptest.NewRecorder()
+	srv.GetTodos(w, req) // This call should be blocked by CB
 
 	if w.Code != http.StatusServiceUnavailable {
 		t.Errorf("expected status 503 when circuit is open, got %d", w.Code)
 	}
+	if !bytes.Contains(w.Body.Bytes(), []byte(`"code":"circuit_open"`)) {
+		t.Errorf("expected body to contain the circuit_open code, got %q", w.Body.String())
+	}
+	if reached.Load() {
+		t.Error("expected the open circuit to stop the request before reaching the store")
+	}
 
 	// --- Phase 3: Wait for CB to enter half-open state ---
 	t.Logf("Waiting for %v for circuit breaker to enter half-open state...", st.Timeout)
@@ -225,14 +227,13 @@ func TestChaosCircuitBreakerOpensAndCloses(t *testing.T) {
 	}
 
 	// --- Phase 4: DB comes back up, test recovery ---
-	t.Log("Restoring database connection (mocksql to return success)...")
-	// Configure mocksql to return a successful query for the single request in half-open state
-	mocksql.ExpectQuery("SELECT (.+) FROM todos").WillReturnRows(sqlmock.NewRows([]string{"id", "task", "completed"}).AddRow(1, "Test Task", false))
+	t.Log("Restoring database connection (clearing injected faults)...")
+	store.SetFault(nil)
 
 	// This request in half-open state should succeed and close the circuit
 	req = httptest.NewRequest(http.MethodGet, "/todos", nil)
 	w = httptest.NewRecorder()
-	app.GetTodos(w, req)
+	srv.GetTodos(w, req)
 
 	if w.Code != http.StatusOK {
 		t.Errorf("expected status %d on recovery request, got %d. Body: %q", http.StatusOK, w.Code, w.Body.String())
@@ -244,15 +245,16 @@ func TestChaosCircuitBreakerOpensAndCloses(t *testing.T) {
 	}
 
 	// Subsequent requests should also succeed
-	mocksql.ExpectQuery("SELECT (.+) FROM todos").WillReturnRows(sqlmock.NewRows([]string{"id", "task", "completed"}).AddRow(2, "Another Task", true))
 	req = httptest.NewRequest(http.MethodGet, "/todos", nil)
 	w = httptest.NewRecorder()
-	app.GetTodos(w, req)
+	srv.GetTodos(w, req)
 	if w.Code != http.StatusOK {
-		t.Errorf("expected status %d on subsequent request, got %d", http.StatusOK, w.Code) // Changed %q to %d
+		t.Errorf("expected status %d on subsequent request, got %d", http.StatusOK, w.Code)
 	}
 }
 
+// TestChaosReadReplicaFailover tests the Postgres store's replica routing, so
+// it scripts the two connection pools with sqlmock.
 func TestChaosReadReplicaFailover(t *testing.T) {
 	// Create separate mock DBs for primary and read replica
 	mockdbPrimary, mocksqlPrimary, err := sqlmock.New()
@@ -277,37 +279,88 @@ func TestChaosReadReplicaFailover(t *testing.T) {
 		}
 	})
 
-	// Save original app.DB and app.DBRead state
-	originalAppDB := app.DB
-	originalAppDBRead := app.DBRead
-	defer func() {
-		app.DB = originalAppDB
-		app.DBRead = originalAppDBRead
-	}()
+	// Primary is mockdbPrimary (success), read replica is mockdbReplica (failure)
+	failoverSrv := app.NewServer(app.NewPostgresStore(mockdbPrimary, mockdbReplica))
 
-	// Configure app.DB to use mockdbPrimary (primary success)
-	app.DB = mockdbPrimary
-	// Configure app.DBRead to use mockdbReplica (replica failure)
-	app.DBRead = mockdbReplica
+	// The list's revision is read first; once it fails over, its time, the
+	// rows and tags are read from the primary too, so they match the revision
+	mocksqlReplica.ExpectQuery("SELECT revision FROM todos_revision").WillReturnError(fmt.Errorf("simulated read replica failure"))
+	mocksqlPrimary.ExpectQuery("SELECT revision FROM todos_revision").WillReturnRows(sqlmock.NewRows([]string{"revision"}).AddRow(1))
+	mocksqlPrimary.ExpectQuery("SELECT created_at FROM todo_events").WillReturnRows(sqlmock.NewRows([]string{"created_at"}).AddRow(time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)))
+	mocksqlPrimary.ExpectQuery("SELECT (.+) FROM todos WHERE deleted_at IS NULL ORDER BY id").WillReturnRows(todoRows().AddRow(todoRow(2, "Fallback Task", true)...))
+	mocksqlPrimary.ExpectQuery("FROM todo_tags").WillReturnRows(tagRows())
 
-	// Expect the query to mockdbReplica to fail multiple times due to retries
-	// `RetryOperation` attempts 8 times
-	numReadReplicaFailures := 1
-	for i := 0; i < numReadReplicaFailures; i++ {
-		mocksqlReplica.ExpectQuery("SELECT id, task, completed FROM todos ORDER BY id").WillReturnError(fmt.Errorf("simulated read replica failure"))
+	// Make a GET request, which should use the read replica first, fail, and fall back to the primary
+	req := httptest.NewRequest(http.MethodGet, "/todos", nil)
+	w := httptest.NewRecorder()
+	failoverSrv.GetTodos(w, req)
+
+	// The request should succeed by falling back to the primary
+	if w.Code != http.StatusOK {
+		t.Errorf("expected status %d when read replica is down but primary is up, got %d. Body: %q", http.StatusOK, w.Code, w.Body.String())
 	}
+}
 
-	// Expect the subsequent query to mockdbPrimary to succeed (after replica failures and fallback)
-	mocksqlPrimary.ExpectQuery("SELECT id, task, completed FROM todos ORDER BY id").WillReturnRows(sqlmock.NewRows([]string{"id", "task", "completed"}).AddRow(2, "Fallback Task", true))
+// TestChaosGetTodoReadReplicaFailover tests that fetching a single todo also
+// falls back to the primary when the read replica fails.
+func TestChaosGetTodoReadReplicaFailover(t *testing.T) {
+	mockdbPrimary, mocksqlPrimary, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to create primary sqlmock: %v", err)
+	}
+	defer mockdbPrimary.Close()
 
+	mockdbReplica, mocksqlReplica, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to create replica sqlmock: %v", err)
+	}
+	defer mockdbReplica.Close()
 
-	// Make a GET request, which should use the read replica first, fail, and fall back to the primary
-	req := httptest.NewRequest(http.MethodGet, "/todos", nil)
+	t.Cleanup(func() {
+		if err := mocksqlPrimary.ExpectationsWereMet(); err != nil {
+			t.Errorf("there were unfulfilled expectations for primary mock: %s", err)
+		}
+		if err := mocksqlReplica.ExpectationsWereMet(); err != nil {
+			t.Errorf("there were unfulfilled expectations for replica mock: %s", err)
+		}
+	})
+
+	failoverSrv := app.NewServer(app.NewPostgresStore(mockdbPrimary, mockdbReplica))
+
+	mocksqlReplica.ExpectQuery("SELECT (.+) FROM todos WHERE id").WillReturnError(fmt.Errorf("simulated read replica failure"))
+	mocksqlPrimary.ExpectQuery("SELECT (.+) FROM todos WHERE id").WithArgs(7).WillReturnRows(todoRows().AddRow(todoRow(7, "Fallback Task", false)...))
+	mocksqlReplica.ExpectQuery("FROM todo_tags").WillReturnError(fmt.Errorf("simulated read replica failure"))
+	mocksqlPrimary.ExpectQuery("FROM todo_tags").WithArgs(7).WillReturnRows(tagRows().AddRow(7, 1, "infra"))
+
+	req := httptest.NewRequest(http.MethodGet, "/todos/7", nil)
 	w := httptest.NewRecorder()
-	app.GetTodos(w, req)
+	failoverSrv.HandleTodo(w, req)
 
-	// The request should succeed by falling back to the primary
 	if w.Code != http.StatusOK {
 		t.Errorf("expected status %d when read replica is down but primary is up, got %d. Body: %q", http.StatusOK, w.Code, w.Body.String())
 	}
-}
\ No newline at end of file
+	if !bytes.Contains(w.Body.Bytes(), []byte("Fallback Task")) {
+		t.Errorf("expected body to contain the todo from the primary, got %q", w.Body.String())
+	}
+}
+
+// todoRows returns sqlmock rows with the columns the SQL store selects.
+func todoRows() *sqlmock.Rows {
+	return sqlmock.NewRows([]string{"id", "list_id", "parent_id", "task", "completed", "due_at", "priority", "notes", "auto_complete", "recurrence", "recurrence_tz",
+		"position", "created_at", "updated_at", "completed_at", "deleted_at", "version", "child_count", "open_blockers"})
+}
+
+// tagRows returns sqlmock rows with the columns the SQL store loads tags with.
+func tagRows() *sqlmock.Rows {
+	return sqlmock.NewRows([]string{"todo_id", "id", "name"})
+}
+
+// todoRow returns the values of one todoRows row.
+func todoRow(id int, task string, completed bool) []driver.Value {
+	ts := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	var completedAt driver.Value
+	if completed {
+		completedAt = ts
+	}
+	return []driver.Value{id, 1, nil, task, completed, nil, "normal", "", false, "", "", "a0", ts, ts, completedAt, nil, 1, 0, 0}
+}